@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go-websocket/internal/fakecqg"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8081", "address to listen on")
+	tick := flag.Duration("tick", 0, "interval between generated market data updates (default 500ms)")
+	user := flag.String("user", "", "only accept this user name, with -password")
+	password := flag.String("password", "", "only accept this password, with -user")
+	strict := flag.Bool("strict", false, "reject symbols that are not known instead of generating them")
+	maxLevel := flag.Uint("max-level", 0, "highest market data level the user is entitled to (default any)")
+	tradingDay := flag.Duration("trading-day", 0, "length of the generated trading days (default 24h)")
+	corrections := flag.Float64("corrections", 0, "fraction of generated trades busted or corrected afterwards")
+	flag.Parse()
+
+	// Configure the fake server
+	server := fakecqg.NewServer()
+	server.UserName = *user
+	server.Password = *password
+	server.Strict = *strict
+	server.MaxLevel = uint32(*maxLevel)
+	server.CorrectionRate = *corrections
+	if *tick > 0 {
+		server.TickInterval = *tick
+	}
+	if *tradingDay > 0 {
+		server.TradingDay = *tradingDay
+	}
+
+	// A few well-known symbols so the README examples work offline
+	server.AddContract(fakecqg.Contract{Symbol: "ZUC", Description: "Fake ZUC", PriceScale: 0.01, StartPrice: 72500})
+	server.AddContract(fakecqg.Contract{Symbol: "EUC", Description: "Fake EUC", PriceScale: 0.0001, StartPrice: 10850})
+	server.AddContract(fakecqg.Contract{Symbol: "ZN", Description: "Fake 10-Year Note", PriceScale: 1.0 / 128, TickSize: 1.0 / 64, DisplayPriceScale: 202, StartPrice: 14144})
+
+	if err := server.Start(*addr); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Fake CQG WebAPI listening on %s, set HOST_NAME=%s", server.URL, server.URL)
+
+	// Run until interrupted
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	server.Close()
+}
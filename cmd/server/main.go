@@ -1,29 +1,68 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"go-websocket/internal/client"
+	"go-websocket/internal/config"
 	"go-websocket/internal/handlers"
+	"go-websocket/internal/marketdata"
+	"go-websocket/internal/services"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/joho/godotenv"
 )
 
 func main() {
-	// Load environment variables from .env file
-	err := godotenv.Load(".env")
+	// Load configuration from .env, the optional config file and the environment
+	cfg, err := config.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatal("Invalid configuration: ", err)
 	}
 
 	// Create a new Fiber app instance
 	app := fiber.New()
 
+	// Shared CQG sessions, one per credential set, for the life of the server
+	store := services.NewPocketBase(cfg.PocketBaseURL, cfg.Timeouts.PocketBase)
+	deps := &handlers.Deps{
+		Config:   cfg,
+		Sessions: client.NewSessionManager(cfg),
+		Store:    store,
+		Hub:      marketdata.NewHub(cfg, store),
+		Bars:     marketdata.NewBarCache(cfg.BarCacheDir),
+	}
+
 	// Register route handlers for different endpoints
-	handlers.RegisterHandler(app)           // Authentication endpoints
-	handlers.RegisterRealtimeHandler(app)   // Real-time data endpoints
-	handlers.RegisterHistoricalHandler(app) // Historical data endpoints
+	handlers.RegisterHandler(app, deps)              // Authentication endpoints
+	handlers.RegisterRealtimeHandler(app, deps)      // Real-time data endpoints
+	handlers.RegisterHistoricalHandler(app, deps)    // Historical data endpoints
+	handlers.RegisterTimeAndSalesHandler(app, deps)  // Time and sales history endpoint
+	handlers.RegisterBarsHandler(app, deps)          // Non-timed bar endpoints
+	handlers.RegisterVolumeProfileHandler(app, deps) // Volume profile endpoint
+	handlers.RegisterStatusHandler(app, deps)        // Session health endpoint
+
+	// Stop accepting connections on SIGINT or SIGTERM
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("Shutting down")
+		if err := app.Shutdown(); err != nil {
+			log.Println("shutdown error:", err)
+		}
+	}()
+
+	// Start the server on the configured port
+	if err := app.Listen(cfg.ListenAddr()); err != nil {
+		log.Fatal(err)
+	}
 
-	// Start the server on port 3000
-	log.Fatal(app.Listen(":3000"))
+	// Log off the shared sessions once the server stopped
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Upstream)
+	defer cancel()
+	deps.Sessions.CloseAll(ctx)
 }
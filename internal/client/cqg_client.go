@@ -1,52 +1,272 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"go-websocket/internal/models"
+	"go-websocket/internal/config"
 	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
 
 	"github.com/gorilla/websocket"
-	"github.com/joho/godotenv"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 )
 
-// CQGClient represents a WebSocket client for connecting to CQG's trading platform
+// CQGClient represents a WebSocket client for connecting to CQG's trading platform.
+// A single client may be shared by many handlers: once Start is called, one reader
+// goroutine owns the socket and routes every server message to attached listeners.
+// If the socket drops, the reader reconnects and replays active subscriptions.
 type CQGClient struct {
-	WS               *websocket.Conn      // WebSocket connection
-	BaseTime         int64                // Base time received from server for time synchronization
-	ContractMetadata *pb.ContractMetadata // Metadata about the trading contract
+	WS Conn // WebSocket connection, possibly recorded or replayed
+
+	cfg          *config.Config
+	recorder     *Recorder    // Records every frame when a record file is configured
+	replaying    bool         // The connection replays a recording instead of a live server
+	creds        Credentials  // Credentials of the last successful logon
+	sessionToken string       // Session token from LogonResult, used to restore the session
+	connected    atomic.Bool  // Whether the session is logged on and usable
+	baseTime     atomic.Int64 // Base time received from server for time synchronization, in Unix milliseconds
+
+	nextID            atomic.Uint32                     // Last allocated request ID
+	writeMu           sync.Mutex                        // Serializes writes to the WebSocket
+	mu                sync.Mutex                        // Guards listeners, contracts and subscriptions
+	listeners         map[*Listener]struct{}            // All attached listeners
+	requests          map[uint32]*Listener              // Listeners by request ID
+	contractListeners map[uint32]map[*Listener]struct{} // Listeners by contract ID
+	contracts         map[uint32]*pb.ContractMetadata   // Metadata of resolved contracts by contract ID
+	symbols           map[uint32]string                 // Resolved symbol names by contract ID
+	subscriptions     *subscriptionSet                  // Active subscriptions to replay after reconnect
+	heartbeat         *heartbeat                        // Ping/Pong state and round-trip statistics
+	done              chan struct{}                     // Closed when the client is closed for good
+	closeOnce         sync.Once
 }
 
 // NewCQGClient creates and initializes a new CQG client with WebSocket connection
-func NewCQGClient() (*CQGClient, error) {
-	// Load environment variables from .env file
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Println("Error loading .env file")
+// to the configured CQG host. If a replay file is configured the client reads the
+// recorded session instead of dialling, and if a record file is configured every
+// frame is appended to it.
+func NewCQGClient(ctx context.Context, cfg *config.Config) (*CQGClient, error) {
+	c := &CQGClient{
+		cfg:               cfg,
+		listeners:         make(map[*Listener]struct{}),
+		requests:          make(map[uint32]*Listener),
+		contractListeners: make(map[uint32]map[*Listener]struct{}),
+		contracts:         make(map[uint32]*pb.ContractMetadata),
+		symbols:           make(map[uint32]string),
+		subscriptions:     newSubscriptionSet(),
+		heartbeat:         newHeartbeat(),
+		done:              make(chan struct{}),
+	}
+
+	// Replay a recorded session instead of connecting
+	if cfg.CQG.ReplayFile != "" {
+		conn, err := NewReplayConn(cfg.CQG.ReplayFile, cfg.CQG.ReplayRealtime)
+		if err != nil {
+			return nil, err
+		}
+		c.WS = conn
+		c.replaying = true
+		log.Printf("Replaying CQG session from %s", cfg.CQG.ReplayFile)
+		return c, nil
 	}
 
-	// Get hostname from environment variables
-	hostName := os.Getenv("HOST_NAME")
-	if hostName == "" {
-		return nil, fmt.Errorf("HOST_NAME environment variable not set")
+	if cfg.CQG.RecordFile != "" {
+		recorder, err := NewRecorder(cfg.CQG.RecordFile)
+		if err != nil {
+			return nil, err
+		}
+		c.recorder = recorder
 	}
 
 	// Establish WebSocket connection
-	ws, _, err := websocket.DefaultDialer.Dial(hostName, nil)
+	if err := c.dial(ctx); err != nil {
+		if c.recorder != nil {
+			c.recorder.Close()
+		}
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// send writes a client message on a logged-on session and records any subscriptions
+// it carries so they can be replayed after a reconnect
+func (c *CQGClient) send(ctx context.Context, clientMsg *pb.ClientMsg) error {
+	if !c.connected.Load() {
+		return fmt.Errorf("not connected to CQG")
+	}
+
+	if err := c.write(ctx, clientMsg); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.subscriptions.track(clientMsg, c.baseTime.Load())
+	c.mu.Unlock()
+
+	return nil
+}
+
+// write marshals a client message and writes it to the WebSocket, giving up at the
+// deadline of ctx
+func (c *CQGClient) write(ctx context.Context, clientMsg *pb.ClientMsg) error {
+	data, err := proto.Marshal(clientMsg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to establish WebSocket connection: %w", err)
+		return fmt.Errorf("marshal error: %w", err)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// The request may have been cancelled while waiting for the socket
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("write message error: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.WS.SetWriteDeadline(deadline)
+		defer c.WS.SetWriteDeadline(time.Time{})
+	}
+	if err := c.WS.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return fmt.Errorf("write message error: %w", err)
+	}
+
+	return nil
+}
+
+// conn returns the current WebSocket connection, which changes on reconnect
+func (c *CQGClient) conn() Conn {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.WS
+}
+
+// readDirect reads a single server message from the socket. It is only used while
+// the reader goroutine is not consuming the connection, i.e. during logon.
+func (c *CQGClient) readDirect(ctx context.Context) (*pb.ServerMsg, error) {
+	ws := c.conn()
+	stop := watchReadDeadline(ctx, ws)
+	_, msg, err := ws.ReadMessage()
+	stop()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("websocket read error: %w", ctxErr)
+		}
+		return nil, fmt.Errorf("websocket read error: %w", err)
 	}
 
-	return &CQGClient{WS: ws}, nil
+	serverMsg := &pb.ServerMsg{}
+	if err := proto.Unmarshal(msg, serverMsg); err != nil {
+		return nil, fmt.Errorf("protobuf unmarshal error: %w", err)
+	}
+
+	return serverMsg, nil
+}
+
+// watchReadDeadline applies the deadline of ctx to reads on ws and interrupts a blocked
+// read when ctx is cancelled. The returned function clears the deadline again.
+func watchReadDeadline(ctx context.Context, ws Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		ws.SetReadDeadline(deadline)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			ws.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		ws.SetReadDeadline(time.Time{})
+	}
+}
+
+// Start launches the reader goroutine that dispatches server messages to listeners,
+// and the heartbeat that keeps the connection alive. It must be called after Logon
+// and only once per client. Replayed sessions have no heartbeat.
+func (c *CQGClient) Start() {
+	go c.readLoop()
+	if !c.replaying {
+		go c.heartbeatLoop()
+	}
+}
+
+// readLoop reads server messages and routes them. When the connection fails it
+// reconnects, and it only exits once the client is closed.
+func (c *CQGClient) readLoop() {
+	defer c.Close()
+
+	for {
+		_, msg, err := c.conn().ReadMessage()
+		if err != nil {
+			if c.Closed() {
+				return
+			}
+			log.Printf("read message error: %v", err)
+			if c.replaying || !c.reconnect(err) {
+				return
+			}
+			continue
+		}
+
+		serverMsg := &pb.ServerMsg{}
+		if err := proto.Unmarshal(msg, serverMsg); err != nil {
+			log.Printf("unmarshal error: %v", err)
+			continue
+		}
+
+		c.handleHeartbeat(serverMsg)
+		c.route(serverMsg)
+
+		// A logged off session is over; do not try to reconnect it
+		if loggedOff := serverMsg.GetLoggedOff(); loggedOff != nil {
+			log.Printf("Logged off by server: %s (reason %d)", loggedOff.GetTextMessage(), loggedOff.GetLogoffReason())
+			return
+		}
+	}
+}
+
+// Closed reports whether the client has been closed for good
+func (c *CQGClient) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Connected reports whether the session is currently logged on
+func (c *CQGClient) Connected() bool {
+	return c.connected.Load()
+}
+
+// Done returns a channel that is closed when the client is closed for good
+func (c *CQGClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// ContractMetadata returns the metadata of a contract previously resolved on this client
+func (c *CQGClient) ContractMetadata(contractID uint32) *pb.ContractMetadata {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.contracts[contractID]
 }
 
 // Logon authenticates the client with the CQG server
-func (c *CQGClient) Logon(userName, password, clientAppId, clientVersion string, protocolVersionMajor uint32, protocolVersionMinor uint32) error {
+func (c *CQGClient) Logon(ctx context.Context, userName, password, clientAppId, clientVersion string, protocolVersionMajor uint32, protocolVersionMinor uint32) error {
 	// Validate required credentials
 	if userName == "" || password == "" || clientAppId == "" || clientVersion == "" {
 		return fmt.Errorf("neccessary creds are not provided")
@@ -66,29 +286,22 @@ func (c *CQGClient) Logon(userName, password, clientAppId, clientVersion string,
 		Logon: logon,
 	}
 
-	// Marshal and send logon message
-	data, err := proto.Marshal(clientMsg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal logon message: %w", err)
-	}
-
-	if err = c.WS.WriteMessage(websocket.BinaryMessage, data); err != nil {
+	// Send logon message
+	if err := c.write(ctx, clientMsg); err != nil {
 		return fmt.Errorf("failed to send logon message: %w", err)
 	}
 
-	// Read and process server response
-	_, msg, err := c.WS.ReadMessage()
+	// Read and process server response. The reader goroutine is not consuming the
+	// socket during logon, so the logon result is read directly.
+	serverMsg, err := c.readDirect(ctx)
 	if err != nil {
-		return fmt.Errorf("websocket read error: %w", err)
+		return err
 	}
 
-	serverMsg := &pb.ServerMsg{}
-	if err := proto.Unmarshal(msg, serverMsg); err != nil {
-		return fmt.Errorf("protobuf unmarshal error: %w", err)
+	if c.cfg.Debug {
+		log.Printf("Raw server response: %+v", serverMsg)
 	}
 
-	log.Printf("Raw server response: %+v", serverMsg)
-
 	// Handle logon result
 	if logonResult := serverMsg.GetLogonResult(); logonResult != nil {
 		log.Printf("Logon result code: %d, message: %s",
@@ -104,26 +317,60 @@ func (c *CQGClient) Logon(userName, password, clientAppId, clientVersion string,
 		}
 
 		// Parse and store base time for time synchronization
-		baseTimeStr := logonResult.GetBaseTime()
-		if baseTimeStr == "" {
-			return fmt.Errorf("empty base time received from server")
-		}
-
-		parsedTime, err := time.Parse("2006-01-02T15:04:05", baseTimeStr)
+		baseTime, err := parseBaseTime(logonResult.GetBaseTime())
 		if err != nil {
-			return fmt.Errorf("invalid base time format: %w", err)
+			return err
 		}
 
-		c.BaseTime = parsedTime.UnixNano() / int64(time.Millisecond)
+		c.baseTime.Store(baseTime)
+		c.sessionToken = logonResult.GetSessionToken()
 	} else {
 		return fmt.Errorf("unexpected response type: %T", serverMsg)
 	}
 
+	// Remember the credentials so the session can be re-established after a disconnect
+	c.creds = Credentials{
+		UserName:             userName,
+		Password:             password,
+		ClientAppId:          clientAppId,
+		ClientVersion:        clientVersion,
+		ProtocolVersionMajor: protocolVersionMajor,
+		ProtocolVersionMinor: protocolVersionMinor,
+	}
+	c.connected.Store(true)
+
 	return nil
 }
 
-// Logoff sends a logoff request to the CQG server to terminate the session
-func (c *CQGClient) Logoff() error {
+// Time converts a CQG timestamp, in milliseconds relative to the session base time,
+// into an absolute time
+func (c *CQGClient) Time(serverTime int64) time.Time {
+	return time.UnixMilli(c.baseTime.Load() + serverTime).UTC()
+}
+
+// ServerTime converts an absolute time into a CQG timestamp of the session, the inverse
+// of Time
+func (c *CQGClient) ServerTime(t time.Time) int64 {
+	return c.serverTime(t)
+}
+
+// parseBaseTime converts the base time sent by the server into Unix milliseconds
+func parseBaseTime(baseTimeStr string) (int64, error) {
+	if baseTimeStr == "" {
+		return 0, fmt.Errorf("empty base time received from server")
+	}
+
+	parsedTime, err := time.Parse("2006-01-02T15:04:05", baseTimeStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid base time format: %w", err)
+	}
+
+	return parsedTime.UnixNano() / int64(time.Millisecond), nil
+}
+
+// Logoff sends a logoff request to the CQG server to terminate the session.
+// It waits for the LoggedOff confirmation from the reader goroutine.
+func (c *CQGClient) Logoff(ctx context.Context) error {
 	logoff := &pb.Logoff{
 		TextMessage: proto.String("logoff test"),
 	}
@@ -132,34 +379,41 @@ func (c *CQGClient) Logoff() error {
 		Logoff: logoff,
 	}
 
-	// Marshal the client message to binary format
-	data, err := proto.Marshal(clientMsg)
-	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
-	}
+	l := c.Listen()
+	defer l.Close()
 
 	// Send the logoff message over websocket connection
-	if err := c.WS.WriteMessage(websocket.BinaryMessage, data); err != nil {
-		return fmt.Errorf("write message error: %w", err)
-	}
-	// Read and process server response
-	_, msg, err := c.WS.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("websocket read error: %w", err)
+	if err := c.send(ctx, clientMsg); err != nil {
+		return err
 	}
 
-	serverMsg := &pb.ServerMsg{}
-	if err := proto.Unmarshal(msg, serverMsg); err != nil {
-		return fmt.Errorf("protobuf unmarshal error: %w", err)
+	// Wait for the server to confirm the logoff
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("logoff not confirmed: %w", ctx.Err())
+		case serverMsg, ok := <-l.C:
+			if !ok {
+				return fmt.Errorf("connection closed before logoff was confirmed")
+			}
+			if loggedOff := serverMsg.GetLoggedOff(); loggedOff != nil {
+				if c.cfg.Debug {
+					log.Printf("Raw server response: %+v", serverMsg)
+				}
+				return nil
+			}
+		}
 	}
+}
 
-	log.Printf("Raw server response: %+v", serverMsg)
-
-	return nil
+// ResolveSymbol resolves a trading symbol and returns its contract ID.
+// The resolved contract metadata is cached and available through ContractMetadata.
+func (c *CQGClient) ResolveSymbol(ctx context.Context, symbolName string, subscribe bool) (uint32, error) {
+	return c.resolveSymbol(ctx, c.NextRequestID(), symbolName, subscribe)
 }
 
-// ResolveSymbol resolves a trading symbol and returns its contract ID
-func (c *CQGClient) ResolveSymbol(symbolName string, msgID uint32, subscribe bool) (uint32, error) {
+// resolveSymbol resolves a trading symbol with the given request ID
+func (c *CQGClient) resolveSymbol(ctx context.Context, msgID uint32, symbolName string, subscribe bool) (uint32, error) {
 	if symbolName == "" {
 		return 0, fmt.Errorf("symbol name cannot be empty")
 	}
@@ -177,54 +431,159 @@ func (c *CQGClient) ResolveSymbol(symbolName string, msgID uint32, subscribe boo
 		InformationRequests: []*pb.InformationRequest{informationRequest},
 	}
 
-	log.Printf("Client message sent:\n%+v\n", clientMsg)
+	if c.cfg.Debug {
+		log.Printf("Client message sent:\n%+v\n", clientMsg)
+	}
 
-	// Marshal and send request
-	data, err := proto.Marshal(clientMsg)
+	// Send request
+	l, err := c.sendRequest(ctx, msgID, clientMsg)
 	if err != nil {
-		return 0, fmt.Errorf("marshal error: %w", err)
+		return 0, err
 	}
+	defer l.Close()
 
-	if err := c.WS.WriteMessage(websocket.BinaryMessage, data); err != nil {
-		return 0, fmt.Errorf("write message error: %w", err)
+	// Wait for the information report answering this request
+	for {
+		var serverMsg *pb.ServerMsg
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("symbol resolution aborted: %w", ctx.Err())
+		case msg, ok := <-l.C:
+			if !ok {
+				return 0, fmt.Errorf("connection closed before symbol was resolved")
+			}
+			serverMsg = msg
+		}
+
+		if c.cfg.Debug {
+			log.Printf("Server message received:\n%+v\n", serverMsg)
+		}
+
+		for _, infoReport := range serverMsg.GetInformationReports() {
+			// Extract contract metadata from response
+			resReport := infoReport.GetSymbolResolutionReport()
+			if resReport == nil {
+				return 0, fmt.Errorf("symbol resolution failed: %s (code %d)",
+					infoReport.GetTextMessage(),
+					infoReport.GetStatusCode(),
+				)
+			}
+			if resReport.GetContractMetadata() == nil {
+				return 0, fmt.Errorf("no contract metadata in response")
+			}
+
+			contractID := resReport.GetContractMetadata().GetContractId()
+			c.mu.Lock()
+			c.symbols[contractID] = symbolName
+			c.mu.Unlock()
+
+			return contractID, nil
+		}
 	}
+}
 
-	// Read and process server response
-	_, msg, err := c.WS.ReadMessage()
-	if err != nil {
-		return 0, fmt.Errorf("read message error: %w", err)
+// SubscribeContractMetadata subscribes to changes of the metadata of a resolved contract,
+// which keep ContractMetadata current, and returns the request ID to cancel it with
+func (c *CQGClient) SubscribeContractMetadata(ctx context.Context, contractID uint32) (uint32, error) {
+	c.mu.Lock()
+	symbolName, ok := c.symbols[contractID]
+	c.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("contract %d was not resolved", contractID)
 	}
 
-	serverMsg := &pb.ServerMsg{}
-	if err := proto.Unmarshal(msg, serverMsg); err != nil {
-		return 0, fmt.Errorf("unmarshal error: %w", err)
+	msgID := c.NextRequestID()
+	informationRequest := &pb.InformationRequest{
+		Id:        proto.Uint32(msgID),
+		Subscribe: proto.Bool(true),
+		SymbolResolutionRequest: &pb.SymbolResolutionRequest{
+			Symbol: proto.String(symbolName),
+		},
 	}
 
-	log.Printf("Server message received:\n%+v\n", serverMsg)
-	if len(serverMsg.InformationReports) == 0 {
-		return 0, fmt.Errorf("no information reports received")
+	clientMsg := &pb.ClientMsg{
+		InformationRequests: []*pb.InformationRequest{informationRequest},
 	}
 
-	// Extract contract metadata from response
-	infoReport := serverMsg.InformationReports[0]
-	if resReport := infoReport.GetSymbolResolutionReport(); resReport != nil {
-		if resReport.GetContractMetadata() == nil {
-			return 0, fmt.Errorf("no contract metadata in response")
-		}
-		c.ContractMetadata = resReport.GetContractMetadata()
-		return c.ContractMetadata.GetContractId(), nil
+	// Reports only refresh the cached metadata, so nobody listens for them
+	if err := c.send(ctx, clientMsg); err != nil {
+		return 0, err
+	}
+	return msgID, nil
+}
+
+// UnsubscribeContractMetadata cancels a subscription made by SubscribeContractMetadata
+func (c *CQGClient) UnsubscribeContractMetadata(ctx context.Context, requestID uint32) error {
+	informationRequest := &pb.InformationRequest{
+		Id:        proto.Uint32(requestID),
+		Subscribe: proto.Bool(false),
+	}
+
+	clientMsg := &pb.ClientMsg{
+		InformationRequests: []*pb.InformationRequest{informationRequest},
 	}
 
-	return 0, fmt.Errorf("symbol resolution failed")
+	return c.send(ctx, clientMsg)
 }
 
-// SubscribeMarketData subscribes to market data updates for a specific contract
-func (c *CQGClient) SubscribeMarketData(contractID, msgID, level uint32) error {
+// RequestTradingDays returns the time ranges of the next count trading days of a session,
+// starting with the trading day in progress at from. The session info ID comes from the
+// contract metadata. Holidays are left out.
+func (c *CQGClient) RequestTradingDays(ctx context.Context, sessionInfoID int32, from time.Time, count uint32) ([]*pb.TradingDayTimeRange, error) {
+	msgID := c.NextRequestID()
+	informationRequest := &pb.InformationRequest{
+		Id: proto.Uint32(msgID),
+		TradingDayTimerangeRequest: &pb.TradingDayTimeRangeRequest{
+			SessionInfoId:   proto.Int32(sessionInfoID),
+			IncludeHolidays: proto.Bool(false),
+			FromUtcTime:     proto.Int64(c.serverTime(from)),
+			Count:           proto.Uint32(count),
+		},
+	}
+
+	clientMsg := &pb.ClientMsg{
+		InformationRequests: []*pb.InformationRequest{informationRequest},
+	}
+
+	// Send request
+	l, err := c.sendRequest(ctx, msgID, clientMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	// Wait for the information report answering this request
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("trading day request aborted: %w", ctx.Err())
+		case serverMsg, ok := <-l.C:
+			if !ok {
+				return nil, fmt.Errorf("connection closed before trading days were received")
+			}
+			for _, infoReport := range serverMsg.GetInformationReports() {
+				report := infoReport.GetTradingDayTimerangeReport()
+				if report == nil {
+					return nil, fmt.Errorf("trading day request failed: %s (code %d)",
+						infoReport.GetTextMessage(),
+						infoReport.GetStatusCode(),
+					)
+				}
+				return report.GetTradingDayTimeRanges(), nil
+			}
+		}
+	}
+}
+
+// SubscribeMarketData subscribes to market data updates for a specific contract and
+// returns the allocated request ID. Updates are delivered to ListenContract listeners.
+func (c *CQGClient) SubscribeMarketData(ctx context.Context, contractID, level uint32) (uint32, error) {
 	if contractID == 0 {
-		return fmt.Errorf("invalid contract ID")
+		return 0, fmt.Errorf("invalid contract ID")
 	}
 
 	// Create market data subscription request
+	msgID := c.NextRequestID()
 	subscription := &pb.MarketDataSubscription{
 		ContractId: proto.Uint32(contractID),
 		RequestId:  proto.Uint32(msgID),
@@ -235,131 +594,395 @@ func (c *CQGClient) SubscribeMarketData(contractID, msgID, level uint32) error {
 		MarketDataSubscriptions: []*pb.MarketDataSubscription{subscription},
 	}
 
-	// Marshal and send subscription request
-	data, err := proto.Marshal(clientMsg)
-	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
+	// Send subscription request
+	if err := c.send(ctx, clientMsg); err != nil {
+		return 0, err
 	}
 
-	if err := c.WS.WriteMessage(websocket.BinaryMessage, data); err != nil {
-		return fmt.Errorf("write message error: %w", err)
+	return msgID, nil
+}
+
+// UnsubscribeMarketData cancels the market data subscription of a contract unless other
+// listeners are still attached to it. Callers close their own listener first.
+func (c *CQGClient) UnsubscribeMarketData(ctx context.Context, contractID uint32) error {
+	c.mu.Lock()
+	inUse := len(c.contractListeners[contractID]) > 0
+	c.mu.Unlock()
+	if inUse {
+		return nil
 	}
 
-	return nil
+	subscription := &pb.MarketDataSubscription{
+		ContractId: proto.Uint32(contractID),
+		RequestId:  proto.Uint32(c.NextRequestID()),
+		Level:      proto.Uint32(uint32(pb.MarketDataSubscription_LEVEL_NONE)),
+	}
+
+	clientMsg := &pb.ClientMsg{
+		MarketDataSubscriptions: []*pb.MarketDataSubscription{subscription},
+	}
+
+	return c.send(ctx, clientMsg)
 }
 
-// RequestBarTime requests historical bar data for a specific time range
-func (c *CQGClient) RequestBarTime(msgID uint32, contractID uint32, barUnit uint32, timeRange models.TimeRange, requestType uint32) error {
+// BarTimeRange selects the time bars of a request: bars of UnitNumber units of BarUnit
+// each, from From up to To, or up to now if To is zero. UnitNumber applies to minute
+// and hour bars only and defaults to 1. For daily and longer bars both times stand for
+// trade dates and To is inclusive; for intra-day bars To is exclusive. Subscribing keeps
+// the bars updated and requires a zero To. A non-zero Continuation, a CQG continuation
+// type, builds the bars of a continuous series rolling over the contracts before the
+// requested one; Equalize back-adjusts it, which only active continuations support.
+type BarTimeRange struct {
+	BarUnit      uint32
+	UnitNumber   uint32
+	From         time.Time
+	To           time.Time
+	Subscribe    bool
+	Continuation uint32
+	Equalize     bool
+}
+
+// RequestBarTime requests the time bars of a contract in a time range, once or as a
+// subscription. The returned listener receives the time bar reports for this request.
+func (c *CQGClient) RequestBarTime(ctx context.Context, contractID uint32, r BarTimeRange) (*Listener, error) {
 	if contractID == 0 {
-		return fmt.Errorf("invalid contract ID")
+		return nil, fmt.Errorf("invalid contract ID")
 	}
-
-	if timeRange.Number <= 0 {
-		return fmt.Errorf("invalid time range number")
+	if _, ok := pb.BarUnit_name[int32(r.BarUnit)]; !ok {
+		return nil, fmt.Errorf("invalid bar unit")
+	}
+	if !r.To.IsZero() && !r.To.After(r.From) {
+		return nil, fmt.Errorf("invalid time range: end is not after start")
+	}
+	if r.Subscribe && !r.To.IsZero() {
+		return nil, fmt.Errorf("subscriptions run up to now and take no end time")
 	}
 
-	var barsNumber int
-	var intervalMillis int64
-
-	// Calculate number of bars and interval based on bar unit and time range
-	switch barUnit {
-	case models.DailyIndex:
-		intervalMillis = models.MillisecondsInDay
-		switch timeRange.Period {
-		case "day":
-			barsNumber = timeRange.Number
-		case "month":
-			barsNumber = timeRange.Number * models.DaysInMonth
-		case "year":
-			barsNumber = timeRange.Number * models.DaysInYear
-		default:
-			return fmt.Errorf("invalid time period for daily bars")
+	// Intra-day bars must fit into a day
+	switch pb.BarUnit(r.BarUnit) {
+	case pb.BarUnit_BAR_UNIT_MIN:
+		if r.UnitNumber > 24*60 {
+			return nil, fmt.Errorf("invalid unit number: minute bars are at most a day long")
 		}
-
-	case models.HourlyIndex:
-		intervalMillis = models.MillisecondsInHour
-		switch timeRange.Period {
-		case "day":
-			barsNumber = timeRange.Number * models.HoursInDay
-		case "month":
-			barsNumber = timeRange.Number * models.DaysInMonth * models.HoursInDay
-		case "year":
-			barsNumber = timeRange.Number * models.DaysInYear * models.HoursInDay
-		default:
-			return fmt.Errorf("invalid time period for hourly bars")
+	case pb.BarUnit_BAR_UNIT_HOUR:
+		if r.UnitNumber > 24 {
+			return nil, fmt.Errorf("invalid unit number: hour bars are at most a day long")
+		}
+	default:
+		if r.UnitNumber > 1 {
+			return nil, fmt.Errorf("invalid unit number: only minute and hour bars span several units")
 		}
+	}
 
-	case models.MinutelyIndex:
-		intervalMillis = models.MillisecondsInMinute
-		switch timeRange.Period {
-		case "day":
-			barsNumber = timeRange.Number * models.HoursInDay * models.MinutesInHour
-		case "month":
-			barsNumber = timeRange.Number * models.DaysInMonth * models.HoursInDay * models.MinutesInHour
-		case "year":
-			barsNumber = timeRange.Number * models.DaysInYear * models.HoursInDay * models.MinutesInHour
-		default:
-			return fmt.Errorf("invalid time period for minutely bars")
+	params := &pb.TimeBarParameters{
+		ContractId:  proto.Uint32(contractID),
+		BarUnit:     proto.Uint32(r.BarUnit),
+		FromUtcTime: proto.Int64(c.serverTime(r.From)),
+	}
+	if r.UnitNumber > 1 {
+		params.UnitNumber = proto.Uint32(r.UnitNumber)
+	}
+	if r.Continuation != 0 {
+		if _, ok := pb.ContinuationParameters_ContinuationType_name[int32(r.Continuation)]; !ok {
+			return nil, fmt.Errorf("invalid continuation type")
+		}
+		if r.Equalize && r.Continuation != uint32(pb.ContinuationParameters_CONTINUATION_TYPE_ACTIVE) {
+			return nil, fmt.Errorf("only active continuations can be equalized")
+		}
+		params.ContinuationParameters = &pb.ContinuationParameters{
+			ContinuationType: proto.Uint32(r.Continuation),
+			Equalize:         proto.Bool(r.Equalize),
 		}
+	} else if r.Equalize {
+		return nil, fmt.Errorf("equalizing requires a continuation type")
+	}
+	if !r.To.IsZero() {
+		params.ToUtcTime = proto.Int64(c.serverTime(r.To))
+	}
+	requestType := pb.TimeBarRequest_REQUEST_TYPE_GET
+	if r.Subscribe {
+		requestType = pb.TimeBarRequest_REQUEST_TYPE_SUBSCRIBE
+	}
 
-	default:
-		return fmt.Errorf("invalid bar unit")
+	msgID := c.NextRequestID()
+	tbRequest := &pb.TimeBarRequest{
+		RequestId:         proto.Uint32(msgID),
+		TimeBarParameters: params,
+		RequestType:       proto.Uint32(uint32(requestType)),
 	}
 
-	// Calculate time range and create request
-	currentTimeMillis := time.Now().UTC().UnixNano() / int64(time.Millisecond)
-	fromUtcTime := currentTimeMillis - c.BaseTime - (int64(barsNumber) * intervalMillis)
+	clientMsg := &pb.ClientMsg{
+		TimeBarRequests: []*pb.TimeBarRequest{tbRequest},
+	}
+
+	if c.cfg.Debug {
+		log.Printf("Requesting historical data:\n%s", PrettyPrintProto(clientMsg))
+	}
 
+	// Send request
+	return c.sendRequest(ctx, msgID, clientMsg)
+}
+
+// DropTimeBars cancels a time bar request or subscription started by RequestBarTime
+func (c *CQGClient) DropTimeBars(ctx context.Context, requestID uint32) error {
 	tbRequest := &pb.TimeBarRequest{
-		RequestId: proto.Uint32(msgID),
-		TimeBarParameters: &pb.TimeBarParameters{
-			ContractId:  proto.Uint32(contractID),
-			BarUnit:     proto.Uint32(barUnit),
-			FromUtcTime: proto.Int64(fromUtcTime),
-		},
-		RequestType: proto.Uint32(requestType),
+		RequestId:   proto.Uint32(requestID),
+		RequestType: proto.Uint32(uint32(pb.TimeBarRequest_REQUEST_TYPE_DROP)),
 	}
 
 	clientMsg := &pb.ClientMsg{
 		TimeBarRequests: []*pb.TimeBarRequest{tbRequest},
 	}
 
-	log.Printf("Requesting historical data:\n%s", PrettyPrintProto(clientMsg))
+	return c.send(ctx, clientMsg)
+}
 
-	// Marshal and send request
-	data, err := proto.Marshal(clientMsg)
-	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
+// BarRange selects the bars of a non-timed bar request: the Count bars before To, or
+// before now if To is zero. ToIndex excludes bars starting at To from that index on.
+// Subscribing keeps the bars updated and requires a zero To. TickTypes, if set, are the
+// quotes bars are built from.
+type BarRange struct {
+	To        time.Time
+	ToIndex   int32
+	Count     uint32
+	TickTypes []uint32
+	Subscribe bool
+}
+
+// RequestTickBars requests tick bars of a contract, optionally building bars from
+// ticks that do not change the price. The returned listener receives the non-timed bar
+// reports for this request.
+func (c *CQGClient) RequestTickBars(ctx context.Context, contractID uint32, r BarRange, flatTicks bool) (*Listener, error) {
+	return c.requestNonTimedBars(ctx, contractID, r, &pb.NonTimedBarRequest{
+		TickBarParameters: &pb.TickBarParameters{
+			UseFlatTicks: proto.Bool(flatTicks),
+		},
+	})
+}
+
+// RequestRangeBars requests range bars of a contract spanning rangeSize ticks each,
+// restarting at the given start point
+func (c *CQGClient) RequestRangeBars(ctx context.Context, contractID uint32, r BarRange, rangeSize, startPoint uint32) (*Listener, error) {
+	return c.requestNonTimedBars(ctx, contractID, r, &pb.NonTimedBarRequest{
+		RangeBarParameters: &pb.RangeBarParameters{
+			RangeSize:  proto.Uint32(rangeSize),
+			StartPoint: proto.Uint32(startPoint),
+		},
+	})
+}
+
+// RequestRenkoBars requests Renko bars of a contract with bricks of brickSize ticks.
+// Price gaps produce up to maxNullBricks empty bricks.
+func (c *CQGClient) RequestRenkoBars(ctx context.Context, contractID uint32, r BarRange, brickSize, maxNullBricks, startPoint uint32) (*Listener, error) {
+	return c.requestNonTimedBars(ctx, contractID, r, &pb.NonTimedBarRequest{
+		RenkoBarParameters: &pb.RenkoBarParameters{
+			BrickSize:     proto.Uint32(brickSize),
+			MaxNullBricks: proto.Uint32(maxNullBricks),
+			StartPoint:    proto.Uint32(startPoint),
+		},
+	})
+}
+
+// RequestConstantVolumeBars requests bars of a contract covering volumeLevel each,
+// counted in exchange volume or, with tickVolume, in price changes
+func (c *CQGClient) RequestConstantVolumeBars(ctx context.Context, contractID uint32, r BarRange, volumeLevel int64, tickVolume, flatTicks bool) (*Listener, error) {
+	return c.requestNonTimedBars(ctx, contractID, r, &pb.NonTimedBarRequest{
+		ConstantVolumeBarParameters: &pb.ConstantVolumeBarParameters{
+			VolumeLevel:   &shared.Decimal{Significand: proto.Int64(volumeLevel)},
+			UseTickVolume: proto.Bool(tickVolume),
+			UseFlatTicks:  proto.Bool(flatTicks),
+		},
+	})
+}
+
+// RequestPointAndFigureBars requests point-and-figure columns of a contract with boxes
+// of boxSize ticks, reversing after reversal boxes
+func (c *CQGClient) RequestPointAndFigureBars(ctx context.Context, contractID uint32, r BarRange, boxSize, reversal uint32) (*Listener, error) {
+	return c.requestNonTimedBars(ctx, contractID, r, &pb.NonTimedBarRequest{
+		PointAndFigureParameters: &pb.PointAndFigureParameters{
+			BoxSize:  proto.Uint32(boxSize),
+			Reversal: proto.Uint32(reversal),
+		},
+	})
+}
+
+// requestNonTimedBars completes a non-timed bar request carrying the parameters of its
+// bar type and sends it
+func (c *CQGClient) requestNonTimedBars(ctx context.Context, contractID uint32, r BarRange, req *pb.NonTimedBarRequest) (*Listener, error) {
+	if contractID == 0 {
+		return nil, fmt.Errorf("invalid contract ID")
+	}
+	if r.Count == 0 {
+		return nil, fmt.Errorf("invalid bar count")
+	}
+	if r.Subscribe && !r.To.IsZero() {
+		return nil, fmt.Errorf("bars can only be subscribed up to now")
 	}
 
-	if err := c.WS.WriteMessage(websocket.BinaryMessage, data); err != nil {
-		return fmt.Errorf("write message error: %w", err)
+	msgID := c.NextRequestID()
+	req.RequestId = proto.Uint32(msgID)
+	req.ContractId = proto.Uint32(contractID)
+	req.TickTypes = r.TickTypes
+	req.BarRange = &pb.BarRange{
+		Count:         proto.Uint32(r.Count),
+		TimeDirection: proto.Uint32(uint32(pb.BarRange_TIME_DIRECTION_BACKWARD)),
+	}
+	if !r.To.IsZero() {
+		req.BarRange.UtcTime = proto.Int64(c.serverTime(r.To))
+		req.BarRange.Index = proto.Int32(r.ToIndex)
+	}
+	req.RequestType = proto.Uint32(uint32(pb.NonTimedBarRequest_REQUEST_TYPE_GET))
+	if r.Subscribe {
+		req.RequestType = proto.Uint32(uint32(pb.NonTimedBarRequest_REQUEST_TYPE_SUBSCRIBE))
 	}
 
-	return nil
+	clientMsg := &pb.ClientMsg{
+		NonTimedBarRequests: []*pb.NonTimedBarRequest{req},
+	}
+
+	if c.cfg.Debug {
+		log.Printf("Requesting non-timed bars:\n%s", PrettyPrintProto(clientMsg))
+	}
+
+	// Send request
+	return c.sendRequest(ctx, msgID, clientMsg)
+}
+
+// DropNonTimedBars cancels a non-timed bar request or subscription
+func (c *CQGClient) DropNonTimedBars(ctx context.Context, requestID uint32) error {
+	clientMsg := &pb.ClientMsg{
+		NonTimedBarRequests: []*pb.NonTimedBarRequest{{
+			RequestId:   proto.Uint32(requestID),
+			RequestType: proto.Uint32(uint32(pb.NonTimedBarRequest_REQUEST_TYPE_DROP)),
+		}},
+	}
+
+	return c.send(ctx, clientMsg)
+}
+
+// RequestTimeAndSales requests the historical trades and quotes of a contract from one
+// time up to another, or up to now if to is zero. Off-market trades and trade
+// attributes are included. The returned listener receives the time and sales reports
+// for this request, which may be split over several reports.
+func (c *CQGClient) RequestTimeAndSales(ctx context.Context, contractID, level uint32, from, to time.Time) (*Listener, error) {
+	if contractID == 0 {
+		return nil, fmt.Errorf("invalid contract ID")
+	}
+	if !to.IsZero() && !to.After(from) {
+		return nil, fmt.Errorf("invalid time range: end is not after start")
+	}
+
+	msgID := c.NextRequestID()
+	params := &pb.TimeAndSalesParameters{
+		ContractId:             proto.Uint32(contractID),
+		Level:                  proto.Uint32(level),
+		FromUtcTime:            proto.Int64(c.serverTime(from)),
+		IncludeOffMarketTrades: proto.Bool(true),
+		IncludeTradeAttributes: proto.Bool(true),
+	}
+	if !to.IsZero() {
+		params.ToUtcTime = proto.Int64(c.serverTime(to))
+	}
+
+	clientMsg := &pb.ClientMsg{
+		TimeAndSalesRequests: []*pb.TimeAndSalesRequest{{
+			RequestId:              proto.Uint32(msgID),
+			TimeAndSalesParameters: params,
+			RequestType:            proto.Uint32(uint32(pb.TimeAndSalesRequest_REQUEST_TYPE_GET)),
+		}},
+	}
+
+	if c.cfg.Debug {
+		log.Printf("Requesting time and sales:\n%s", PrettyPrintProto(clientMsg))
+	}
+
+	// Send request
+	return c.sendRequest(ctx, msgID, clientMsg)
+}
+
+// DropTimeAndSales cancels a time and sales request that has not completed
+func (c *CQGClient) DropTimeAndSales(ctx context.Context, requestID uint32) error {
+	clientMsg := &pb.ClientMsg{
+		TimeAndSalesRequests: []*pb.TimeAndSalesRequest{{
+			RequestId:   proto.Uint32(requestID),
+			RequestType: proto.Uint32(uint32(pb.TimeAndSalesRequest_REQUEST_TYPE_DROP)),
+		}},
+	}
+
+	return c.send(ctx, clientMsg)
 }
 
-// HandleMessages continuously reads and processes incoming server messages
-func (c *CQGClient) HandleMessages(handler func(*pb.ServerMsg)) {
+// RequestVolumeProfile requests the volume traded at each price of a contract from one
+// time up to another, or up to now if to is zero. CQG rounds both times out to whole
+// minutes and rejects the same request made again within 60 seconds of its completion.
+// The returned listener receives the volume profile reports for this request, which
+// may be split over several reports.
+func (c *CQGClient) RequestVolumeProfile(ctx context.Context, contractID uint32, from, to time.Time) (*Listener, error) {
+	if contractID == 0 {
+		return nil, fmt.Errorf("invalid contract ID")
+	}
+	if !to.IsZero() && !to.After(from) {
+		return nil, fmt.Errorf("invalid time range: end is not after start")
+	}
+
+	params := &pb.VolumeProfileParameters{
+		ContractId:   proto.Uint32(contractID),
+		StartUtcTime: proto.Int64(c.serverTime(from)),
+	}
+	if !to.IsZero() {
+		params.EndUtcTime = proto.Int64(c.serverTime(to))
+	}
+
+	msgID := c.NextRequestID()
+	clientMsg := &pb.ClientMsg{
+		VolumeProfileRequests: []*pb.VolumeProfileRequest{{
+			RequestId:               proto.Uint32(msgID),
+			VolumeProfileParameters: params,
+			RequestType:             proto.Uint32(uint32(pb.VolumeProfileRequest_REQUEST_TYPE_GET)),
+		}},
+	}
+
+	if c.cfg.Debug {
+		log.Printf("Requesting volume profile:\n%s", PrettyPrintProto(clientMsg))
+	}
+
+	// Send request
+	return c.sendRequest(ctx, msgID, clientMsg)
+}
+
+// DropVolumeProfile cancels a volume profile request that has not completed
+func (c *CQGClient) DropVolumeProfile(ctx context.Context, requestID uint32) error {
+	clientMsg := &pb.ClientMsg{
+		VolumeProfileRequests: []*pb.VolumeProfileRequest{{
+			RequestId:   proto.Uint32(requestID),
+			RequestType: proto.Uint32(uint32(pb.VolumeProfileRequest_REQUEST_TYPE_DROP)),
+		}},
+	}
+
+	return c.send(ctx, clientMsg)
+}
+
+// HandleMessages passes every incoming server message to handler until the connection
+// closes or ctx is done
+func (c *CQGClient) HandleMessages(ctx context.Context, handler func(*pb.ServerMsg)) {
 	if handler == nil {
 		log.Printf("error: message handler is nil")
 		return
 	}
 
+	l := c.Listen()
+	defer l.Close()
+
 	for {
-		_, msg, err := c.WS.ReadMessage()
-		if err != nil {
-			log.Printf("read message error: %v", err)
+		select {
+		case <-ctx.Done():
 			return
+		case serverMsg, ok := <-l.C:
+			if !ok {
+				return
+			}
+			handler(serverMsg)
 		}
-
-		serverMsg := &pb.ServerMsg{}
-		if err := proto.Unmarshal(msg, serverMsg); err != nil {
-			log.Printf("unmarshal error: %v", err)
-			continue
-		}
-
-		handler(serverMsg)
 	}
 }
 
@@ -368,9 +991,23 @@ func PrettyPrintProto(msg proto.Message) string {
 	return prototext.Format(msg)
 }
 
-// Close cleanly closes the WebSocket connection
+// Close cleanly closes the WebSocket connection, stops reconnecting and detaches all listeners
 func (c *CQGClient) Close() {
-	if c.WS != nil {
-		c.WS.Close()
-	}
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.connected.Store(false)
+		if ws := c.conn(); ws != nil {
+			ws.Close()
+		}
+		if c.recorder != nil {
+			c.recorder.Close()
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for l := range c.listeners {
+			c.detach(l)
+		}
+	})
 }
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+func TestRequestBarTimeValidation(t *testing.T) {
+	from := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	minute, hour, day := uint32(pb.BarUnit_BAR_UNIT_MIN), uint32(pb.BarUnit_BAR_UNIT_HOUR), uint32(pb.BarUnit_BAR_UNIT_DAY)
+	standard := uint32(pb.ContinuationParameters_CONTINUATION_TYPE_STANDARD)
+
+	// Every request is rejected before anything is sent, so no connection is needed
+	c := &CQGClient{}
+	for _, test := range []struct {
+		name       string
+		contractID uint32
+		r          BarTimeRange
+		want       string
+	}{
+		{"no contract", 0, BarTimeRange{BarUnit: day, From: from}, "invalid contract ID"},
+		{"unknown unit", 1, BarTimeRange{BarUnit: 999, From: from}, "invalid bar unit"},
+		{"end at start", 1, BarTimeRange{BarUnit: day, From: from, To: from}, "end is not after start"},
+		{"end before start", 1, BarTimeRange{BarUnit: day, From: from, To: from.Add(-time.Hour)}, "end is not after start"},
+		{"subscription with end", 1, BarTimeRange{BarUnit: day, From: from, To: from.AddDate(0, 0, 1), Subscribe: true}, "take no end time"},
+		{"minutes over a day", 1, BarTimeRange{BarUnit: minute, UnitNumber: 24*60 + 1, From: from}, "minute bars are at most a day long"},
+		{"hours over a day", 1, BarTimeRange{BarUnit: hour, UnitNumber: 25, From: from}, "hour bars are at most a day long"},
+		{"several days", 1, BarTimeRange{BarUnit: day, UnitNumber: 2, From: from}, "only minute and hour bars span several units"},
+		{"unknown continuation", 1, BarTimeRange{BarUnit: day, From: from, Continuation: 99}, "invalid continuation type"},
+		{"equalize without continuation", 1, BarTimeRange{BarUnit: day, From: from, Equalize: true}, "requires a continuation type"},
+		{"equalize standard", 1, BarTimeRange{BarUnit: day, From: from, Continuation: standard, Equalize: true}, "only active continuations"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := c.RequestBarTime(context.Background(), test.contractID, test.r)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("RequestBarTime error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// heartbeatMaxMissed is the number of unanswered pings after which the connection is declared dead
+const heartbeatMaxMissed = 3
+
+// latencyBucketBounds are the upper bounds of the round-trip histogram buckets.
+// Samples above the last bound are counted in an overflow bucket.
+var latencyBucketBounds = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// LatencyHistogram records Ping/Pong round-trip times. It is safe for concurrent use.
+type LatencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64 // One count per bucket bound plus the overflow bucket
+	total  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+	last   time.Duration
+	lastAt time.Time
+}
+
+// LatencyBucket is the number of samples at or below an upper bound in milliseconds.
+// The overflow bucket has an upper bound of zero.
+type LatencyBucket struct {
+	UpperBoundMs float64 `json:"le_ms,omitempty"`
+	Count        uint64  `json:"count"`
+}
+
+// LatencySnapshot is a point-in-time copy of a latency histogram
+type LatencySnapshot struct {
+	Count      uint64          `json:"count"`
+	LastMs     float64         `json:"last_ms"`
+	MinMs      float64         `json:"min_ms"`
+	MaxMs      float64         `json:"max_ms"`
+	MeanMs     float64         `json:"mean_ms"`
+	LastSample time.Time       `json:"last_sample,omitempty"`
+	Buckets    []LatencyBucket `json:"buckets"`
+}
+
+// newLatencyHistogram creates an empty histogram
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		counts: make([]uint64, len(latencyBucketBounds)+1),
+	}
+}
+
+// Observe records a round-trip time
+func (h *LatencyHistogram) Observe(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	bucket := len(latencyBucketBounds)
+	for i, bound := range latencyBucketBounds {
+		if rtt <= bound {
+			bucket = i
+			break
+		}
+	}
+	h.counts[bucket]++
+
+	if h.total == 0 || rtt < h.min {
+		h.min = rtt
+	}
+	if rtt > h.max {
+		h.max = rtt
+	}
+	h.total++
+	h.sum += rtt
+	h.last = rtt
+	h.lastAt = time.Now()
+}
+
+// Snapshot returns a copy of the recorded statistics
+func (h *LatencyHistogram) Snapshot() LatencySnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := LatencySnapshot{
+		Count:      h.total,
+		LastMs:     durationMs(h.last),
+		MinMs:      durationMs(h.min),
+		MaxMs:      durationMs(h.max),
+		LastSample: h.lastAt,
+		Buckets:    make([]LatencyBucket, 0, len(h.counts)),
+	}
+	if h.total > 0 {
+		snapshot.MeanMs = durationMs(h.sum / time.Duration(h.total))
+	}
+
+	for i, count := range h.counts {
+		bucket := LatencyBucket{Count: count}
+		if i < len(latencyBucketBounds) {
+			bucket.UpperBoundMs = durationMs(latencyBucketBounds[i])
+		}
+		snapshot.Buckets = append(snapshot.Buckets, bucket)
+	}
+
+	return snapshot
+}
+
+// durationMs converts a duration into fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// heartbeat holds the Ping/Pong state of a client
+type heartbeat struct {
+	mu      sync.Mutex
+	seq     uint64               // Sequence used to build ping tokens
+	pending map[string]time.Time // Send time of unanswered pings by token
+	missed  int                  // Consecutive pings without a pong
+	latency *LatencyHistogram
+}
+
+// newHeartbeat creates the heartbeat state for a client
+func newHeartbeat() *heartbeat {
+	return &heartbeat{
+		pending: make(map[string]time.Time),
+		latency: newLatencyHistogram(),
+	}
+}
+
+// reset forgets unanswered pings, e.g. after the socket was replaced
+func (h *heartbeat) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.pending = make(map[string]time.Time)
+	h.missed = 0
+}
+
+// Latency returns the round-trip statistics of the heartbeat
+func (c *CQGClient) Latency() LatencySnapshot {
+	return c.heartbeat.latency.Snapshot()
+}
+
+// heartbeatLoop pings the server on an interval and closes the socket once too many
+// pings go unanswered, which makes the reader reconnect. It exits when the client is closed.
+func (c *CQGClient) heartbeatLoop() {
+	ticker := time.NewTicker(c.cfg.Timeouts.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.ping()
+		}
+	}
+}
+
+// ping sends the next ping, or closes the socket if the last heartbeatMaxMissed pings
+// went unanswered
+func (c *CQGClient) ping() {
+	// Nothing to ping while the reader is reconnecting
+	if !c.connected.Load() {
+		c.heartbeat.reset()
+		return
+	}
+
+	h := c.heartbeat
+	h.mu.Lock()
+	missed := h.missed
+	if missed >= heartbeatMaxMissed {
+		h.mu.Unlock()
+		log.Printf("No pong for %d pings, closing connection", missed)
+		h.reset()
+		c.conn().Close()
+		return
+	}
+	h.missed++
+	h.seq++
+	token := strconv.FormatUint(h.seq, 10)
+	h.pending[token] = time.Now()
+	h.mu.Unlock()
+
+	ping := &pb.ClientMsg{
+		Ping: &pb.Ping{
+			Token:       proto.String(token),
+			PingUtcTime: proto.Int64(c.serverTime(time.Now())),
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Heartbeat)
+	err := c.write(ctx, ping)
+	cancel()
+	if err != nil {
+		log.Printf("failed to send ping: %v", err)
+	}
+}
+
+// handleHeartbeat answers server pings and records round-trip times of server pongs
+func (c *CQGClient) handleHeartbeat(serverMsg *pb.ServerMsg) {
+	if ping := serverMsg.GetPing(); ping != nil {
+		pong := &pb.ClientMsg{
+			Pong: &pb.Pong{
+				Token:       proto.String(ping.GetToken()),
+				PingUtcTime: proto.Int64(ping.GetPingUtcTime()),
+				PongUtcTime: proto.Int64(c.serverTime(time.Now())),
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Heartbeat)
+		err := c.write(ctx, pong)
+		cancel()
+		if err != nil {
+			log.Printf("failed to send pong: %v", err)
+		}
+	}
+
+	if pong := serverMsg.GetPong(); pong != nil {
+		h := c.heartbeat
+		h.mu.Lock()
+		sentAt, ok := h.pending[pong.GetToken()]
+		if ok {
+			delete(h.pending, pong.GetToken())
+			h.missed = 0
+		}
+		h.mu.Unlock()
+
+		if ok {
+			h.latency.Observe(time.Since(sentAt))
+		}
+	}
+}
+
+// serverTime converts a local time into milliseconds relative to the session base time
+func (c *CQGClient) serverTime(t time.Time) int64 {
+	return t.UnixNano()/int64(time.Millisecond) - c.baseTime.Load()
+}
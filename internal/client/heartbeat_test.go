@@ -0,0 +1,164 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-websocket/internal/config"
+	pb "go-websocket/proto/WebAPI"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	if snapshot := h.Snapshot(); snapshot.Count != 0 || snapshot.MeanMs != 0 {
+		t.Fatalf("empty snapshot = %+v", snapshot)
+	}
+
+	for _, rtt := range []time.Duration{
+		3 * time.Millisecond,
+		10 * time.Millisecond, // On a bound, counted in that bucket
+		11 * time.Millisecond,
+		4 * time.Second, // Above every bound
+	} {
+		h.Observe(rtt)
+	}
+
+	snapshot := h.Snapshot()
+	if snapshot.Count != 4 || snapshot.MinMs != 3 || snapshot.MaxMs != 4000 || snapshot.LastMs != 4000 {
+		t.Errorf("snapshot = %+v", snapshot)
+	}
+	if snapshot.MeanMs != 1006 {
+		t.Errorf("mean = %v, want 1006", snapshot.MeanMs)
+	}
+	if snapshot.LastSample.IsZero() {
+		t.Error("last sample time not set")
+	}
+
+	if len(snapshot.Buckets) != len(latencyBucketBounds)+1 {
+		t.Fatalf("got %d buckets, want %d", len(snapshot.Buckets), len(latencyBucketBounds)+1)
+	}
+	want := map[float64]uint64{5: 1, 10: 1, 25: 1, 0: 1}
+	for _, bucket := range snapshot.Buckets {
+		if bucket.Count != want[bucket.UpperBoundMs] {
+			t.Errorf("bucket %v ms count = %d, want %d", bucket.UpperBoundMs, bucket.Count, want[bucket.UpperBoundMs])
+		}
+	}
+	if overflow := snapshot.Buckets[len(snapshot.Buckets)-1]; overflow.UpperBoundMs != 0 {
+		t.Errorf("overflow bucket bound = %v, want 0", overflow.UpperBoundMs)
+	}
+}
+
+func TestHeartbeatAnswersPing(t *testing.T) {
+	c, frames := heartbeatClient(t)
+
+	c.handleHeartbeat(&pb.ServerMsg{
+		Ping: &pb.Ping{Token: proto.String("server-1"), PingUtcTime: proto.Int64(1234)},
+	})
+
+	pong := (<-frames).GetPong()
+	if pong.GetToken() != "server-1" || pong.GetPingUtcTime() != 1234 || pong.PongUtcTime == nil {
+		t.Errorf("pong = %v", pong)
+	}
+}
+
+func TestHeartbeatRecordsPong(t *testing.T) {
+	c, frames := heartbeatClient(t)
+
+	c.ping()
+	ping := (<-frames).GetPing()
+	if ping == nil {
+		t.Fatal("no ping sent")
+	}
+
+	c.handleHeartbeat(&pb.ServerMsg{
+		Pong: &pb.Pong{
+			Token:       proto.String(ping.GetToken()),
+			PingUtcTime: proto.Int64(ping.GetPingUtcTime()),
+			PongUtcTime: proto.Int64(ping.GetPingUtcTime()),
+		},
+	})
+
+	if count := c.Latency().Count; count != 1 {
+		t.Errorf("latency count = %d, want 1", count)
+	}
+	if missed := c.heartbeat.missed; missed != 0 {
+		t.Errorf("missed = %d after pong, want 0", missed)
+	}
+}
+
+func TestHeartbeatClosesAfterMissedPongs(t *testing.T) {
+	c, frames := heartbeatClient(t)
+
+	for i := 0; i < heartbeatMaxMissed; i++ {
+		c.ping()
+		if ping := (<-frames).GetPing(); ping == nil {
+			t.Fatalf("ping %d not sent", i+1)
+		}
+	}
+
+	// The next tick finds every ping unanswered and drops the socket
+	c.ping()
+	select {
+	case frame, ok := <-frames:
+		if ok {
+			t.Fatalf("got %v, want the connection closed", frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	if missed := c.heartbeat.missed; missed != 0 {
+		t.Errorf("missed = %d after closing, want 0", missed)
+	}
+}
+
+// heartbeatClient returns a logged-on client connected to a test server, and the client
+// messages the server receives. The channel is closed when the connection drops.
+func heartbeatClient(t *testing.T) (*CQGClient, <-chan *pb.ClientMsg) {
+	t.Helper()
+
+	frames := make(chan *pb.ClientMsg, 16)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		defer close(frames)
+
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			clientMsg := &pb.ClientMsg{}
+			if err := proto.Unmarshal(data, clientMsg); err != nil {
+				t.Errorf("unmarshal client message: %v", err)
+				return
+			}
+			frames <- clientMsg
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	c := &CQGClient{
+		WS:        ws,
+		cfg:       &config.Config{Timeouts: config.Timeouts{Heartbeat: time.Second}},
+		heartbeat: newHeartbeat(),
+		done:      make(chan struct{}),
+	}
+	c.connected.Store(true)
+	return c, frames
+}
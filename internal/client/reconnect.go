@@ -0,0 +1,419 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	reconnectInitialDelay = time.Second      // Delay before the first reconnect attempt
+	reconnectMaxDelay     = 30 * time.Second // Upper bound of the exponential backoff
+)
+
+// ConnectionState describes a change of the upstream connection
+type ConnectionState string
+
+const (
+	StateDisconnected ConnectionState = "disconnected" // The socket dropped; data may be missing from now on
+	StateReconnected  ConnectionState = "reconnected"  // The session is back and subscriptions were replayed
+)
+
+// ConnectionNotice is delivered to every listener when the upstream connection drops
+// or comes back, so that downstream clients can report a gap instead of a dead stream
+type ConnectionNotice struct {
+	State    ConnectionState
+	Time     time.Time
+	Restored bool  // True if the previous session was restored rather than logged on again
+	Err      error // Cause of the disconnect, if any
+}
+
+// subscriptionSet tracks the subscriptions sent on a client so they can be
+// resubmitted after a reconnect
+type subscriptionSet struct {
+	marketData   map[uint32]*pb.MarketDataSubscription // By contract ID
+	timeBars     map[uint32]*pb.TimeBarRequest         // By request ID
+	nonTimedBars map[uint32]*pb.NonTimedBarRequest     // By request ID
+	trades       map[uint32]*pb.TradeSubscription      // By subscription ID
+	information  map[uint32]*pb.InformationRequest     // By request ID
+	times        map[uint32]requestTimes               // Times of bar subscriptions by request ID
+}
+
+// requestTimes holds the times of a bar subscription in Unix milliseconds. Times are
+// sent relative to the base time of the session, which changes with a new logon or a
+// restored session, so they are encoded again when the subscription is replayed. The
+// boundary of a non-timed bar range is kept in from.
+type requestTimes struct {
+	from, to *int64
+}
+
+// newSubscriptionSet creates an empty subscription set
+func newSubscriptionSet() *subscriptionSet {
+	return &subscriptionSet{
+		marketData:   make(map[uint32]*pb.MarketDataSubscription),
+		timeBars:     make(map[uint32]*pb.TimeBarRequest),
+		nonTimedBars: make(map[uint32]*pb.NonTimedBarRequest),
+		trades:       make(map[uint32]*pb.TradeSubscription),
+		information:  make(map[uint32]*pb.InformationRequest),
+		times:        make(map[uint32]requestTimes),
+	}
+}
+
+// track records subscriptions started by a client message, sent with the given base
+// time, and forgets cancelled ones
+func (s *subscriptionSet) track(clientMsg *pb.ClientMsg, baseTime int64) {
+	for _, sub := range clientMsg.GetMarketDataSubscriptions() {
+		if sub.GetLevel() == uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+			delete(s.marketData, sub.GetContractId())
+		} else {
+			s.marketData[sub.GetContractId()] = sub
+		}
+	}
+
+	for _, req := range clientMsg.GetTimeBarRequests() {
+		switch req.GetRequestType() {
+		case uint32(pb.TimeBarRequest_REQUEST_TYPE_SUBSCRIBE):
+			params := req.GetTimeBarParameters()
+			s.timeBars[req.GetRequestId()] = req
+			s.times[req.GetRequestId()] = requestTimes{
+				from: absoluteTime(params.FromUtcTime, baseTime),
+				to:   absoluteTime(params.ToUtcTime, baseTime),
+			}
+		case uint32(pb.TimeBarRequest_REQUEST_TYPE_DROP):
+			delete(s.timeBars, req.GetRequestId())
+			delete(s.times, req.GetRequestId())
+		}
+	}
+
+	for _, req := range clientMsg.GetNonTimedBarRequests() {
+		switch req.GetRequestType() {
+		case uint32(pb.NonTimedBarRequest_REQUEST_TYPE_SUBSCRIBE):
+			s.nonTimedBars[req.GetRequestId()] = req
+			s.times[req.GetRequestId()] = requestTimes{from: absoluteTime(req.GetBarRange().UtcTime, baseTime)}
+		case uint32(pb.NonTimedBarRequest_REQUEST_TYPE_DROP):
+			delete(s.nonTimedBars, req.GetRequestId())
+			delete(s.times, req.GetRequestId())
+		}
+	}
+
+	for _, sub := range clientMsg.GetTradeSubscriptions() {
+		if sub.GetSubscribe() {
+			s.trades[sub.GetId()] = sub
+		} else {
+			delete(s.trades, sub.GetId())
+		}
+	}
+
+	for _, req := range clientMsg.GetInformationRequests() {
+		if req.GetSubscribe() {
+			s.information[req.GetId()] = req
+		} else {
+			delete(s.information, req.GetId())
+		}
+	}
+}
+
+// replayMsg builds a single client message resubmitting every tracked subscription,
+// with the times of bar subscriptions relative to the base time of the new session
+func (s *subscriptionSet) replayMsg(baseTime int64) *pb.ClientMsg {
+	clientMsg := &pb.ClientMsg{}
+	for _, req := range s.information {
+		clientMsg.InformationRequests = append(clientMsg.InformationRequests, req)
+	}
+	for _, sub := range s.marketData {
+		clientMsg.MarketDataSubscriptions = append(clientMsg.MarketDataSubscriptions, sub)
+	}
+	for requestID, req := range s.timeBars {
+		req = proto.Clone(req).(*pb.TimeBarRequest)
+		if params := req.GetTimeBarParameters(); params != nil {
+			times := s.times[requestID]
+			params.FromUtcTime = sessionTime(times.from, baseTime)
+			params.ToUtcTime = sessionTime(times.to, baseTime)
+		}
+		clientMsg.TimeBarRequests = append(clientMsg.TimeBarRequests, req)
+	}
+	for requestID, req := range s.nonTimedBars {
+		req = proto.Clone(req).(*pb.NonTimedBarRequest)
+		if barRange := req.GetBarRange(); barRange != nil {
+			barRange.UtcTime = sessionTime(s.times[requestID].from, baseTime)
+		}
+		clientMsg.NonTimedBarRequests = append(clientMsg.NonTimedBarRequests, req)
+	}
+	for _, sub := range s.trades {
+		clientMsg.TradeSubscriptions = append(clientMsg.TradeSubscriptions, sub)
+	}
+	return clientMsg
+}
+
+// absoluteTime converts an optional time relative to a base time into Unix milliseconds
+func absoluteTime(t *int64, baseTime int64) *int64 {
+	if t == nil {
+		return nil
+	}
+	return proto.Int64(*t + baseTime)
+}
+
+// sessionTime converts optional Unix milliseconds into a time relative to a base time
+func sessionTime(t *int64, baseTime int64) *int64 {
+	if t == nil {
+		return nil
+	}
+	return proto.Int64(*t - baseTime)
+}
+
+// remapContract rewrites subscriptions of a contract whose ID changed after a new logon
+func (s *subscriptionSet) remapContract(oldID, newID uint32) {
+	if sub, ok := s.marketData[oldID]; ok {
+		delete(s.marketData, oldID)
+		sub.ContractId = proto.Uint32(newID)
+		s.marketData[newID] = sub
+	}
+	for _, req := range s.timeBars {
+		if params := req.GetTimeBarParameters(); params.GetContractId() == oldID {
+			params.ContractId = proto.Uint32(newID)
+		}
+	}
+	for _, req := range s.nonTimedBars {
+		if req.GetContractId() == oldID {
+			req.ContractId = proto.Uint32(newID)
+		}
+	}
+}
+
+// reconnect redials the server with exponential backoff until the session is back or
+// the client is closed. It reports whether reading can resume.
+func (c *CQGClient) reconnect(cause error) bool {
+	c.connected.Store(false)
+	c.conn().Close()
+	c.notify(ConnectionNotice{State: StateDisconnected, Time: time.Now(), Err: cause})
+
+	delay := reconnectInitialDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.done:
+			return false
+		case <-time.After(delay):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Reconnect)
+		restored, err := c.redial(ctx)
+		cancel()
+		if err == nil {
+			c.heartbeat.reset()
+			log.Printf("Reconnected to CQG after %d attempt(s), session restored: %t", attempt, restored)
+			c.connected.Store(true)
+
+			// Resubscribe once the reader is consuming the new socket again
+			go c.resubscribe(restored)
+			return true
+		}
+
+		log.Printf("reconnect attempt %d failed: %v", attempt, err)
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// redial opens a new socket and restores the previous session, falling back to a
+// full logon if the session cannot be restored
+func (c *CQGClient) redial(ctx context.Context) (bool, error) {
+	if err := c.dial(ctx); err != nil {
+		return false, err
+	}
+
+	err := c.restoreSession(ctx)
+	if err == nil {
+		return true, nil
+	}
+	log.Printf("session restore failed, logging on again: %v", err)
+
+	// The server may drop the socket after a failed restore, so log on from scratch
+	c.conn().Close()
+	if err := c.dial(ctx); err != nil {
+		return false, err
+	}
+
+	creds := c.creds
+	if err := c.Logon(ctx, creds.UserName, creds.Password, creds.ClientAppId, creds.ClientVersion, creds.ProtocolVersionMajor, creds.ProtocolVersionMinor); err != nil {
+		c.conn().Close()
+		return false, err
+	}
+
+	return false, nil
+}
+
+// dial replaces the WebSocket connection with a fresh one
+func (c *CQGClient) dial(ctx context.Context) error {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, c.cfg.CQG.HostName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to establish WebSocket connection: %w", err)
+	}
+
+	var conn Conn = ws
+	if c.recorder != nil {
+		conn = c.recorder.Wrap(ws)
+	}
+
+	c.writeMu.Lock()
+	c.WS = conn
+	c.writeMu.Unlock()
+
+	return nil
+}
+
+// restoreSession rejoins the previous session using the token from LogonResult
+func (c *CQGClient) restoreSession(ctx context.Context) error {
+	if c.sessionToken == "" {
+		return fmt.Errorf("no session token to restore")
+	}
+
+	clientMsg := &pb.ClientMsg{
+		RestoreOrJoinSession: &pb.RestoreOrJoinSession{
+			SessionToken:         proto.String(c.sessionToken),
+			ClientAppId:          proto.String(c.creds.ClientAppId),
+			ProtocolVersionMajor: proto.Uint32(c.creds.ProtocolVersionMajor),
+			ProtocolVersionMinor: proto.Uint32(c.creds.ProtocolVersionMinor),
+		},
+	}
+
+	if err := c.write(ctx, clientMsg); err != nil {
+		return err
+	}
+
+	serverMsg, err := c.readDirect(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := serverMsg.GetRestoreOrJoinSessionResult()
+	if result == nil {
+		return fmt.Errorf("unexpected response type: %T", serverMsg)
+	}
+	if result.GetResultCode() != uint32(pb.RestoreOrJoinSessionResult_RESULT_CODE_SUCCESS) {
+		return fmt.Errorf("server rejection: %s (code %d)", result.GetTextMessage(), result.GetResultCode())
+	}
+
+	baseTime, err := parseBaseTime(result.GetBaseTime())
+	if err != nil {
+		return err
+	}
+	c.baseTime.Store(baseTime)
+
+	return nil
+}
+
+// resubscribe resubmits every active subscription after a reconnect. Contract IDs are
+// assigned per session, so after a full logon the resolved symbols are resolved again
+// and subscriptions are moved to the new IDs first.
+func (c *CQGClient) resubscribe(restored bool) {
+	if !restored {
+		c.mu.Lock()
+		symbols := make(map[uint32]string, len(c.symbols))
+		for contractID, symbol := range c.symbols {
+			symbols[contractID] = symbol
+		}
+		// Symbol subscriptions are renewed by resolving again with their own request IDs
+		subscribed := make(map[string]uint32)
+		for requestID, req := range c.subscriptions.information {
+			if symbol := req.GetSymbolResolutionRequest().GetSymbol(); symbol != "" {
+				subscribed[symbol] = requestID
+			}
+		}
+		c.subscriptions.information = make(map[uint32]*pb.InformationRequest)
+		c.mu.Unlock()
+
+		for oldID, symbol := range symbols {
+			requestID, subscribe := subscribed[symbol]
+			if subscribe {
+				delete(subscribed, symbol)
+			} else {
+				requestID = c.NextRequestID()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Reconnect)
+			newID, err := c.resolveSymbol(ctx, requestID, symbol, subscribe)
+			cancel()
+			if err != nil {
+				log.Printf("failed to resolve %s after reconnect: %v", symbol, err)
+				continue
+			}
+			if newID != oldID {
+				c.remapContract(oldID, newID)
+			}
+		}
+
+		// Subscriptions to contracts since resolved under another symbol
+		for symbol, requestID := range subscribed {
+			ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Reconnect)
+			if _, err := c.resolveSymbol(ctx, requestID, symbol, true); err != nil {
+				log.Printf("failed to resolve %s after reconnect: %v", symbol, err)
+			}
+			cancel()
+		}
+	}
+
+	c.mu.Lock()
+	replay := c.subscriptions.replayMsg(c.baseTime.Load())
+	c.mu.Unlock()
+	if !restored {
+		// Symbol subscriptions were renewed above
+		replay.InformationRequests = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Reconnect)
+	defer cancel()
+	if err := c.write(ctx, replay); err != nil {
+		log.Printf("failed to resubmit subscriptions: %v", err)
+		return
+	}
+
+	log.Printf("Resubmitted %d market data, %d time bar, %d non-timed bar and %d trade subscription(s)",
+		len(replay.GetMarketDataSubscriptions()),
+		len(replay.GetTimeBarRequests()),
+		len(replay.GetNonTimedBarRequests()),
+		len(replay.GetTradeSubscriptions()),
+	)
+	c.notify(ConnectionNotice{State: StateReconnected, Time: time.Now(), Restored: restored})
+}
+
+// remapContract moves listeners and subscriptions of a contract to its new ID. The old
+// ID stays usable as an alias for metadata lookups by handlers that still hold it.
+func (c *CQGClient) remapContract(oldID, newID uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log.Printf("Contract ID changed after reconnect: %d -> %d", oldID, newID)
+
+	c.subscriptions.remapContract(oldID, newID)
+	c.contracts[oldID] = c.contracts[newID]
+	delete(c.symbols, oldID)
+
+	for l := range c.contractListeners[oldID] {
+		l.key = newID
+		if c.contractListeners[newID] == nil {
+			c.contractListeners[newID] = make(map[*Listener]struct{})
+		}
+		c.contractListeners[newID][l] = struct{}{}
+	}
+	delete(c.contractListeners, oldID)
+}
+
+// notify delivers a connection notice to every listener without blocking
+func (c *CQGClient) notify(notice ConnectionNotice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for l := range c.listeners {
+		select {
+		case l.notices <- notice:
+		default:
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Conn is the message-oriented connection used by CQGClient. It is implemented by
+// *websocket.Conn, by the recorder wrapper and by replayed sessions.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Frame directions in a recording
+const (
+	frameInbound  = "in"  // Server to client
+	frameOutbound = "out" // Client to server
+)
+
+// recordedFrame is one line of a recording: a raw protobuf frame with the time it
+// crossed the connection. Data is base64 encoded in the file.
+type recordedFrame struct {
+	Time        time.Time `json:"time"`
+	Direction   string    `json:"dir"`
+	MessageType int       `json:"type"`
+	Data        []byte    `json:"data"`
+}
+
+// Recorder appends every frame sent or received on wrapped connections to a file,
+// one JSON object per line. Passwords and session tokens are blanked out before a frame
+// is written. A recording can be replayed with NewReplayConn.
+type Recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewRecorder opens path for appending frames, creating it if needed
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	return &Recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Wrap returns a connection that records every frame passing through conn
+func (r *Recorder) Wrap(conn Conn) Conn {
+	return &recordingConn{Conn: conn, recorder: r}
+}
+
+// Close closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// record appends a frame to the file
+func (r *Recorder) record(direction string, messageType int, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	frame := recordedFrame{Time: time.Now().UTC(), Direction: direction, MessageType: messageType, Data: redact(direction, data)}
+	if err := r.enc.Encode(frame); err != nil {
+		log.Printf("failed to record frame: %v", err)
+	}
+}
+
+// redact returns a frame with the credentials it carries blanked out: the passwords and
+// tokens of a logon, and the session token used to restore or join a session. Frames
+// without credentials, or that cannot be decoded, are returned unchanged.
+func redact(direction string, data []byte) []byte {
+	var msg proto.Message
+	switch direction {
+	case frameOutbound:
+		clientMsg := &pb.ClientMsg{}
+		if err := proto.Unmarshal(data, clientMsg); err != nil {
+			return data
+		}
+		logon, restore := clientMsg.GetLogon(), clientMsg.GetRestoreOrJoinSession()
+		if logon == nil && restore == nil {
+			return data
+		}
+		if logon != nil {
+			blank(&logon.Password)
+			blank(&logon.OneTimePassword)
+			blank(&logon.AccessToken)
+			blank(&logon.PartnerToken)
+		}
+		if restore != nil {
+			blank(&restore.SessionToken)
+		}
+		msg = clientMsg
+	default:
+		serverMsg := &pb.ServerMsg{}
+		if err := proto.Unmarshal(data, serverMsg); err != nil {
+			return data
+		}
+		result := serverMsg.GetLogonResult()
+		if result == nil {
+			return data
+		}
+		blank(&result.SessionToken)
+		msg = serverMsg
+	}
+
+	redacted, err := proto.Marshal(msg)
+	if err != nil {
+		return data
+	}
+	return redacted
+}
+
+// blank replaces a string field that is set with an empty string
+func blank(field **string) {
+	if *field != nil {
+		*field = proto.String("")
+	}
+}
+
+// recordingConn records the frames of the connection it wraps
+type recordingConn struct {
+	Conn
+	recorder *Recorder
+}
+
+// ReadMessage reads and records an inbound frame
+func (rc *recordingConn) ReadMessage() (int, []byte, error) {
+	messageType, data, err := rc.Conn.ReadMessage()
+	if err == nil {
+		rc.recorder.record(frameInbound, messageType, data)
+	}
+	return messageType, data, err
+}
+
+// WriteMessage records and writes an outbound frame
+func (rc *recordingConn) WriteMessage(messageType int, data []byte) error {
+	err := rc.Conn.WriteMessage(messageType, data)
+	if err == nil {
+		rc.recorder.record(frameOutbound, messageType, data)
+	}
+	return err
+}
+
+// errReplayClosed is returned by a replayed connection after Close
+var errReplayClosed = errors.New("replay connection closed")
+
+// replayFrame is an inbound frame of a recording together with the number of client
+// writes that preceded it, so that replies are not delivered before their request
+type replayFrame struct {
+	recordedFrame
+	writesBefore int
+}
+
+// replayConn plays back the inbound frames of a recording. Client writes are discarded
+// but counted: each inbound frame is held back until the client has sent as many
+// messages as it had when the frame was recorded. Replay therefore assumes the client
+// issues the same requests in the same order as in the recorded session. Heartbeat
+// messages are not counted since their timing differs between runs.
+type replayConn struct {
+	frames   []replayFrame
+	outTimes []time.Time // Recorded times of outbound frames
+	realtime bool        // Reproduce the recorded gaps between frames
+
+	mu         sync.Mutex
+	changed    chan struct{} // Closed and replaced whenever the state below changes
+	next       int           // Index of the next inbound frame
+	writes     int           // Client writes so far
+	anchorRec  time.Time     // Recorded time of the last delivered or written frame
+	anchorWall time.Time     // Wall time at which that frame was replayed
+	deadline   time.Time
+	closed     bool
+}
+
+// NewReplayConn loads a recording made by Recorder. With realtime set, inbound frames
+// are delivered with their original timing, otherwise as fast as the client reads them.
+func NewReplayConn(path string, realtime bool) (Conn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	rc := &replayConn{realtime: realtime, changed: make(chan struct{})}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var frame recordedFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return nil, fmt.Errorf("invalid recording line %d: %w", line, err)
+		}
+		switch frame.Direction {
+		case frameInbound:
+			rc.frames = append(rc.frames, replayFrame{recordedFrame: frame, writesBefore: len(rc.outTimes)})
+		case frameOutbound:
+			if !isHeartbeat(frame.Data) {
+				rc.outTimes = append(rc.outTimes, frame.Time)
+			}
+		default:
+			return nil, fmt.Errorf("invalid recording line %d: unknown direction %q", line, frame.Direction)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	if len(rc.frames) > 0 {
+		rc.anchorRec = rc.frames[0].Time
+	}
+	rc.anchorWall = time.Now()
+
+	return rc, nil
+}
+
+// broadcast wakes up a waiting reader. The caller must hold rc.mu.
+func (rc *replayConn) broadcast() {
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+}
+
+// ReadMessage returns the next inbound frame once it is due. After the last frame it
+// blocks until the connection is closed or the read deadline passes.
+func (rc *replayConn) ReadMessage() (int, []byte, error) {
+	rc.mu.Lock()
+	for {
+		if rc.closed {
+			rc.mu.Unlock()
+			return 0, nil, errReplayClosed
+		}
+
+		now := time.Now()
+		if !rc.deadline.IsZero() && !now.Before(rc.deadline) {
+			rc.mu.Unlock()
+			return 0, nil, fmt.Errorf("replay read: %w", os.ErrDeadlineExceeded)
+		}
+
+		// Work out when the next frame is due, if its request was already sent
+		var due time.Time
+		ready := false
+		if rc.next < len(rc.frames) && rc.writes >= rc.frames[rc.next].writesBefore {
+			frame := rc.frames[rc.next]
+			ready = true
+			due = now
+			if rc.realtime && frame.Time.After(rc.anchorRec) {
+				due = rc.anchorWall.Add(frame.Time.Sub(rc.anchorRec))
+			}
+			if !now.Before(due) {
+				rc.next++
+				if frame.Time.After(rc.anchorRec) {
+					rc.anchorRec = frame.Time
+				}
+				rc.anchorWall = now
+				rc.mu.Unlock()
+				return frame.MessageType, frame.Data, nil
+			}
+		}
+
+		// Sleep until the frame is due, the deadline passes or the state changes
+		wake := rc.deadline
+		if ready && (wake.IsZero() || due.Before(wake)) {
+			wake = due
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			timeout = timer.C
+		}
+		changed := rc.changed
+		rc.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		rc.mu.Lock()
+	}
+}
+
+// WriteMessage discards a client frame and releases the replies recorded after it
+func (rc *replayConn) WriteMessage(messageType int, data []byte) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.closed {
+		return errReplayClosed
+	}
+	if isHeartbeat(data) {
+		return nil
+	}
+
+	// Time the following replies from this write, as the server did
+	if rc.writes < len(rc.outTimes) && rc.outTimes[rc.writes].After(rc.anchorRec) {
+		rc.anchorRec = rc.outTimes[rc.writes]
+		rc.anchorWall = time.Now()
+	}
+	rc.writes++
+	rc.broadcast()
+
+	return nil
+}
+
+// SetReadDeadline sets the time after which a blocked ReadMessage fails
+func (rc *replayConn) SetReadDeadline(t time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.deadline = t
+	rc.broadcast()
+	return nil
+}
+
+// SetWriteDeadline is a no-op since replayed writes never block
+func (rc *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close ends the replay and unblocks any reader
+func (rc *replayConn) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if !rc.closed {
+		rc.closed = true
+		rc.broadcast()
+	}
+	return nil
+}
+
+// isHeartbeat reports whether a client frame carries nothing but Ping or Pong
+func isHeartbeat(data []byte) bool {
+	clientMsg := &pb.ClientMsg{}
+	if err := proto.Unmarshal(data, clientMsg); err != nil {
+		return false
+	}
+	if clientMsg.GetPing() == nil && clientMsg.GetPong() == nil {
+		return false
+	}
+
+	clientMsg.Ping = nil
+	clientMsg.Pong = nil
+	return proto.Size(clientMsg) == 0
+}
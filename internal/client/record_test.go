@@ -0,0 +1,227 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// scriptedConn is a connection whose inbound frames are given up front. Frames written
+// to it are discarded.
+type scriptedConn struct {
+	inbound [][]byte
+}
+
+func (sc *scriptedConn) ReadMessage() (int, []byte, error) {
+	if len(sc.inbound) == 0 {
+		return 0, nil, errors.New("no more frames")
+	}
+	data := sc.inbound[0]
+	sc.inbound = sc.inbound[1:]
+	return websocket.BinaryMessage, data, nil
+}
+
+func (sc *scriptedConn) WriteMessage(messageType int, data []byte) error { return nil }
+func (sc *scriptedConn) SetReadDeadline(t time.Time) error               { return nil }
+func (sc *scriptedConn) SetWriteDeadline(t time.Time) error              { return nil }
+func (sc *scriptedConn) Close() error                                    { return nil }
+
+// marshal encodes a message or fails the test
+func marshal(t *testing.T, msg proto.Message) []byte {
+	t.Helper()
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// logonSession returns the frames of a logon followed by one information request:
+// the client frames and the server frames in the order they are exchanged
+func logonSession(t *testing.T) (out, in [][]byte) {
+	out = [][]byte{
+		marshal(t, &pb.ClientMsg{Logon: &pb.Logon{
+			UserName:      proto.String("trader"),
+			Password:      proto.String("secret-password"),
+			ClientVersion: proto.String("1"),
+		}}),
+		marshal(t, &pb.ClientMsg{InformationRequests: []*pb.InformationRequest{{Id: proto.Uint32(2)}}}),
+	}
+	in = [][]byte{
+		marshal(t, &pb.ServerMsg{LogonResult: &pb.LogonResult{
+			ResultCode:           proto.Uint32(0),
+			BaseTime:             proto.String("2026-03-01T00:00:00"),
+			SessionToken:         proto.String("secret-token"),
+			ProtocolVersionMinor: proto.Uint32(0),
+			ProtocolVersionMajor: proto.Uint32(2),
+			ServerTime:           proto.Int64(0),
+		}}),
+		marshal(t, &pb.ServerMsg{InformationReports: []*pb.InformationReport{{Id: proto.Uint32(2), StatusCode: proto.Uint32(0)}}}),
+	}
+	return out, in
+}
+
+// recordSession plays a session through a recorder and returns the path of the recording
+func recordSession(t *testing.T, out, in [][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := recorder.Wrap(&scriptedConn{inbound: in})
+	for i := range out {
+		if err := conn.WriteMessage(websocket.BinaryMessage, out[i]); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRecorderRedactsCredentials(t *testing.T) {
+	out, in := logonSession(t)
+	path := recordSession(t, out, in)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 4 {
+		t.Fatalf("recorded %d frames, want 4", lines)
+	}
+
+	// Frames are base64 encoded; decode them through a replay
+	conn, err := NewReplayConn(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.BinaryMessage, out[0])
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverMsg := &pb.ServerMsg{}
+	if err := proto.Unmarshal(frame, serverMsg); err != nil {
+		t.Fatal(err)
+	}
+	if token := serverMsg.GetLogonResult().SessionToken; token == nil || *token != "" {
+		t.Fatalf("session token = %v, want it blanked", token)
+	}
+
+	rc := conn.(*replayConn)
+	if len(rc.outTimes) != 2 {
+		t.Fatalf("replay holds %d client frames, want 2", len(rc.outTimes))
+	}
+}
+
+func TestRedact(t *testing.T) {
+	out, in := logonSession(t)
+
+	clientMsg := &pb.ClientMsg{}
+	if err := proto.Unmarshal(redact(frameOutbound, out[0]), clientMsg); err != nil {
+		t.Fatal(err)
+	}
+	logon := clientMsg.GetLogon()
+	if logon.GetPassword() != "" || logon.Password == nil || logon.GetUserName() != "trader" || logon.AccessToken != nil {
+		t.Fatalf("redacted logon = %v", logon)
+	}
+
+	restore := marshal(t, &pb.ClientMsg{RestoreOrJoinSession: &pb.RestoreOrJoinSession{
+		SessionToken: proto.String("secret-token"),
+		ClientAppId:  proto.String("a"),
+	}})
+	if strings.Contains(string(redact(frameOutbound, restore)), "secret") {
+		t.Fatal("session token of a restore was recorded")
+	}
+	if strings.Contains(string(redact(frameInbound, in[0])), "secret") {
+		t.Fatal("session token of a logon result was recorded")
+	}
+
+	// Frames without credentials are kept as they are
+	if got := redact(frameOutbound, out[1]); string(got) != string(out[1]) {
+		t.Fatal("information request was changed")
+	}
+	if got := redact(frameInbound, []byte("not protobuf")); string(got) != "not protobuf" {
+		t.Fatal("undecodable frame was changed")
+	}
+}
+
+func TestReplayWaitsForRequests(t *testing.T) {
+	out, in := logonSession(t)
+	conn, err := NewReplayConn(recordSession(t, out, in), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// No reply is delivered before its request was sent
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read before the logon = %v, want a deadline error", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn.WriteMessage(websocket.BinaryMessage, out[0])
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := unmarshalServer(t, data); got.GetLogonResult() == nil {
+		t.Fatalf("first reply = %v, want the logon result", got)
+	}
+
+	// Heartbeats do not count as requests
+	ping := marshal(t, &pb.ClientMsg{Ping: &pb.Ping{PingUtcTime: proto.Int64(1)}})
+	conn.WriteMessage(websocket.BinaryMessage, ping)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read after a ping = %v, want a deadline error", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn.WriteMessage(websocket.BinaryMessage, out[1])
+	if _, data, err = conn.ReadMessage(); err != nil || string(data) != string(in[1]) {
+		t.Fatalf("second reply = %v, %v", data, err)
+	}
+
+	// A read after the last frame blocks until the connection is closed
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		done <- err
+	}()
+	conn.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errReplayClosed) {
+			t.Fatalf("read after close = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read was not unblocked by Close")
+	}
+}
+
+// unmarshalServer decodes a server frame or fails the test
+func unmarshalServer(t *testing.T, data []byte) *pb.ServerMsg {
+	t.Helper()
+	serverMsg := &pb.ServerMsg{}
+	if err := proto.Unmarshal(data, serverMsg); err != nil {
+		t.Fatal(err)
+	}
+	return serverMsg
+}
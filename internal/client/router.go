@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// listenerBufferSize is the number of server messages queued per listener before the
+// listener is closed with ErrListenerOverflow
+const listenerBufferSize = 256
+
+// ErrListenerOverflow is the error of a listener closed because its queue was full.
+// Messages were lost, so its owner has to make its request or subscription again.
+var ErrListenerOverflow = errors.New("listener queue overflowed")
+
+// noticeBufferSize is the number of connection notices queued per listener
+const noticeBufferSize = 8
+
+// listenerKind selects which server messages a listener receives
+type listenerKind int
+
+const (
+	listenSession  listenerKind = iota // Every server message, unfiltered
+	listenRequest                      // Reports answering a single request ID
+	listenContract                     // Real-time data and statuses for a single contract ID
+	listenMessages                     // User messages and the logoff notification of the session
+)
+
+// Listener receives server messages routed to it by a started client.
+// Request and contract listeners receive messages carrying only their own reports.
+type Listener struct {
+	C         <-chan *pb.ServerMsg    // Closed when the listener or the client is closed
+	Notices   <-chan ConnectionNotice // Disconnect and reconnect notices, closed with C
+	RequestID uint32                  // Request ID for request listeners, zero otherwise
+
+	ch      chan *pb.ServerMsg
+	notices chan ConnectionNotice
+	client  *CQGClient
+	kind    listenerKind
+	key     uint32
+	err     error // Why the router closed the listener, if it did
+}
+
+// NextRequestID allocates a new request ID. IDs are unique for the life of the client
+// and shared by information, market data and historical requests.
+func (c *CQGClient) NextRequestID() uint32 {
+	return c.nextID.Add(1)
+}
+
+// Listen attaches a listener receiving every server message. The caller must Close it when done.
+func (c *CQGClient) Listen() *Listener {
+	return c.attach(listenSession, 0)
+}
+
+// ListenContract attaches a listener receiving real-time market data and subscription
+// statuses for a contract. The caller must Close it when done.
+func (c *CQGClient) ListenContract(contractID uint32) *Listener {
+	return c.attach(listenContract, contractID)
+}
+
+// ListenMessages attaches a listener receiving the user messages sent to the session and
+// the notification that the server logged it off. The caller must Close it when done.
+func (c *CQGClient) ListenMessages() *Listener {
+	return c.attach(listenMessages, 0)
+}
+
+// listenRequest attaches a listener receiving the reports for a request ID
+func (c *CQGClient) listenRequest(requestID uint32) *Listener {
+	return c.attach(listenRequest, requestID)
+}
+
+// sendRequest registers a request listener and then sends the request, so that
+// the reply cannot arrive before anyone is waiting for it
+func (c *CQGClient) sendRequest(ctx context.Context, requestID uint32, clientMsg *pb.ClientMsg) (*Listener, error) {
+	l := c.listenRequest(requestID)
+	if err := c.send(ctx, clientMsg); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// attach registers a new listener of the given kind
+func (c *CQGClient) attach(kind listenerKind, key uint32) *Listener {
+	ch := make(chan *pb.ServerMsg, listenerBufferSize)
+	notices := make(chan ConnectionNotice, noticeBufferSize)
+	l := &Listener{C: ch, Notices: notices, ch: ch, notices: notices, client: c, kind: kind, key: key}
+	if kind == listenRequest {
+		l.RequestID = key
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Closed() {
+		close(ch)
+		close(notices)
+		return l
+	}
+
+	c.listeners[l] = struct{}{}
+	switch kind {
+	case listenRequest:
+		c.requests[key] = l
+	case listenContract:
+		if c.contractListeners[key] == nil {
+			c.contractListeners[key] = make(map[*Listener]struct{})
+		}
+		c.contractListeners[key][l] = struct{}{}
+	}
+	return l
+}
+
+// Err returns ErrListenerOverflow once the listener was closed because it fell behind,
+// and nil otherwise
+func (l *Listener) Err() error {
+	l.client.mu.Lock()
+	defer l.client.mu.Unlock()
+	return l.err
+}
+
+// ContractID returns the contract ID of a contract listener, which follows the contract
+// when it is renumbered after a reconnect
+func (l *Listener) ContractID() uint32 {
+	l.client.mu.Lock()
+	defer l.client.mu.Unlock()
+	return l.key
+}
+
+// Close detaches the listener from its client and closes its channel
+func (l *Listener) Close() {
+	c := l.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.detach(l)
+}
+
+// detach removes a listener from every index and closes its channel.
+// The caller must hold c.mu.
+func (c *CQGClient) detach(l *Listener) {
+	if _, ok := c.listeners[l]; !ok {
+		return
+	}
+
+	delete(c.listeners, l)
+	switch l.kind {
+	case listenRequest:
+		if c.requests[l.key] == l {
+			delete(c.requests, l.key)
+		}
+	case listenContract:
+		delete(c.contractListeners[l.key], l)
+		if len(c.contractListeners[l.key]) == 0 {
+			delete(c.contractListeners, l.key)
+		}
+	}
+	close(l.ch)
+	close(l.notices)
+}
+
+// route splits a server message by request and contract ID and delivers each part to
+// the listeners waiting for it. Session listeners receive the whole message.
+func (c *CQGClient) route(serverMsg *pb.ServerMsg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, report := range serverMsg.GetInformationReports() {
+		// Keep cached metadata current, including subscription updates
+		if metadata := report.GetSymbolResolutionReport().GetContractMetadata(); metadata != nil {
+			c.contracts[metadata.GetContractId()] = metadata
+		}
+		c.deliverRequest(report.GetId(), &pb.ServerMsg{InformationReports: []*pb.InformationReport{report}})
+	}
+
+	for _, report := range serverMsg.GetTimeBarReports() {
+		c.deliverRequest(report.GetRequestId(), &pb.ServerMsg{TimeBarReports: []*pb.TimeBarReport{report}})
+	}
+
+	for _, report := range serverMsg.GetTimeAndSalesReports() {
+		c.deliverRequest(report.GetRequestId(), &pb.ServerMsg{TimeAndSalesReports: []*pb.TimeAndSalesReport{report}})
+	}
+
+	for _, report := range serverMsg.GetVolumeProfileReports() {
+		c.deliverRequest(report.GetRequestId(), &pb.ServerMsg{VolumeProfileReports: []*pb.VolumeProfileReport{report}})
+	}
+
+	for _, report := range serverMsg.GetNonTimedBarReports() {
+		c.deliverRequest(report.GetRequestId(), &pb.ServerMsg{NonTimedBarReports: []*pb.NonTimedBarReport{report}})
+	}
+
+	for _, status := range serverMsg.GetMarketDataSubscriptionStatuses() {
+		msg := &pb.ServerMsg{MarketDataSubscriptionStatuses: []*pb.MarketDataSubscriptionStatus{status}}
+		if !c.deliverRequest(status.GetRequestId(), msg) {
+			c.deliverContract(status.GetContractId(), msg)
+		}
+	}
+
+	for _, rtData := range serverMsg.GetRealTimeMarketData() {
+		c.deliverContract(rtData.GetContractId(), &pb.ServerMsg{RealTimeMarketData: []*pb.RealTimeMarketData{rtData}})
+	}
+
+	// Session-wide messages concern every client of the session
+	var messages *pb.ServerMsg
+	if len(serverMsg.GetUserMessages()) > 0 || serverMsg.GetLoggedOff() != nil {
+		messages = &pb.ServerMsg{UserMessages: serverMsg.GetUserMessages(), LoggedOff: serverMsg.GetLoggedOff()}
+	}
+
+	for l := range c.listeners {
+		switch {
+		case l.kind == listenSession:
+			c.deliver(l, serverMsg)
+		case l.kind == listenMessages && messages != nil:
+			c.deliver(l, messages)
+		}
+	}
+}
+
+// deliverRequest sends a message to the listener of a request ID and reports
+// whether such a listener exists. The caller must hold c.mu.
+func (c *CQGClient) deliverRequest(requestID uint32, msg *pb.ServerMsg) bool {
+	l, ok := c.requests[requestID]
+	if !ok {
+		return false
+	}
+	c.deliver(l, msg)
+	return true
+}
+
+// deliverContract sends a message to every listener of a contract ID.
+// The caller must hold c.mu.
+func (c *CQGClient) deliverContract(contractID uint32, msg *pb.ServerMsg) {
+	for l := range c.contractListeners[contractID] {
+		c.deliver(l, msg)
+	}
+}
+
+// deliver queues a message on a listener without blocking the reader goroutine. A
+// listener whose queue is full is closed with ErrListenerOverflow rather than left to
+// miss the message unnoticed. The caller must hold c.mu.
+func (c *CQGClient) deliver(l *Listener, msg *pb.ServerMsg) {
+	select {
+	case l.ch <- msg:
+	default:
+		log.Printf("listener queue full, closing listener for request or contract %d", l.key)
+		l.err = ErrListenerOverflow
+		c.detach(l)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"go-websocket/internal/config"
+)
+
+// Credentials identifies a CQG login. Sessions are shared per distinct set of credentials.
+type Credentials struct {
+	UserName             string
+	Password             string
+	ClientAppId          string
+	ClientVersion        string
+	ProtocolVersionMajor uint32
+	ProtocolVersionMinor uint32
+}
+
+// SessionManager holds one authenticated CQGClient per credential set for the life
+// of the server. Handlers borrow sessions from the manager and must never close them.
+type SessionManager struct {
+	cfg      *config.Config
+	mu       sync.Mutex
+	sessions map[Credentials]*CQGClient
+	dialing  map[Credentials]*pendingSession // Logons in progress
+}
+
+// pendingSession is a logon in progress that concurrent Acquire calls for the same
+// credentials wait for instead of dialling again
+type pendingSession struct {
+	done      chan struct{} // Closed once cqgClient or err is set
+	cqgClient *CQGClient
+	err       error
+}
+
+// NewSessionManager creates an empty session manager whose clients use cfg
+func NewSessionManager(cfg *config.Config) *SessionManager {
+	return &SessionManager{
+		cfg:      cfg,
+		sessions: make(map[Credentials]*CQGClient),
+		dialing:  make(map[Credentials]*pendingSession),
+	}
+}
+
+// Acquire returns the shared session for the given credentials, dialling and logging
+// on if no live session exists yet. The returned client is owned by the manager. The
+// manager is not locked while dialling, so a slow logon only holds up the callers
+// waiting for the same credentials.
+func (m *SessionManager) Acquire(ctx context.Context, creds Credentials) (*CQGClient, error) {
+	for {
+		m.mu.Lock()
+		if cqgClient, ok := m.sessions[creds]; ok {
+			if !cqgClient.Closed() {
+				m.mu.Unlock()
+				return cqgClient, nil
+			}
+			delete(m.sessions, creds)
+		}
+
+		pending, ok := m.dialing[creds]
+		if !ok {
+			break
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pending.done:
+		}
+		if pending.err == nil {
+			return pending.cqgClient, nil
+		}
+		if !errors.Is(pending.err, context.Canceled) && !errors.Is(pending.err, context.DeadlineExceeded) {
+			return nil, pending.err
+		}
+		// The caller that dialled gave up; try again with this caller's context
+	}
+
+	pending := &pendingSession{done: make(chan struct{})}
+	m.dialing[creds] = pending
+	m.mu.Unlock()
+
+	pending.cqgClient, pending.err = m.logon(ctx, creds)
+
+	m.mu.Lock()
+	delete(m.dialing, creds)
+	if pending.err == nil {
+		m.sessions[creds] = pending.cqgClient
+	}
+	m.mu.Unlock()
+	close(pending.done)
+
+	return pending.cqgClient, pending.err
+}
+
+// logon dials CQG and logs on with the given credentials
+func (m *SessionManager) logon(ctx context.Context, creds Credentials) (*CQGClient, error) {
+	// Establish a new upstream connection for these credentials
+	cqgClient, err := NewCQGClient(ctx, m.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connection failed: %w", err)
+	}
+
+	if err := cqgClient.Logon(ctx, creds.UserName, creds.Password, creds.ClientAppId, creds.ClientVersion, creds.ProtocolVersionMajor, creds.ProtocolVersionMinor); err != nil {
+		cqgClient.Close()
+		return nil, fmt.Errorf("logon failed: %w", err)
+	}
+
+	cqgClient.Start()
+	log.Printf("CQG session established for user %s", creds.UserName)
+
+	return cqgClient, nil
+}
+
+// Logoff terminates the shared session for the given credentials, if any
+func (m *SessionManager) Logoff(ctx context.Context, creds Credentials) error {
+	m.mu.Lock()
+	cqgClient, ok := m.sessions[creds]
+	delete(m.sessions, creds)
+	m.mu.Unlock()
+
+	if !ok || cqgClient.Closed() {
+		return fmt.Errorf("no active session")
+	}
+	defer cqgClient.Close()
+
+	return cqgClient.Logoff(ctx)
+}
+
+// CloseAll logs off and closes every session held by the manager, for when the
+// server stops. Sessions still logging off when ctx is done are closed anyway.
+func (m *SessionManager) CloseAll(ctx context.Context) {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[Credentials]*CQGClient)
+	m.mu.Unlock()
+
+	for creds, cqgClient := range sessions {
+		if !cqgClient.Closed() {
+			if err := cqgClient.Logoff(ctx); err != nil {
+				log.Printf("logoff of %s failed: %v", creds.UserName, err)
+			}
+		}
+		cqgClient.Close()
+	}
+}
+
+// SessionStatus describes the health of a shared session
+type SessionStatus struct {
+	UserName  string          `json:"user_name"`
+	Connected bool            `json:"connected"`
+	Latency   LatencySnapshot `json:"latency"`
+}
+
+// Status reports the health of every session held by the manager
+func (m *SessionManager) Status() []SessionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]SessionStatus, 0, len(m.sessions))
+	for creds, cqgClient := range m.sessions {
+		statuses = append(statuses, SessionStatus{
+			UserName:  creds.UserName,
+			Connected: cqgClient.Connected(),
+			Latency:   cqgClient.Latency(),
+		})
+	}
+	return statuses
+}
+
+// CredentialsFromConfig returns the login configured for the CQG server
+func CredentialsFromConfig(cfg config.CQGConfig) Credentials {
+	return Credentials{
+		UserName:             cfg.UserName,
+		Password:             cfg.Password,
+		ClientAppId:          cfg.ClientAppId,
+		ClientVersion:        cfg.ClientVersion,
+		ProtocolVersionMajor: cfg.ProtocolVersionMajor,
+		ProtocolVersionMinor: cfg.ProtocolVersionMinor,
+	}
+}
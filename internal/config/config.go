@@ -0,0 +1,338 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings. It is loaded once at startup and passed to the
+// client and handlers.
+type Config struct {
+	Port          string         // Port the HTTP server listens on
+	PocketBaseURL string         // Records endpoint of the PocketBase market_data collection
+	TimeZone      string         // IANA name of the zone used for local timestamps
+	Location      *time.Location // Loaded TimeZone
+	BarCacheDir   string         // Directory the historical bar cache is stored in
+	Debug         bool           // Log the messages exchanged with CQG in full
+	CQG           CQGConfig
+	Timeouts      Timeouts
+}
+
+// CQGConfig holds the CQG server address and login details
+type CQGConfig struct {
+	HostName             string
+	UserName             string
+	Password             string
+	ClientAppId          string
+	ClientVersion        string
+	ProtocolVersionMajor uint32
+	ProtocolVersionMinor uint32
+
+	RecordFile     string // Append every frame exchanged with CQG to this file
+	ReplayFile     string // Replay a recorded session from this file instead of connecting
+	ReplayRealtime bool   // Replay with the recorded timing rather than as fast as possible
+}
+
+// Timeouts bounds the time spent waiting on CQG and PocketBase
+type Timeouts struct {
+	Upstream   time.Duration // Each CQG call made on behalf of a client request
+	Reconnect  time.Duration // Each dial, logon or resubscribe step while reconnecting
+	Heartbeat  time.Duration // Interval between pings sent to CQG
+	PocketBase time.Duration // Each request to PocketBase
+}
+
+// fileConfig mirrors Config in the optional YAML or TOML configuration file
+type fileConfig struct {
+	Port          string `yaml:"port" toml:"port"`
+	PocketBaseURL string `yaml:"pocketbase_url" toml:"pocketbase_url"`
+	TimeZone      string `yaml:"time_zone" toml:"time_zone"`
+	BarCacheDir   string `yaml:"bar_cache_dir" toml:"bar_cache_dir"`
+	Debug         bool   `yaml:"debug" toml:"debug"`
+	CQG           struct {
+		HostName             string `yaml:"host_name" toml:"host_name"`
+		UserName             string `yaml:"username" toml:"username"`
+		Password             string `yaml:"password" toml:"password"`
+		ClientAppId          string `yaml:"client_app_id" toml:"client_app_id"`
+		ClientVersion        string `yaml:"client_version" toml:"client_version"`
+		ProtocolVersionMajor uint32 `yaml:"protocol_version_major" toml:"protocol_version_major"`
+		ProtocolVersionMinor uint32 `yaml:"protocol_version_minor" toml:"protocol_version_minor"`
+		RecordFile           string `yaml:"record_file" toml:"record_file"`
+		ReplayFile           string `yaml:"replay_file" toml:"replay_file"`
+		ReplayTiming         string `yaml:"replay_timing" toml:"replay_timing"`
+	} `yaml:"cqg" toml:"cqg"`
+	Timeouts struct {
+		Upstream   string `yaml:"upstream" toml:"upstream"`
+		Reconnect  string `yaml:"reconnect" toml:"reconnect"`
+		Heartbeat  string `yaml:"heartbeat" toml:"heartbeat"`
+		PocketBase string `yaml:"pocketbase" toml:"pocketbase"`
+	} `yaml:"timeouts" toml:"timeouts"`
+}
+
+// defaults returns the configuration used when nothing else is set
+func defaults() *Config {
+	return &Config{
+		Port:          "3000",
+		PocketBaseURL: "http://127.0.0.1:8090/api/collections/market_data/records",
+		TimeZone:      "Asia/Kolkata",
+		BarCacheDir:   "bar_cache",
+		Timeouts: Timeouts{
+			Upstream:   30 * time.Second,
+			Reconnect:  10 * time.Second,
+			Heartbeat:  15 * time.Second,
+			PocketBase: 10 * time.Second,
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the optional file named by CONFIG_FILE,
+// and environment variables, in increasing order of precedence. Variables in .env are
+// added to the environment first without overriding variables already set.
+func Load() (*Config, error) {
+	// Load environment variables from .env file
+	if err := godotenv.Load(".env"); err != nil {
+		log.Println("No .env file loaded:", err)
+	}
+
+	cfg := defaults()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// loadFile applies the settings of a YAML or TOML file, chosen by its extension
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var file fileConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	default:
+		return fmt.Errorf("unsupported config file format: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	setString(&cfg.Port, file.Port)
+	setString(&cfg.PocketBaseURL, file.PocketBaseURL)
+	setString(&cfg.TimeZone, file.TimeZone)
+	setString(&cfg.BarCacheDir, file.BarCacheDir)
+	if file.Debug {
+		cfg.Debug = true
+	}
+	setString(&cfg.CQG.HostName, file.CQG.HostName)
+	setString(&cfg.CQG.UserName, file.CQG.UserName)
+	setString(&cfg.CQG.Password, file.CQG.Password)
+	setString(&cfg.CQG.ClientAppId, file.CQG.ClientAppId)
+	setString(&cfg.CQG.ClientVersion, file.CQG.ClientVersion)
+	if file.CQG.ProtocolVersionMajor != 0 {
+		cfg.CQG.ProtocolVersionMajor = file.CQG.ProtocolVersionMajor
+	}
+	if file.CQG.ProtocolVersionMinor != 0 {
+		cfg.CQG.ProtocolVersionMinor = file.CQG.ProtocolVersionMinor
+	}
+	setString(&cfg.CQG.RecordFile, file.CQG.RecordFile)
+	setString(&cfg.CQG.ReplayFile, file.CQG.ReplayFile)
+	if err := setReplayTiming(&cfg.CQG.ReplayRealtime, "cqg.replay_timing", file.CQG.ReplayTiming); err != nil {
+		return err
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"timeouts.upstream", file.Timeouts.Upstream, &cfg.Timeouts.Upstream},
+		{"timeouts.reconnect", file.Timeouts.Reconnect, &cfg.Timeouts.Reconnect},
+		{"timeouts.heartbeat", file.Timeouts.Heartbeat, &cfg.Timeouts.Heartbeat},
+		{"timeouts.pocketbase", file.Timeouts.PocketBase, &cfg.Timeouts.PocketBase},
+	}
+	for _, d := range durations {
+		if err := setDuration(d.field, d.name, d.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadEnv applies the settings found in environment variables
+func (cfg *Config) loadEnv() error {
+	setString(&cfg.Port, os.Getenv("PORT"))
+	setString(&cfg.PocketBaseURL, os.Getenv("POCKETBASE_URL"))
+	setString(&cfg.TimeZone, os.Getenv("TIME_ZONE"))
+	setString(&cfg.BarCacheDir, os.Getenv("BAR_CACHE_DIR"))
+	if err := setBool(&cfg.Debug, "DEBUG", os.Getenv("DEBUG")); err != nil {
+		return err
+	}
+	setString(&cfg.CQG.HostName, os.Getenv("HOST_NAME"))
+	setString(&cfg.CQG.UserName, os.Getenv("USERNAME"))
+	setString(&cfg.CQG.Password, os.Getenv("PASSWORD"))
+	setString(&cfg.CQG.ClientAppId, os.Getenv("CLIENT_APP_ID"))
+	setString(&cfg.CQG.ClientVersion, os.Getenv("CLIENT_VERSION"))
+	setString(&cfg.CQG.RecordFile, os.Getenv("CQG_RECORD_FILE"))
+	setString(&cfg.CQG.ReplayFile, os.Getenv("CQG_REPLAY_FILE"))
+	if err := setReplayTiming(&cfg.CQG.ReplayRealtime, "CQG_REPLAY_TIMING", os.Getenv("CQG_REPLAY_TIMING")); err != nil {
+		return err
+	}
+
+	// Parse protocol version numbers from string to uint
+	versions := []struct {
+		name  string
+		field *uint32
+	}{
+		{"PROTOCOL_VERSION_MAJOR", &cfg.CQG.ProtocolVersionMajor},
+		{"PROTOCOL_VERSION_MINOR", &cfg.CQG.ProtocolVersionMinor},
+	}
+	for _, v := range versions {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", v.name, err)
+		}
+		*v.field = uint32(parsed)
+	}
+
+	durations := []struct {
+		name  string
+		field *time.Duration
+	}{
+		{"UPSTREAM_TIMEOUT", &cfg.Timeouts.Upstream},
+		{"RECONNECT_TIMEOUT", &cfg.Timeouts.Reconnect},
+		{"HEARTBEAT_INTERVAL", &cfg.Timeouts.Heartbeat},
+		{"POCKETBASE_TIMEOUT", &cfg.Timeouts.PocketBase},
+	}
+	for _, d := range durations {
+		if err := setDuration(d.field, d.name, os.Getenv(d.name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks that required settings are present and loads the time zone
+func (cfg *Config) validate() error {
+	if cfg.CQG.HostName == "" && cfg.CQG.ReplayFile == "" {
+		return fmt.Errorf("HOST_NAME is not set")
+	}
+	if cfg.CQG.RecordFile != "" && cfg.CQG.ReplayFile != "" {
+		return fmt.Errorf("a session cannot be recorded and replayed at the same time")
+	}
+	if cfg.CQG.UserName == "" || cfg.CQG.Password == "" || cfg.CQG.ClientAppId == "" || cfg.CQG.ClientVersion == "" {
+		return fmt.Errorf("username, password, client app ID and client version are required")
+	}
+	if cfg.CQG.ProtocolVersionMajor == 0 {
+		return fmt.Errorf("PROTOCOL_VERSION_MAJOR is not set")
+	}
+
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %q", cfg.Port)
+	}
+	if cfg.PocketBaseURL == "" {
+		return fmt.Errorf("POCKETBASE_URL is not set")
+	}
+
+	timeouts := map[string]time.Duration{
+		"upstream timeout":   cfg.Timeouts.Upstream,
+		"reconnect timeout":  cfg.Timeouts.Reconnect,
+		"heartbeat interval": cfg.Timeouts.Heartbeat,
+		"pocketbase timeout": cfg.Timeouts.PocketBase,
+	}
+	for name, timeout := range timeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+
+	location, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid time zone %q: %w", cfg.TimeZone, err)
+	}
+	cfg.Location = location
+
+	return nil
+}
+
+// ListenAddr returns the address the HTTP server listens on
+func (cfg *Config) ListenAddr() string {
+	return ":" + cfg.Port
+}
+
+// setString overrides a setting when value is not empty
+func setString(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// setDuration parses and overrides a duration setting when value is not empty
+func setDuration(field *time.Duration, name, value string) error {
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	*field = d
+	return nil
+}
+
+// setBool parses and overrides a boolean setting when value is not empty
+func setBool(field *bool, name, value string) error {
+	if value == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %q", name, value)
+	}
+	*field = b
+	return nil
+}
+
+// setReplayTiming parses a replay timing of "original" or "fast" when value is not empty
+func setReplayTiming(field *bool, name, value string) error {
+	switch value {
+	case "":
+	case "original":
+		*field = true
+	case "fast":
+		*field = false
+	default:
+		return fmt.Errorf("invalid %s: %q, expected original or fast", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configVars are the environment variables read by Load
+var configVars = []string{
+	"CONFIG_FILE", "PORT", "POCKETBASE_URL", "TIME_ZONE", "BAR_CACHE_DIR", "DEBUG",
+	"HOST_NAME", "USERNAME", "PASSWORD", "CLIENT_APP_ID", "CLIENT_VERSION",
+	"PROTOCOL_VERSION_MAJOR", "PROTOCOL_VERSION_MINOR",
+	"CQG_RECORD_FILE", "CQG_REPLAY_FILE", "CQG_REPLAY_TIMING",
+	"UPSTREAM_TIMEOUT", "RECONNECT_TIMEOUT", "HEARTBEAT_INTERVAL", "POCKETBASE_TIMEOUT",
+}
+
+// requiredEnv holds the settings Load refuses to start without
+var requiredEnv = map[string]string{
+	"HOST_NAME":              "wss://cqg.example",
+	"USERNAME":               "user",
+	"PASSWORD":               "secret",
+	"CLIENT_APP_ID":          "app",
+	"CLIENT_VERSION":         "1.0",
+	"PROTOCOL_VERSION_MAJOR": "2",
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string // File name and contents, separated by a newline
+		env      map[string]string
+		port     string
+		zone     string
+		upstream time.Duration
+		debug    bool
+	}{
+		{
+			name:     "defaults",
+			port:     "3000",
+			zone:     "Asia/Kolkata",
+			upstream: 30 * time.Second,
+		},
+		{
+			name:     "yaml file over defaults",
+			file:     "config.yaml\nport: \"4000\"\ntime_zone: Europe/London\ndebug: true\ntimeouts:\n  upstream: 5s\n",
+			port:     "4000",
+			zone:     "Europe/London",
+			upstream: 5 * time.Second,
+			debug:    true,
+		},
+		{
+			name:     "toml file over defaults",
+			file:     "config.toml\nport = \"4001\"\ntime_zone = \"America/Chicago\"\n[timeouts]\nupstream = \"7s\"\n",
+			port:     "4001",
+			zone:     "America/Chicago",
+			upstream: 7 * time.Second,
+		},
+		{
+			name:     "environment over file",
+			file:     "config.yml\nport: \"4000\"\ntime_zone: Europe/London\ndebug: true\n",
+			env:      map[string]string{"PORT": "5000", "UPSTREAM_TIMEOUT": "1m", "DEBUG": "false"},
+			port:     "5000",
+			zone:     "Europe/London",
+			upstream: time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			if tt.file != "" {
+				t.Setenv("CONFIG_FILE", writeFile(t, tt.file))
+			}
+
+			cfg, err := Load()
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.Port != tt.port || cfg.TimeZone != tt.zone || cfg.Timeouts.Upstream != tt.upstream || cfg.Debug != tt.debug {
+				t.Errorf("got port %q, zone %q, upstream %v, debug %v, want %q, %q, %v, %v",
+					cfg.Port, cfg.TimeZone, cfg.Timeouts.Upstream, cfg.Debug, tt.port, tt.zone, tt.upstream, tt.debug)
+			}
+			if cfg.CQG.UserName != "user" || cfg.CQG.ProtocolVersionMajor != 2 {
+				t.Errorf("CQG settings = %+v", cfg.CQG)
+			}
+		})
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // File name and contents, separated by a newline
+		env  map[string]string
+		want string // Part of the error message
+	}{
+		{name: "port out of range", env: map[string]string{"PORT": "70000"}, want: "invalid port"},
+		{name: "port not a number", env: map[string]string{"PORT": "http"}, want: "invalid port"},
+		{name: "unknown time zone", env: map[string]string{"TIME_ZONE": "Mars/Olympus_Mons"}, want: "invalid time zone"},
+		{name: "malformed duration", env: map[string]string{"UPSTREAM_TIMEOUT": "soon"}, want: "UPSTREAM_TIMEOUT"},
+		{name: "missing host", env: map[string]string{"HOST_NAME": ""}, want: "HOST_NAME"},
+		{name: "malformed yaml file", file: "config.yaml\nport: [3000\n", want: "failed to parse config file"},
+		{name: "malformed toml file", file: "config.toml\nport = \n", want: "failed to parse config file"},
+		{name: "unsupported file format", file: "config.json\n{}\n", want: "unsupported config file format"},
+		{name: "bad port in file", file: "config.yaml\nport: \"0\"\n", want: "invalid port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			if tt.file != "" {
+				t.Setenv("CONFIG_FILE", writeFile(t, tt.file))
+			}
+
+			cfg, err := Load()
+			if err == nil {
+				t.Fatalf("Load = %+v, want an error", cfg)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	setEnv(t, nil)
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "failed to read config file") {
+		t.Errorf("Load error = %v, want a read error", err)
+	}
+}
+
+func TestValidateLoadsLocation(t *testing.T) {
+	cfg := defaults()
+	cfg.CQG = CQGConfig{
+		HostName:             "wss://cqg.example",
+		UserName:             "user",
+		Password:             "secret",
+		ClientAppId:          "app",
+		ClientVersion:        "1.0",
+		ProtocolVersionMajor: 2,
+	}
+	cfg.TimeZone = "America/New_York"
+
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if cfg.Location == nil || cfg.Location.String() != "America/New_York" {
+		t.Errorf("Location = %v, want America/New_York", cfg.Location)
+	}
+}
+
+// setEnv clears every configuration variable, then sets the required ones and the
+// given overrides for the rest of the test
+func setEnv(t *testing.T, overrides map[string]string) {
+	t.Helper()
+	for _, name := range configVars {
+		t.Setenv(name, "")
+	}
+	for name, value := range requiredEnv {
+		t.Setenv(name, value)
+	}
+	for name, value := range overrides {
+		t.Setenv(name, value)
+	}
+}
+
+// writeFile writes a configuration file given as its name, a newline and its contents
+// into a temporary directory and returns its path
+func writeFile(t *testing.T, file string) string {
+	t.Helper()
+	name, contents, _ := strings.Cut(file, "\n")
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
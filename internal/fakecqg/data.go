@@ -0,0 +1,1298 @@
+package fakecqg
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxBarsPerRequest = 10000 // Older bars are omitted and the report marked truncated
+	barsPerReport     = 1000  // Bars sent in each TimeBarReport of a response
+	maxTradingDays    = 100   // Trading days returned for one request before truncating
+
+	timeAndSalesDepth    = 30 * 24 * time.Hour // History kept for time and sales requests
+	timeAndSalesInterval = 30 * time.Second    // Time between generated historical trades
+	quotesPerReport      = 2000                // Quotes sent in each TimeAndSalesReport
+
+	profileItemsPerReport = 10 // Prices sent in each VolumeProfileReport
+)
+
+// Contract describes an instrument known to the fake server. Prices are generated as
+// integers in units of PriceScale, the way CQG sends them.
+type Contract struct {
+	ContractID  uint32
+	Symbol      string
+	Description string
+	PriceScale  float64 // CorrectPriceScale reported in the contract metadata
+	TickSize    float64
+	StartPrice  int64 // Scaled price the generated data moves around
+
+	// DisplayPriceScale is reported in the contract metadata, e.g. 105 for 32nds.
+	// Zero gives the number of decimals of PriceScale.
+	DisplayPriceScale uint32
+}
+
+// AddContract registers a contract for symbol resolution. A zero ContractID and
+// unset prices are filled in with generated values.
+func (s *Server) AddContract(contract Contract) *Contract {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addContractLocked(contract)
+}
+
+// addContractLocked registers a contract. The caller must hold s.mu.
+func (s *Server) addContractLocked(contract Contract) *Contract {
+	if contract.ContractID == 0 {
+		s.lastID++
+		contract.ContractID = s.lastID
+	} else if contract.ContractID > s.lastID {
+		s.lastID = contract.ContractID
+	}
+	if contract.Description == "" {
+		contract.Description = "Fake contract " + contract.Symbol
+	}
+	if contract.PriceScale == 0 {
+		contract.PriceScale = 0.01
+	}
+	if contract.TickSize == 0 {
+		contract.TickSize = contract.PriceScale
+	}
+	if contract.DisplayPriceScale == 0 {
+		contract.DisplayPriceScale = uint32(math.Round(-math.Log10(contract.PriceScale)))
+	}
+	if contract.StartPrice == 0 {
+		contract.StartPrice = 10000
+	}
+
+	c := &contract
+	s.contracts[strings.ToUpper(contract.Symbol)] = c
+	return c
+}
+
+// resolve looks up a symbol, generating a contract for it unless the server is strict
+func (s *Server) resolve(symbol string) (*Contract, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if contract, ok := s.contracts[strings.ToUpper(symbol)]; ok {
+		return contract, true
+	}
+	if s.Strict || symbol == "" {
+		return nil, false
+	}
+	return s.addContractLocked(Contract{Symbol: symbol}), true
+}
+
+// contractByID returns a previously resolved contract
+func (s *Server) contractByID(contractID uint32) *Contract {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, contract := range s.contracts {
+		if contract.ContractID == contractID {
+			return contract
+		}
+	}
+	return nil
+}
+
+// metadata builds the contract metadata sent in symbol resolution reports
+func (c *Contract) metadata() *pb.ContractMetadata {
+	return &pb.ContractMetadata{
+		ContractId:                 proto.Uint32(c.ContractID),
+		ContractSymbol:             proto.String(c.Symbol),
+		CqgContractSymbol:          proto.String(c.Symbol),
+		CorrectPriceScale:          proto.Float64(c.PriceScale),
+		DisplayPriceScale:          proto.Uint32(c.DisplayPriceScale),
+		Description:                proto.String(c.Description),
+		Title:                      proto.String(c.Symbol),
+		TickSize:                   proto.Float64(c.TickSize),
+		Currency:                   proto.String("USD"),
+		TickValue:                  proto.Float64(c.TickSize),
+		CfiCode:                    proto.String("FXXXXX"),
+		InstrumentGroupName:        proto.String("F.US." + c.Symbol),
+		SessionInfoId:              proto.Int32(1),
+		ShortInstrumentGroupName:   proto.String(c.Symbol),
+		InstrumentGroupDescription: proto.String(c.Description),
+		CountryCode:                proto.String("US"),
+		Mic:                        proto.String("XCME"),
+	}
+}
+
+// runFeed sends a snapshot and then generated quotes for a contract until stop is closed
+func (sess *session) runFeed(contract *Contract, level uint32, stop chan struct{}) {
+	s := sess.server
+	rnd := rand.New(rand.NewSource(int64(contract.ContractID)))
+	withBBA := level >= uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA) &&
+		level != uint32(pb.MarketDataSubscription_LEVEL_SETTLEMENTS) &&
+		level != uint32(pb.MarketDataSubscription_LEVEL_END_OF_DAY)
+	withVolumes := withBBA && level != uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA)
+	withDOM := level == uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DOM) ||
+		level == uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DETAILED_DOM)
+	dom := newDOMGenerator(rnd, level == uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DETAILED_DOM))
+
+	price := contract.StartPrice
+	open, high, low := price, price, price
+	var volume int64
+	now := time.Now()
+	day, _ := s.tradingDayAt(now)
+
+	snapshot := &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(contract.ContractID),
+		IsSnapshot: proto.Bool(true),
+		MarketValues: []*pb.MarketValues{{
+			DayIndex:                    proto.Int32(0),
+			TradeDate:                   proto.Int64(s.tradeDate(day)),
+			ScaledOpenPrice:             proto.Int64(open),
+			ScaledHighPrice:             proto.Int64(high),
+			ScaledLowPrice:              proto.Int64(low),
+			ScaledLastPrice:             proto.Int64(price),
+			ScaledLastPriceNoSettlement: proto.Int64(price),
+			ScaledYesterdaySettlement:   proto.Int64(contract.StartPrice),
+			TotalVolume:                 &shared.Decimal{Significand: proto.Int64(0)},
+			OpenInterest:                &shared.Decimal{Significand: proto.Int64(1000)},
+			LastTradeUtcTimestamp:       &timestamp.Timestamp{Seconds: now.Unix()},
+		}, s.priorValues(contract, day-1)},
+	}
+	if withBBA {
+		snapshot.Quotes = bbaQuotes(s.serverTime(now), price, withVolumes)
+	}
+	if withDOM {
+		dom.update(snapshot, s.serverTime(now), price, true)
+	}
+	sess.write(&pb.ServerMsg{RealTimeMarketData: []*pb.RealTimeMarketData{snapshot}})
+
+	ticker := time.NewTicker(s.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sess.closed:
+			return
+		case now = <-ticker.C:
+		}
+
+		// Start a new trading day: restate the one that ended as day -1 and reset the
+		// statistics of day 0
+		if n, _ := s.tradingDayAt(now); n != day {
+			ended := &pb.MarketValues{
+				DayIndex:                    proto.Int32(-1),
+				TradeDate:                   proto.Int64(s.tradeDate(day)),
+				ScaledOpenPrice:             proto.Int64(open),
+				ScaledHighPrice:             proto.Int64(high),
+				ScaledLowPrice:              proto.Int64(low),
+				ScaledClosePrice:            proto.Int64(price),
+				ScaledLastPriceNoSettlement: proto.Int64(price),
+				TotalVolume:                 &shared.Decimal{Significand: proto.Int64(volume)},
+			}
+			day = n
+			open, high, low, volume = price, price, price, 0
+			sess.write(&pb.ServerMsg{RealTimeMarketData: []*pb.RealTimeMarketData{{
+				ContractId: proto.Uint32(contract.ContractID),
+				MarketValues: []*pb.MarketValues{{
+					DayIndex:                  proto.Int32(0),
+					TradeDate:                 proto.Int64(s.tradeDate(day)),
+					ScaledYesterdaySettlement: proto.Int64(price),
+					TotalVolume:               &shared.Decimal{Significand: proto.Int64(0)},
+				}, ended},
+			}}})
+		}
+
+		// Random walk of up to two ticks per update
+		price += int64(rnd.Intn(5) - 2)
+		if price < 1 {
+			price = 1
+		}
+		size := int64(rnd.Intn(10) + 1)
+		volume += size
+		high = max(high, price)
+		low = min(low, price)
+
+		utcTime := s.serverTime(now)
+		update := &pb.RealTimeMarketData{
+			ContractId: proto.Uint32(contract.ContractID),
+			Quotes: []*pb.Quote{{
+				Type:         proto.Uint32(uint32(pb.Quote_TYPE_TRADE)),
+				QuoteUtcTime: proto.Int64(utcTime),
+				ScaledPrice:  proto.Int64(price),
+				Volume:       &shared.Decimal{Significand: proto.Int64(size)},
+			}},
+		}
+		if withBBA {
+			update.Quotes = append(update.Quotes, bbaQuotes(utcTime, price, withVolumes)...)
+		}
+		if withDOM {
+			dom.update(update, utcTime, price, false)
+		}
+		sess.write(&pb.ServerMsg{RealTimeMarketData: []*pb.RealTimeMarketData{update}})
+
+		// Now and then bust the trade, or correct its price
+		if s.CorrectionRate > 0 && rnd.Float64() < s.CorrectionRate {
+			correction := &pb.RealTimeMarketData{
+				ContractId:  proto.Uint32(contract.ContractID),
+				Corrections: []*pb.Quote{tradeCorrection(utcTime, price, size, pb.Quote_INDICATOR_DELETION)},
+			}
+			volume -= size
+			if rnd.Intn(2) == 0 {
+				correction.Corrections = append(correction.Corrections, tradeCorrection(utcTime, price+1, size, pb.Quote_INDICATOR_INSERTION))
+				volume += size
+			}
+			correction.MarketValues = []*pb.MarketValues{{
+				DayIndex:    proto.Int32(0),
+				TradeDate:   proto.Int64(s.tradeDate(day)),
+				TotalVolume: &shared.Decimal{Significand: proto.Int64(volume)},
+			}}
+			sess.write(&pb.ServerMsg{RealTimeMarketData: []*pb.RealTimeMarketData{correction}})
+		}
+	}
+}
+
+// tradeCorrection returns a correction deleting or inserting a trade
+func tradeCorrection(utcTime, price, volume int64, indicator pb.Quote_Indicator) *pb.Quote {
+	return &pb.Quote{
+		Type:         proto.Uint32(uint32(pb.Quote_TYPE_TRADE)),
+		QuoteUtcTime: proto.Int64(utcTime),
+		ScaledPrice:  proto.Int64(price),
+		Volume:       &shared.Decimal{Significand: proto.Int64(volume)},
+		Indicators:   []uint32{uint32(indicator)},
+	}
+}
+
+// priorValues generates the statistics of an earlier trading day, reported with day
+// index -1
+func (s *Server) priorValues(contract *Contract, day int64) *pb.MarketValues {
+	rnd := rand.New(rand.NewSource(int64(contract.ContractID)<<32 ^ day))
+	open := contract.StartPrice + int64(rnd.Intn(21)-10)
+	closePrice := contract.StartPrice + int64(rnd.Intn(21)-10)
+	return &pb.MarketValues{
+		DayIndex:                    proto.Int32(-1),
+		TradeDate:                   proto.Int64(s.tradeDate(day)),
+		ScaledOpenPrice:             proto.Int64(open),
+		ScaledHighPrice:             proto.Int64(max(open, closePrice) + int64(rnd.Intn(20))),
+		ScaledLowPrice:              proto.Int64(min(open, closePrice) - int64(rnd.Intn(20))),
+		ScaledClosePrice:            proto.Int64(closePrice),
+		ScaledLastPriceNoSettlement: proto.Int64(closePrice),
+		TotalVolume:                 &shared.Decimal{Significand: proto.Int64(int64(rnd.Intn(90000) + 10000))},
+	}
+}
+
+// tradingDayAt returns the number of the generated trading day in progress at t and its
+// start. Day 0 starts at the base time.
+func (s *Server) tradingDayAt(t time.Time) (int64, time.Time) {
+	elapsed := t.Sub(s.baseTime)
+	n := int64(elapsed / s.TradingDay)
+	if elapsed%s.TradingDay < 0 {
+		n--
+	}
+	return n, s.baseTime.Add(time.Duration(n) * s.TradingDay)
+}
+
+// tradeDate returns the trade date of a generated trading day relative to the base time.
+// Consecutive trading days have consecutive dates however long they are.
+func (s *Server) tradeDate(n int64) int64 {
+	current, _ := s.tradingDayAt(s.created)
+	return s.serverTime(s.created.Truncate(24*time.Hour).AddDate(0, 0, int(n-current)))
+}
+
+// tradingDayReport answers a trading day request. Of the from, to and count fields the
+// request sets two.
+func (s *Server) tradingDayReport(req *pb.TradingDayTimeRangeRequest) *pb.TradingDayTimeRangeReport {
+	from := s.baseTime.Add(time.Duration(req.GetFromUtcTime()) * time.Millisecond)
+	to := s.baseTime.Add(time.Duration(req.GetToUtcTime())*time.Millisecond - time.Millisecond)
+
+	// Days ending after from and starting before to
+	count := int64(req.GetCount())
+	var first int64
+	switch {
+	case req.FromUtcTime != nil && req.ToUtcTime != nil:
+		first, _ = s.tradingDayAt(from)
+		last, _ := s.tradingDayAt(to)
+		count = last - first + 1
+	case req.FromUtcTime != nil:
+		first, _ = s.tradingDayAt(from)
+	default:
+		last, _ := s.tradingDayAt(to)
+		first = last - count + 1
+	}
+
+	report := &pb.TradingDayTimeRangeReport{Truncated: proto.Bool(count > maxTradingDays)}
+	for n := first; n < first+min(count, maxTradingDays); n++ {
+		start := s.baseTime.Add(time.Duration(n) * s.TradingDay)
+		end := start.Add(s.TradingDay)
+		report.TradingDayTimeRanges = append(report.TradingDayTimeRanges, &pb.TradingDayTimeRange{
+			TradeDate:                  proto.Int64(s.tradeDate(n)),
+			TradingDayPreOpenUtcTime:   proto.Int64(s.serverTime(start)),
+			TradingDayOpenUtcTime:      proto.Int64(s.serverTime(start)),
+			TradingDayCloseUtcTime:     proto.Int64(s.serverTime(end)),
+			TradingDayPostCloseUtcTime: proto.Int64(s.serverTime(end)),
+		})
+	}
+	return report
+}
+
+// bbaQuotes returns a best bid and ask one tick around price. Volumes are only sent
+// from the trades_bba_volumes level up.
+func bbaQuotes(utcTime, price int64, withVolumes bool) []*pb.Quote {
+	quotes := []*pb.Quote{
+		{
+			Type:         proto.Uint32(uint32(pb.Quote_TYPE_BESTBID)),
+			QuoteUtcTime: proto.Int64(utcTime),
+			ScaledPrice:  proto.Int64(price - 1),
+		},
+		{
+			Type:         proto.Uint32(uint32(pb.Quote_TYPE_BESTASK)),
+			QuoteUtcTime: proto.Int64(utcTime),
+			ScaledPrice:  proto.Int64(price + 1),
+		},
+	}
+	if withVolumes {
+		for _, quote := range quotes {
+			quote.Volume = &shared.Decimal{Significand: proto.Int64(5)}
+		}
+	}
+	return quotes
+}
+
+// domDepth is the number of generated DOM levels on each side of the book
+const domDepth = 5
+
+// fakeOrder is an order resting in the generated book
+type fakeOrder struct {
+	id     string
+	volume int64
+}
+
+// domGenerator keeps a book of orders around the last price and reports its changes
+// as combined DOM quotes and, if detailed, as detailed DOM operations
+type domGenerator struct {
+	rnd       *rand.Rand
+	detailed  bool
+	levels    [2]map[int64][]fakeOrder // Orders by scaled price, bids first
+	nextOrder int
+}
+
+// newDOMGenerator creates an empty book
+func newDOMGenerator(rnd *rand.Rand, detailed bool) *domGenerator {
+	return &domGenerator{
+		rnd:      rnd,
+		detailed: detailed,
+		levels:   [2]map[int64][]fakeOrder{make(map[int64][]fakeOrder), make(map[int64][]fakeOrder)},
+	}
+}
+
+// newOrder creates an order with a random volume
+func (g *domGenerator) newOrder() fakeOrder {
+	g.nextOrder++
+	return fakeOrder{id: fmt.Sprintf("o%d", g.nextOrder), volume: int64(g.rnd.Intn(20) + 1)}
+}
+
+// update moves the book around price and adds its changes to rtData. A snapshot lists
+// every level; otherwise only levels that changed are sent.
+func (g *domGenerator) update(rtData *pb.RealTimeMarketData, utcTime, price int64, snapshot bool) {
+	var detailed *pb.DetailedDOM
+	if g.detailed {
+		detailed = &pb.DetailedDOM{
+			IsSnapshot:            proto.Bool(snapshot),
+			IsDetailedDomComplete: proto.Bool(true),
+			IsStale:               proto.Bool(false),
+		}
+		rtData.DetailedDom = detailed
+	}
+
+	for i, side := range []uint32{1, 2} {
+		levels := g.levels[i]
+		quoteType, direction := pb.Quote_TYPE_BID, int64(-1)
+		if side == 2 {
+			quoteType, direction = pb.Quote_TYPE_ASK, 1
+		}
+
+		// Levels that left the book are cleared with zero volume
+		wanted := make(map[int64]bool, domDepth)
+		for n := int64(1); n <= domDepth; n++ {
+			wanted[price+direction*n] = true
+		}
+		for p := range levels {
+			if wanted[p] {
+				continue
+			}
+			delete(levels, p)
+			rtData.Quotes = append(rtData.Quotes, domQuote(quoteType, utcTime, p, 0))
+			if detailed != nil {
+				detailed.PriceLevels = append(detailed.PriceLevels, &pb.DetailedDOMAtPrice{
+					ScaledPrice: proto.Int64(p),
+					Side:        proto.Uint32(side),
+					IsSnapshot:  proto.Bool(true),
+				})
+			}
+		}
+
+		for n := int64(1); n <= domDepth; n++ {
+			p := price + direction*n
+			orders, ok := levels[p]
+			var ops []*pb.DetailedDOMOrder
+			switch {
+			case !ok || snapshot:
+				// New levels start with a few orders
+				if !ok {
+					for k := g.rnd.Intn(3); k >= 0; k-- {
+						orders = append(orders, g.newOrder())
+					}
+				}
+				for _, order := range orders {
+					ops = append(ops, insertOp(order, -1))
+				}
+			case g.rnd.Intn(3) == 0 && len(orders) > 1:
+				ops = append(ops, &pb.DetailedDOMOrder{
+					DetailedDomOrderId: proto.String(orders[0].id),
+					Operation:          proto.Uint32(uint32(pb.DetailedDOMOrder_OPERATION_REMOVE)),
+				})
+				orders = orders[1:]
+			case g.rnd.Intn(2) == 0:
+				order := g.newOrder()
+				ops = append(ops, insertOp(order, len(orders)))
+				orders = append(orders, order)
+			default:
+				orders[0].volume = int64(g.rnd.Intn(20) + 1)
+				ops = append(ops, &pb.DetailedDOMOrder{
+					DetailedDomOrderId: proto.String(orders[0].id),
+					Operation:          proto.Uint32(uint32(pb.DetailedDOMOrder_OPERATION_MODIFY)),
+					Volume:             &shared.Decimal{Significand: proto.Int64(orders[0].volume)},
+				})
+			}
+			levels[p] = orders
+
+			var volume int64
+			for _, order := range orders {
+				volume += order.volume
+			}
+			rtData.Quotes = append(rtData.Quotes, domQuote(quoteType, utcTime, p, volume))
+			if detailed != nil {
+				detailed.PriceLevels = append(detailed.PriceLevels, &pb.DetailedDOMAtPrice{
+					ScaledPrice: proto.Int64(p),
+					Side:        proto.Uint32(side),
+					IsSnapshot:  proto.Bool(!ok || snapshot),
+					Orders:      ops,
+				})
+			}
+		}
+	}
+}
+
+// domQuote returns a combined DOM quote; zero volume removes the price
+func domQuote(quoteType pb.Quote_Type, utcTime, price, volume int64) *pb.Quote {
+	return &pb.Quote{
+		Type:         proto.Uint32(uint32(quoteType)),
+		QuoteUtcTime: proto.Int64(utcTime),
+		ScaledPrice:  proto.Int64(price),
+		Volume:       &shared.Decimal{Significand: proto.Int64(volume)},
+	}
+}
+
+// insertOp returns a detailed DOM insert; a negative index follows the previous order
+func insertOp(order fakeOrder, index int) *pb.DetailedDOMOrder {
+	op := &pb.DetailedDOMOrder{
+		DetailedDomOrderId: proto.String(order.id),
+		Operation:          proto.Uint32(uint32(pb.DetailedDOMOrder_OPERATION_INSERT)),
+		Volume:             &shared.Decimal{Significand: proto.Int64(order.volume)},
+	}
+	if index >= 0 {
+		op.OrderIndex = proto.Uint32(uint32(index))
+	}
+	return op
+}
+
+// timeBarReports generates the reports answering a GET or SUBSCRIBE time bar request
+func (s *Server) timeBarReports(contract *Contract, req *pb.TimeBarRequest, subscribe bool) []*pb.TimeBarReport {
+	params := req.GetTimeBarParameters()
+	from := s.baseTime.Add(time.Duration(params.GetFromUtcTime()) * time.Millisecond)
+	to := time.Now()
+	if params.ToUtcTime != nil {
+		to = s.baseTime.Add(time.Duration(params.GetToUtcTime()) * time.Millisecond)
+		if params.GetBarUnit() <= uint32(pb.BarUnit_BAR_UNIT_DAY) {
+			// The end of daily and longer bars is an inclusive trade date
+			to = nextBar(barStart(to, params.GetBarUnit(), 1), params.GetBarUnit(), 1)
+		}
+	}
+
+	var bars []*pb.TimeBar
+	var segments []int // Rolls back from the current contract of each continuation bar
+	continuation := params.GetContinuationParameters()
+	for start := barStart(from, params.GetBarUnit(), params.GetUnitNumber()); start.Before(to); start = nextBar(start, params.GetBarUnit(), params.GetUnitNumber()) {
+		bar := s.timeBar(contract, start)
+		if continuation != nil {
+			back := rollsBack(start, continuation)
+			if back > 0 && !continuation.GetEqualize() {
+				// Expired contracts traded apart from the current one
+				gap := int64(back) * contract.StartPrice / 200
+				bar.ScaledOpenPrice = proto.Int64(bar.GetScaledOpenPrice() + gap)
+				bar.ScaledHighPrice = proto.Int64(bar.GetScaledHighPrice() + gap)
+				bar.ScaledLowPrice = proto.Int64(bar.GetScaledLowPrice() + gap)
+				bar.ScaledClosePrice = proto.Int64(bar.GetScaledClosePrice() + gap)
+			}
+			segments = append(segments, back)
+		}
+		bars = append(bars, bar)
+	}
+
+	// Segments are marked on the first bar of the response and on the first bar of
+	// every further segment, in the order bars are sent
+	if continuation != nil && params.GetBarUnit() >= uint32(pb.BarUnit_BAR_UNIT_MONTH) {
+		for i := len(bars) - 1; i >= 0; i-- {
+			if i == len(bars)-1 || segments[i] != segments[i+1] {
+				bars[i].ContinuationSegment = continuationSegment(contract, segments[i], continuation)
+			}
+		}
+	}
+
+	truncated := len(bars) > maxBarsPerRequest
+	if truncated {
+		bars = bars[len(bars)-maxBarsPerRequest:]
+	}
+
+	statusCode := uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_SUCCESS)
+	if subscribe {
+		statusCode = uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_SUBSCRIBED)
+	}
+
+	// CQG sends bars newest first, split over several reports
+	for i, j := 0, len(bars)-1; i < j; i, j = i+1, j-1 {
+		bars[i], bars[j] = bars[j], bars[i]
+	}
+
+	var reports []*pb.TimeBarReport
+	for i := 0; i < len(bars) || i == 0; i += barsPerReport {
+		end := min(i+barsPerReport, len(bars))
+		reports = append(reports, &pb.TimeBarReport{
+			RequestId:        proto.Uint32(req.GetRequestId()),
+			StatusCode:       proto.Uint32(statusCode),
+			TimeBars:         bars[i:end],
+			UpToUtcTime:      proto.Int64(s.serverTime(to)),
+			IsReportComplete: proto.Bool(end == len(bars)),
+			Truncated:        proto.Bool(truncated),
+		})
+	}
+	return reports
+}
+
+// runBarUpdates sends the current bar of a subscription on every tick until stop is closed
+func (sess *session) runBarUpdates(contract *Contract, req *pb.TimeBarRequest, stop chan struct{}) {
+	s := sess.server
+	params := req.GetTimeBarParameters()
+
+	ticker := time.NewTicker(s.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sess.closed:
+			return
+		case now := <-ticker.C:
+			bar := s.timeBar(contract, barStart(now, params.GetBarUnit(), params.GetUnitNumber()))
+			sess.write(&pb.ServerMsg{TimeBarReports: []*pb.TimeBarReport{{
+				RequestId:        proto.Uint32(req.GetRequestId()),
+				StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_UPDATE)),
+				TimeBars:         []*pb.TimeBar{bar},
+				UpToUtcTime:      proto.Int64(s.serverTime(now)),
+				IsReportComplete: proto.Bool(true),
+			}}})
+		}
+	}
+}
+
+// timeBar generates the bar starting at start. The same contract and start always
+// produce the same bar, so repeated requests return consistent history.
+func (s *Server) timeBar(contract *Contract, start time.Time) *pb.TimeBar {
+	rnd := rand.New(rand.NewSource(int64(contract.ContractID)<<32 ^ start.Unix()))
+
+	// Some noise around the slow weekly wave
+	mid := midPrice(contract, start)
+	open := mid + int64(rnd.Intn(21)-10)
+	closePrice := mid + int64(rnd.Intn(21)-10)
+	high := max(open, closePrice) + int64(rnd.Intn(10))
+	low := min(open, closePrice) - int64(rnd.Intn(10))
+
+	return &pb.TimeBar{
+		BarUtcTime:       proto.Int64(s.serverTime(start)),
+		ScaledOpenPrice:  proto.Int64(open),
+		ScaledHighPrice:  proto.Int64(high),
+		ScaledLowPrice:   proto.Int64(low),
+		ScaledClosePrice: proto.Int64(closePrice),
+		Volume:           &shared.Decimal{Significand: proto.Int64(int64(rnd.Intn(900) + 100))},
+		TradeDate:        proto.Int64(s.serverTime(start.UTC().Truncate(24 * time.Hour))),
+	}
+}
+
+// rollMonthCodes are the month codes of the quarterly contracts continuous series are
+// built from, by quarter
+const rollMonthCodes = "HMUZ"
+
+// rollsBack returns the number of contract rolls between t and now in a continuous
+// series. Active series roll a week before the standard ones, which roll at expiration
+// in the middle of the expiry month.
+func rollsBack(t time.Time, params *pb.ContinuationParameters) int {
+	return rollIndex(time.Now(), params) - rollIndex(t, params)
+}
+
+// rollIndex numbers the quarterly contract traded at t in a continuous series
+func rollIndex(t time.Time, params *pb.ContinuationParameters) int {
+	rollDay := 15
+	if params.GetContinuationType() == uint32(pb.ContinuationParameters_CONTINUATION_TYPE_ACTIVE) {
+		rollDay = 8
+	}
+	t = t.UTC()
+	quarter := t.Year()*4 + (int(t.Month())-1)/3
+	if int(t.Month())%3 == 0 && t.Day() >= rollDay {
+		quarter++
+	}
+	return quarter
+}
+
+// continuationSegment describes the contract traded back rolls before the current one
+// of a continuous series. Expired contracts get IDs derived from the series.
+func continuationSegment(contract *Contract, back int, params *pb.ContinuationParameters) *pb.ContinuationSegment {
+	quarter := rollIndex(time.Now(), params) - back
+	year, code := quarter/4, rollMonthCodes[quarter%4]
+
+	contractID := contract.ContractID
+	if back > 0 {
+		contractID = contract.ContractID*10000 + uint32(back)
+	}
+	return &pb.ContinuationSegment{
+		ContractId:             proto.Uint32(contractID),
+		CqgShortContractSymbol: proto.String(fmt.Sprintf("%s%c%d", contract.Symbol, code, year%10)),
+		ContractSymbol:         proto.String(fmt.Sprintf("%s%c%02d", contract.Symbol, code, year%100)),
+	}
+}
+
+// midPrice returns the price historical data moves around at t, following a slow
+// weekly wave around the start price
+func midPrice(contract *Contract, t time.Time) int64 {
+	wave := math.Sin(float64(t.Unix()) / (7 * 24 * 3600) * 2 * math.Pi)
+	return contract.StartPrice + int64(float64(contract.StartPrice)*0.05*wave)
+}
+
+// barStart aligns t to the start of the bar containing it
+func barStart(t time.Time, barUnit, unitNumber uint32) time.Time {
+	t = t.UTC()
+	n := int(max(unitNumber, 1))
+
+	switch pb.BarUnit(barUnit) {
+	case pb.BarUnit_BAR_UNIT_MIN:
+		return t.Truncate(time.Duration(n) * time.Minute)
+	case pb.BarUnit_BAR_UNIT_HOUR:
+		return t.Truncate(time.Duration(n) * time.Hour)
+	case pb.BarUnit_BAR_UNIT_WEEK:
+		day := t.Truncate(24 * time.Hour)
+		return day.AddDate(0, 0, -int(day.Weekday()+6)%7)
+	case pb.BarUnit_BAR_UNIT_MONTH, pb.BarUnit_BAR_UNIT_QUARTER, pb.BarUnit_BAR_UNIT_SEMI_ANNUAL:
+		months := monthsPerBar(barUnit, n)
+		month := (int(t.Month()) - 1) / months * months
+		return time.Date(t.Year(), time.Month(month+1), 1, 0, 0, 0, 0, time.UTC)
+	case pb.BarUnit_BAR_UNIT_YEAR:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return t.Truncate(24 * time.Hour)
+	}
+}
+
+// nextBar returns the start of the bar following the one starting at start
+func nextBar(start time.Time, barUnit, unitNumber uint32) time.Time {
+	n := int(max(unitNumber, 1))
+
+	switch pb.BarUnit(barUnit) {
+	case pb.BarUnit_BAR_UNIT_MIN:
+		return start.Add(time.Duration(n) * time.Minute)
+	case pb.BarUnit_BAR_UNIT_HOUR:
+		return start.Add(time.Duration(n) * time.Hour)
+	case pb.BarUnit_BAR_UNIT_WEEK:
+		return start.AddDate(0, 0, 7*n)
+	case pb.BarUnit_BAR_UNIT_MONTH, pb.BarUnit_BAR_UNIT_QUARTER, pb.BarUnit_BAR_UNIT_SEMI_ANNUAL:
+		return start.AddDate(0, monthsPerBar(barUnit, n), 0)
+	case pb.BarUnit_BAR_UNIT_YEAR:
+		return start.AddDate(n, 0, 0)
+	default:
+		return start.AddDate(0, 0, n)
+	}
+}
+
+// monthsPerBar returns the length in months of monthly, quarterly and semi-annual bars
+func monthsPerBar(barUnit uint32, n int) int {
+	switch pb.BarUnit(barUnit) {
+	case pb.BarUnit_BAR_UNIT_QUARTER:
+		return 3 * n
+	case pb.BarUnit_BAR_UNIT_SEMI_ANNUAL:
+		return 6 * n
+	default:
+		return n
+	}
+}
+
+// timeAndSalesReports generates the reports answering a time and sales request. A start
+// beyond the history kept is moved up and the reports marked truncated.
+func (s *Server) timeAndSalesReports(contract *Contract, req *pb.TimeAndSalesRequest) []*pb.TimeAndSalesReport {
+	params := req.GetTimeAndSalesParameters()
+	now := time.Now()
+	from := s.baseTime.Add(time.Duration(params.GetFromUtcTime()) * time.Millisecond)
+	to := now
+	if params.ToUtcTime != nil {
+		to = s.baseTime.Add(time.Duration(params.GetToUtcTime()) * time.Millisecond)
+	}
+	if !to.After(from) {
+		return []*pb.TimeAndSalesReport{{
+			RequestId:        proto.Uint32(req.GetRequestId()),
+			ResultCode:       proto.Uint32(uint32(pb.TimeAndSalesReport_RESULT_CODE_INVALID_PARAMS)),
+			Details:          &shared.Text{Text: proto.String("End time is not after start time")},
+			IsReportComplete: proto.Bool(true),
+		}}
+	}
+	truncated := from.Before(now.Add(-timeAndSalesDepth))
+	if truncated {
+		from = now.Add(-timeAndSalesDepth)
+	}
+	if to.After(now) {
+		to = now
+	}
+
+	withBBA := params.GetLevel() == uint32(pb.TimeAndSalesParameters_LEVEL_TRADES_BBA_VOLUMES)
+	var quotes, corrections []*pb.Quote
+	for t := from.Truncate(timeAndSalesInterval); t.Before(to); t = t.Add(timeAndSalesInterval) {
+		if t.Before(from) {
+			continue
+		}
+		trade, busted := s.historicalTrade(contract, t, params)
+		if trade == nil {
+			continue
+		}
+		quotes = append(quotes, trade)
+		if withBBA {
+			// Quotes at the time of the quote before them carry no time
+			bba := bbaQuotes(trade.GetQuoteUtcTime(), trade.GetScaledPrice(), true)
+			for _, quote := range bba {
+				quote.QuoteUtcTime = nil
+			}
+			quotes = append(quotes, bba...)
+		}
+		if busted {
+			corrections = append(corrections, tradeCorrection(trade.GetQuoteUtcTime(), trade.GetScaledPrice(), trade.GetVolume().GetSignificand(), pb.Quote_INDICATOR_DELETION))
+		}
+	}
+
+	var reports []*pb.TimeAndSalesReport
+	for i := 0; i < len(quotes) || i == 0; i += quotesPerReport {
+		end := min(i+quotesPerReport, len(quotes))
+		report := &pb.TimeAndSalesReport{
+			RequestId:               proto.Uint32(req.GetRequestId()),
+			ResultCode:              proto.Uint32(uint32(pb.TimeAndSalesReport_RESULT_CODE_SUCCESS)),
+			Quotes:                  quotes[i:end],
+			IsReportComplete:        proto.Bool(end == len(quotes)),
+			Truncated:               proto.Bool(truncated),
+			OffMarketTradesIncluded: proto.Bool(params.GetIncludeOffMarketTrades()),
+			TradeAttributesIncluded: proto.Bool(params.GetIncludeTradeAttributes()),
+		}
+		if params.ToUtcTime == nil {
+			report.UpToUtcTime = proto.Int64(s.serverTime(to))
+		}
+		reports = append(reports, report)
+	}
+
+	// Corrections follow the quotes they refer to
+	last := reports[len(reports)-1]
+	last.Corrections = corrections
+	return reports
+}
+
+// historicalTrade generates the trade at t and reports whether it was busted later.
+// The same contract and time always produce the same trade. Off-market trades are left
+// out unless requested.
+func (s *Server) historicalTrade(contract *Contract, t time.Time, params *pb.TimeAndSalesParameters) (*pb.Quote, bool) {
+	rnd := rand.New(rand.NewSource(int64(contract.ContractID)<<32 ^ t.Unix()))
+	offMarket := rnd.Intn(50) == 0
+	if offMarket && !params.GetIncludeOffMarketTrades() {
+		return nil, false
+	}
+
+	condition := pb.Quote_SALES_CONDITION_BUY_SIDE_AGGRESSOR
+	if rnd.Intn(2) == 0 {
+		condition = pb.Quote_SALES_CONDITION_SELL_SIDE_AGGRESSOR
+	}
+	trade := &pb.Quote{
+		Type:           proto.Uint32(uint32(pb.Quote_TYPE_TRADE)),
+		QuoteUtcTime:   proto.Int64(s.serverTime(t)),
+		ScaledPrice:    proto.Int64(midPrice(contract, t) + int64(rnd.Intn(21)-10)),
+		Volume:         &shared.Decimal{Significand: proto.Int64(int64(rnd.Intn(10) + 1))},
+		SalesCondition: proto.Uint32(uint32(condition)),
+	}
+	if offMarket {
+		trade.Indicators = []uint32{uint32(pb.Quote_INDICATOR_OFF_MARKET)}
+	}
+	if params.GetIncludeTradeAttributes() {
+		trade.TradeAttributes = &pb.TradeAttributes{
+			Buyer:     proto.Int32(int32(rnd.Intn(900) + 100)),
+			Seller:    proto.Int32(int32(rnd.Intn(900) + 100)),
+			TradeType: proto.String("Regular"),
+			MatchId:   proto.String(fmt.Sprintf("%d-%d", contract.ContractID, t.Unix())),
+		}
+		if offMarket {
+			trade.TradeAttributes.TradeType = proto.String("Block")
+			trade.TradeAttributes.AgreementTimeUtc = &timestamp.Timestamp{Seconds: t.Add(-time.Minute).Unix()}
+		}
+	}
+	return trade, s.CorrectionRate > 0 && rnd.Float64() < s.CorrectionRate
+}
+
+// fakeBar is a non-timed bar built from generated trades
+type fakeBar struct {
+	start                  time.Time
+	index                  int32
+	open, high, low, close int64
+	rawHigh, rawLow        int64 // Traded extremes of P&F columns
+	volume                 int64
+	ticks                  uint64
+	up                     bool
+	first                  bool // First bar of its trading day
+}
+
+// nonTimedBarReports generates the reports answering a GET or SUBSCRIBE non-timed bar
+// request, newest bar first
+func (s *Server) nonTimedBarReports(contract *Contract, req *pb.NonTimedBarRequest, statusCode uint32) []*pb.NonTimedBarReport {
+	barRange := req.GetBarRange()
+	count := int(barRange.GetCount())
+	to := time.Now()
+	if barRange.UtcTime != nil {
+		to = s.baseTime.Add(time.Duration(barRange.GetUtcTime()) * time.Millisecond)
+	}
+
+	truncated := count > maxBarsPerRequest
+	if truncated {
+		count = maxBarsPerRequest
+	}
+
+	// Bars restart every trading day; build whole days back from the one in progress
+	var bars []fakeBar
+	_, dayStart := s.tradingDayAt(to)
+	reachedStart := false
+	for len(bars) < count {
+		if time.Since(dayStart) > timeAndSalesDepth {
+			reachedStart = true
+			break
+		}
+		var day []fakeBar
+		for _, bar := range s.buildBars(contract, req, dayStart, dayStart.Add(s.TradingDay)) {
+			// The range ends before the bar at utc_time and index
+			if bar.start.After(to) || (barRange.UtcTime != nil && bar.start.Equal(to) && bar.index >= barRange.GetIndex()) {
+				break
+			}
+			day = append(day, bar)
+		}
+		bars = append(day, bars...)
+		dayStart = dayStart.Add(-s.TradingDay)
+	}
+	if len(bars) > count {
+		bars = bars[len(bars)-count:]
+	}
+
+	// CQG sends bars newest first, split over several reports
+	for i, j := 0, len(bars)-1; i < j; i, j = i+1, j-1 {
+		bars[i], bars[j] = bars[j], bars[i]
+	}
+
+	var reports []*pb.NonTimedBarReport
+	var previous fakeBar
+	for i := 0; i < len(bars) || i == 0; i += barsPerReport {
+		end := min(i+barsPerReport, len(bars))
+		report := &pb.NonTimedBarReport{
+			RequestId:           proto.Uint32(req.GetRequestId()),
+			StatusCode:          proto.Uint32(statusCode),
+			IsReportComplete:    proto.Bool(end == len(bars)),
+			TruncatedByBarCount: proto.Bool(truncated),
+			ReachedStartOfData:  proto.Bool(reachedStart && end == len(bars)),
+		}
+		if barRange.UtcTime == nil {
+			report.UpToUtcTime = proto.Int64(s.serverTime(to))
+		}
+		for _, bar := range bars[i:end] {
+			s.addBar(report, req, bar, previous)
+			previous = bar
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// buildBars builds the bars of the request type from the generated trades between two
+// times, oldest first
+func (s *Server) buildBars(contract *Contract, req *pb.NonTimedBarRequest, from, to time.Time) []fakeBar {
+	tick := max(int64(math.Round(contract.TickSize/contract.PriceScale)), 1)
+	var bars []fakeBar
+	var bar *fakeBar
+	var base int64 // Renko brick or P&F column boundary
+
+	// emit closes the current bar, numbering bars that start at the same time
+	emit := func() {
+		if n := len(bars); n > 0 && bars[n-1].start.Equal(bar.start) {
+			bar.index = bars[n-1].index + 1
+		}
+		bar.first = len(bars) == 0
+		bars = append(bars, *bar)
+		bar = nil
+	}
+
+	for t := from.Truncate(timeAndSalesInterval); t.Before(to); t = t.Add(timeAndSalesInterval) {
+		if t.Before(from) {
+			continue
+		}
+		trade, _ := s.historicalTrade(contract, t, &pb.TimeAndSalesParameters{})
+		if trade == nil {
+			continue
+		}
+		price, volume := trade.GetScaledPrice(), trade.GetVolume().GetSignificand()
+		if bar == nil {
+			bar = &fakeBar{start: t, open: price, high: price, low: price, close: price, rawHigh: price, rawLow: price}
+		}
+		rawHigh, rawLow := bar.rawHigh, bar.rawLow
+		bar.high, bar.low, bar.close = max(bar.high, price), min(bar.low, price), price
+		bar.rawHigh, bar.rawLow = max(rawHigh, price), min(rawLow, price)
+		bar.volume += volume
+		bar.ticks++
+
+		switch {
+		case req.TickBarParameters != nil:
+			emit()
+		case req.ConstantVolumeBarParameters != nil:
+			params := req.GetConstantVolumeBarParameters()
+			level := max(params.GetVolumeLevel().GetSignificand(), 1)
+			if (params.GetUseTickVolume() && int64(bar.ticks) >= level) || (!params.GetUseTickVolume() && bar.volume >= level) {
+				emit()
+			}
+		case req.RangeBarParameters != nil:
+			if bar.high-bar.low >= int64(req.GetRangeBarParameters().GetRangeSize())*tick {
+				emit()
+			}
+		case req.RenkoBarParameters != nil:
+			brick := int64(req.GetRenkoBarParameters().GetBrickSize()) * tick
+			if len(bars) == 0 && bar.ticks == 1 {
+				base = price
+			}
+			// A move of a brick or more closes bricks at brick boundaries
+			for price >= base+brick || price <= base-brick {
+				up := price >= base+brick
+				next := base - brick
+				if up {
+					next = base + brick
+				}
+				bar.open, bar.close, bar.up = base, next, up
+				bar.high, bar.low = max(base, next), min(base, next)
+				emit()
+				bar = &fakeBar{start: t, open: next, high: next, low: next, close: next}
+				base = next
+			}
+		case req.PointAndFigureParameters != nil:
+			params := req.GetPointAndFigureParameters()
+			box := int64(params.GetBoxSize()) * tick
+			boxed := price / box * box
+			if bar.ticks == 1 {
+				base = boxed
+				bar.open, bar.high, bar.low, bar.close = boxed, boxed, boxed, boxed
+				bar.up = true
+				continue
+			}
+			reversal := int64(params.GetReversal()) * box
+			switch {
+			case bar.up && boxed > base:
+				base = boxed
+			case !bar.up && boxed < base:
+				base = boxed
+			case bar.up && boxed <= base-reversal, !bar.up && boxed >= base+reversal:
+				// The column ends before this trade; the next one starts a box off its
+				// extreme
+				bar.rawHigh, bar.rawLow = rawHigh, rawLow
+				bar.volume -= volume
+				bar.ticks--
+				bar.close = base
+				bar.high, bar.low = max(bar.open, base), min(bar.open, base)
+				up := !bar.up
+				emit()
+				start := base - box
+				if up {
+					start = base + box
+				}
+				bar = &fakeBar{start: t, open: start, high: max(start, boxed), low: min(start, boxed), close: boxed, rawHigh: price, rawLow: price, volume: volume, ticks: 1, up: up}
+				base = boxed
+				continue
+			}
+			bar.close = base
+			bar.high, bar.low = max(bar.open, base), min(bar.open, base)
+		}
+	}
+
+	// The current bar is still open
+	if bar != nil && bar.ticks > 0 {
+		emit()
+	}
+	return bars
+}
+
+// addBar adds a bar to a report as the message of the request type. Start times and
+// trade dates are only set when they differ from the previous bar's, as CQG does.
+func (s *Server) addBar(report *pb.NonTimedBarReport, req *pb.NonTimedBarRequest, bar, previous fakeBar) {
+	var barTime, tradeDate *int64
+	if !bar.start.Equal(previous.start) {
+		barTime = proto.Int64(s.serverTime(bar.start))
+	}
+	day, _ := s.tradingDayAt(bar.start)
+	if previousDay, _ := s.tradingDayAt(previous.start); previous.start.IsZero() || day != previousDay {
+		tradeDate = proto.Int64(s.tradeDate(day))
+	}
+	var index *int32
+	if bar.index != 0 {
+		index = proto.Int32(bar.index)
+	}
+	volume := &shared.Decimal{Significand: proto.Int64(bar.volume)}
+
+	switch {
+	case req.TickBarParameters != nil:
+		report.TickBars = append(report.TickBars, &pb.TickBar{
+			BarUtcTime:       barTime,
+			Index:            index,
+			TradeDate:        tradeDate,
+			ScaledClosePrice: proto.Int64(bar.close),
+			Volume:           volume,
+		})
+	case req.ConstantVolumeBarParameters != nil:
+		report.ConstantVolumeBars = append(report.ConstantVolumeBars, &pb.ConstantVolumeBar{
+			BarUtcTime:       barTime,
+			Index:            index,
+			TradeDate:        tradeDate,
+			ScaledOpenPrice:  proto.Int64(bar.open),
+			ScaledHighPrice:  proto.Int64(bar.high),
+			ScaledLowPrice:   proto.Int64(bar.low),
+			ScaledClosePrice: proto.Int64(bar.close),
+			Volume:           volume,
+			TickVolume:       proto.Uint64(bar.ticks),
+		})
+	case req.RangeBarParameters != nil:
+		report.RangeBars = append(report.RangeBars, &pb.RangeBar{
+			BarUtcTime:       barTime,
+			Index:            index,
+			TradeDate:        tradeDate,
+			ScaledOpenPrice:  proto.Int64(bar.open),
+			ScaledHighPrice:  proto.Int64(bar.high),
+			ScaledLowPrice:   proto.Int64(bar.low),
+			ScaledClosePrice: proto.Int64(bar.close),
+			Volume:           volume,
+			TickVolume:       proto.Uint64(bar.ticks),
+		})
+	case req.RenkoBarParameters != nil:
+		report.RenkoBars = append(report.RenkoBars, &pb.RenkoBar{
+			BarUtcTime:              barTime,
+			Index:                   index,
+			TradeDate:               tradeDate,
+			ScaledOpenPrice:         proto.Int64(bar.open),
+			ScaledHighPrice:         proto.Int64(bar.high),
+			ScaledLowPrice:          proto.Int64(bar.low),
+			ScaledClosePrice:        proto.Int64(bar.close),
+			ScaledRenkoHighPrice:    proto.Int64(max(bar.open, bar.close)),
+			ScaledRenkoLowPrice:     proto.Int64(min(bar.open, bar.close)),
+			Up:                      proto.Bool(bar.up),
+			Volume:                  volume,
+			TickVolume:              proto.Uint64(bar.ticks),
+			FirstBarAfterStartPoint: proto.Bool(bar.first),
+		})
+	case req.PointAndFigureParameters != nil:
+		report.PointAndFigureBars = append(report.PointAndFigureBars, &pb.PointAndFigureBar{
+			BarUtcTime:         barTime,
+			Index:              index,
+			TradeDate:          tradeDate,
+			PfScaledOpenPrice:  proto.Int64(bar.open),
+			PfScaledHighPrice:  proto.Int64(bar.high),
+			PfScaledLowPrice:   proto.Int64(bar.low),
+			PfScaledClosePrice: proto.Int64(bar.close),
+			ScaledHighPrice:    proto.Int64(bar.rawHigh),
+			ScaledLowPrice:     proto.Int64(bar.rawLow),
+			Up:                 proto.Bool(bar.up),
+			Volume:             volume,
+			TickVolume:         proto.Uint64(bar.ticks),
+		})
+	}
+}
+
+// runNonTimedBarUpdates sends the latest bar of a subscription on every tick until
+// stop is closed
+func (sess *session) runNonTimedBarUpdates(contract *Contract, req *pb.NonTimedBarRequest, stop chan struct{}) {
+	s := sess.server
+
+	ticker := time.NewTicker(s.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sess.closed:
+			return
+		case now := <-ticker.C:
+			_, dayStart := s.tradingDayAt(now)
+			bars := s.buildBars(contract, req, dayStart, now)
+			if len(bars) == 0 {
+				continue
+			}
+			report := &pb.NonTimedBarReport{
+				RequestId:        proto.Uint32(req.GetRequestId()),
+				StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_UPDATE)),
+				UpToUtcTime:      proto.Int64(s.serverTime(now)),
+				IsReportComplete: proto.Bool(true),
+			}
+			s.addBar(report, req, bars[len(bars)-1], fakeBar{})
+			sess.write(&pb.ServerMsg{NonTimedBarReports: []*pb.NonTimedBarReport{report}})
+		}
+	}
+}
+
+// volumeProfileReports generates the reports answering a volume profile request from the
+// generated trades of its range. Buyer-initiated trades count on the ask side, seller-
+// initiated ones on the bid side, and every fifth trade, inside the spread, is split
+// half and half.
+func (s *Server) volumeProfileReports(contract *Contract, req *pb.VolumeProfileRequest) []*pb.VolumeProfileReport {
+	params := req.GetVolumeProfileParameters()
+	if params.StartUtcTime == nil {
+		return []*pb.VolumeProfileReport{{
+			RequestId:        proto.Uint32(req.GetRequestId()),
+			ResultCode:       proto.Uint32(uint32(pb.VolumeProfileReport_RESULT_CODE_INVALID_PARAMS)),
+			Details:          &shared.Text{Text: proto.String("Start time is required")},
+			IsReportComplete: proto.Bool(true),
+		}}
+	}
+
+	// The range is widened to whole minutes
+	now := time.Now()
+	from := s.baseTime.Add(time.Duration(params.GetStartUtcTime()) * time.Millisecond).Truncate(time.Minute)
+	to := now
+	if params.EndUtcTime != nil {
+		to = s.baseTime.Add(time.Duration(params.GetEndUtcTime()) * time.Millisecond)
+	}
+	if rounded := to.Truncate(time.Minute); rounded.Before(to) {
+		to = rounded.Add(time.Minute)
+	}
+	if !to.After(now.Add(-timeAndSalesDepth)) {
+		return []*pb.VolumeProfileReport{{
+			RequestId:        proto.Uint32(req.GetRequestId()),
+			ResultCode:       proto.Uint32(uint32(pb.VolumeProfileReport_RESULT_CODE_OUTSIDE_ALLOWED_RANGE)),
+			Details:          &shared.Text{Text: proto.String("Range is beyond the available history")},
+			IsReportComplete: proto.Bool(true),
+		}}
+	}
+	truncated := from.Before(now.Add(-timeAndSalesDepth))
+	if truncated {
+		from = now.Add(-timeAndSalesDepth)
+	}
+	if to.After(now) {
+		to = now
+	}
+
+	// Volumes are kept in halves so split trades stay exact
+	type level struct {
+		volume, ask, bid          int64
+		ticks, askTicks, bidTicks int64
+	}
+	levels := make(map[int64]*level)
+	var lastTrade *pb.Quote
+	var askVolume, bidVolume int64
+	for t := from.Truncate(timeAndSalesInterval); t.Before(to); t = t.Add(timeAndSalesInterval) {
+		if t.Before(from) {
+			continue
+		}
+		trade, _ := s.historicalTrade(contract, t, &pb.TimeAndSalesParameters{})
+		if trade == nil {
+			continue
+		}
+		price, volume := trade.GetScaledPrice(), trade.GetVolume().GetSignificand()
+		l, ok := levels[price]
+		if !ok {
+			l = &level{}
+			levels[price] = l
+		}
+		l.volume += 2 * volume
+		l.ticks += 2
+		switch {
+		case t.Unix()/int64(timeAndSalesInterval/time.Second)%5 == 0:
+			l.ask, l.bid = l.ask+volume, l.bid+volume
+			l.askTicks, l.bidTicks = l.askTicks+1, l.bidTicks+1
+		case trade.GetSalesCondition() == uint32(pb.Quote_SALES_CONDITION_BUY_SIDE_AGGRESSOR):
+			l.ask += 2 * volume
+			l.askTicks += 2
+		default:
+			l.bid += 2 * volume
+			l.bidTicks += 2
+		}
+		lastTrade = trade
+
+		// The best bid and ask move with every trade
+		askVolume, bidVolume = 0, 0
+		if trade.GetSalesCondition() == uint32(pb.Quote_SALES_CONDITION_BUY_SIDE_AGGRESSOR) {
+			askVolume = volume
+		} else {
+			bidVolume = volume
+		}
+	}
+
+	var items []*pb.VolumeProfileItem
+	for price, l := range levels {
+		items = append(items, &pb.VolumeProfileItem{
+			ScaledPrice:   proto.Int64(price),
+			Volume:        halves(l.volume),
+			AskVolume:     halves(l.ask),
+			BidVolume:     halves(l.bid),
+			TickVolume:    proto.Uint32(uint32(l.ticks / 2)),
+			AskTickVolume: halves(l.askTicks),
+			BidTickVolume: halves(l.bidTicks),
+		})
+	}
+
+	var reports []*pb.VolumeProfileReport
+	for i := 0; i < len(items) || i == 0; i += profileItemsPerReport {
+		end := min(i+profileItemsPerReport, len(items))
+		reports = append(reports, &pb.VolumeProfileReport{
+			RequestId:          proto.Uint32(req.GetRequestId()),
+			ResultCode:         proto.Uint32(uint32(pb.VolumeProfileReport_RESULT_CODE_SUCCESS)),
+			VolumeProfileItems: items[i:end],
+			IsReportComplete:   proto.Bool(end == len(items)),
+			Truncated:          proto.Bool(truncated),
+		})
+	}
+	if params.EndUtcTime == nil {
+		// Profiles up to now report the time they reached
+		reports[len(reports)-1].UpToUtcTime = proto.Int64(s.serverTime(to))
+	}
+	if lastTrade != nil {
+		bba := bbaQuotes(lastTrade.GetQuoteUtcTime(), lastTrade.GetScaledPrice(), false)
+		reports[0].LastQuotesCumulativeStatistics = &pb.VolumeProfileLastQuotesCumulativeStatistics{
+			ScaledLastBidPrice: proto.Int64(bba[0].GetScaledPrice()),
+			ScaledLastAskPrice: proto.Int64(bba[1].GetScaledPrice()),
+			AskTradeVolume:     proto.Float64(float64(askVolume)),
+			BidTradeVolume:     proto.Float64(float64(bidVolume)),
+		}
+	}
+	return reports
+}
+
+// halves converts a count of halves into a decimal
+func halves(n int64) *shared.Decimal {
+	if n%2 == 0 {
+		return &shared.Decimal{Significand: proto.Int64(n / 2)}
+	}
+	return &shared.Decimal{Significand: proto.Int64(n * 5), Exponent: proto.Int32(-1)}
+}
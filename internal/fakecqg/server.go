@@ -0,0 +1,629 @@
+// Package fakecqg implements an in-process fake of the CQG WebAPI server. It speaks the
+// pb.ClientMsg/pb.ServerMsg protocol over WebSocket and answers logon, symbol resolution,
+// trading day, market data subscription, time bar, non-timed bar, time and sales and
+// volume profile requests with generated data, so the client and handlers can be
+// exercised without network access or CQG credentials.
+package fakecqg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// baseTimeLayout is the format of the base time sent in LogonResult
+const baseTimeLayout = "2006-01-02T15:04:05"
+
+// Server is a fake CQG WebAPI endpoint. Exported fields must be set before Start.
+type Server struct {
+	// UserName and Password, if set, are the only credentials accepted by Logon.
+	// Otherwise any non-empty user name is accepted.
+	UserName string
+	Password string
+
+	// Strict rejects symbols that were not added with AddContract. Otherwise a contract
+	// is generated for every symbol on first resolution.
+	Strict bool
+
+	// MaxLevel, if set, is the highest market data level the user is entitled to.
+	// Subscriptions to richer trade and DOM levels are lowered to it, as CQG does.
+	MaxLevel uint32
+
+	// TickInterval is the interval between generated market data updates
+	TickInterval time.Duration
+
+	// CorrectionRate is the fraction of generated trades that are busted right after,
+	// half of them replaced by a trade one tick higher. Time and sales history lists
+	// busts of the same fraction of its trades.
+	CorrectionRate float64
+
+	// TradingDay is the length of the generated trading days, which follow each other
+	// without a break from the base time on. Shorter days show session rollovers without
+	// waiting for one.
+	TradingDay time.Duration
+
+	// Handler, if set, sees every client message first. When it reports the message as
+	// handled its replies are sent instead of the built-in ones, which allows tests to
+	// script errors or specific data.
+	Handler func(clientMsg *pb.ClientMsg) (replies []*pb.ServerMsg, handled bool)
+
+	// URL is the ws:// address of the server, set by Start
+	URL string
+
+	baseTime   time.Time
+	created    time.Time // Trading days are dated so that the one in progress now is today
+	mu         sync.Mutex
+	contracts  map[string]*Contract // By symbol
+	lastID     uint32               // Last generated contract ID
+	tokens     map[string]bool      // Session tokens that can be restored
+	sessions   map[*session]struct{}
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+// NewServer creates a fake server with no contracts, a 500ms tick interval and trading
+// days of 24 hours
+func NewServer() *Server {
+	return &Server{
+		TickInterval: 500 * time.Millisecond,
+		TradingDay:   24 * time.Hour,
+		baseTime:     time.Now().UTC().Truncate(time.Hour).Add(-24 * time.Hour),
+		created:      time.Now().UTC(),
+		contracts:    make(map[string]*Contract),
+		tokens:       make(map[string]bool),
+		sessions:     make(map[*session]struct{}),
+	}
+}
+
+// Start listens on addr, e.g. "127.0.0.1:0", and serves WebSocket connections in the background
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s.listener = listener
+	s.httpServer = &http.Server{Handler: s}
+	s.URL = "ws://" + listener.Addr().String()
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("fake CQG server error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the server and closes every open connection
+func (s *Server) Close() error {
+	s.DropConnections()
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Close()
+}
+
+// DropConnections closes every open connection without logging the sessions off, as a
+// network failure would. Their session tokens stay valid for RestoreOrJoinSession.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sess := range s.sessions {
+		sess.ws.Close()
+	}
+}
+
+// Broadcast sends a server message to every logged on connection
+func (s *Server) Broadcast(serverMsg *pb.ServerMsg) {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		if sess.loggedOn() {
+			sess.write(serverMsg)
+		}
+	}
+}
+
+// BaseTime returns the base time the server reports at logon. Times in server messages
+// are milliseconds relative to it.
+func (s *Server) BaseTime() time.Time {
+	return s.baseTime
+}
+
+// serverTime converts a time into milliseconds relative to the base time
+func (s *Server) serverTime(t time.Time) int64 {
+	return t.Sub(s.baseTime).Milliseconds()
+}
+
+// ServeHTTP upgrades a request to a WebSocket connection and serves a client session on it
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("fake CQG upgrade error: %v", err)
+		return
+	}
+
+	sess := newSession(s, ws)
+
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+
+	sess.serve()
+
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	s.mu.Unlock()
+}
+
+// session is a single client connection to the fake server
+type session struct {
+	server  *Server
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	token  string                   // Session token once logged on
+	feeds  map[uint32]chan struct{} // Stops market data feeds by contract ID
+	bars   map[uint32]chan struct{} // Stops time and non-timed bar updates by request ID
+	closed chan struct{}
+}
+
+// newSession creates the state of a new connection
+func newSession(server *Server, ws *websocket.Conn) *session {
+	return &session{
+		server: server,
+		ws:     ws,
+		feeds:  make(map[uint32]chan struct{}),
+		bars:   make(map[uint32]chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// serve reads client messages until the connection closes
+func (sess *session) serve() {
+	defer func() {
+		close(sess.closed)
+		sess.ws.Close()
+	}()
+
+	for {
+		_, data, err := sess.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		clientMsg := &pb.ClientMsg{}
+		if err := proto.Unmarshal(data, clientMsg); err != nil {
+			log.Printf("fake CQG unmarshal error: %v", err)
+			return
+		}
+
+		if !sess.handle(clientMsg) {
+			return
+		}
+	}
+}
+
+// loggedOn reports whether the connection has an active session
+func (sess *session) loggedOn() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.token != ""
+}
+
+// write marshals and sends a server message
+func (sess *session) write(serverMsg *pb.ServerMsg) {
+	data, err := proto.Marshal(serverMsg)
+	if err != nil {
+		log.Printf("fake CQG marshal error: %v", err)
+		return
+	}
+
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	sess.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// handle answers a client message and reports whether the connection stays open
+func (sess *session) handle(clientMsg *pb.ClientMsg) bool {
+	if handler := sess.server.Handler; handler != nil {
+		if replies, handled := handler(clientMsg); handled {
+			for _, reply := range replies {
+				sess.write(reply)
+			}
+			return true
+		}
+	}
+
+	if logon := clientMsg.GetLogon(); logon != nil {
+		sess.handleLogon(logon)
+		return true
+	}
+	if restore := clientMsg.GetRestoreOrJoinSession(); restore != nil {
+		sess.handleRestore(restore)
+		return true
+	}
+	if clientMsg.GetLogoff() != nil {
+		sess.write(&pb.ServerMsg{
+			LoggedOff: &pb.LoggedOff{
+				LogoffReason: proto.Uint32(uint32(pb.LoggedOff_LOGOFF_REASON_BY_REQUEST)),
+			},
+		})
+		return false
+	}
+	if ping := clientMsg.GetPing(); ping != nil {
+		sess.write(&pb.ServerMsg{
+			Pong: &pb.Pong{
+				Token:       proto.String(ping.GetToken()),
+				PingUtcTime: proto.Int64(ping.GetPingUtcTime()),
+				PongUtcTime: proto.Int64(sess.server.serverTime(time.Now())),
+			},
+		})
+	}
+
+	// Everything else requires a logged on session
+	if !sess.loggedOn() {
+		return true
+	}
+
+	for _, req := range clientMsg.GetInformationRequests() {
+		sess.handleInformationRequest(req)
+	}
+	for _, sub := range clientMsg.GetMarketDataSubscriptions() {
+		sess.handleMarketDataSubscription(sub)
+	}
+	for _, req := range clientMsg.GetTimeBarRequests() {
+		sess.handleTimeBarRequest(req)
+	}
+	for _, req := range clientMsg.GetTimeAndSalesRequests() {
+		sess.handleTimeAndSalesRequest(req)
+	}
+	for _, req := range clientMsg.GetNonTimedBarRequests() {
+		sess.handleNonTimedBarRequest(req)
+	}
+	for _, req := range clientMsg.GetVolumeProfileRequests() {
+		sess.handleVolumeProfileRequest(req)
+	}
+
+	return true
+}
+
+// handleLogon checks the credentials and starts a new session
+func (sess *session) handleLogon(logon *pb.Logon) {
+	s := sess.server
+	result := &pb.LogonResult{
+		ResultCode:           proto.Uint32(uint32(pb.LogonResult_RESULT_CODE_SUCCESS)),
+		BaseTime:             proto.String(s.baseTime.Format(baseTimeLayout)),
+		ProtocolVersionMajor: proto.Uint32(logon.GetProtocolVersionMajor()),
+		ProtocolVersionMinor: proto.Uint32(logon.GetProtocolVersionMinor()),
+		ServerTime:           proto.Int64(s.serverTime(time.Now())),
+	}
+
+	validUser := logon.GetUserName() != ""
+	if s.UserName != "" || s.Password != "" {
+		validUser = logon.GetUserName() == s.UserName && logon.GetPassword() == s.Password
+	}
+
+	if !validUser {
+		result.ResultCode = proto.Uint32(uint32(pb.LogonResult_RESULT_CODE_FAILURE))
+		result.TextMessage = proto.String("Invalid user name or password")
+	} else {
+		s.mu.Lock()
+		token := "fake-session-" + strconv.Itoa(len(s.tokens)+1)
+		s.tokens[token] = true
+		s.mu.Unlock()
+
+		sess.mu.Lock()
+		sess.token = token
+		sess.mu.Unlock()
+
+		result.SessionToken = proto.String(token)
+		result.TextMessage = proto.String("Logged on to fake CQG server")
+	}
+
+	sess.write(&pb.ServerMsg{LogonResult: result})
+}
+
+// handleRestore rejoins a session dropped by DropConnections
+func (sess *session) handleRestore(restore *pb.RestoreOrJoinSession) {
+	s := sess.server
+	result := &pb.RestoreOrJoinSessionResult{
+		ResultCode: proto.Uint32(uint32(pb.RestoreOrJoinSessionResult_RESULT_CODE_SUCCESS)),
+		BaseTime:   proto.String(s.baseTime.Format(baseTimeLayout)),
+		ServerTime: proto.Int64(s.serverTime(time.Now())),
+	}
+
+	s.mu.Lock()
+	known := s.tokens[restore.GetSessionToken()]
+	s.mu.Unlock()
+
+	if known {
+		sess.mu.Lock()
+		sess.token = restore.GetSessionToken()
+		sess.mu.Unlock()
+	} else {
+		result.ResultCode = proto.Uint32(uint32(pb.RestoreOrJoinSessionResult_RESULT_CODE_UNKNOWN_SESSION))
+		result.TextMessage = proto.String("Unknown session token")
+	}
+
+	sess.write(&pb.ServerMsg{RestoreOrJoinSessionResult: result})
+}
+
+// handleInformationRequest answers symbol resolution and trading day requests
+func (sess *session) handleInformationRequest(req *pb.InformationRequest) {
+	report := &pb.InformationReport{
+		Id:         proto.Uint32(req.GetId()),
+		StatusCode: proto.Uint32(uint32(pb.InformationReport_STATUS_CODE_SUCCESS)),
+	}
+
+	if days := req.GetTradingDayTimerangeRequest(); days != nil {
+		report.TradingDayTimerangeReport = sess.server.tradingDayReport(days)
+		sess.write(&pb.ServerMsg{InformationReports: []*pb.InformationReport{report}})
+		return
+	}
+
+	resolution := req.GetSymbolResolutionRequest()
+	if resolution == nil && req.Subscribe != nil && !req.GetSubscribe() {
+		// Cancelling a subscription needs nothing but its ID
+		report.StatusCode = proto.Uint32(uint32(pb.InformationReport_STATUS_CODE_DROPPED))
+		sess.write(&pb.ServerMsg{InformationReports: []*pb.InformationReport{report}})
+		return
+	}
+	if resolution == nil {
+		report.StatusCode = proto.Uint32(uint32(pb.InformationReport_STATUS_CODE_INVALID_PARAMS))
+		report.TextMessage = proto.String("Only symbol resolution and trading days are supported by the fake server")
+		sess.write(&pb.ServerMsg{InformationReports: []*pb.InformationReport{report}})
+		return
+	}
+
+	contract, ok := sess.server.resolve(resolution.GetSymbol())
+	if !ok {
+		report.StatusCode = proto.Uint32(uint32(pb.InformationReport_STATUS_CODE_NOT_FOUND))
+		report.TextMessage = proto.String("Unknown symbol " + resolution.GetSymbol())
+		sess.write(&pb.ServerMsg{InformationReports: []*pb.InformationReport{report}})
+		return
+	}
+
+	if req.GetSubscribe() {
+		report.StatusCode = proto.Uint32(uint32(pb.InformationReport_STATUS_CODE_SUBSCRIBED))
+	}
+	report.SymbolResolutionReport = &pb.SymbolResolutionReport{
+		ContractMetadata: contract.metadata(),
+	}
+	sess.write(&pb.ServerMsg{InformationReports: []*pb.InformationReport{report}})
+}
+
+// tradeLevelOrder ranks the market data levels that include trades by the data they add
+var tradeLevelOrder = map[uint32]int{
+	uint32(pb.MarketDataSubscription_LEVEL_TRADES):                  1,
+	uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA):              2,
+	uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_VOLUMES):      3,
+	uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DOM):          4,
+	uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DETAILED_DOM): 5,
+}
+
+// handleMarketDataSubscription starts, changes or stops the feed of a contract
+func (sess *session) handleMarketDataSubscription(sub *pb.MarketDataSubscription) {
+	contractID := sub.GetContractId()
+	level := sub.GetLevel()
+
+	status := &pb.MarketDataSubscriptionStatus{
+		ContractId: proto.Uint32(contractID),
+		StatusCode: proto.Uint32(uint32(pb.MarketDataSubscriptionStatus_STATUS_CODE_SUCCESS)),
+		Level:      proto.Uint32(level),
+		RequestId:  proto.Uint32(sub.GetRequestId()),
+	}
+
+	contract := sess.server.contractByID(contractID)
+	if contract == nil {
+		status.StatusCode = proto.Uint32(uint32(pb.MarketDataSubscriptionStatus_STATUS_CODE_INVALID_PARAMS))
+		status.TextMessage = proto.String("Unknown contract ID")
+		sess.write(&pb.ServerMsg{MarketDataSubscriptionStatuses: []*pb.MarketDataSubscriptionStatus{status}})
+		return
+	}
+
+	// Lower the level to the user's entitlement
+	if max := sess.server.MaxLevel; max != 0 && tradeLevelOrder[level] > tradeLevelOrder[max] && tradeLevelOrder[max] > 0 {
+		level = max
+		status.Level = proto.Uint32(level)
+	}
+
+	// Replace any running feed; level NONE only stops it
+	sess.mu.Lock()
+	if stop, ok := sess.feeds[contractID]; ok {
+		close(stop)
+		delete(sess.feeds, contractID)
+	}
+	var stop chan struct{}
+	if level != uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+		stop = make(chan struct{})
+		sess.feeds[contractID] = stop
+	}
+	sess.mu.Unlock()
+
+	sess.write(&pb.ServerMsg{MarketDataSubscriptionStatuses: []*pb.MarketDataSubscriptionStatus{status}})
+
+	if stop != nil {
+		go sess.runFeed(contract, level, stop)
+	}
+}
+
+// handleTimeBarRequest answers GET, SUBSCRIBE and DROP time bar requests
+func (sess *session) handleTimeBarRequest(req *pb.TimeBarRequest) {
+	requestID := req.GetRequestId()
+
+	if req.GetRequestType() == uint32(pb.TimeBarRequest_REQUEST_TYPE_DROP) {
+		sess.mu.Lock()
+		if stop, ok := sess.bars[requestID]; ok {
+			close(stop)
+			delete(sess.bars, requestID)
+		}
+		sess.mu.Unlock()
+
+		sess.write(&pb.ServerMsg{TimeBarReports: []*pb.TimeBarReport{{
+			RequestId:        proto.Uint32(requestID),
+			StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DROPPED)),
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	params := req.GetTimeBarParameters()
+	contract := sess.server.contractByID(params.GetContractId())
+	if contract == nil {
+		sess.write(&pb.ServerMsg{TimeBarReports: []*pb.TimeBarReport{{
+			RequestId:        proto.Uint32(requestID),
+			StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_NOT_FOUND)),
+			TextMessage:      proto.String("Unknown contract ID"),
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	subscribe := req.GetRequestType() == uint32(pb.TimeBarRequest_REQUEST_TYPE_SUBSCRIBE)
+	for _, report := range sess.server.timeBarReports(contract, req, subscribe) {
+		sess.write(&pb.ServerMsg{TimeBarReports: []*pb.TimeBarReport{report}})
+	}
+
+	if subscribe {
+		stop := make(chan struct{})
+		sess.mu.Lock()
+		sess.bars[requestID] = stop
+		sess.mu.Unlock()
+
+		go sess.runBarUpdates(contract, req, stop)
+	}
+}
+
+// handleTimeAndSalesRequest answers GET and DROP time and sales requests. A GET is
+// answered in full right away, so a DROP only confirms it.
+func (sess *session) handleTimeAndSalesRequest(req *pb.TimeAndSalesRequest) {
+	requestID := req.GetRequestId()
+
+	if req.GetRequestType() == uint32(pb.TimeAndSalesRequest_REQUEST_TYPE_DROP) {
+		sess.write(&pb.ServerMsg{TimeAndSalesReports: []*pb.TimeAndSalesReport{{
+			RequestId:        proto.Uint32(requestID),
+			ResultCode:       proto.Uint32(uint32(pb.TimeAndSalesReport_RESULT_CODE_DROPPED)),
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	contract := sess.server.contractByID(req.GetTimeAndSalesParameters().GetContractId())
+	if contract == nil {
+		sess.write(&pb.ServerMsg{TimeAndSalesReports: []*pb.TimeAndSalesReport{{
+			RequestId:        proto.Uint32(requestID),
+			ResultCode:       proto.Uint32(uint32(pb.TimeAndSalesReport_RESULT_CODE_NOT_FOUND)),
+			Details:          &shared.Text{Text: proto.String("Unknown contract ID")},
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	for _, report := range sess.server.timeAndSalesReports(contract, req) {
+		sess.write(&pb.ServerMsg{TimeAndSalesReports: []*pb.TimeAndSalesReport{report}})
+	}
+}
+
+// handleNonTimedBarRequest answers GET, SUBSCRIBE and DROP requests for tick, range,
+// Renko, constant volume and point-and-figure bars
+func (sess *session) handleNonTimedBarRequest(req *pb.NonTimedBarRequest) {
+	requestID := req.GetRequestId()
+
+	if req.GetRequestType() == uint32(pb.NonTimedBarRequest_REQUEST_TYPE_DROP) {
+		sess.mu.Lock()
+		if stop, ok := sess.bars[requestID]; ok {
+			close(stop)
+			delete(sess.bars, requestID)
+		}
+		sess.mu.Unlock()
+
+		sess.write(&pb.ServerMsg{NonTimedBarReports: []*pb.NonTimedBarReport{{
+			RequestId:        proto.Uint32(requestID),
+			StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DROPPED)),
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	contract := sess.server.contractByID(req.GetContractId())
+	if contract == nil {
+		sess.write(&pb.ServerMsg{NonTimedBarReports: []*pb.NonTimedBarReport{{
+			RequestId:        proto.Uint32(requestID),
+			StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_NOT_FOUND)),
+			Details:          &shared.Text{Text: proto.String("Unknown contract ID")},
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	statusCode := uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_SUCCESS)
+	subscribe := req.GetRequestType() == uint32(pb.NonTimedBarRequest_REQUEST_TYPE_SUBSCRIBE)
+	if subscribe {
+		statusCode = uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_SUBSCRIBED)
+	}
+	for _, report := range sess.server.nonTimedBarReports(contract, req, statusCode) {
+		sess.write(&pb.ServerMsg{NonTimedBarReports: []*pb.NonTimedBarReport{report}})
+	}
+
+	if subscribe {
+		stop := make(chan struct{})
+		sess.mu.Lock()
+		sess.bars[requestID] = stop
+		sess.mu.Unlock()
+
+		go sess.runNonTimedBarUpdates(contract, req, stop)
+	}
+}
+
+// handleVolumeProfileRequest answers GET and DROP volume profile requests. A GET is
+// answered in full right away, so a DROP only confirms it.
+func (sess *session) handleVolumeProfileRequest(req *pb.VolumeProfileRequest) {
+	requestID := req.GetRequestId()
+
+	if req.GetRequestType() == uint32(pb.VolumeProfileRequest_REQUEST_TYPE_DROP) {
+		sess.write(&pb.ServerMsg{VolumeProfileReports: []*pb.VolumeProfileReport{{
+			RequestId:        proto.Uint32(requestID),
+			ResultCode:       proto.Uint32(uint32(pb.VolumeProfileReport_RESULT_CODE_DROPPED)),
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	contract := sess.server.contractByID(req.GetVolumeProfileParameters().GetContractId())
+	if contract == nil {
+		sess.write(&pb.ServerMsg{VolumeProfileReports: []*pb.VolumeProfileReport{{
+			RequestId:        proto.Uint32(requestID),
+			ResultCode:       proto.Uint32(uint32(pb.VolumeProfileReport_RESULT_CODE_NOT_FOUND)),
+			Details:          &shared.Text{Text: proto.String("Unknown contract ID")},
+			IsReportComplete: proto.Bool(true),
+		}}})
+		return
+	}
+
+	for _, report := range sess.server.volumeProfileReports(contract, req) {
+		sess.write(&pb.ServerMsg{VolumeProfileReports: []*pb.VolumeProfileReport{report}})
+	}
+}
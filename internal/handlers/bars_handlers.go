@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-websocket/internal/client"
+	"go-websocket/internal/marketdata"
+	pb "go-websocket/proto/WebAPI"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// defaultBarCount is the number of non-timed bars sent when no count is given
+const defaultBarCount = 500
+
+// RegisterBarsHandler registers the WebSocket endpoint for non-timed bars
+func RegisterBarsHandler(app *fiber.App, deps *Deps) {
+	app.Get("/bars", websocket.New(func(c *websocket.Conn) {
+		handleBars(c, deps)
+	}))
+}
+
+// barsPage is a page of non-timed bars tagged with the symbol it belongs to
+type barsPage struct {
+	*marketdata.Bars
+	Symbol string `json:"symbol"`
+}
+
+// barsRequest holds the query parameters of a non-timed bar request
+type barsRequest struct {
+	barType       string
+	r             client.BarRange
+	size          uint32 // Range or brick size, or P&F box size, in ticks
+	startPoint    uint32
+	maxNullBricks uint32
+	reversal      uint32
+	volume        int64
+	tickVolume    bool
+	flatTicks     bool
+}
+
+// handleBars streams tick, range, Renko, constant volume or point-and-figure bars of a
+// symbol. The count query parameter gives the number of bars before to, an RFC 3339
+// time, or before now; live=true keeps streaming updates until the client disconnects,
+// otherwise the socket is closed once the last page was sent.
+func handleBars(c *websocket.Conn, deps *Deps) {
+	symbol := c.Query("symbol")
+	if symbol == "" || c.Query("barType") == "" {
+		c.WriteJSON(fiber.Map{"error": "Required parameters missing"})
+		c.Close()
+		return
+	}
+
+	req, err := parseBarsRequest(c)
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+		c.Close()
+		return
+	}
+	location, err := marketdata.ParseZone(c.Query("tz"), deps.Config.Location)
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+		c.Close()
+		return
+	}
+
+	// Upstream work for this connection is cancelled when the browser disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer watchClient(c, cancel)()
+
+	acquireCtx, acquireCancel := deps.upstreamContext(ctx)
+	defer acquireCancel()
+
+	// Borrow the shared CQG session
+	cqgClient, err := deps.Sessions.Acquire(acquireCtx, deps.credentials())
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": "Connection failed: " + err.Error()})
+		c.Close()
+		return
+	}
+
+	stream := &barsStream{c: c, deps: deps, cqgClient: cqgClient, symbol: symbol, req: req}
+	if err := stream.run(ctx, location); err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+	}
+	c.Close()
+}
+
+// parseBarsRequest reads the bar type and its parameters from the query
+func parseBarsRequest(c *websocket.Conn) (*barsRequest, error) {
+	barType, err := marketdata.ParseBarType(c.Query("barType"))
+	if err != nil {
+		return nil, err
+	}
+	req := &barsRequest{
+		barType:    barType,
+		tickVolume: c.Query("tickVolume") == "true",
+		flatTicks:  c.Query("flatTicks") == "true",
+	}
+
+	count, err := queryUint(c, "count", defaultBarCount)
+	if err != nil {
+		return nil, err
+	}
+	req.r.Count = count
+	req.r.Subscribe = c.Query("live") == "true"
+	if value := c.Query("to"); value != "" {
+		if req.r.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, fmt.Errorf("invalid to time")
+		}
+	}
+	if req.r.TickTypes, err = marketdata.ParseBarTickTypes(c.Query("tickTypes")); err != nil {
+		return nil, err
+	}
+
+	switch barType {
+	case marketdata.BarTypeRange, marketdata.BarTypeRenko:
+		if req.size, err = queryUint(c, "size", 0); err != nil {
+			return nil, err
+		}
+		if req.startPoint, err = marketdata.ParseBarStartPoint(c.Query("start")); err != nil {
+			return nil, err
+		}
+		if req.maxNullBricks, err = queryUint(c, "maxNullBricks", 0); err != nil {
+			return nil, err
+		}
+		if req.size == 0 {
+			return nil, fmt.Errorf("size is required for %s bars", barType)
+		}
+	case marketdata.BarTypeVolume:
+		volume, err := queryUint(c, "volume", 0)
+		if err != nil {
+			return nil, err
+		}
+		if volume == 0 {
+			return nil, fmt.Errorf("volume is required for volume bars")
+		}
+		req.volume = int64(volume)
+	case marketdata.BarTypePnF:
+		if req.size, err = queryUint(c, "box", 0); err != nil {
+			return nil, err
+		}
+		if req.reversal, err = queryUint(c, "reversal", 3); err != nil {
+			return nil, err
+		}
+		if req.size == 0 || req.reversal == 0 {
+			return nil, fmt.Errorf("box and reversal are required for pnf bars")
+		}
+	}
+	return req, nil
+}
+
+// queryUint reads an optional unsigned query parameter
+func queryUint(c *websocket.Conn, name string, fallback uint32) (uint32, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return uint32(n), nil
+}
+
+// barsStream sends the non-timed bars of one symbol to a client
+type barsStream struct {
+	c         *websocket.Conn
+	deps      *Deps
+	cqgClient *client.CQGClient
+	symbol    string
+	req       *barsRequest
+
+	contractID uint32
+	decoder    *marketdata.BarsDecoder
+	sent       uint32 // Bars of the snapshot sent so far
+	complete   bool   // The snapshot was sent
+}
+
+// run resolves the symbol and streams its bars until the snapshot was sent, or for
+// live bars until ctx is done, or the request failed
+func (s *barsStream) run(ctx context.Context, location *time.Location) error {
+	setupCtx, setupCancel := s.deps.upstreamContext(ctx)
+	defer setupCancel()
+
+	// Resolve symbol to contract ID; no real-time subscription is needed
+	contractID, err := s.cqgClient.ResolveSymbol(setupCtx, s.symbol, false)
+	if err != nil {
+		return err
+	}
+	s.contractID = contractID
+
+	metadata := s.cqgClient.ContractMetadata(contractID)
+	if location == nil {
+		var ok bool
+		if location, ok = marketdata.ExchangeLocation(metadata); !ok {
+			log.Printf("time zone of exchange %q unknown, using %s", metadata.GetMic(), s.deps.Config.Location)
+			location = s.deps.Config.Location
+		}
+	}
+	s.decoder = marketdata.NewBarsDecoder(s.req.barType, marketdata.NewPriceFormat(metadata), s.cqgClient.Time, location)
+
+	listener, err := s.request(setupCtx, s.req.r)
+	if err != nil {
+		return err
+	}
+	setupCancel()
+
+	for {
+		done, err := s.receive(ctx, listener)
+		listener.Close()
+		if done || err != nil {
+			return err
+		}
+
+		// A request in flight when the connection dropped is not answered after the
+		// reconnect; ask again for the bars older than the last one sent
+		r := s.req.r
+		if s.sent >= r.Count {
+			// Every bar asked for was sent
+			return nil
+		}
+		if last, index := s.decoder.Last(); !last.IsZero() {
+			r.To, r.ToIndex = last, index
+			r.Count -= s.sent
+		}
+		retryCtx, retryCancel := s.deps.upstreamContext(ctx)
+		listener, err = s.request(retryCtx, r)
+		retryCancel()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// request sends the request for the bar type
+func (s *barsStream) request(ctx context.Context, r client.BarRange) (*client.Listener, error) {
+	req := s.req
+	switch req.barType {
+	case marketdata.BarTypeRange:
+		return s.cqgClient.RequestRangeBars(ctx, s.contractID, r, req.size, req.startPoint)
+	case marketdata.BarTypeRenko:
+		return s.cqgClient.RequestRenkoBars(ctx, s.contractID, r, req.size, req.maxNullBricks, req.startPoint)
+	case marketdata.BarTypeVolume:
+		return s.cqgClient.RequestConstantVolumeBars(ctx, s.contractID, r, req.volume, req.tickVolume, req.flatTicks)
+	case marketdata.BarTypePnF:
+		return s.cqgClient.RequestPointAndFigureBars(ctx, s.contractID, r, req.size, req.reversal)
+	default:
+		return s.cqgClient.RequestTickBars(ctx, s.contractID, r, req.flatTicks)
+	}
+}
+
+// receive handles the reports and notices of one request. It reports done once the
+// bars are sent or can no longer be sent, and not done when the request has to be made
+// again after a reconnect. Subscriptions are resubmitted by the client itself.
+func (s *barsStream) receive(ctx context.Context, listener *client.Listener) (bool, error) {
+	notices := listener.Notices
+	for {
+		select {
+		case <-ctx.Done():
+			if s.req.r.Subscribe || !s.complete {
+				// Stop CQG from sending more bars
+				s.drop(listener.RequestID)
+			}
+			return true, nil
+		case notice, ok := <-notices:
+			if !ok {
+				notices = nil
+				continue
+			}
+			s.c.WriteJSON(createConnectionNotice(notice, s.symbol))
+			if notice.State == client.StateReconnected && !s.req.r.Subscribe && !s.complete {
+				return false, nil
+			}
+		case serverMsg, ok := <-listener.C:
+			if !ok && errors.Is(listener.Err(), client.ErrListenerOverflow) {
+				// Bars were lost; make the request again, live bars from a new snapshot
+				s.drop(listener.RequestID)
+				if s.req.r.Subscribe {
+					s.restart()
+				}
+				return false, nil
+			}
+			if !ok {
+				// Upstream connection closed before the request completed
+				return true, fmt.Errorf("connection closed before the bars were received")
+			}
+			for _, report := range serverMsg.GetNonTimedBarReports() {
+				if done, err := s.handleReport(report); done || err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// drop stops CQG from sending more bars for a request
+func (s *barsStream) drop(requestID uint32) {
+	dropCtx, dropCancel := s.deps.upstreamContext(context.Background())
+	defer dropCancel()
+	if err := s.cqgClient.DropNonTimedBars(dropCtx, requestID); err != nil {
+		log.Println("drop error:", err)
+	}
+}
+
+// restart forgets the bars sent so far, so that the request is made again in full, and
+// tells the client a new snapshot follows
+func (s *barsStream) restart() {
+	s.decoder.Reset()
+	s.sent = 0
+	s.complete = false
+	s.c.WriteJSON(fiber.Map{
+		"type":   "bars_status",
+		"symbol": s.symbol,
+		"status": "restarted",
+	})
+}
+
+// handleReport sends a page of bars to the client and reports whether the request is
+// finished
+func (s *barsStream) handleReport(report *pb.NonTimedBarReport) (bool, error) {
+	switch code := report.GetStatusCode(); {
+	case code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DISCONNECTED):
+		// CQG resumes the request by itself once its data source is back
+		s.c.WriteJSON(fiber.Map{
+			"type":   "bars_status",
+			"symbol": s.symbol,
+			"status": marketdata.BarStatus(code),
+		})
+		return false, nil
+	case code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DROPPED):
+		return true, nil
+	case code >= uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_FAILURE):
+		return true, fmt.Errorf("bar request failed: %s (%s)", report.GetDetails().GetText(), marketdata.BarStatus(code))
+	}
+
+	page := s.decoder.Decode(s.contractID, report)
+	if err := s.c.WriteJSON(barsPage{Bars: page, Symbol: s.symbol}); err != nil {
+		log.Println("write error:", err)
+		return true, nil
+	}
+	if !s.complete {
+		s.sent += uint32(len(page.Bars))
+		s.complete = page.Complete
+		if s.complete {
+			log.Println("Bars complete")
+		}
+	}
+
+	// Live bars keep coming until the client leaves, unless CQG stopped updating them
+	stopped := page.InvalidatedFrom != "" && page.InvalidatedTo == ""
+	return s.complete && (!s.req.r.Subscribe || stopped), nil
+}
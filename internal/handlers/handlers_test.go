@@ -0,0 +1,629 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-websocket/internal/client"
+	"go-websocket/internal/config"
+	"go-websocket/internal/fakecqg"
+	"go-websocket/internal/marketdata"
+	"go-websocket/internal/services"
+	pb "go-websocket/proto/WebAPI"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// testTimeout bounds every wait for a message in these tests
+const testTimeout = 10 * time.Second
+
+// testServer is the HTTP server of the handlers connected to a fake CQG server
+type testServer struct {
+	fake *fakecqg.Server
+	url  string // ws:// address of the handlers
+
+	mu       sync.Mutex
+	received []*pb.ClientMsg // Messages the fake server received
+}
+
+// newTestServer starts a fake CQG server and the handlers using it. PocketBase is
+// replaced by a server accepting every record.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ts := &testServer{fake: fakecqg.NewServer()}
+	ts.fake.TickInterval = 20 * time.Millisecond
+	ts.fake.Handler = func(clientMsg *pb.ClientMsg) ([]*pb.ServerMsg, bool) {
+		ts.mu.Lock()
+		ts.received = append(ts.received, clientMsg)
+		ts.mu.Unlock()
+		return nil, false
+	}
+	if err := ts.fake.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.fake.Close() })
+
+	pocketBase := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"record"}`))
+	}))
+	t.Cleanup(pocketBase.Close)
+
+	cfg := &config.Config{
+		PocketBaseURL: pocketBase.URL,
+		TimeZone:      "UTC",
+		Location:      time.UTC,
+		BarCacheDir:   t.TempDir(),
+		CQG: config.CQGConfig{
+			HostName:             ts.fake.URL,
+			UserName:             "user",
+			Password:             "password",
+			ClientAppId:          "test",
+			ClientVersion:        "1",
+			ProtocolVersionMajor: 2,
+		},
+		Timeouts: config.Timeouts{
+			Upstream:   testTimeout,
+			Reconnect:  testTimeout,
+			Heartbeat:  time.Minute,
+			PocketBase: time.Second,
+		},
+	}
+	store := services.NewPocketBase(cfg.PocketBaseURL, cfg.Timeouts.PocketBase)
+	deps := &Deps{
+		Config:   cfg,
+		Sessions: client.NewSessionManager(cfg),
+		Store:    store,
+		Hub:      marketdata.NewHub(cfg, store),
+		Bars:     marketdata.NewBarCache(cfg.BarCacheDir),
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		deps.Sessions.CloseAll(ctx)
+	})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	RegisterRealtimeHandler(app, deps)
+	RegisterHistoricalHandler(app, deps)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { app.Shutdown() })
+
+	ts.url = "ws://" + listener.Addr().String()
+	return ts
+}
+
+// dial opens a WebSocket to an endpoint of the handlers
+func (ts *testServer) dial(t *testing.T, path string, query url.Values) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(ts.url+path+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitReceived waits until the fake server received a message matching match
+func (ts *testServer) waitReceived(t *testing.T, what string, match func(*pb.ClientMsg) bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		ts.mu.Lock()
+		for _, clientMsg := range ts.received {
+			if match(clientMsg) {
+				ts.mu.Unlock()
+				return
+			}
+		}
+		ts.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("fake server never received %s", what)
+}
+
+// readUntil reads JSON messages until one matches match and returns it
+func readUntil(t *testing.T, conn *websocket.Conn, what string, match func(map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", what, err)
+		}
+		if errMsg, ok := msg["error"]; ok && msg["type"] == nil {
+			t.Fatalf("waiting for %s: error %v", what, errMsg)
+		}
+		if match(msg) {
+			return msg
+		}
+	}
+}
+
+// isType matches messages of a type
+func isType(eventType string) func(map[string]interface{}) bool {
+	return func(msg map[string]interface{}) bool {
+		return msg["type"] == eventType
+	}
+}
+
+// hasTrades matches market data updates carrying trades
+func hasTrades(msg map[string]interface{}) bool {
+	trades, ok := msg["trades"].([]interface{})
+	return ok && len(trades) > 0
+}
+
+func TestRealtimeSubscribeAndUnsubscribe(t *testing.T) {
+	ts := newTestServer(t)
+	conn := ts.dial(t, "/realtime", url.Values{"symbol": {"ZUC"}, "level": {"trades_bba"}})
+
+	status := readUntil(t, conn, "subscription status", isType(marketdata.SubscriptionStatusType))
+	if status["symbol"] != "ZUC" || status["status"] != "success" {
+		t.Fatalf("unexpected subscription status: %v", status)
+	}
+	update := readUntil(t, conn, "trades", hasTrades)
+	if update["symbol"] != "ZUC" {
+		t.Fatalf("update of symbol %v", update["symbol"])
+	}
+
+	// Further symbols are added by command
+	if err := conn.WriteJSON(map[string]string{"command": "subscribe", "symbol": "EUC", "level": "trades"}); err != nil {
+		t.Fatal(err)
+	}
+	subscribed := readUntil(t, conn, "subscription", isType("subscribed"))
+	subscription := subscribed["subscription"].(map[string]interface{})
+	if subscription["symbol"] != "EUC" || subscription["level_name"] != "trades" {
+		t.Fatalf("unexpected subscription: %v", subscription)
+	}
+
+	if err := conn.WriteJSON(map[string]string{"command": "unsubscribe", "symbol": "ZUC"}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "unsubscribe confirmation", isType("unsubscribed"))
+
+	// The market data and the metadata subscription are both cancelled upstream
+	ts.waitReceived(t, "market data unsubscription", func(clientMsg *pb.ClientMsg) bool {
+		for _, sub := range clientMsg.GetMarketDataSubscriptions() {
+			if sub.GetLevel() == uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+				return true
+			}
+		}
+		return false
+	})
+	ts.waitReceived(t, "metadata unsubscription", func(clientMsg *pb.ClientMsg) bool {
+		for _, req := range clientMsg.GetInformationRequests() {
+			if req.Subscribe != nil && !req.GetSubscribe() {
+				return true
+			}
+		}
+		return false
+	})
+
+	if err := conn.WriteJSON(map[string]string{"command": "list"}); err != nil {
+		t.Fatal(err)
+	}
+	list := readUntil(t, conn, "subscription list", isType("subscriptions"))
+	subscriptions := list["subscriptions"].([]interface{})
+	if len(subscriptions) != 1 || subscriptions[0].(map[string]interface{})["symbol"] != "EUC" {
+		t.Fatalf("unexpected subscriptions: %v", subscriptions)
+	}
+}
+
+func TestRealtimeRejectsUnknownCommand(t *testing.T) {
+	ts := newTestServer(t)
+	conn := ts.dial(t, "/realtime", url.Values{})
+
+	if err := conn.WriteJSON(map[string]string{"command": "resubscribe", "symbol": "ZUC"}); err != nil {
+		t.Fatal(err)
+	}
+	reply := readUntil(t, conn, "command error", isType("error"))
+	if reply["command"] != "resubscribe" || reply["error"] != `Unknown command "resubscribe"` {
+		t.Fatalf("unexpected reply: %v", reply)
+	}
+}
+
+func TestRealtimeSurvivesReconnect(t *testing.T) {
+	ts := newTestServer(t)
+	conn := ts.dial(t, "/realtime", url.Values{"symbol": {"EUC"}})
+	readUntil(t, conn, "trades", hasTrades)
+
+	ts.fake.DropConnections()
+
+	gap := func(state client.ConnectionState) func(map[string]interface{}) bool {
+		return func(msg map[string]interface{}) bool {
+			return msg["type"] == "gap" && msg["state"] == string(state)
+		}
+	}
+	readUntil(t, conn, "disconnect notice", gap(client.StateDisconnected))
+	reconnected := readUntil(t, conn, "reconnect notice", gap(client.StateReconnected))
+	if reconnected["session_restored"] != true {
+		t.Errorf("session was not restored: %v", reconnected)
+	}
+	readUntil(t, conn, "trades after the reconnect", hasTrades)
+}
+
+func TestRealtimeRejectsUnknownZone(t *testing.T) {
+	ts := newTestServer(t)
+	conn := ts.dial(t, "/realtime", url.Values{"tz": {"Nowhere/Nothing"}})
+
+	var msg map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["error"] == nil {
+		t.Fatalf("expected an error, got %v", msg)
+	}
+}
+
+func TestContractLocationFallback(t *testing.T) {
+	configured := time.FixedZone("configured", 3600)
+	s := newRealtimeSession(nil, &Deps{Config: &config.Config{Location: configured}}, &client.CQGClient{}, nil)
+
+	// Without metadata naming a known exchange the configured zone is used
+	if location := s.contractLocation(1); location != configured {
+		t.Errorf("contractLocation = %v, want the configured zone", location)
+	}
+
+	s.location = time.UTC
+	if location := s.contractLocation(1); location != time.UTC {
+		t.Errorf("contractLocation = %v, want the session zone", location)
+	}
+}
+
+// readHistorical reads the pages of a historical response and returns its bars and
+// the last page
+func readHistorical(t *testing.T, conn *websocket.Conn) ([]map[string]interface{}, map[string]interface{}) {
+	t.Helper()
+	var bars []map[string]interface{}
+	for {
+		page := readUntil(t, conn, "historical page", func(msg map[string]interface{}) bool {
+			_, ok := msg["is_report_complete"]
+			return ok
+		})
+		pageBars, _ := page["bars"].([]interface{})
+		for _, bar := range pageBars {
+			bars = append(bars, bar.(map[string]interface{}))
+		}
+		if page["is_report_complete"] == true {
+			return bars, page
+		}
+	}
+}
+
+// readError reads the next message and returns its error
+func readError(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	var msg map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	errMsg, ok := msg["error"].(string)
+	if !ok {
+		t.Fatalf("expected an error, got %v", msg)
+	}
+	return errMsg
+}
+
+// timeBarRequest waits for the first time bar request the fake server received
+func (ts *testServer) timeBarRequest(t *testing.T) *pb.TimeBarParameters {
+	t.Helper()
+	var params *pb.TimeBarParameters
+	ts.waitReceived(t, "time bar request", func(clientMsg *pb.ClientMsg) bool {
+		for _, req := range clientMsg.GetTimeBarRequests() {
+			if req.GetTimeBarParameters() != nil {
+				params = req.GetTimeBarParameters()
+				return true
+			}
+		}
+		return false
+	})
+	return params
+}
+
+// timeBarGets returns the time bar GET requests the fake server received
+func (ts *testServer) timeBarGets() []*pb.TimeBarRequest {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var gets []*pb.TimeBarRequest
+	for _, clientMsg := range ts.received {
+		for _, req := range clientMsg.GetTimeBarRequests() {
+			if req.GetRequestType() == uint32(pb.TimeBarRequest_REQUEST_TYPE_GET) {
+				gets = append(gets, req)
+			}
+		}
+	}
+	return gets
+}
+
+func TestHistoricalBars(t *testing.T) {
+	ts := newTestServer(t)
+	query := url.Values{
+		"symbol":  {"EUC"},
+		"barType": {"hourly"},
+		"period":  {"day"},
+		"number":  {"1"},
+	}
+	conn := ts.dial(t, "/historical", query)
+
+	if bars, _ := readHistorical(t, conn); len(bars) == 0 {
+		t.Fatal("no bars received")
+	}
+
+	// A period back from now runs up to now
+	params := ts.timeBarRequest(t)
+	from := ts.fake.BaseTime().Add(time.Duration(params.GetFromUtcTime()) * time.Millisecond)
+	to := ts.fake.BaseTime().Add(time.Duration(params.GetToUtcTime()) * time.Millisecond)
+	if since := time.Since(from); since < 24*time.Hour || since > 25*time.Hour || time.Since(to) > time.Minute {
+		t.Errorf("requested from %v to %v, want a day back up to now", from, to)
+	}
+}
+
+func TestHistoricalFromCache(t *testing.T) {
+	ts := newTestServer(t)
+	query := url.Values{
+		"symbol":  {"EUC"},
+		"barType": {"hourly"},
+		"from":    {time.Now().UTC().Add(-5 * time.Hour).Format(time.RFC3339)},
+	}
+
+	first, page := readHistorical(t, ts.dial(t, "/historical", query))
+	if len(first) < 5 {
+		t.Fatalf("got %d bars, want at least 5", len(first))
+	}
+	if gaps, _ := page["gaps"].([]interface{}); len(gaps) > 0 {
+		t.Errorf("unexpected gaps: %v", gaps)
+	}
+	for i := 1; i < len(first); i++ {
+		if first[i]["bar_utc_time"].(float64) >= first[i-1]["bar_utc_time"].(float64) {
+			t.Fatalf("bars are not newest first: %v", first)
+		}
+	}
+	gets := ts.timeBarGets()
+	if len(gets) != 1 {
+		t.Fatalf("first request made %d time bar requests, want 1", len(gets))
+	}
+
+	// Closed bars come from the cache; only the bar still open is asked for again
+	second, _ := readHistorical(t, ts.dial(t, "/historical", query))
+	if len(second) != len(first) {
+		t.Fatalf("second request got %d bars, want %d", len(second), len(first))
+	}
+	for i := 1; i < len(first); i++ {
+		if first[i]["bar_utc_time"] != second[i]["bar_utc_time"] || first[i]["scaled_close_price"] != second[i]["scaled_close_price"] {
+			t.Errorf("closed bar %d changed: %v, then %v", i, first[i], second[i])
+		}
+	}
+	gets = ts.timeBarGets()
+	if len(gets) != 2 {
+		t.Fatalf("second request made %d time bar requests, want 1", len(gets)-1)
+	}
+	if from := gets[1].GetTimeBarParameters().GetFromUtcTime(); from != int64(first[0]["bar_utc_time"].(float64)) {
+		t.Errorf("second request started at %d, want the open bar at %v", from, first[0]["bar_utc_time"])
+	}
+}
+
+func TestHistoricalLive(t *testing.T) {
+	ts := newTestServer(t)
+	query := url.Values{
+		"symbol":  {"ZUC"},
+		"barType": {"minutely"},
+		"from":    {time.Now().UTC().Add(-10 * time.Minute).Format(time.RFC3339)},
+		"live":    {"true"},
+	}
+	conn := ts.dial(t, "/historical", query)
+	readHistorical(t, conn)
+
+	event := readUntil(t, conn, "bar update", isType("bar_update"))
+	if event["symbol"] != "ZUC" || event["bar"] == nil {
+		t.Fatalf("unexpected bar update: %v", event)
+	}
+}
+
+func TestHistoricalRejectsLiveWithEnd(t *testing.T) {
+	ts := newTestServer(t)
+	query := url.Values{
+		"symbol": {"ZUC"},
+		"from":   {time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)},
+		"to":     {time.Now().UTC().Format(time.RFC3339)},
+		"live":   {"true"},
+	}
+	conn := ts.dial(t, "/historical", query)
+
+	if got, want := readError(t, conn), "live bars run up to now and take no end time"; got != want {
+		t.Fatalf("error = %q, want %q", got, want)
+	}
+}
+
+func TestHistoricalTimeRange(t *testing.T) {
+	ts := newTestServer(t)
+	from := ts.fake.BaseTime().Add(-3 * time.Hour)
+	query := url.Values{
+		"symbol":     {"EUC"},
+		"barType":    {"minutely"},
+		"unitNumber": {"15"},
+		"from":       {from.Format(time.RFC3339)},
+		"to":         {from.Add(2 * time.Hour).Format(time.RFC3339)},
+	}
+	conn := ts.dial(t, "/historical", query)
+
+	if bars, _ := readHistorical(t, conn); len(bars) != 8 {
+		t.Fatalf("got %d bars, want 8 bars of 15 minutes", len(bars))
+	}
+	params := ts.timeBarRequest(t)
+	if params.GetBarUnit() != uint32(pb.BarUnit_BAR_UNIT_MIN) || params.GetUnitNumber() != 15 ||
+		params.GetFromUtcTime() != -3*3600*1000 || params.GetToUtcTime() != -3600*1000 {
+		t.Errorf("time bar parameters = %v", params)
+	}
+}
+
+func TestHistoricalCount(t *testing.T) {
+	ts := newTestServer(t)
+	query := url.Values{
+		"symbol":  {"EUC"},
+		"barType": {"hourly"},
+		"period":  {"day"},
+		"number":  {"2"},
+		"count":   {"3"},
+	}
+	conn := ts.dial(t, "/historical", query)
+
+	// Only the newest bars are kept, and bars arrive newest first
+	bars, _ := readHistorical(t, conn)
+	if len(bars) != 3 {
+		t.Fatalf("got %d bars, want 3", len(bars))
+	}
+	first, last := bars[0]["bar_utc_time"].(float64), bars[2]["bar_utc_time"].(float64)
+	if first-last != 2*3600*1000 {
+		t.Errorf("bars start at %v and %v, want consecutive hours newest first", first, last)
+	}
+}
+
+func TestHistoricalRejectsInvalidQuery(t *testing.T) {
+	ts := newTestServer(t)
+	from := time.Now().Add(-time.Hour).UTC()
+	for _, test := range []struct {
+		name  string
+		query url.Values
+		want  string
+	}{
+		{"bar type", url.Values{"barType": {"secondly"}, "period": {"day"}, "number": {"1"}}, `invalid bar type: "secondly"`},
+		{"unit number", url.Values{"unitNumber": {"-1"}, "period": {"day"}, "number": {"1"}}, `invalid unitNumber: "-1"`},
+		{"number", url.Values{"period": {"day"}, "number": {"0"}}, "invalid number format"},
+		{"period", url.Values{"period": {"week"}, "number": {"1"}}, `invalid time period: "week"`},
+		{"from", url.Values{"from": {"yesterday"}}, "invalid from time"},
+		{"to", url.Values{"from": {from.Format(time.RFC3339)}, "to": {"now"}}, "invalid to time"},
+		{"count", url.Values{"period": {"day"}, "number": {"1"}, "count": {"all"}}, `invalid count: "all"`},
+		{
+			"range",
+			url.Values{"from": {from.Format(time.RFC3339)}, "to": {from.Add(-time.Hour).Format(time.RFC3339)}},
+			"invalid time range: end is not after start",
+		},
+		{"continuation", url.Values{"continuation": {"rolling"}, "period": {"day"}, "number": {"1"}}, `invalid continuation type: "rolling"`},
+		{
+			"adjusted without continuation",
+			url.Values{"adjusted": {"true"}, "period": {"day"}, "number": {"1"}},
+			"equalizing requires a continuation type",
+		},
+		{
+			"adjusted standard continuation",
+			url.Values{"continuation": {"standard"}, "adjusted": {"true"}, "period": {"day"}, "number": {"1"}},
+			"only active continuations can be equalized",
+		},
+		{
+			"hours over a day",
+			url.Values{"barType": {"hourly"}, "unitNumber": {"25"}, "period": {"day"}, "number": {"1"}},
+			"invalid unit number: hour bars are at most a day long",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.query.Set("symbol", "EUC")
+			conn := ts.dial(t, "/historical", test.query)
+			if got := readError(t, conn); got != test.want {
+				t.Errorf("error = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHistoricalContinuation(t *testing.T) {
+	ts := newTestServer(t)
+	query := url.Values{
+		"symbol":       {"EUC"},
+		"barType":      {"daily"},
+		"period":       {"month"},
+		"number":       {"7"},
+		"continuation": {"Active"},
+		"adjusted":     {"true"},
+	}
+	conn := ts.dial(t, "/historical", query)
+
+	// Seven months back cross at least two rolls of quarterly contracts
+	var segments []interface{}
+	for {
+		page := readUntil(t, conn, "historical page", func(msg map[string]interface{}) bool {
+			_, ok := msg["is_report_complete"]
+			return ok
+		})
+		pageSegments, ok := page["segments"].([]interface{})
+		if !ok {
+			t.Fatalf("page without segments: %v", page)
+		}
+		segments = append(segments, pageSegments...)
+		if page["is_report_complete"] == true {
+			break
+		}
+	}
+	if len(segments) < 3 {
+		t.Fatalf("got %d segments, want at least 3", len(segments))
+	}
+	for i, s := range segments {
+		segment := s.(map[string]interface{})
+		if i > 0 && segment["contract_id"] == segments[i-1].(map[string]interface{})["contract_id"] {
+			t.Errorf("segment %d repeats the contract of the one before: %v", i, segment)
+		}
+		if symbol, _ := segment["symbol"].(string); !strings.HasPrefix(symbol, "EUC") || segment["from"].(string) > segment["to"].(string) {
+			t.Errorf("segment %d = %v", i, segment)
+		}
+	}
+
+	continuation := ts.timeBarRequest(t).GetContinuationParameters()
+	if continuation.GetContinuationType() != uint32(pb.ContinuationParameters_CONTINUATION_TYPE_ACTIVE) || !continuation.GetEqualize() {
+		t.Errorf("continuation parameters = %v", continuation)
+	}
+}
+
+func TestHistoricalSegments(t *testing.T) {
+	s := &historicalStream{cqgClient: &client.CQGClient{}}
+	hour := int64(3600 * 1000)
+	bar := func(hours int64, contractID uint32) *pb.TimeBar {
+		bar := &pb.TimeBar{BarUtcTime: proto.Int64(hours * hour)}
+		if contractID != 0 {
+			bar.ContinuationSegment = &pb.ContinuationSegment{
+				ContractId:     proto.Uint32(contractID),
+				ContractSymbol: proto.String(fmt.Sprintf("C%d", contractID)),
+			}
+		}
+		return bar
+	}
+	check := func(got []continuationSegment, want ...continuationSegment) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("segments = %+v, want %+v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("segment %d = %+v, want %+v", i, got[i], want[i])
+			}
+		}
+	}
+
+	// Bars arrive newest first, and only the first bar of a segment is marked
+	check(s.segmentsOf([]*pb.TimeBar{bar(10, 1), bar(9, 0), bar(8, 2), bar(7, 0)}),
+		continuationSegment{ContractID: 1, Symbol: "C1", From: "1970-01-01T09:00:00Z", To: "1970-01-01T10:00:00Z"},
+		continuationSegment{ContractID: 2, Symbol: "C2", From: "1970-01-01T07:00:00Z", To: "1970-01-01T08:00:00Z"})
+
+	// The next page continues the last segment until a bar marks another one
+	check(s.segmentsOf([]*pb.TimeBar{bar(6, 0), bar(5, 0), bar(4, 3)}),
+		continuationSegment{ContractID: 2, Symbol: "C2", From: "1970-01-01T05:00:00Z", To: "1970-01-01T06:00:00Z"},
+		continuationSegment{ContractID: 3, Symbol: "C3", From: "1970-01-01T04:00:00Z", To: "1970-01-01T04:00:00Z"})
+
+	if segments := s.segmentsOf(nil); segments == nil || len(segments) != 0 {
+		t.Errorf("segments of an empty page = %#v, want an empty list", segments)
+	}
+}
@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"go-websocket/internal/client"
-	"go-websocket/internal/models"
+	"go-websocket/internal/marketdata"
 	pb "go-websocket/proto/WebAPI"
 	"log"
-	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
@@ -15,172 +19,643 @@ import (
 )
 
 // RegisterHistoricalHandler registers the WebSocket endpoint for historical data
-func RegisterHistoricalHandler(app *fiber.App) {
-	app.Get("/historical", websocket.New(handleHistorical))
+func RegisterHistoricalHandler(app *fiber.App, deps *Deps) {
+	app.Get("/historical", websocket.New(func(c *websocket.Conn) {
+		handleHistorical(c, deps)
+	}))
 }
 
-// handleHistorical processes WebSocket connections for historical data requests
-// It validates input parameters and initializes the CQG client connection
-func handleHistorical(c *websocket.Conn) {
-	symbol := c.Query("symbol")
-	barType := c.Query("barType")
-	period := c.Query("period")
-	number := c.Query("number")
+// barUnits maps the bar types accepted by the historical endpoint to CQG bar units
+var barUnits = map[string]pb.BarUnit{
+	"minutely":   pb.BarUnit_BAR_UNIT_MIN,
+	"hourly":     pb.BarUnit_BAR_UNIT_HOUR,
+	"daily":      pb.BarUnit_BAR_UNIT_DAY,
+	"weekly":     pb.BarUnit_BAR_UNIT_WEEK,
+	"monthly":    pb.BarUnit_BAR_UNIT_MONTH,
+	"quarterly":  pb.BarUnit_BAR_UNIT_QUARTER,
+	"semiannual": pb.BarUnit_BAR_UNIT_SEMI_ANNUAL,
+	"yearly":     pb.BarUnit_BAR_UNIT_YEAR,
+}
+
+// continuationTypes maps the continuation types accepted by the historical endpoint to
+// CQG continuation types, which set when a continuous series rolls to the next contract
+var continuationTypes = map[string]pb.ContinuationParameters_ContinuationType{
+	"active":   pb.ContinuationParameters_CONTINUATION_TYPE_ACTIVE,
+	"standard": pb.ContinuationParameters_CONTINUATION_TYPE_STANDARD,
+}
+
+// continuationSegment is the span of a page of continuous bars taken from one contract
+type continuationSegment struct {
+	ContractID  uint32 `json:"contract_id"`
+	Symbol      string `json:"symbol"`
+	ShortSymbol string `json:"cqg_short_symbol"`
+	From        string `json:"from"` // Start of the oldest bar of the segment in the page, RFC 3339 in UTC
+	To          string `json:"to"`   // Start of the newest bar
+}
 
-	// Validate required parameters
-	if symbol == "" || period == "" || number == "" {
+// handleHistorical processes WebSocket connections for historical data requests.
+// The bars run from the from query parameter up to to, RFC 3339 times, or up to now
+// without to; period and number instead ask for that many calendar days, months or
+// years back from now. count keeps only the newest bars of the range, and continuation
+// builds a continuous series over past contracts, back-adjusted with adjusted=true.
+// live=true keeps streaming changes of the current bar and the bars closed after it until
+// the client disconnects, otherwise the socket is closed once the last bar was sent.
+func handleHistorical(c *websocket.Conn, deps *Deps) {
+	symbol := c.Query("symbol")
+	if symbol == "" || (c.Query("from") == "" && (c.Query("period") == "" || c.Query("number") == "")) {
 		c.WriteJSON(fiber.Map{"error": "Required parameters missing"})
 		c.Close()
 		return
 	}
 
-	// Convert number parameter to integer
-	numberInt, err := strconv.Atoi(number)
+	r, err := parseBarTimeRange(c)
 	if err != nil {
-		c.WriteJSON(fiber.Map{"error": "Invalid number format"})
+		c.WriteJSON(fiber.Map{"error": err.Error()})
 		c.Close()
 		return
 	}
-
-	barUnit := getBarUnit(barType)
-	timeRange := models.TimeRange{
-		Period: period,
-		Number: numberInt,
+	count, err := queryUint(c, "count", 0)
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+		c.Close()
+		return
 	}
+	live := c.Query("live") == "true"
+	if live && !r.To.IsZero() {
+		c.WriteJSON(fiber.Map{"error": "live bars run up to now and take no end time"})
+		c.Close()
+		return
+	}
+
+	// Upstream work for this connection is cancelled when the browser disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer watchClient(c, cancel)()
 
-	// Initialize CQG client
-	cqgClient, err := client.NewCQGClient()
+	acquireCtx, acquireCancel := deps.upstreamContext(ctx)
+	defer acquireCancel()
+
+	// Borrow the shared CQG session
+	cqgClient, err := deps.Sessions.Acquire(acquireCtx, deps.credentials())
 	if err != nil {
 		c.WriteJSON(fiber.Map{"error": "Connection failed: " + err.Error()})
 		c.Close()
 		return
 	}
-	defer cqgClient.Close()
 
-	if err := handleHistoricalData(c, cqgClient, symbol, barUnit, timeRange); err != nil {
+	stream := &historicalStream{c: c, deps: deps, cqgClient: cqgClient, symbol: symbol, r: r, count: count, live: live}
+	if err := stream.run(ctx); err != nil {
 		c.WriteJSON(fiber.Map{"error": err.Error()})
-		c.Close()
-		return
 	}
+	c.Close()
 }
 
-// getBarUnit converts string bar type to corresponding uint32 index
-func getBarUnit(barType string) uint32 {
-	switch barType {
-	case "hourly":
-		return models.HourlyIndex
-	case "minutely":
-		return models.MinutelyIndex
+// parseBarTimeRange reads the bar unit and time range of a historical request from the
+// query
+func parseBarTimeRange(c *websocket.Conn) (client.BarTimeRange, error) {
+	var r client.BarTimeRange
+
+	barType := c.Query("barType", "daily")
+	unit, ok := barUnits[strings.ToLower(barType)]
+	if !ok {
+		return r, fmt.Errorf("invalid bar type: %q", barType)
+	}
+	r.BarUnit = uint32(unit)
+
+	var err error
+	if r.UnitNumber, err = queryUint(c, "unitNumber", 0); err != nil {
+		return r, err
+	}
+
+	if value := c.Query("continuation"); value != "" {
+		continuation, ok := continuationTypes[strings.ToLower(value)]
+		if !ok {
+			return r, fmt.Errorf("invalid continuation type: %q", value)
+		}
+		r.Continuation = uint32(continuation)
+	}
+	r.Equalize = c.Query("adjusted") == "true"
+
+	if value := c.Query("from"); value != "" {
+		if r.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return r, fmt.Errorf("invalid from time")
+		}
+		if value := c.Query("to"); value != "" {
+			if r.To, err = time.Parse(time.RFC3339, value); err != nil {
+				return r, fmt.Errorf("invalid to time")
+			}
+			if !r.To.After(r.From) {
+				return r, fmt.Errorf("invalid time range: end is not after start")
+			}
+		}
+		return r, nil
+	}
+
+	// Calendar periods back from now
+	number, err := strconv.Atoi(c.Query("number"))
+	if err != nil || number <= 0 {
+		return r, fmt.Errorf("invalid number format")
+	}
+	now := time.Now()
+	switch c.Query("period") {
+	case "day":
+		r.From = now.AddDate(0, 0, -number)
+	case "month":
+		r.From = now.AddDate(0, -number, 0)
+	case "year":
+		r.From = now.AddDate(-number, 0, 0)
 	default:
-		return models.DailyIndex
+		return r, fmt.Errorf("invalid time period: %q", c.Query("period"))
 	}
+	return r, nil
+}
+
+// historicalPageSize is the number of bars sent to the client in each message
+const historicalPageSize = 1000
+
+// historicalStream sends the time bars of one symbol to a client. Bars are taken from
+// the bar cache, and only the ranges it is missing are requested from CQG.
+type historicalStream struct {
+	c         *websocket.Conn
+	deps      *Deps
+	cqgClient *client.CQGClient
+	symbol    string
+	r         client.BarTimeRange
+	count     uint32 // Newest bars to send at most, or 0 for all
+	live      bool   // Keep streaming bar changes after the bars of the range
+
+	contractID uint32
+	cache      *marketdata.BarCache
+	series     marketdata.BarSeries
+	window     marketdata.TimeRange    // Starts of the bars to send
+	handled    []marketdata.TimeRange  // Ranges requested from CQG for this client
+	gaps       []marketdata.TimeRange  // Ranges CQG returned no bars for
+	truncated  bool                    // CQG cut a range to its newest bars
+	requestID  uint32                  // Last request made to CQG
+	fetched    *pb.ContinuationSegment // Continuation segment of the last bar received
+
+	segment *pb.ContinuationSegment // Continuation segment of the oldest bar sent
+	current *pb.TimeBar             // Newest bar sent
 }
 
-// handleHistoricalData manages the main flow of historical data retrieval
-// It handles authentication, symbol resolution, and data request
-func handleHistoricalData(c *websocket.Conn, cqgClient *client.CQGClient, symbol string, barUnit uint32, timeRange models.TimeRange) error {
-	// Get authentication credentials from environment
-	userName := os.Getenv("USERNAME")
-	password := os.Getenv("PASSWORD")
-	clientAppId := os.Getenv("CLIENT_APP_ID")
-	clientVersion := os.Getenv("CLIENT_VERSION")
-	protocolVersionMajor := os.Getenv("PROTOCOL_VERSION_MAJOR")
-	protocolVersionMinor := os.Getenv("PROTOCOL_VERSION_MINOR")
+// run resolves the symbol, fills the gaps of the bar cache and sends the bars, and for
+// live bars streams their changes until ctx is done, unless a request failed
+func (s *historicalStream) run(ctx context.Context) error {
+	setupCtx, setupCancel := s.deps.upstreamContext(ctx)
+	defer setupCancel()
 
-	// Parse protocol version numbers
-	protocolMajor, err := strconv.ParseUint(protocolVersionMajor, 10, 32)
+	// Resolve symbol to contract ID; no real-time subscription is needed
+	contractID, err := s.cqgClient.ResolveSymbol(setupCtx, s.symbol, false)
 	if err != nil {
-		return fmt.Errorf("invalid PROTOCOL_VERSION_MAJOR: %v", err)
+		return err
 	}
+	setupCancel()
+	s.contractID = contractID
 
-	protocolMinor, err := strconv.ParseUint(protocolVersionMinor, 10, 32)
-	if err != nil {
-		return fmt.Errorf("invalid PROTOCOL_VERSION_MINOR: %v", err)
+	contractSymbol := s.cqgClient.ContractMetadata(contractID).GetContractSymbol()
+	if contractSymbol == "" {
+		contractSymbol = s.symbol
+	}
+	s.series = marketdata.BarSeries{
+		Symbol:       contractSymbol,
+		BarUnit:      s.r.BarUnit,
+		UnitNumber:   max(s.r.UnitNumber, 1),
+		Continuation: s.r.Continuation,
+	}
+	s.cache = s.deps.Bars
+	if s.r.Equalize {
+		// Every roll changes all the bars of a back-adjusted series, so they are not kept
+		s.cache = marketdata.NewBarCache("")
 	}
 
-	// Authenticate with CQG
-	if err := cqgClient.Logon(userName, password, clientAppId, clientVersion, uint32(protocolMajor), uint32(protocolMinor)); err != nil {
-		return err
+	now := time.Now().UTC()
+	s.window = marketdata.TimeRange{From: s.r.From.UTC(), To: now}
+	if !s.r.To.IsZero() && s.r.To.Before(now) {
+		s.window.To = s.r.To.UTC()
+		if s.r.BarUnit <= uint32(pb.BarUnit_BAR_UNIT_DAY) {
+			// The end of daily and longer bars is an inclusive trade date
+			s.window.To = s.window.To.Add(time.Millisecond)
+		}
 	}
 
-	// Resolve symbol to contract ID
-	contractID, err := cqgClient.ResolveSymbol(symbol, 1, true)
-	if err != nil {
+	for {
+		missing := s.cache.Missing(s.series, s.window, append(s.handled, s.gaps...)...)
+		if len(missing) == 0 || s.enough(missing) {
+			break
+		}
+		if err := s.fetch(ctx, missing[0]); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	if err := s.cache.Save(s.series); err != nil {
+		log.Println("bar cache error:", err)
+	}
+	if err := s.send(); err != nil || !s.live {
 		return err
 	}
+	return s.follow(ctx)
+}
+
+// enough reports whether the cache holds the newest count bars of the window, so that
+// the missing ranges, given newest first, are older than any bar to send
+func (s *historicalStream) enough(missing []marketdata.TimeRange) bool {
+	if s.count == 0 {
+		return false
+	}
+	bars := s.cache.Bars(s.series, s.window, s.count, s.cqgClient.ServerTime)
+	if uint32(len(bars)) < s.count {
+		return false
+	}
+	oldest := s.cqgClient.Time(bars[len(bars)-1].GetBarUtcTime())
+	return !missing[0].To.After(oldest)
+}
+
+// fetch requests the bars of a range missing from the cache and stores them. It returns
+// early, leaving the rest of the range missing, when the connection to CQG was restored
+// or the count of bars to send was reached.
+func (s *historicalStream) fetch(ctx context.Context, m marketdata.TimeRange) error {
+	r := s.r
+	r.From, r.To = m.From, m.To
+	if r.BarUnit <= uint32(pb.BarUnit_BAR_UNIT_DAY) && m.To.Add(-time.Millisecond).After(m.From) {
+		r.To = m.To.Add(-time.Millisecond)
+	}
 
-	// Request historical bar data
-	// requestTYpe => 2 -> subscribe, 3 -> drop, 1 -> get
-	msgID := uint32(2)
-	if err := cqgClient.RequestBarTime(msgID, contractID, barUnit, timeRange, 2); err != nil {
+	asOf := time.Now()
+	requestCtx, requestCancel := s.deps.upstreamContext(ctx)
+	listener, err := s.cqgClient.RequestBarTime(requestCtx, s.contractID, r)
+	requestCancel()
+	if err != nil {
 		return err
 	}
+	defer listener.Close()
+	s.requestID = listener.RequestID
+	s.fetched = nil
 
-	// Start processing messages
-	done := make(chan bool)
-	go processHistoricalMessages(c, cqgClient, done)
+	return s.receive(ctx, listener, m, asOf)
+}
 
-	// Keep connection alive until client disconnects
+// receive handles the reports and notices of the request for a missing range until it
+// is answered, can no longer be answered or has to be made again after a reconnect
+func (s *historicalStream) receive(ctx context.Context, listener *client.Listener, m marketdata.TimeRange, asOf time.Time) error {
+	notices := listener.Notices
 	for {
-		if _, _, err := c.ReadMessage(); err != nil {
-			log.Println("client read error:", err)
-			break
+		select {
+		case <-ctx.Done():
+			s.drop(listener.RequestID)
+			return nil
+		case notice, ok := <-notices:
+			if !ok {
+				notices = nil
+				continue
+			}
+			s.c.WriteJSON(createConnectionNotice(notice, s.symbol))
+			if notice.State == client.StateReconnected {
+				// A request in flight when the connection dropped is not answered
+				// after the reconnect; the bars still missing are requested again
+				return nil
+			}
+		case serverMsg, ok := <-listener.C:
+			if !ok && errors.Is(listener.Err(), client.ErrListenerOverflow) {
+				// Pages were lost; the bars still missing are requested again
+				s.drop(listener.RequestID)
+				return nil
+			}
+			if !ok {
+				// Upstream connection closed before the request completed
+				return fmt.Errorf("connection closed before the bars were received")
+			}
+			for _, report := range serverMsg.GetTimeBarReports() {
+				done, err := s.handleReport(report, m, asOf)
+				if err != nil {
+					return err
+				}
+				if done {
+					return nil
+				}
+				if s.enough(s.cache.Missing(s.series, s.window, append(s.handled, s.gaps...)...)) {
+					// The count was reached before the end of the range
+					s.drop(listener.RequestID)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// drop stops CQG from sending more bars for a request
+func (s *historicalStream) drop(requestID uint32) {
+	dropCtx, dropCancel := s.deps.upstreamContext(context.Background())
+	defer dropCancel()
+	if err := s.cqgClient.DropTimeBars(dropCtx, requestID); err != nil {
+		log.Println("drop error:", err)
+	}
+}
+
+// handleReport stores a page of bars of the missing range m in the cache and reports
+// whether the request is finished
+func (s *historicalStream) handleReport(report *pb.TimeBarReport, m marketdata.TimeRange, asOf time.Time) (bool, error) {
+	switch code := report.GetStatusCode(); {
+	case code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DISCONNECTED):
+		// CQG resumes the request by itself once its data source is back
+		s.c.WriteJSON(fiber.Map{
+			"type":   "historical_status",
+			"symbol": s.symbol,
+			"status": marketdata.BarStatus(code),
+		})
+		return false, nil
+	case code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DROPPED),
+		code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_OUTSIDE_ALLOWED_RANGE):
+		// Nothing CQG keeps is this old, or CQG gave up on the range
+		s.gaps = append(s.gaps, m)
+		return true, nil
+	case code >= uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_FAILURE):
+		text := report.GetDetails().GetText()
+		if text == "" {
+			text = report.GetTextMessage()
+		}
+		return true, fmt.Errorf("historical request failed: %s (%s)", text, marketdata.BarStatus(code))
+	}
+
+	// CQG only marks the first bar of each continuation segment, in the order bars are
+	// sent; the cache keeps the segment of every bar
+	bars := report.GetTimeBars()
+	for _, bar := range bars {
+		if bar.ContinuationSegment != nil {
+			s.fetched = bar.ContinuationSegment
+		} else {
+			bar.ContinuationSegment = s.fetched
+		}
+	}
+
+	// Bars arrive newest first, so everything from the oldest bar so far up to the end of
+	// the range is known
+	complete := report.GetIsReportComplete()
+	covered := m
+	if !complete || report.GetTruncated() {
+		covered.From = covered.To
+		if len(bars) > 0 {
+			covered.From = s.cqgClient.Time(bars[len(bars)-1].GetBarUtcTime())
+		}
+	}
+	s.cache.Store(s.series, bars, covered, asOf, s.cqgClient.Time)
+
+	if !complete {
+		return false, nil
+	}
+	if report.GetTruncated() {
+		s.truncated = true
+		oldest := s.cache.Bars(s.series, m, 0, s.cqgClient.ServerTime)
+		gap := m
+		if len(oldest) > 0 {
+			gap.To = s.cqgClient.Time(oldest[len(oldest)-1].GetBarUtcTime())
+		}
+		if gap.To.After(gap.From) {
+			s.gaps = append(s.gaps, gap)
+		}
+	}
+	s.handled = append(s.handled, m)
+	return true, nil
+}
+
+// send sends the bars of the window from the cache, newest first and in pages, with the
+// gaps left on the last page
+func (s *historicalStream) send() error {
+	bars := s.cache.Bars(s.series, s.window, s.count, s.cqgClient.ServerTime)
+	if len(bars) > 0 {
+		s.current = proto.Clone(bars[0]).(*pb.TimeBar)
+	}
+
+	// Like CQG, mark the continuation segment only on the first bar and where it changes
+	var previous *pb.ContinuationSegment
+	for _, bar := range bars {
+		segment := bar.ContinuationSegment
+		if previous != nil && proto.Equal(segment, previous) {
+			bar.ContinuationSegment = nil
+		}
+		previous = segment
+	}
+
+	upTo := s.window.To
+	if !s.r.To.IsZero() && s.r.To.Before(upTo) {
+		upTo = s.r.To
+	}
+	for i := 0; i < len(bars) || i == 0; i += historicalPageSize {
+		page := bars[i:min(i+historicalPageSize, len(bars))]
+		complete := i+historicalPageSize >= len(bars)
+
+		response := createHistoricalResponse(s.requestID, s.cqgClient.ServerTime(upTo), page, complete, s.truncated)
+		if s.r.Continuation != 0 {
+			response["segments"] = s.segmentsOf(page)
+		}
+		if complete {
+			response["gaps"] = s.gapsOf()
+		}
+		if err := s.c.WriteJSON(response); err != nil {
+			log.Println("write error:", err)
+			return nil
 		}
 	}
-	<-done
+	log.Printf("Historical data complete: %d bars of %s", len(bars), s.series.Symbol)
 	return nil
 }
 
-// processHistoricalMessages handles incoming messages from CQG
-// It processes time bar reports and sends them to the client
-func processHistoricalMessages(c *websocket.Conn, cqgClient *client.CQGClient, done chan bool) {
-	for {
-		// Read message from CQG
-		_, msg, err := cqgClient.WS.ReadMessage()
-		if err != nil {
-			log.Println("read:", err)
-			c.WriteJSON(fiber.Map{"error": "Connection closed"})
-			c.Close()
-			done <- true
-			return
-		}
-
-		// Unmarshal protobuf message
-		serverMsg := &pb.ServerMsg{}
-		if err := proto.Unmarshal(msg, serverMsg); err != nil {
-			log.Println("unmarshal error:", err)
-			continue
+// follow subscribes to the bars from the newest one sent and streams their changes
+// until ctx is done or CQG ends the subscription. Subscriptions are resubmitted by the
+// client itself after a reconnect, and CQG then sends the bars missed meanwhile.
+func (s *historicalStream) follow(ctx context.Context) error {
+	listener, err := s.subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { listener.Close() }()
+	defer func() {
+		if err := s.cache.Save(s.series); err != nil {
+			log.Println("bar cache error:", err)
 		}
+	}()
 
-		// Process time bar reports
-		if len(serverMsg.TimeBarReports) > 0 {
-			for _, report := range serverMsg.TimeBarReports {
-				response := createHistoricalResponse(report)
-				if err := c.WriteJSON(response); err != nil {
-					log.Println("write error:", err)
-					done <- true
-					return
+	notices := listener.Notices
+	for {
+		select {
+		case <-ctx.Done():
+			// Stop CQG from sending more updates
+			s.drop(listener.RequestID)
+			return nil
+		case notice, ok := <-notices:
+			if !ok {
+				notices = nil
+				continue
+			}
+			s.c.WriteJSON(createConnectionNotice(notice, s.symbol))
+		case serverMsg, ok := <-listener.C:
+			if !ok && errors.Is(listener.Err(), client.ErrListenerOverflow) {
+				// Updates were lost; subscribe again from the current bar
+				s.drop(listener.RequestID)
+				if listener, err = s.subscribe(ctx); err != nil {
+					return err
 				}
-
-				// Check if all data has been received
-				if report.GetIsReportComplete() {
-					log.Println("Historical data complete")
-					done <- true
-					return
+				notices = listener.Notices
+				continue
+			}
+			if !ok {
+				return fmt.Errorf("connection closed while streaming live bars")
+			}
+			for _, report := range serverMsg.GetTimeBarReports() {
+				if done, err := s.handleUpdate(report); done || err != nil {
+					return err
 				}
 			}
 		}
 	}
 }
 
-// createHistoricalResponse creates a map of time bar report data
+// subscribe requests the bars from the start of the current one on, with updates
+func (s *historicalStream) subscribe(ctx context.Context) (*client.Listener, error) {
+	r := s.r
+	r.From, r.To = time.Now(), time.Time{}
+	if s.current != nil {
+		r.From = s.cqgClient.Time(s.current.GetBarUtcTime())
+	}
+	r.Subscribe = true
+
+	requestCtx, requestCancel := s.deps.upstreamContext(ctx)
+	defer requestCancel()
+	return s.cqgClient.RequestBarTime(requestCtx, s.contractID, r)
+}
+
+// handleUpdate sends the changes of a live bar report and reports whether the
+// subscription ended. A bar newer than the current one closes it.
+func (s *historicalStream) handleUpdate(report *pb.TimeBarReport) (bool, error) {
+	switch code := report.GetStatusCode(); {
+	case code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DISCONNECTED),
+		code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_INVALIDATED):
+		if code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_INVALIDATED) {
+			// Corrected bars have to be fetched again
+			s.cache.Invalidate(s.series)
+		}
+		s.c.WriteJSON(fiber.Map{
+			"type":   "historical_status",
+			"symbol": s.symbol,
+			"status": marketdata.BarStatus(code),
+		})
+		return false, nil
+	case code == uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_DROPPED):
+		return true, nil
+	case code >= uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_FAILURE):
+		text := report.GetDetails().GetText()
+		if text == "" {
+			text = report.GetTextMessage()
+		}
+		return true, fmt.Errorf("live bars failed: %s (%s)", text, marketdata.BarStatus(code))
+	}
+
+	// Bars arrive newest first
+	bars := report.GetTimeBars()
+	for i := len(bars) - 1; i >= 0; i-- {
+		bar := bars[i]
+		if s.current != nil {
+			if bar.GetBarUtcTime() < s.current.GetBarUtcTime() {
+				// Bars before the current one were sent already
+				continue
+			}
+			if bar.ContinuationSegment == nil {
+				bar.ContinuationSegment = s.current.ContinuationSegment
+			}
+			if bar.GetBarUtcTime() > s.current.GetBarUtcTime() {
+				s.closeBar(report, bar)
+			}
+		}
+		s.current = bar
+		if err := s.c.WriteJSON(createBarEvent("bar_update", s.symbol, report, bar)); err != nil {
+			log.Println("write error:", err)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// closeBar sends the current bar as closed once the next bar started and keeps it in the
+// cache
+func (s *historicalStream) closeBar(report *pb.TimeBarReport, next *pb.TimeBar) {
+	closed := marketdata.TimeRange{
+		From: s.cqgClient.Time(s.current.GetBarUtcTime()),
+		To:   s.cqgClient.Time(next.GetBarUtcTime()),
+	}
+	s.cache.Store(s.series, []*pb.TimeBar{s.current}, closed, time.Now(), s.cqgClient.Time)
+	if err := s.c.WriteJSON(createBarEvent("bar_closed", s.symbol, report, s.current)); err != nil {
+		log.Println("write error:", err)
+	}
+}
+
+// gapsOf returns the gaps of the window, oldest first, as RFC 3339 times in UTC
+func (s *historicalStream) gapsOf() []fiber.Map {
+	sort.Slice(s.gaps, func(i, j int) bool { return s.gaps[i].From.Before(s.gaps[j].From) })
+	gaps := make([]fiber.Map, len(s.gaps))
+	for i, gap := range s.gaps {
+		gaps[i] = fiber.Map{
+			"from": gap.From.UTC().Format(time.RFC3339),
+			"to":   gap.To.UTC().Format(time.RFC3339),
+		}
+	}
+	return gaps
+}
+
+// segmentsOf returns the continuation segments a page of bars spans. Only the first bar
+// of each segment is marked, so bars without a mark belong to the segment before them,
+// also across pages.
+func (s *historicalStream) segmentsOf(bars []*pb.TimeBar) []continuationSegment {
+	segments := make([]continuationSegment, 0, 1)
+	for i, bar := range bars {
+		if segment := bar.GetContinuationSegment(); segment != nil || (i == 0 && s.segment != nil) {
+			if segment != nil {
+				s.segment = segment
+			}
+			segments = append(segments, continuationSegment{
+				ContractID:  s.segment.GetContractId(),
+				Symbol:      s.segment.GetContractSymbol(),
+				ShortSymbol: s.segment.GetCqgShortContractSymbol(),
+			})
+		}
+		if len(segments) == 0 {
+			continue
+		}
+
+		// Bars are sent newest first
+		t := s.cqgClient.Time(bar.GetBarUtcTime()).UTC().Format(time.RFC3339)
+		last := &segments[len(segments)-1]
+		if last.To == "" {
+			last.To = t
+		}
+		last.From = t
+	}
+	return segments
+}
+
+// createBarEvent creates a live bar event of the given type
+// to be sent to the client
+func createBarEvent(eventType, symbol string, report *pb.TimeBarReport, bar *pb.TimeBar) map[string]interface{} {
+	return map[string]interface{}{
+		"type":           eventType,
+		"symbol":         symbol,
+		"request_id":     report.GetRequestId(),
+		"up_to_utc_time": report.GetUpToUtcTime(),
+		"bar":            bar,
+	}
+}
+
+// createHistoricalResponse creates a map of a page of time bars
 // to be sent to the client
-func createHistoricalResponse(report *pb.TimeBarReport) map[string]interface{} {
+func createHistoricalResponse(requestID uint32, upTo int64, bars []*pb.TimeBar, complete, truncated bool) map[string]interface{} {
 	return map[string]interface{}{
-		"request_id":         report.GetRequestId(),
-		"status_code":        report.GetStatusCode(),
-		"up_to_utc_time":     report.GetUpToUtcTime(),
-		"is_report_complete": report.GetIsReportComplete(),
-		"bars":               report.GetTimeBars(),
+		"request_id":         requestID,
+		"status_code":        uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_SUCCESS),
+		"up_to_utc_time":     upTo,
+		"is_report_complete": complete,
+		"truncated":          truncated,
+		"bars":               bars,
 	}
 }
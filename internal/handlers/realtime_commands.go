@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-websocket/internal/client"
+	"go-websocket/internal/marketdata"
+	pb "go-websocket/proto/WebAPI"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// realtimeCommand is a message sent by the browser on a /realtime socket, e.g.
+// {"command": "subscribe", "symbol": "ZUC", "level": "dom"}
+type realtimeCommand struct {
+	Command string          `json:"command"` // subscribe, unsubscribe or list
+	Symbol  string          `json:"symbol"`
+	Level   json.RawMessage `json:"level"` // Level name or number, trades if omitted
+}
+
+// parseLevel returns the subscription level given in a command or query parameter,
+// by name or number, defaulting to trades
+func parseLevel(value string) (uint32, error) {
+	if value == "" {
+		return uint32(pb.MarketDataSubscription_LEVEL_TRADES), nil
+	}
+	return marketdata.ParseLevel(value)
+}
+
+// realtimeSubscription is one symbol streamed on a /realtime socket
+type realtimeSubscription struct {
+	symbol     string
+	contractID uint32
+	feed       *marketdata.Subscription // Shared upstream market data of the contract
+	location   *time.Location           // Zone of local times sent to the client
+	done       chan struct{}            // Closed when the message goroutine exits
+}
+
+// realtimeSession holds the subscriptions of one /realtime socket. Subscriptions are
+// only changed by the handler goroutine; writes to the socket come from every
+// subscription and are serialized by writeMu.
+type realtimeSession struct {
+	c             *websocket.Conn
+	deps          *Deps
+	cqgClient     *client.CQGClient
+	location      *time.Location // Zone of local times, nil for the zone of each exchange
+	writeMu       sync.Mutex
+	subscriptions map[string]*realtimeSubscription // By symbol
+}
+
+// newRealtimeSession creates an empty session for a client socket
+func newRealtimeSession(c *websocket.Conn, deps *Deps, cqgClient *client.CQGClient, location *time.Location) *realtimeSession {
+	return &realtimeSession{
+		c:             c,
+		deps:          deps,
+		cqgClient:     cqgClient,
+		location:      location,
+		subscriptions: make(map[string]*realtimeSubscription),
+	}
+}
+
+// readCommands reads client messages until the client disconnects, then cancels the
+// upstream work started for it and closes the returned channel. Handlers must close the
+// socket and wait for the channel to close before returning, as the connection's
+// buffers are reused once the handler returned.
+func readCommands(ctx context.Context, c *websocket.Conn, cancel context.CancelFunc) <-chan []byte {
+	commands := make(chan []byte)
+	go func() {
+		defer close(commands)
+		defer cancel()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				log.Println("client read:", err)
+				return
+			}
+			select {
+			case commands <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return commands
+}
+
+// writeJSON sends a message to the client
+func (s *realtimeSession) writeJSON(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.c.WriteJSON(v)
+}
+
+// handleCommand runs a client command and replies with its outcome
+func (s *realtimeSession) handleCommand(ctx context.Context, data []byte) {
+	var command realtimeCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		s.writeJSON(fiber.Map{"type": "error", "error": "Invalid command: " + err.Error()})
+		return
+	}
+
+	commandError := func(message string) {
+		s.writeJSON(fiber.Map{
+			"type":    "error",
+			"command": command.Command,
+			"symbol":  command.Symbol,
+			"error":   message,
+		})
+	}
+
+	switch command.Command {
+	case "subscribe":
+		if command.Symbol == "" {
+			commandError("Symbol is required")
+			return
+		}
+
+		// The level may be a JSON string or number
+		value := string(command.Level)
+		var name string
+		if json.Unmarshal(command.Level, &name) == nil {
+			value = name
+		}
+		level, err := parseLevel(value)
+		if err != nil {
+			commandError(err.Error())
+			return
+		}
+
+		subscribeCtx, cancel := s.deps.upstreamContext(ctx)
+		defer cancel()
+		if err := s.subscribe(subscribeCtx, command.Symbol, level); err != nil {
+			commandError(err.Error())
+			return
+		}
+		s.writeJSON(fiber.Map{"type": "subscribed", "subscription": s.describe(s.subscriptions[command.Symbol])})
+
+	case "unsubscribe":
+		sub, ok := s.subscriptions[command.Symbol]
+		if !ok {
+			commandError(fmt.Sprintf("Not subscribed to %q", command.Symbol))
+			return
+		}
+		s.unsubscribe(sub)
+		s.writeJSON(fiber.Map{"type": "unsubscribed", "symbol": command.Symbol})
+
+	case "list":
+		symbols := make([]string, 0, len(s.subscriptions))
+		for symbol := range s.subscriptions {
+			symbols = append(symbols, symbol)
+		}
+		sort.Strings(symbols)
+
+		list := make([]fiber.Map, 0, len(symbols))
+		for _, symbol := range symbols {
+			list = append(list, s.describe(s.subscriptions[symbol]))
+		}
+		s.writeJSON(fiber.Map{"type": "subscriptions", "subscriptions": list})
+
+	default:
+		commandError(fmt.Sprintf("Unknown command %q", command.Command))
+	}
+}
+
+// describe reports a subscription to the client
+func (s *realtimeSession) describe(sub *realtimeSubscription) fiber.Map {
+	return fiber.Map{
+		"symbol":       sub.symbol,
+		"contract_id":  sub.contractID,
+		"level":        sub.feed.Level(),
+		"level_name":   marketdata.LevelName(sub.feed.Level()),
+		"request_id":   sub.feed.RequestID(),
+		"price_format": sub.feed.PriceFormat().Info(),
+		"time_zone":    sub.location.String(),
+	}
+}
+
+// subscribe resolves a symbol and starts streaming it at the given level. Subscribing
+// again to a symbol only changes its level.
+func (s *realtimeSession) subscribe(ctx context.Context, symbol string, level uint32) error {
+	// Change the level of an existing subscription
+	if sub, ok := s.subscriptions[symbol]; ok {
+		if err := sub.feed.SetLevel(ctx, level); err != nil {
+			return fmt.Errorf("subscription failed: %w", err)
+		}
+		return nil
+	}
+
+	// Resolve symbol to contract ID; the hub keeps the metadata of streamed contracts current
+	contractID, err := s.cqgClient.ResolveSymbol(ctx, symbol, false)
+	if err != nil {
+		return fmt.Errorf("symbol resolution failed: %w", err)
+	}
+
+	// Join the shared market data of the contract
+	feed, err := s.deps.Hub.Subscribe(ctx, s.cqgClient, contractID, level)
+	if err != nil {
+		return fmt.Errorf("subscription failed: %w", err)
+	}
+
+	sub := &realtimeSubscription{
+		symbol:     symbol,
+		contractID: contractID,
+		feed:       feed,
+		location:   s.contractLocation(contractID),
+		done:       make(chan struct{}),
+	}
+	s.subscriptions[symbol] = sub
+
+	// Start message handling goroutine
+	go handleRealtimeMessages(s, sub)
+	return nil
+}
+
+// contractLocation returns the zone of local times for a contract: the zone chosen for
+// the session, or the exchange's zone, falling back to the configured zone when the
+// exchange is not known
+func (s *realtimeSession) contractLocation(contractID uint32) *time.Location {
+	if s.location != nil {
+		return s.location
+	}
+	metadata := s.cqgClient.ContractMetadata(contractID)
+	if location, ok := marketdata.ExchangeLocation(metadata); ok {
+		return location
+	}
+	log.Printf("time zone of exchange %q unknown, using %s", metadata.GetMic(), s.deps.Config.Location)
+	return s.deps.Config.Location
+}
+
+// unsubscribe stops streaming a symbol. The hub drops the upstream subscription when
+// no other client still uses the contract.
+func (s *realtimeSession) unsubscribe(sub *realtimeSubscription) {
+	delete(s.subscriptions, sub.symbol)
+
+	// Leave the shared market data; this ends the message goroutine
+	sub.feed.Close()
+	<-sub.done
+}
+
+// close ends every subscription of the session
+func (s *realtimeSession) close() {
+	for _, sub := range s.subscriptions {
+		s.unsubscribe(sub)
+	}
+}
@@ -1,63 +1,76 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
 	"go-websocket/internal/client"
-	"os"
-	"strconv"
+	"go-websocket/internal/config"
+	"go-websocket/internal/marketdata"
+	"go-websocket/internal/services"
+	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
 )
 
-// RegisterLogonHandler registers the logon endpoint with the Fiber application
-func RegisterHandler(app *fiber.App) {
-	app.Get("/logon", handleLogon)
-	app.Get("/logoff", handleLogoff)
+// Deps holds the configuration and shared services injected into the handlers
+type Deps struct {
+	Config   *config.Config
+	Sessions *client.SessionManager
+	Store    *services.PocketBase
+	Hub      *marketdata.Hub
+	Bars     *marketdata.BarCache
 }
 
-// handleLogon processes the logon request by retrieving credentials and client information
-// from environment variables, establishing a connection with CQG, and attempting to log in
-func handleLogon(c *fiber.Ctx) error {
-	// Retrieve credentials and client information from environment variables
-	userName := os.Getenv("USERNAME")
-	password := os.Getenv("PASSWORD")
-	clientAppId := os.Getenv("CLIENT_APP_ID")
-	clientVersion := os.Getenv("CLIENT_VERSION")
-	protocolVersionMajor := os.Getenv("PROTOCOL_VERSION_MAJOR")
-	protocolVersionMinor := os.Getenv("PROTOCOL_VERSION_MINOR")
+// credentials returns the configured CQG login
+func (d *Deps) credentials() client.Credentials {
+	return client.CredentialsFromConfig(d.Config.CQG)
+}
 
-	// Parse protocol version major number from string to uint
-	protocolMajor, err := strconv.ParseUint(protocolVersionMajor, 10, 32)
-	if err != nil {
-		return fmt.Errorf("invalid PROTOCOL_VERSION_MAJOR: %v", err)
-	}
+// upstreamContext bounds a CQG call made on behalf of a client request
+func (d *Deps) upstreamContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, d.Config.Timeouts.Upstream)
+}
 
-	// Parse protocol version minor number from string to uint
-	protocolMinor, err := strconv.ParseUint(protocolVersionMinor, 10, 32)
-	if err != nil {
-		return fmt.Errorf("invalid PROTOCOL_VERSION_MINOR: %v", err)
-	}
+// RegisterLogonHandler registers the logon endpoint with the Fiber application
+func RegisterHandler(app *fiber.App, deps *Deps) {
+	app.Get("/logon", func(c *fiber.Ctx) error {
+		return handleLogon(c, deps)
+	})
+	app.Get("/logoff", func(c *fiber.Ctx) error {
+		return handleLogoff(c, deps)
+	})
+}
 
-	// Validate that required environment variables are set
-	if userName == "" || password == "" || clientAppId == "" || clientVersion == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Username or password or clientAppId or clientVersion not found in environment variables",
-		})
+// watchClient reads from a client WebSocket until it disconnects and then cancels the
+// upstream work started for it. Incoming client messages are discarded. The returned
+// function closes the socket and waits for the reads to end; handlers must call it
+// before returning, as the connection's buffers are reused once the handler returned.
+func watchClient(c *websocket.Conn, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				log.Println("client read:", err)
+				return
+			}
+		}
+	}()
+	return func() {
+		c.Close()
+		<-done
 	}
+}
 
-	// Create a new CQG client instance
-	cqgClient, err := client.NewCQGClient()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Connection failed: " + err.Error(),
-		})
-	}
+// handleLogon establishes the shared CQG session for the configured credentials,
+// logging on only if no live session exists yet
+func handleLogon(c *fiber.Ctx, deps *Deps) error {
+	ctx, cancel := deps.upstreamContext(c.UserContext())
+	defer cancel()
 
-	// Attempt to log in to CQG with provided credentials and client information
-	err = cqgClient.Logon(userName, password, clientAppId, clientVersion, uint32(protocolMajor), uint32(protocolMinor))
-	if err != nil {
+	// Borrow the shared session, logging on if necessary
+	if _, err := deps.Sessions.Acquire(ctx, deps.credentials()); err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"success": false,
 			"error":   "Logon failed: " + err.Error(),
@@ -71,19 +84,13 @@ func handleLogon(c *fiber.Ctx) error {
 	})
 }
 
-func handleLogoff(c *fiber.Ctx) error {
-	// Create a new CQG client instance
-	cqgClient, err := client.NewCQGClient()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Connection failed: " + err.Error(),
-		})
-	}
+// handleLogoff terminates the shared CQG session for the configured credentials
+func handleLogoff(c *fiber.Ctx, deps *Deps) error {
+	ctx, cancel := deps.upstreamContext(c.UserContext())
+	defer cancel()
 
 	// Attempt to log off from CQG
-	err = cqgClient.Logoff()
-	if err != nil {
+	if err := deps.Sessions.Logoff(ctx, deps.credentials()); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"success": false,
 			"error":   "Logoff failed: " + err.Error(),
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"fmt"
+	"go-websocket/internal/client"
+	pb "go-websocket/proto/WebAPI"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// userMessageSeverities names the CQG user message types
+var userMessageSeverities = map[pb.UserMessage_MessageType]string{
+	pb.UserMessage_MESSAGE_TYPE_CRITICAL_ERROR: "critical",
+	pb.UserMessage_MESSAGE_TYPE_WARNING:        "warning",
+	pb.UserMessage_MESSAGE_TYPE_INFO:           "info",
+	pb.UserMessage_MESSAGE_TYPE_LOG:            "log",
+}
+
+// logoffReasons explains why CQG logged the session off
+var logoffReasons = map[pb.LoggedOff_LogoffReason]struct{ name, text string }{
+	pb.LoggedOff_LOGOFF_REASON_BY_REQUEST: {"by_request", "The session was logged off on request"},
+	pb.LoggedOff_LOGOFF_REASON_REDIRECTED: {"redirected", "The session was redirected to another server"},
+	pb.LoggedOff_LOGOFF_REASON_FORCED:     {"forced", "CQG logged the session off"},
+	pb.LoggedOff_LOGOFF_REASON_REASSIGNED: {"reassigned", "The session was taken over by another connection"},
+}
+
+// createUserMessage converts a message CQG sent to the user into an event for the client
+func createUserMessage(msg *pb.UserMessage, cqgClient *client.CQGClient) fiber.Map {
+	severity, ok := userMessageSeverities[pb.UserMessage_MessageType(msg.GetMessageType())]
+	if !ok {
+		severity = fmt.Sprintf("type_%d", msg.GetMessageType())
+	}
+
+	response := fiber.Map{
+		"type":     "user_message",
+		"severity": severity,
+		"source":   msg.GetSource(),
+		"subject":  msg.GetSubject(),
+		"text":     msg.GetText(),
+	}
+
+	// Expiration is relative to the session base time
+	if msg.ExpirationUtcTime != nil {
+		response["expires"] = cqgClient.Time(msg.GetExpirationUtcTime()).Format(time.RFC3339)
+	}
+	return response
+}
+
+// createLoggedOff converts the logoff notification of the CQG session into an event
+// for the client
+func createLoggedOff(loggedOff *pb.LoggedOff) fiber.Map {
+	reason, ok := logoffReasons[pb.LoggedOff_LogoffReason(loggedOff.GetLogoffReason())]
+	if !ok {
+		reason.name = fmt.Sprintf("reason_%d", loggedOff.GetLogoffReason())
+		reason.text = "CQG logged the session off"
+	}
+
+	response := fiber.Map{
+		"type":    "logged_off",
+		"reason":  reason.name,
+		"message": reason.text,
+	}
+	if text := loggedOff.GetTextMessage(); text != "" {
+		response["details"] = text
+	}
+	if url := loggedOff.GetRedirectUrl(); url != "" {
+		response["redirect_url"] = url
+	}
+	return response
+}
+
+// forwardSessionMessages sends the user messages and logoff notification of a CQG
+// session message to the client
+func forwardSessionMessages(serverMsg *pb.ServerMsg, cqgClient *client.CQGClient, write func(v interface{}) error) {
+	for _, msg := range serverMsg.GetUserMessages() {
+		write(createUserMessage(msg, cqgClient))
+	}
+	if loggedOff := serverMsg.GetLoggedOff(); loggedOff != nil {
+		write(createLoggedOff(loggedOff))
+	}
+}
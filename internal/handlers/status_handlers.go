@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// RegisterStatusHandler registers the endpoint reporting upstream session health
+func RegisterStatusHandler(app *fiber.App, deps *Deps) {
+	app.Get("/status", func(c *fiber.Ctx) error {
+		return handleStatus(c, deps)
+	})
+}
+
+// handleStatus returns the connection state and heartbeat latency of every shared session
+func handleStatus(c *fiber.Ctx, deps *Deps) error {
+	return c.JSON(fiber.Map{
+		"sessions": deps.Sessions.Status(),
+	})
+}
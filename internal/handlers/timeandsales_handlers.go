@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-websocket/internal/client"
+	"go-websocket/internal/marketdata"
+	pb "go-websocket/proto/WebAPI"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// RegisterTimeAndSalesHandler registers the WebSocket endpoint for time and sales history
+func RegisterTimeAndSalesHandler(app *fiber.App, deps *Deps) {
+	app.Get("/timeandsales", websocket.New(func(c *websocket.Conn) {
+		handleTimeAndSales(c, deps)
+	}))
+}
+
+// timeAndSalesPage is a page of time and sales tagged with the symbol it belongs to
+type timeAndSalesPage struct {
+	*marketdata.TimeAndSales
+	Symbol string `json:"symbol"`
+}
+
+// handleTimeAndSales streams every historical trade and quote of a symbol between the
+// from and to query parameters, RFC 3339 times, in pages as CQG reports them. Without
+// to, history up to now is sent. The level query parameter picks "trades" or
+// "trades_bba_volumes" (the default) and tz the zone of local times, as for /realtime.
+// The socket is closed once the last page was sent.
+func handleTimeAndSales(c *websocket.Conn, deps *Deps) {
+	symbol := c.Query("symbol")
+	if symbol == "" || c.Query("from") == "" {
+		c.WriteJSON(fiber.Map{"error": "Required parameters missing"})
+		c.Close()
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, c.Query("from"))
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": "Invalid from time"})
+		c.Close()
+		return
+	}
+	var to time.Time
+	if value := c.Query("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			c.WriteJSON(fiber.Map{"error": "Invalid to time"})
+			c.Close()
+			return
+		}
+	}
+
+	level, err := marketdata.ParseTimeAndSalesLevel(c.Query("level"))
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+		c.Close()
+		return
+	}
+	location, err := marketdata.ParseZone(c.Query("tz"), deps.Config.Location)
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+		c.Close()
+		return
+	}
+
+	// Upstream work for this connection is cancelled when the browser disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer watchClient(c, cancel)()
+
+	acquireCtx, acquireCancel := deps.upstreamContext(ctx)
+	defer acquireCancel()
+
+	// Borrow the shared CQG session
+	cqgClient, err := deps.Sessions.Acquire(acquireCtx, deps.credentials())
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": "Connection failed: " + err.Error()})
+		c.Close()
+		return
+	}
+
+	stream := &timeAndSalesStream{
+		c:         c,
+		deps:      deps,
+		cqgClient: cqgClient,
+		symbol:    symbol,
+		level:     level,
+		from:      from,
+		to:        to,
+	}
+	if err := stream.run(ctx, location); err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+	}
+	c.Close()
+}
+
+// timeAndSalesStream sends the time and sales history of one symbol to a client
+type timeAndSalesStream struct {
+	c         *websocket.Conn
+	deps      *Deps
+	cqgClient *client.CQGClient
+	symbol    string
+	level     uint32
+	from, to  time.Time
+
+	contractID uint32
+	decoder    *marketdata.TimeAndSalesDecoder
+	truncated  bool // Truncation was logged
+}
+
+// run resolves the symbol and streams its history until the last page was sent, the
+// request failed or ctx is done
+func (s *timeAndSalesStream) run(ctx context.Context, location *time.Location) error {
+	setupCtx, setupCancel := s.deps.upstreamContext(ctx)
+	defer setupCancel()
+
+	// Resolve symbol to contract ID; no real-time subscription is needed
+	contractID, err := s.cqgClient.ResolveSymbol(setupCtx, s.symbol, false)
+	if err != nil {
+		return err
+	}
+	s.contractID = contractID
+
+	metadata := s.cqgClient.ContractMetadata(contractID)
+	if location == nil {
+		var ok bool
+		if location, ok = marketdata.ExchangeLocation(metadata); !ok {
+			log.Printf("time zone of exchange %q unknown, using %s", metadata.GetMic(), s.deps.Config.Location)
+			location = s.deps.Config.Location
+		}
+	}
+	s.decoder = marketdata.NewTimeAndSalesDecoder(marketdata.NewPriceFormat(metadata), s.cqgClient.Time, location)
+
+	listener, err := s.cqgClient.RequestTimeAndSales(setupCtx, contractID, s.level, s.from, s.to)
+	if err != nil {
+		return err
+	}
+	setupCancel()
+
+	for {
+		done, err := s.receive(ctx, listener)
+		listener.Close()
+		if done || err != nil {
+			return err
+		}
+
+		// A request in flight when the connection dropped is not answered after the
+		// reconnect; ask again for the history from the latest tick sent on, skipping
+		// the ticks of that millisecond sent already
+		from := s.from
+		if last := s.decoder.Last(); !last.IsZero() {
+			from = last
+			s.decoder.Resume()
+		}
+		if !s.to.IsZero() && !from.Before(s.to) {
+			return nil
+		}
+		retryCtx, retryCancel := s.deps.upstreamContext(ctx)
+		listener, err = s.cqgClient.RequestTimeAndSales(retryCtx, contractID, s.level, from, s.to)
+		retryCancel()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receive handles the reports and notices of one request. It reports done once the
+// history is complete or can no longer be sent, and not done when the request has to be
+// made again after a reconnect.
+func (s *timeAndSalesStream) receive(ctx context.Context, listener *client.Listener) (bool, error) {
+	notices := listener.Notices
+	for {
+		select {
+		case <-ctx.Done():
+			// Stop CQG from sending the rest of the history
+			s.drop(listener.RequestID)
+			return true, nil
+		case notice, ok := <-notices:
+			if !ok {
+				notices = nil
+				continue
+			}
+			s.c.WriteJSON(createConnectionNotice(notice, s.symbol))
+			if notice.State == client.StateReconnected {
+				return false, nil
+			}
+		case serverMsg, ok := <-listener.C:
+			if !ok && errors.Is(listener.Err(), client.ErrListenerOverflow) {
+				// Ticks were lost; ask again for the history after the latest tick sent
+				s.drop(listener.RequestID)
+				return false, nil
+			}
+			if !ok {
+				// Upstream connection closed before the request completed
+				return true, fmt.Errorf("connection closed before the history was received")
+			}
+			for _, report := range serverMsg.GetTimeAndSalesReports() {
+				if done, err := s.handleReport(report); done || err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// drop stops CQG from sending the rest of the history of a request
+func (s *timeAndSalesStream) drop(requestID uint32) {
+	dropCtx, dropCancel := s.deps.upstreamContext(context.Background())
+	defer dropCancel()
+	if err := s.cqgClient.DropTimeAndSales(dropCtx, requestID); err != nil {
+		log.Println("drop error:", err)
+	}
+}
+
+// handleReport sends a page of history to the client and reports whether the request
+// is finished
+func (s *timeAndSalesStream) handleReport(report *pb.TimeAndSalesReport) (bool, error) {
+	switch code := report.GetResultCode(); {
+	case code == uint32(pb.TimeAndSalesReport_RESULT_CODE_DISCONNECTED):
+		// CQG resumes the request by itself once its data source is back
+		s.c.WriteJSON(fiber.Map{
+			"type":   "time_and_sales_status",
+			"symbol": s.symbol,
+			"status": marketdata.TimeAndSalesResult(code),
+		})
+		return false, nil
+	case code == uint32(pb.TimeAndSalesReport_RESULT_CODE_DROPPED):
+		return true, nil
+	case code >= uint32(pb.TimeAndSalesReport_RESULT_CODE_FAILURE):
+		text := report.GetDetails().GetText()
+		if text == "" {
+			text = report.GetTextMessage()
+		}
+		return true, fmt.Errorf("time and sales request failed: %s (%s)", text, marketdata.TimeAndSalesResult(code))
+	}
+
+	page := s.decoder.Decode(s.contractID, report)
+	if page.Truncated && !s.truncated {
+		log.Printf("time and sales of %s truncated to the available history", s.symbol)
+		s.truncated = true
+	}
+	if err := s.c.WriteJSON(timeAndSalesPage{TimeAndSales: page, Symbol: s.symbol}); err != nil {
+		log.Println("write error:", err)
+		return true, nil
+	}
+	if page.Complete {
+		log.Println("Time and sales complete")
+	}
+	return page.Complete, nil
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-websocket/internal/client"
+	"go-websocket/internal/marketdata"
+	pb "go-websocket/proto/WebAPI"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// RegisterVolumeProfileHandler registers the WebSocket endpoint for volume profiles
+func RegisterVolumeProfileHandler(app *fiber.App, deps *Deps) {
+	app.Get("/volumeprofile", websocket.New(func(c *websocket.Conn) {
+		handleVolumeProfile(c, deps)
+	}))
+}
+
+// volumeProfileMessage is a volume profile tagged with the symbol and time range it
+// belongs to
+type volumeProfileMessage struct {
+	*marketdata.VolumeProfile
+	Symbol string `json:"symbol"`
+	From   string `json:"from"`
+	To     string `json:"to,omitempty"` // Left out when the profile runs up to now
+}
+
+// handleVolumeProfile sends the volume traded at each price of a symbol between the
+// from and to query parameters, RFC 3339 times, with its point of control and value
+// area. Without to, the profile runs up to now and CQG reports the time it reached in
+// up_to_utc_time. valueArea sets the share of the volume in the value area, 70 percent
+// by default. The socket is closed once the profile was sent.
+func handleVolumeProfile(c *websocket.Conn, deps *Deps) {
+	symbol := c.Query("symbol")
+	if symbol == "" || c.Query("from") == "" {
+		c.WriteJSON(fiber.Map{"error": "Required parameters missing"})
+		c.Close()
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, c.Query("from"))
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": "Invalid from time"})
+		c.Close()
+		return
+	}
+	var to time.Time
+	if value := c.Query("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			c.WriteJSON(fiber.Map{"error": "Invalid to time"})
+			c.Close()
+			return
+		}
+	}
+
+	valueArea := float64(marketdata.DefaultValueArea)
+	if value := c.Query("valueArea"); value != "" {
+		valueArea, err = strconv.ParseFloat(value, 64)
+		if err != nil || valueArea <= 0 || valueArea > 100 {
+			c.WriteJSON(fiber.Map{"error": "Invalid value area percentage"})
+			c.Close()
+			return
+		}
+	}
+
+	// Upstream work for this connection is cancelled when the browser disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer watchClient(c, cancel)()
+
+	acquireCtx, acquireCancel := deps.upstreamContext(ctx)
+	defer acquireCancel()
+
+	// Borrow the shared CQG session
+	cqgClient, err := deps.Sessions.Acquire(acquireCtx, deps.credentials())
+	if err != nil {
+		c.WriteJSON(fiber.Map{"error": "Connection failed: " + err.Error()})
+		c.Close()
+		return
+	}
+
+	stream := &volumeProfileStream{
+		c:         c,
+		deps:      deps,
+		cqgClient: cqgClient,
+		symbol:    symbol,
+		from:      from,
+		to:        to,
+		valueArea: valueArea,
+	}
+	if err := stream.run(ctx); err != nil {
+		c.WriteJSON(fiber.Map{"error": err.Error()})
+	}
+	c.Close()
+}
+
+// volumeProfileStream sends the volume profile of one symbol to a client
+type volumeProfileStream struct {
+	c         *websocket.Conn
+	deps      *Deps
+	cqgClient *client.CQGClient
+	symbol    string
+	from, to  time.Time
+	valueArea float64
+
+	contractID uint32
+	format     *marketdata.PriceFormat
+	builder    *marketdata.VolumeProfileBuilder
+}
+
+// run resolves the symbol, collects its profile and sends it once complete, unless the
+// request failed or ctx is done
+func (s *volumeProfileStream) run(ctx context.Context) error {
+	setupCtx, setupCancel := s.deps.upstreamContext(ctx)
+	defer setupCancel()
+
+	// Resolve symbol to contract ID; no real-time subscription is needed
+	contractID, err := s.cqgClient.ResolveSymbol(setupCtx, s.symbol, false)
+	if err != nil {
+		return err
+	}
+	s.contractID = contractID
+	s.format = marketdata.NewPriceFormat(s.cqgClient.ContractMetadata(contractID))
+	s.builder = marketdata.NewVolumeProfileBuilder(s.format, s.cqgClient.Time, s.valueArea)
+
+	listener, err := s.cqgClient.RequestVolumeProfile(setupCtx, contractID, s.from, s.to)
+	if err != nil {
+		return err
+	}
+	setupCancel()
+
+	for {
+		done, err := s.receive(ctx, listener)
+		listener.Close()
+		if done || err != nil {
+			return err
+		}
+
+		// A request in flight when the connection dropped is not answered after the
+		// reconnect; start the profile over
+		s.builder = marketdata.NewVolumeProfileBuilder(s.format, s.cqgClient.Time, s.valueArea)
+		retryCtx, retryCancel := s.deps.upstreamContext(ctx)
+		listener, err = s.cqgClient.RequestVolumeProfile(retryCtx, contractID, s.from, s.to)
+		retryCancel()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receive handles the reports and notices of one request. It reports done once the
+// profile was sent or can no longer be sent, and not done when the request has to be
+// made again after a reconnect.
+func (s *volumeProfileStream) receive(ctx context.Context, listener *client.Listener) (bool, error) {
+	notices := listener.Notices
+	for {
+		select {
+		case <-ctx.Done():
+			// Stop CQG from computing a profile nobody waits for
+			s.drop(listener.RequestID)
+			return true, nil
+		case notice, ok := <-notices:
+			if !ok {
+				notices = nil
+				continue
+			}
+			s.c.WriteJSON(createConnectionNotice(notice, s.symbol))
+			if notice.State == client.StateReconnected {
+				return false, nil
+			}
+		case serverMsg, ok := <-listener.C:
+			if !ok && errors.Is(listener.Err(), client.ErrListenerOverflow) {
+				// Chunks of the profile were lost; start it over
+				s.drop(listener.RequestID)
+				return false, nil
+			}
+			if !ok {
+				// Upstream connection closed before the request completed
+				return true, fmt.Errorf("connection closed before the volume profile was received")
+			}
+			for _, report := range serverMsg.GetVolumeProfileReports() {
+				if done, err := s.handleReport(report); done || err != nil {
+					return true, err
+				}
+			}
+		}
+	}
+}
+
+// drop stops CQG from computing the profile of a request
+func (s *volumeProfileStream) drop(requestID uint32) {
+	dropCtx, dropCancel := s.deps.upstreamContext(context.Background())
+	defer dropCancel()
+	if err := s.cqgClient.DropVolumeProfile(dropCtx, requestID); err != nil {
+		log.Println("drop error:", err)
+	}
+}
+
+// handleReport adds a chunk of the profile and sends the profile to the client once it
+// is complete. It reports whether the request is finished.
+func (s *volumeProfileStream) handleReport(report *pb.VolumeProfileReport) (bool, error) {
+	switch code := report.GetResultCode(); {
+	case code == uint32(pb.VolumeProfileReport_RESULT_CODE_DISCONNECTED):
+		// CQG resumes the request by itself once its data source is back
+		s.c.WriteJSON(fiber.Map{
+			"type":   "volume_profile_status",
+			"symbol": s.symbol,
+			"status": marketdata.VolumeProfileResult(code),
+		})
+		return false, nil
+	case code == uint32(pb.VolumeProfileReport_RESULT_CODE_DROPPED):
+		return true, nil
+	case code >= uint32(pb.VolumeProfileReport_RESULT_CODE_FAILURE):
+		text := report.GetDetails().GetText()
+		if text == "" {
+			text = report.GetTextMessage()
+		}
+		return true, fmt.Errorf("volume profile request failed: %s (%s)", text, marketdata.VolumeProfileResult(code))
+	}
+
+	s.builder.Add(report)
+	if !report.GetIsReportComplete() {
+		return false, nil
+	}
+
+	profile := s.builder.Profile(s.contractID)
+	if profile.Truncated {
+		log.Printf("volume profile of %s truncated to the available history", s.symbol)
+	}
+	msg := volumeProfileMessage{
+		VolumeProfile: profile,
+		Symbol:        s.symbol,
+		From:          s.from.UTC().Format(time.RFC3339),
+	}
+	if !s.to.IsZero() {
+		msg.To = s.to.UTC().Format(time.RFC3339)
+	}
+	if err := s.c.WriteJSON(msg); err != nil {
+		log.Println("write error:", err)
+	}
+	log.Println("Volume profile complete")
+	return true, nil
+}
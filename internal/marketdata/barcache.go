@@ -0,0 +1,317 @@
+package marketdata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// BarSeries identifies a series of time bars in the bar cache: the bars of one contract
+// with one bar unit, number of units per bar and continuation type
+type BarSeries struct {
+	Symbol       string `json:"symbol"`
+	BarUnit      uint32 `json:"bar_unit"`
+	UnitNumber   uint32 `json:"unit_number"`
+	Continuation uint32 `json:"continuation"`
+}
+
+// TimeRange is the span of time from From up to but excluding To
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// BarCache keeps the time bars fetched from CQG with the time ranges they are known to
+// be complete for, so that a request only needs the ranges not fetched before. Bars are
+// kept with absolute times, as CQG timestamps are relative to the session. With a
+// directory, each series is loaded from its own file on first use and written back by
+// Save, so the cache outlives the server.
+type BarCache struct {
+	dir    string
+	mu     sync.Mutex
+	series map[BarSeries]*barSeries
+}
+
+// barSeries holds the cached bars of one series
+type barSeries struct {
+	bars    map[int64]*pb.TimeBar // By start in Unix milliseconds
+	starts  []int64               // Sorted starts of the bars
+	covered []TimeRange           // Sorted, disjoint ranges all bars are known for
+	dirty   bool                  // Changed since it was last saved
+}
+
+// barSeriesFile is the stored form of a series. Bars are in the protobuf JSON format with
+// their start and trade date in Unix milliseconds.
+type barSeriesFile struct {
+	Series  BarSeries         `json:"series"`
+	Covered []TimeRange       `json:"covered"`
+	Bars    []json.RawMessage `json:"bars"`
+}
+
+// NewBarCache creates a bar cache stored in dir, or only held in memory if dir is empty
+func NewBarCache(dir string) *BarCache {
+	return &BarCache{
+		dir:    dir,
+		series: make(map[BarSeries]*barSeries),
+	}
+}
+
+// Missing returns the parts of r the cache holds no complete bars for, newest first,
+// also leaving out the known ranges. The bar being built at the time it was fetched
+// never counts as complete.
+func (c *BarCache) Missing(series BarSeries, r TimeRange, known ...TimeRange) []TimeRange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &barSeries{covered: c.load(series).covered}
+	for _, k := range known {
+		s.cover(k)
+	}
+
+	var missing []TimeRange
+	from := r.From
+	for _, covered := range s.covered {
+		if !covered.To.After(from) {
+			continue
+		}
+		if !covered.From.Before(r.To) {
+			break
+		}
+		if covered.From.After(from) {
+			missing = append(missing, TimeRange{From: from, To: covered.From})
+		}
+		from = covered.To
+	}
+	if from.Before(r.To) {
+		missing = append(missing, TimeRange{From: from, To: r.To})
+	}
+
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	return missing
+}
+
+// Store adds bars fetched at asOf, whose session-relative times clock converts, and
+// marks covered as complete. Bars not yet closed at asOf are kept but end the covered
+// range, so they are fetched again by the next request that includes them.
+func (c *BarCache) Store(series BarSeries, bars []*pb.TimeBar, covered TimeRange, asOf time.Time, clock func(int64) time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.load(series)
+
+	if covered.To.After(asOf) {
+		covered.To = asOf
+	}
+	for _, bar := range bars {
+		start := clock(bar.GetBarUtcTime())
+		if barEnd(start, series.BarUnit, series.UnitNumber).After(asOf) && start.Before(covered.To) {
+			covered.To = start
+		}
+
+		stored := proto.Clone(bar).(*pb.TimeBar)
+		stored.BarUtcTime = proto.Int64(start.UnixMilli())
+		if bar.TradeDate != nil {
+			stored.TradeDate = proto.Int64(clock(bar.GetTradeDate()).UnixMilli())
+		}
+		s.put(stored)
+	}
+	if covered.To.After(covered.From) {
+		s.cover(covered)
+	}
+	s.dirty = true
+}
+
+// Bars returns copies of the cached bars starting in r, and of the bar r starts in,
+// newest first and at most limit of them unless limit is 0. serverTime converts their
+// times back into the timestamps of the current session.
+func (c *BarCache) Bars(series BarSeries, r TimeRange, limit uint32, serverTime func(time.Time) int64) []*pb.TimeBar {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.load(series)
+
+	first := sort.Search(len(s.starts), func(i int) bool { return s.starts[i] >= r.From.UnixMilli() })
+	if first > 0 {
+		start := time.UnixMilli(s.starts[first-1]).UTC()
+		if barEnd(start, series.BarUnit, series.UnitNumber).After(r.From) {
+			first--
+		}
+	}
+
+	var bars []*pb.TimeBar
+	for i := len(s.starts) - 1; i >= first && (limit == 0 || uint32(len(bars)) < limit); i-- {
+		if s.starts[i] >= r.To.UnixMilli() {
+			continue
+		}
+		bar := proto.Clone(s.bars[s.starts[i]]).(*pb.TimeBar)
+		bar.BarUtcTime = proto.Int64(serverTime(time.UnixMilli(bar.GetBarUtcTime())))
+		if bar.TradeDate != nil {
+			bar.TradeDate = proto.Int64(serverTime(time.UnixMilli(bar.GetTradeDate())))
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
+// Invalidate forgets which ranges of a series are complete after CQG corrected its bars,
+// so that all of them are fetched again
+func (c *BarCache) Invalidate(series BarSeries) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.load(series)
+	s.covered = nil
+	s.dirty = true
+}
+
+// Save writes a series to its file if it changed since it was loaded or last saved
+func (c *BarCache) Save(series BarSeries) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.load(series)
+	if c.dir == "" || !s.dirty {
+		return nil
+	}
+
+	file := barSeriesFile{
+		Series:  series,
+		Covered: s.covered,
+		Bars:    make([]json.RawMessage, 0, len(s.starts)),
+	}
+	for _, start := range s.starts {
+		data, err := protojson.Marshal(s.bars[start])
+		if err != nil {
+			return fmt.Errorf("error encoding bar: %v", err)
+		}
+		file.Bars = append(file.Bars, data)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("error encoding bar series: %v", err)
+	}
+
+	// Replace the file in one step so a crash never leaves half a series behind
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return fmt.Errorf("error creating bar cache directory: %v", err)
+	}
+	path := c.path(series)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("error writing bar cache: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing bar cache: %v", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// load returns a series, reading it from its file the first time it is used. A file that
+// cannot be read is logged and the series starts empty. c.mu must be held.
+func (c *BarCache) load(series BarSeries) *barSeries {
+	if s, ok := c.series[series]; ok {
+		return s
+	}
+	s := &barSeries{bars: make(map[int64]*pb.TimeBar)}
+	c.series[series] = s
+	if c.dir == "" {
+		return s
+	}
+
+	data, err := os.ReadFile(c.path(series))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error reading bar cache of %s: %v", series.Symbol, err)
+		}
+		return s
+	}
+	var file barSeriesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("error decoding bar cache of %s: %v", series.Symbol, err)
+		return s
+	}
+	for _, raw := range file.Bars {
+		bar := &pb.TimeBar{}
+		if err := protojson.Unmarshal(raw, bar); err != nil {
+			log.Printf("error decoding bar cache of %s: %v", series.Symbol, err)
+			*s = barSeries{bars: make(map[int64]*pb.TimeBar)}
+			return s
+		}
+		s.put(bar)
+	}
+	for _, covered := range file.Covered {
+		s.cover(covered)
+	}
+	return s
+}
+
+// path returns the file a series is stored in
+func (c *BarCache) path(series BarSeries) string {
+	name := fmt.Sprintf("%s_%d_%d_%d.json", url.PathEscape(series.Symbol), series.BarUnit, series.UnitNumber, series.Continuation)
+	return filepath.Join(c.dir, name)
+}
+
+// put adds a bar with absolute times, replacing a bar with the same start
+func (s *barSeries) put(bar *pb.TimeBar) {
+	start := bar.GetBarUtcTime()
+	if _, ok := s.bars[start]; !ok {
+		i := sort.Search(len(s.starts), func(i int) bool { return s.starts[i] >= start })
+		s.starts = append(s.starts, 0)
+		copy(s.starts[i+1:], s.starts[i:])
+		s.starts[i] = start
+	}
+	s.bars[start] = bar
+}
+
+// cover adds r to the covered ranges, merging ranges that overlap or touch
+func (s *barSeries) cover(r TimeRange) {
+	merged := make([]TimeRange, 0, len(s.covered)+1)
+	for _, covered := range s.covered {
+		if covered.To.Before(r.From) || covered.From.After(r.To) {
+			merged = append(merged, covered)
+			continue
+		}
+		if covered.From.Before(r.From) {
+			r.From = covered.From
+		}
+		if covered.To.After(r.To) {
+			r.To = covered.To
+		}
+	}
+	merged = append(merged, r)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].From.Before(merged[j].From) })
+	s.covered = merged
+}
+
+// barEnd returns the end of the time bar starting at start
+func barEnd(start time.Time, barUnit, unitNumber uint32) time.Time {
+	n := int(max(unitNumber, 1))
+
+	switch pb.BarUnit(barUnit) {
+	case pb.BarUnit_BAR_UNIT_MIN:
+		return start.Add(time.Duration(n) * time.Minute)
+	case pb.BarUnit_BAR_UNIT_HOUR:
+		return start.Add(time.Duration(n) * time.Hour)
+	case pb.BarUnit_BAR_UNIT_WEEK:
+		return start.AddDate(0, 0, 7)
+	case pb.BarUnit_BAR_UNIT_MONTH:
+		return start.AddDate(0, 1, 0)
+	case pb.BarUnit_BAR_UNIT_QUARTER:
+		return start.AddDate(0, 3, 0)
+	case pb.BarUnit_BAR_UNIT_SEMI_ANNUAL:
+		return start.AddDate(0, 6, 0)
+	case pb.BarUnit_BAR_UNIT_YEAR:
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
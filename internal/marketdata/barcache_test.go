@@ -0,0 +1,171 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// hourly is the series of the bar cache tests
+var hourly = BarSeries{Symbol: "ZUC", BarUnit: uint32(pb.BarUnit_BAR_UNIT_HOUR), UnitNumber: 1}
+
+// hours returns the range between two hours after testBase
+func hours(from, to int) TimeRange {
+	return TimeRange{From: testClock(at(0, from)), To: testClock(at(0, to))}
+}
+
+// hourlyBars returns bars starting at the given hours after testBase, closing at the
+// hour
+func hourlyBars(startHours ...int) []*pb.TimeBar {
+	bars := make([]*pb.TimeBar, 0, len(startHours))
+	for _, h := range startHours {
+		bars = append(bars, &pb.TimeBar{
+			BarUtcTime:       proto.Int64(at(0, h)),
+			ScaledClosePrice: proto.Int64(int64(h)),
+		})
+	}
+	return bars
+}
+
+// serverTime converts absolute times back into times relative to testBase
+func serverTime(t time.Time) int64 {
+	return t.Sub(testBase).Milliseconds()
+}
+
+// checkRanges fails the test unless ranges are the given pairs of hours
+func checkRanges(t *testing.T, ranges []TimeRange, want ...TimeRange) {
+	t.Helper()
+	if len(ranges) != len(want) {
+		t.Fatalf("ranges = %v, want %v", ranges, want)
+	}
+	for i := range want {
+		if !ranges[i].From.Equal(want[i].From) || !ranges[i].To.Equal(want[i].To) {
+			t.Fatalf("ranges = %v, want %v", ranges, want)
+		}
+	}
+}
+
+// checkCloses fails the test unless bars hold the given closes in order
+func checkCloses(t *testing.T, bars []*pb.TimeBar, want ...int64) {
+	t.Helper()
+	got := make([]int64, 0, len(bars))
+	for _, bar := range bars {
+		got = append(got, bar.GetScaledClosePrice())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("closes = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("closes = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBarSeriesCover(t *testing.T) {
+	var s barSeries
+	s.cover(hours(4, 5))
+	s.cover(hours(0, 1))
+	checkRanges(t, s.covered, hours(0, 1), hours(4, 5))
+
+	// Touching and overlapping ranges merge
+	s.cover(hours(1, 2))
+	s.cover(hours(3, 4))
+	checkRanges(t, s.covered, hours(0, 2), hours(3, 5))
+	s.cover(hours(1, 4))
+	checkRanges(t, s.covered, hours(0, 5))
+}
+
+func TestBarCacheMissing(t *testing.T) {
+	c := NewBarCache("")
+	checkRanges(t, c.Missing(hourly, hours(0, 6)), hours(0, 6))
+
+	c.Store(hourly, hourlyBars(2, 3), hours(2, 4), testClock(at(1, 0)), testClock)
+	checkRanges(t, c.Missing(hourly, hours(0, 6)), hours(4, 6), hours(0, 2))
+	checkRanges(t, c.Missing(hourly, hours(2, 4)))
+	checkRanges(t, c.Missing(hourly, hours(3, 5)), hours(4, 5))
+
+	// Known ranges are left out without being cached
+	checkRanges(t, c.Missing(hourly, hours(0, 6), hours(5, 6)), hours(4, 5), hours(0, 2))
+	checkRanges(t, c.Missing(hourly, hours(0, 6)), hours(4, 6), hours(0, 2))
+
+	// Other series have nothing cached
+	daily := hourly
+	daily.BarUnit = uint32(pb.BarUnit_BAR_UNIT_DAY)
+	checkRanges(t, c.Missing(daily, hours(0, 6)), hours(0, 6))
+}
+
+func TestBarCacheStoreOpenBar(t *testing.T) {
+	c := NewBarCache("")
+
+	// At 3:30 the bar of 3:00 is still open: it is kept but not covered
+	c.Store(hourly, hourlyBars(1, 2, 3), hours(1, 5), testClock(at(0, 3)+30*60*1000), testClock)
+	checkRanges(t, c.Missing(hourly, hours(0, 5)), hours(3, 5), hours(0, 1))
+	checkCloses(t, c.Bars(hourly, hours(0, 5), 0, serverTime), 3, 2, 1)
+
+	// Fetching it again once closed replaces it
+	closed := hourlyBars(3, 4)
+	closed[0].ScaledClosePrice = proto.Int64(30)
+	c.Store(hourly, closed, hours(3, 5), testClock(at(0, 6)), testClock)
+	checkRanges(t, c.Missing(hourly, hours(0, 5)), hours(0, 1))
+	checkCloses(t, c.Bars(hourly, hours(0, 5), 0, serverTime), 4, 30, 2, 1)
+}
+
+func TestBarCacheBars(t *testing.T) {
+	c := NewBarCache("")
+	c.Store(hourly, hourlyBars(1, 2, 3, 4), hours(1, 5), testClock(at(1, 0)), testClock)
+
+	// The bar the range starts in is included, the one it ends at is not
+	bars := c.Bars(hourly, TimeRange{From: testClock(at(0, 1) + 1), To: testClock(at(0, 4))}, 0, serverTime)
+	checkCloses(t, bars, 3, 2, 1)
+	if bars[0].GetBarUtcTime() != at(0, 3) {
+		t.Fatalf("bar time = %d, want %d", bars[0].GetBarUtcTime(), at(0, 3))
+	}
+
+	// The limit keeps the newest bars
+	checkCloses(t, c.Bars(hourly, hours(0, 6), 2, serverTime), 4, 3)
+
+	// Bars are copies
+	bars[0].ScaledClosePrice = proto.Int64(99)
+	checkCloses(t, c.Bars(hourly, hours(3, 4), 0, serverTime), 3)
+}
+
+func TestBarCacheInvalidate(t *testing.T) {
+	c := NewBarCache("")
+	c.Store(hourly, hourlyBars(1, 2), hours(1, 3), testClock(at(1, 0)), testClock)
+	c.Invalidate(hourly)
+	checkRanges(t, c.Missing(hourly, hours(1, 3)), hours(1, 3))
+	checkCloses(t, c.Bars(hourly, hours(1, 3), 0, serverTime), 2, 1)
+}
+
+func TestBarCacheSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	c := NewBarCache(dir)
+	bars := hourlyBars(1, 2)
+	bars[0].TradeDate = proto.Int64(at(0, 0))
+	c.Store(hourly, bars, hours(1, 3), testClock(at(1, 0)), testClock)
+	if err := c.Save(hourly); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cache reads the series from its file, with times of its own session
+	loaded := NewBarCache(dir)
+	checkRanges(t, loaded.Missing(hourly, hours(0, 4)), hours(3, 4), hours(0, 1))
+	shifted := func(t time.Time) int64 { return serverTime(t) + 1000 }
+	got := loaded.Bars(hourly, hours(0, 4), 0, shifted)
+	checkCloses(t, got, 2, 1)
+	if got[1].GetBarUtcTime() != at(0, 1)+1000 || got[1].GetTradeDate() != 1000 {
+		t.Fatalf("bar times = %d and %d", got[1].GetBarUtcTime(), got[1].GetTradeDate())
+	}
+
+	// Series that were not stored start empty
+	daily := hourly
+	daily.BarUnit = uint32(pb.BarUnit_BAR_UNIT_DAY)
+	checkRanges(t, loaded.Missing(daily, hours(0, 4)), hours(0, 4))
+	if err := NewBarCache("").Save(hourly); err != nil {
+		t.Fatalf("saving without a directory: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package marketdata
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// BarsType is the event type of non-timed bar pages
+const BarsType = "bars"
+
+// Non-timed bar types accepted by the bars endpoint
+const (
+	BarTypeTick   = "tick"
+	BarTypeRange  = "range"
+	BarTypeRenko  = "renko"
+	BarTypeVolume = "volume"
+	BarTypePnF    = "pnf"
+)
+
+// barTickTypes maps the names accepted for bar building tick types to CQG tick types
+var barTickTypes = map[string]pb.BarBuildingTickType{
+	"bid":   pb.BarBuildingTickType_BAR_BUILDING_TICK_TYPE_BID,
+	"ask":   pb.BarBuildingTickType_BAR_BUILDING_TICK_TYPE_ASK,
+	"trade": pb.BarBuildingTickType_BAR_BUILDING_TICK_TYPE_TRADE,
+}
+
+// barStartPoints maps the names accepted for range and Renko start points to CQG start
+// points, which both enums number alike
+var barStartPoints = map[string]uint32{
+	"session": uint32(pb.RangeBarParameters_START_POINT_SESSION),
+	"week":    uint32(pb.RangeBarParameters_START_POINT_WEEK),
+	"month":   uint32(pb.RangeBarParameters_START_POINT_MONTH),
+}
+
+// Bars is one page of non-timed bars of a contract, newest first as CQG reports them
+type Bars struct {
+	Type                string `json:"type"`
+	ContractID          uint32 `json:"contract_id"`
+	BarType             string `json:"bar_type"`
+	Status              string `json:"status"` // success, subscribed, update or invalidated
+	Bars                []Bar  `json:"bars"`
+	UpToUTCTime         string `json:"up_to_utc_time,omitempty"` // Set when the page holds the current bar
+	Complete            bool   `json:"is_report_complete"`       // No more pages of the snapshot follow
+	TruncatedByBarCount bool   `json:"truncated_by_bar_count"`   // More bars were asked for than CQG allows
+	ReachedStartOfData  bool   `json:"reached_start_of_data"`    // CQG keeps no earlier bars
+
+	// Bars between these times must be requested again; updates stopped if only the
+	// start is set
+	InvalidatedFrom string `json:"invalidated_from,omitempty"`
+	InvalidatedTo   string `json:"invalidated_to,omitempty"`
+}
+
+// Bar is a tick, range, Renko, constant volume or point-and-figure bar. Tick bars have
+// their close as open, high and low; point-and-figure bars are rounded to boxes, with
+// the traded extremes in raw_high and raw_low.
+type Bar struct {
+	UTCTime    string `json:"utc_time"`   // Bar start, RFC 3339 in UTC
+	LocalTime  string `json:"local_time"` // Bar start, RFC 3339 in the zone chosen by the client
+	Index      int32  `json:"index"`      // Orders bars with the same start time
+	TradeDate  string `json:"trade_date,omitempty"`
+	Open       Price  `json:"open"`
+	High       Price  `json:"high"`
+	Low        Price  `json:"low"`
+	Close      Price  `json:"close"`
+	Volume     int64  `json:"volume"`
+	TickVolume uint64 `json:"tick_volume,omitempty"`
+	Up         *bool  `json:"up,omitempty"` // Direction of Renko bricks and P&F columns
+	RawHigh    *Price `json:"raw_high,omitempty"`
+	RawLow     *Price `json:"raw_low,omitempty"`
+
+	// FirstAfterStart marks the first Renko brick after the start point
+	FirstAfterStart bool `json:"first_after_start,omitempty"`
+}
+
+// ParseBarType checks a non-timed bar type name
+func ParseBarType(value string) (string, error) {
+	switch value = strings.ToLower(value); value {
+	case BarTypeTick, BarTypeRange, BarTypeRenko, BarTypeVolume, BarTypePnF:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid bar type: %q", value)
+}
+
+// ParseBarTickTypes parses a comma-separated list of bar building tick types such as
+// "bid,ask". An empty value leaves the choice to CQG.
+func ParseBarTickTypes(value string) ([]uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var tickTypes []uint32
+	for _, name := range strings.Split(value, ",") {
+		tickType, ok := barTickTypes[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("invalid tick type: %q", name)
+		}
+		tickTypes = append(tickTypes, uint32(tickType))
+	}
+	return tickTypes, nil
+}
+
+// ParseBarStartPoint parses the point range and Renko bars restart from. An empty value
+// restarts them every session.
+func ParseBarStartPoint(value string) (uint32, error) {
+	if value == "" {
+		return barStartPoints["session"], nil
+	}
+	startPoint, ok := barStartPoints[strings.ToLower(value)]
+	if !ok {
+		return 0, fmt.Errorf("invalid start point: %q", value)
+	}
+	return startPoint, nil
+}
+
+// BarStatus names the status code of a bar report, such as "invalid_params"
+func BarStatus(code uint32) string {
+	name, ok := pb.BarReportStatusCode_name[int32(code)]
+	if !ok {
+		return fmt.Sprintf("code_%d", code)
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "BAR_REPORT_STATUS_CODE_"))
+}
+
+// BarsDecoder turns the non-timed bar reports answering one request into pages. Bars
+// carry their start time and trade date only when they differ from the bar before,
+// also across reports, so one decoder must see every report of its request in order.
+type BarsDecoder struct {
+	format    *PriceFormat
+	clock     func(int64) time.Time // Converts CQG timestamps into absolute times
+	location  *time.Location        // Zone of local times
+	barType   string
+	barTime   time.Time
+	index     int32 // Index of the bar decoded last
+	tradeDate string
+}
+
+// NewBarsDecoder creates a decoder for bars of a type of a contract with the given
+// price format. clock converts the session-relative timestamps of the reports.
+func NewBarsDecoder(barType string, format *PriceFormat, clock func(int64) time.Time, location *time.Location) *BarsDecoder {
+	return &BarsDecoder{format: format, clock: clock, location: location, barType: barType}
+}
+
+// Decode converts a non-timed bar report into a page
+func (d *BarsDecoder) Decode(contractID uint32, report *pb.NonTimedBarReport) *Bars {
+	page := &Bars{
+		Type:                BarsType,
+		ContractID:          contractID,
+		BarType:             d.barType,
+		Status:              BarStatus(report.GetStatusCode()),
+		Bars:                make([]Bar, 0),
+		Complete:            report.GetIsReportComplete(),
+		TruncatedByBarCount: report.GetTruncatedByBarCount(),
+		ReachedStartOfData:  report.GetReachedStartOfData(),
+	}
+	if report.UpToUtcTime != nil {
+		page.UpToUTCTime = formatTime(d.clock(report.GetUpToUtcTime()), time.UTC)
+	}
+	if report.InvalidatedFromUtcTime != nil {
+		page.InvalidatedFrom = formatTime(d.clock(report.GetInvalidatedFromUtcTime()), time.UTC)
+	}
+	if report.InvalidatedToUtcTime != nil {
+		page.InvalidatedTo = formatTime(d.clock(report.GetInvalidatedToUtcTime()), time.UTC)
+	}
+
+	for _, b := range report.GetTickBars() {
+		bar := d.bar(b.BarUtcTime, b.GetIndex(), b.TradeDate)
+		closePrice := d.format.Price(b.GetScaledClosePrice())
+		bar.Open, bar.High, bar.Low, bar.Close = closePrice, closePrice, closePrice, closePrice
+		bar.Volume = b.GetVolume().GetSignificand()
+		page.Bars = append(page.Bars, bar)
+	}
+	for _, b := range report.GetRangeBars() {
+		bar := d.bar(b.BarUtcTime, b.GetIndex(), b.TradeDate)
+		d.ohlc(&bar, b.GetScaledOpenPrice(), b.GetScaledHighPrice(), b.GetScaledLowPrice(), b.GetScaledClosePrice())
+		bar.Volume, bar.TickVolume = b.GetVolume().GetSignificand(), b.GetTickVolume()
+		page.Bars = append(page.Bars, bar)
+	}
+	for _, b := range report.GetRenkoBars() {
+		bar := d.bar(b.BarUtcTime, b.GetIndex(), b.TradeDate)
+		d.ohlc(&bar, b.GetScaledOpenPrice(), b.GetScaledHighPrice(), b.GetScaledLowPrice(), b.GetScaledClosePrice())
+		bar.Volume, bar.TickVolume = b.GetVolume().GetSignificand(), b.GetTickVolume()
+		bar.Up = b.Up
+		bar.FirstAfterStart = b.GetFirstBarAfterStartPoint()
+		page.Bars = append(page.Bars, bar)
+	}
+	for _, b := range report.GetConstantVolumeBars() {
+		bar := d.bar(b.BarUtcTime, b.GetIndex(), b.TradeDate)
+		d.ohlc(&bar, b.GetScaledOpenPrice(), b.GetScaledHighPrice(), b.GetScaledLowPrice(), b.GetScaledClosePrice())
+		bar.Volume, bar.TickVolume = b.GetVolume().GetSignificand(), b.GetTickVolume()
+		page.Bars = append(page.Bars, bar)
+	}
+	for _, b := range report.GetPointAndFigureBars() {
+		bar := d.bar(b.BarUtcTime, b.GetIndex(), b.TradeDate)
+		d.ohlc(&bar, b.GetPfScaledOpenPrice(), b.GetPfScaledHighPrice(), b.GetPfScaledLowPrice(), b.GetPfScaledClosePrice())
+		bar.Volume, bar.TickVolume = b.GetVolume().GetSignificand(), b.GetTickVolume()
+		bar.Up = b.Up
+		if b.ScaledHighPrice != nil {
+			high := d.format.Price(b.GetScaledHighPrice())
+			bar.RawHigh = &high
+		}
+		if b.ScaledLowPrice != nil {
+			low := d.format.Price(b.GetScaledLowPrice())
+			bar.RawLow = &low
+		}
+		page.Bars = append(page.Bars, bar)
+	}
+	return page
+}
+
+// bar starts a bar, carrying over the start time and trade date of the bar before
+// when they are not given
+func (d *BarsDecoder) bar(barTime *int64, index int32, date *int64) Bar {
+	if barTime != nil {
+		d.barTime = d.clock(*barTime)
+	}
+	if date != nil {
+		d.tradeDate = tradeDate(d.clock(*date)).Format(dateLayout)
+	}
+	d.index = index
+	return Bar{
+		UTCTime:   formatTime(d.barTime, time.UTC),
+		LocalTime: formatTime(d.barTime, d.location),
+		Index:     index,
+		TradeDate: d.tradeDate,
+	}
+}
+
+// Reset forgets the bars decoded so far, for the reports of a new request
+func (d *BarsDecoder) Reset() {
+	d.barTime, d.index, d.tradeDate = time.Time{}, 0, ""
+}
+
+// Last returns the start time and index of the bar decoded last, zero before the
+// first one. As snapshots are sent newest first, this is the oldest bar so far.
+func (d *BarsDecoder) Last() (time.Time, int32) {
+	return d.barTime, d.index
+}
+
+// ohlc sets the prices of a bar from scaled prices
+func (d *BarsDecoder) ohlc(bar *Bar, open, high, low, closePrice int64) {
+	bar.Open = d.format.Price(open)
+	bar.High = d.format.Price(high)
+	bar.Low = d.format.Price(low)
+	bar.Close = d.format.Price(closePrice)
+}
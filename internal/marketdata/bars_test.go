@@ -0,0 +1,166 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// rangeBar returns a range bar, with its start time and trade date only if ms is set
+func rangeBar(ms *int64, index int32, open, high, low, closePrice int64) *pb.RangeBar {
+	bar := &pb.RangeBar{
+		BarUtcTime:       ms,
+		Index:            proto.Int32(index),
+		ScaledOpenPrice:  proto.Int64(open),
+		ScaledHighPrice:  proto.Int64(high),
+		ScaledLowPrice:   proto.Int64(low),
+		ScaledClosePrice: proto.Int64(closePrice),
+		Volume:           &shared.Decimal{Significand: proto.Int64(10)},
+		TickVolume:       proto.Uint64(4),
+	}
+	if ms != nil {
+		bar.TradeDate = proto.Int64(at(1, 0))
+	}
+	return bar
+}
+
+func TestBarsDecodeCarriesTimes(t *testing.T) {
+	zone := time.FixedZone("exchange", -6*3600)
+	d := NewBarsDecoder(BarTypeRange, priceFormat(0.25, 2, 0.25), testClock, zone)
+
+	// Bars without a start time and trade date have those of the bar before
+	page := d.Decode(testContractID, &pb.NonTimedBarReport{
+		StatusCode:       proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_SUCCESS)),
+		IsReportComplete: proto.Bool(false),
+		RangeBars: []*pb.RangeBar{
+			rangeBar(proto.Int64(at(1, 10)), 1, 400, 404, 399, 403),
+			rangeBar(nil, 0, 396, 400, 396, 400),
+		},
+	})
+	if page.Type != BarsType || page.BarType != BarTypeRange || page.Status != "success" || page.Complete {
+		t.Fatalf("page = %+v", page)
+	}
+	if len(page.Bars) != 2 {
+		t.Fatalf("got %d bars, want 2", len(page.Bars))
+	}
+	first, second := page.Bars[0], page.Bars[1]
+	if first.UTCTime != "2026-03-02T10:00:00.000Z" || first.LocalTime != "2026-03-02T04:00:00.000-06:00" ||
+		first.TradeDate != "2026-03-02" || first.Index != 1 {
+		t.Errorf("first bar = %+v", first)
+	}
+	if first.Open.Decimal() != "100" || first.High.Decimal() != "101" || first.Low.Decimal() != "99.75" ||
+		first.Close.Decimal() != "100.75" || first.Volume != 10 || first.TickVolume != 4 {
+		t.Errorf("first bar prices = %+v", first)
+	}
+	if second.UTCTime != first.UTCTime || second.TradeDate != first.TradeDate || second.Index != 0 {
+		t.Errorf("second bar = %+v, want the time and date of the first", second)
+	}
+
+	// Also across reports of the same request
+	page = d.Decode(testContractID, &pb.NonTimedBarReport{
+		IsReportComplete: proto.Bool(true),
+		RangeBars:        []*pb.RangeBar{rangeBar(nil, 2, 400, 400, 400, 400)},
+	})
+	if bar := page.Bars[0]; bar.UTCTime != first.UTCTime || bar.TradeDate != "2026-03-02" || !page.Complete {
+		t.Errorf("bar of the next report = %+v", bar)
+	}
+	if last, index := d.Last(); !last.Equal(testClock(at(1, 10))) || index != 2 {
+		t.Errorf("Last() = %v, %d", last, index)
+	}
+
+	// A new request starts over
+	d.Reset()
+	page = d.Decode(testContractID, &pb.NonTimedBarReport{RangeBars: []*pb.RangeBar{rangeBar(nil, 0, 400, 400, 400, 400)}})
+	if bar := page.Bars[0]; bar.UTCTime != "" || bar.TradeDate != "" {
+		t.Errorf("bar after Reset = %+v, want no time", bar)
+	}
+}
+
+func TestBarsDecodeTypes(t *testing.T) {
+	d := NewBarsDecoder(BarTypePnF, NewPriceFormat(nil), testClock, time.UTC)
+	page := d.Decode(testContractID, &pb.NonTimedBarReport{
+		StatusCode:             proto.Uint32(uint32(pb.BarReportStatusCode_BAR_REPORT_STATUS_CODE_INVALIDATED)),
+		InvalidatedFromUtcTime: proto.Int64(at(1, 8)),
+		InvalidatedToUtcTime:   proto.Int64(at(1, 9)),
+		TickBars: []*pb.TickBar{{
+			BarUtcTime:       proto.Int64(at(1, 10)),
+			ScaledClosePrice: proto.Int64(50),
+			Volume:           &shared.Decimal{Significand: proto.Int64(2)},
+		}},
+		RenkoBars: []*pb.RenkoBar{{
+			ScaledOpenPrice:         proto.Int64(50),
+			ScaledHighPrice:         proto.Int64(52),
+			ScaledLowPrice:          proto.Int64(50),
+			ScaledClosePrice:        proto.Int64(52),
+			Up:                      proto.Bool(true),
+			FirstBarAfterStartPoint: proto.Bool(true),
+		}},
+		PointAndFigureBars: []*pb.PointAndFigureBar{{
+			PfScaledOpenPrice:  proto.Int64(60),
+			PfScaledHighPrice:  proto.Int64(60),
+			PfScaledLowPrice:   proto.Int64(50),
+			PfScaledClosePrice: proto.Int64(50),
+			ScaledHighPrice:    proto.Int64(61),
+			ScaledLowPrice:     proto.Int64(49),
+			Up:                 proto.Bool(false),
+		}},
+	})
+
+	if page.Status != "invalidated" || page.InvalidatedFrom != "2026-03-02T08:00:00.000Z" || page.InvalidatedTo != "2026-03-02T09:00:00.000Z" {
+		t.Fatalf("page = %+v", page)
+	}
+	if len(page.Bars) != 3 {
+		t.Fatalf("got %d bars, want 3", len(page.Bars))
+	}
+
+	// Tick bars have their close as every price
+	tick := page.Bars[0]
+	if tick.Open.Scaled != 50 || tick.High.Scaled != 50 || tick.Low.Scaled != 50 || tick.Close.Scaled != 50 || tick.Volume != 2 {
+		t.Errorf("tick bar = %+v", tick)
+	}
+	renko := page.Bars[1]
+	if renko.Up == nil || !*renko.Up || !renko.FirstAfterStart || renko.Close.Scaled != 52 {
+		t.Errorf("Renko bar = %+v", renko)
+	}
+	pnf := page.Bars[2]
+	if pnf.Up == nil || *pnf.Up || pnf.High.Scaled != 60 || pnf.RawHigh == nil || pnf.RawHigh.Scaled != 61 ||
+		pnf.RawLow == nil || pnf.RawLow.Scaled != 49 {
+		t.Errorf("point-and-figure bar = %+v", pnf)
+	}
+}
+
+func TestBarsParse(t *testing.T) {
+	if barType, err := ParseBarType("Renko"); err != nil || barType != BarTypeRenko {
+		t.Errorf(`ParseBarType("Renko") = %q, %v`, barType, err)
+	}
+	if _, err := ParseBarType("daily"); err == nil {
+		t.Error(`ParseBarType("daily") accepted`)
+	}
+
+	tickTypes, err := ParseBarTickTypes("bid, ASK")
+	if err != nil || len(tickTypes) != 2 || tickTypes[0] != uint32(pb.BarBuildingTickType_BAR_BUILDING_TICK_TYPE_BID) ||
+		tickTypes[1] != uint32(pb.BarBuildingTickType_BAR_BUILDING_TICK_TYPE_ASK) {
+		t.Errorf(`ParseBarTickTypes("bid, ASK") = %v, %v`, tickTypes, err)
+	}
+	if tickTypes, err := ParseBarTickTypes(""); err != nil || tickTypes != nil {
+		t.Errorf(`ParseBarTickTypes("") = %v, %v`, tickTypes, err)
+	}
+	if _, err := ParseBarTickTypes("bid,settlement"); err == nil {
+		t.Error(`ParseBarTickTypes("bid,settlement") accepted`)
+	}
+
+	if startPoint, err := ParseBarStartPoint(""); err != nil || startPoint != uint32(pb.RangeBarParameters_START_POINT_SESSION) {
+		t.Errorf(`ParseBarStartPoint("") = %d, %v`, startPoint, err)
+	}
+	if startPoint, err := ParseBarStartPoint("week"); err != nil || startPoint != uint32(pb.RangeBarParameters_START_POINT_WEEK) {
+		t.Errorf(`ParseBarStartPoint("week") = %d, %v`, startPoint, err)
+	}
+
+	if got := BarStatus(12345); got != "code_12345" {
+		t.Errorf("BarStatus(12345) = %q", got)
+	}
+}
@@ -0,0 +1,123 @@
+package marketdata
+
+import (
+	"math"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// BestQuote is a best bid or ask quote received in an update
+type BestQuote struct {
+	Price   Price  `json:"price"`
+	Volume  int64  `json:"volume"`             // Zero below the trades_bba_volumes level
+	Cleared bool   `json:"cleared,omitempty"`  // The side has no best price any more
+	UTCTime string `json:"utc_time,omitempty"` // RFC 3339 in UTC
+}
+
+// TopOfBook is the best bid and offer of a contract. Prices are nil while a side is
+// not quoted, and the spread and mid-price while either side is missing.
+type TopOfBook struct {
+	BidPrice    *Price   `json:"bid_price"`
+	BidDisplay  string   `json:"bid_display,omitempty"` // Bid in the contract's native format
+	BidVolume   int64    `json:"bid_volume"`
+	AskPrice    *Price   `json:"ask_price"`
+	AskDisplay  string   `json:"ask_display,omitempty"`
+	AskVolume   int64    `json:"ask_volume"`
+	Spread      *Price   `json:"spread"`
+	SpreadTicks *float64 `json:"spread_ticks"` // Spread in ticks at the bid price
+	Mid         *Price   `json:"mid"`
+}
+
+// scaledQuote is one side of the top of book in CQG scaled prices
+type scaledQuote struct {
+	price  int64
+	volume int64
+}
+
+// bbo tracks the best bid and offer of a contract from BESTBID and BESTASK quotes
+type bbo struct {
+	bid, ask *scaledQuote
+}
+
+// reset forgets both sides, as a snapshot restates them
+func (b *bbo) reset() {
+	b.bid, b.ask = nil, nil
+}
+
+// apply updates a side from a best bid or ask quote. A zero volume clears the side;
+// a missing volume, below the trades_bba_volumes level, keeps only the price.
+func (b *bbo) apply(quote *pb.Quote) {
+	side := &b.bid
+	if quote.GetType() == uint32(pb.Quote_TYPE_BESTASK) {
+		side = &b.ask
+	}
+
+	if quote.GetVolume() != nil && quote.GetVolume().GetSignificand() == 0 {
+		*side = nil
+		return
+	}
+	*side = &scaledQuote{price: quote.GetScaledPrice(), volume: quote.GetVolume().GetSignificand()}
+}
+
+// top returns the current top of book with its spread and mid-price
+func (b *bbo) top(format *PriceFormat) *TopOfBook {
+	top := &TopOfBook{}
+	if b.bid != nil {
+		price := format.Price(b.bid.price)
+		top.BidPrice, top.BidDisplay, top.BidVolume = &price, price.Display(), b.bid.volume
+	}
+	if b.ask != nil {
+		price := format.Price(b.ask.price)
+		top.AskPrice, top.AskDisplay, top.AskVolume = &price, price.Display(), b.ask.volume
+	}
+
+	// Derive from scaled prices so that both stay exact
+	if b.bid != nil && b.ask != nil {
+		spread := format.Price(b.ask.price - b.bid.price)
+		mid := format.halved().Price(b.ask.price + b.bid.price)
+		top.Spread, top.Mid = &spread, &mid
+		if tickSize := format.TickSize(*top.BidPrice); tickSize > 0 {
+			ticks := math.Round(spread.Float()/tickSize*1e6) / 1e6
+			top.SpreadTicks = &ticks
+		}
+	}
+	return top
+}
+
+// forLevel returns the update as seen by a subscriber of the given level: no quotes
+// below the trades_bba level and no quote volumes below trades_bba_volumes. It returns
+// nil if nothing is left to send.
+func (u *Update) forLevel(level uint32) *Update {
+	rank := levelRank(level)
+	if rank >= levelRank(uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_VOLUMES)) || u.TopOfBook == nil && len(u.Bids) == 0 && len(u.Asks) == 0 {
+		return u
+	}
+
+	stripped := *u
+	if rank < levelRank(uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA)) {
+		stripped.Bids, stripped.Asks, stripped.TopOfBook = make([]BestQuote, 0), make([]BestQuote, 0), nil
+		if !stripped.published() {
+			return nil
+		}
+		return &stripped
+	}
+
+	stripped.Bids = withoutVolumes(u.Bids)
+	stripped.Asks = withoutVolumes(u.Asks)
+	if u.TopOfBook != nil {
+		top := *u.TopOfBook
+		top.BidVolume, top.AskVolume = 0, 0
+		stripped.TopOfBook = &top
+	}
+	return &stripped
+}
+
+// withoutVolumes copies quotes without their volumes
+func withoutVolumes(quotes []BestQuote) []BestQuote {
+	stripped := make([]BestQuote, len(quotes))
+	for i, q := range quotes {
+		q.Volume = 0
+		stripped[i] = q
+	}
+	return stripped
+}
@@ -0,0 +1,67 @@
+package marketdata
+
+import (
+	"testing"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBBOSpreadAndMid(t *testing.T) {
+	// Tenths do not divide exactly in floats; the spread still counts whole ticks
+	format := priceFormat(0.1, 1, 0.1)
+	var b bbo
+	b.apply(quote(pb.Quote_TYPE_BESTBID, 10, 4))
+	b.apply(quote(pb.Quote_TYPE_BESTASK, 13, 6))
+
+	top := b.top(format)
+	if top.BidDisplay != "1.0" || top.AskDisplay != "1.3" || top.BidVolume != 4 || top.AskVolume != 6 {
+		t.Fatalf("top = %+v", top)
+	}
+	if top.Spread == nil || top.Spread.Decimal() != "0.3" {
+		t.Fatalf("spread = %v, want 0.3", top.Spread)
+	}
+	if top.SpreadTicks == nil || *top.SpreadTicks != 3 {
+		t.Fatalf("spread ticks = %v, want 3", top.SpreadTicks)
+	}
+	if top.Mid == nil || top.Mid.Decimal() != "1.15" {
+		t.Fatalf("mid = %v, want 1.15", top.Mid)
+	}
+}
+
+func TestBBOClearedSide(t *testing.T) {
+	format := priceFormat(0.25, 2, 0.25)
+	var b bbo
+	b.apply(quote(pb.Quote_TYPE_BESTBID, 400, 1))
+	b.apply(quote(pb.Quote_TYPE_BESTASK, 402, 1))
+	b.apply(quote(pb.Quote_TYPE_BESTASK, 0, 0))
+
+	top := b.top(format)
+	if top.BidPrice == nil || top.AskPrice != nil || top.Spread != nil || top.SpreadTicks != nil || top.Mid != nil {
+		t.Fatalf("top = %+v, want the bid only", top)
+	}
+}
+
+func TestBBOWithoutVolumes(t *testing.T) {
+	// Below the trades_bba_volumes level, quotes carry prices only
+	var b bbo
+	b.apply(&pb.Quote{
+		Type:        proto.Uint32(uint32(pb.Quote_TYPE_BESTBID)),
+		ScaledPrice: proto.Int64(400),
+	})
+	b.apply(&pb.Quote{
+		Type:        proto.Uint32(uint32(pb.Quote_TYPE_BESTASK)),
+		ScaledPrice: proto.Int64(402),
+		Volume:      &shared.Decimal{},
+	})
+
+	top := b.top(priceFormat(0.25, 2, 0.25))
+	if top.BidPrice == nil || top.BidPrice.Decimal() != "100" || top.BidVolume != 0 {
+		t.Fatalf("bid = %v x %d, want 100 without volume", top.BidPrice, top.BidVolume)
+	}
+	if top.AskPrice != nil {
+		t.Fatalf("ask = %v, want cleared by its zero volume", top.AskPrice)
+	}
+}
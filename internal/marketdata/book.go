@@ -0,0 +1,420 @@
+package marketdata
+
+import (
+	"log"
+	"sort"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// BookDepth is the number of price levels per side published to clients
+const BookDepth = 10
+
+// Book event types
+const (
+	BookSnapshot = "book"       // The full top of the book, replacing anything known before
+	BookDelta    = "book_delta" // Changed levels only; a level with zero volume was removed
+)
+
+// BookEvent publishes the top BookDepth levels of an order book. Bids are ordered from
+// the highest price and asks from the lowest.
+type BookEvent struct {
+	Type       string       `json:"type"`
+	ContractID uint32       `json:"contract_id"`
+	Bids       []PriceLevel `json:"bids"`
+	Asks       []PriceLevel `json:"asks"`
+	Stale      bool         `json:"stale"` // The book is not being updated and may be wrong
+}
+
+// PriceLevel is one price of the order book
+type PriceLevel struct {
+	Price         Price   `json:"price"`
+	Volume        int64   `json:"volume"`
+	ImpliedVolume int64   `json:"implied_volume,omitempty"`
+	Orders        []Order `json:"orders,omitempty"` // Detailed DOM orders in queue order
+}
+
+// Order is an individual order of the detailed DOM
+type Order struct {
+	ID      string `json:"id"`
+	Volume  int64  `json:"volume"`
+	Implied bool   `json:"implied,omitempty"`
+}
+
+// Order book sides, as in DetailedDOMAtPrice.side
+const (
+	sideBuy  = 1
+	sideSell = 2
+)
+
+// bookLevel is the state of one price of the book
+type bookLevel struct {
+	quoteVolume   int64 // Combined DOM volume from BID and ASK quotes
+	hasQuote      bool
+	impliedVolume int64 // Volume from IMPLIED_BID and IMPLIED_ASK quotes
+	orders        []Order
+}
+
+// empty reports whether nothing rests at the level any more
+func (l *bookLevel) empty() bool {
+	return !l.hasQuote && l.impliedVolume == 0 && len(l.orders) == 0
+}
+
+// volume returns the combined DOM volume, or the sum of the detailed orders when no
+// combined quote was received for the level
+func (l *bookLevel) volume() int64 {
+	if l.hasQuote {
+		return l.quoteVolume
+	}
+	var volume int64
+	for _, order := range l.orders {
+		volume += order.Volume
+	}
+	return volume
+}
+
+// book rebuilds the order book of a contract from DOM quotes and detailed DOM updates
+// and turns its changes into snapshots and deltas of the top levels
+type book struct {
+	format *PriceFormat
+	bids   map[int64]*bookLevel // By scaled price
+	asks   map[int64]*bookLevel
+
+	domStale     bool // Reported stale by CQG
+	disconnected bool // Updates may have been missed since the connection dropped
+	incomplete   bool // A series of detailed DOM messages is still in progress
+	reset        bool // The book was rebuilt since the last published event
+
+	published bool // A snapshot was published and deltas may follow
+	lastBids  []PriceLevel
+	lastAsks  []PriceLevel
+	lastStale bool
+}
+
+// newBook creates an empty book for a contract with the given price format
+func newBook(format *PriceFormat) *book {
+	return &book{
+		format: format,
+		bids:   make(map[int64]*bookLevel),
+		asks:   make(map[int64]*bookLevel),
+	}
+}
+
+// stale reports whether the book cannot be trusted at the moment
+func (b *book) stale() bool {
+	return b.domStale || b.disconnected
+}
+
+// side returns the levels of a book side
+func (b *book) side(buy bool) map[int64]*bookLevel {
+	if buy {
+		return b.bids
+	}
+	return b.asks
+}
+
+// level returns the level at a price, creating it if needed
+func (b *book) level(buy bool, scaledPrice int64) *bookLevel {
+	levels := b.side(buy)
+	l, ok := levels[scaledPrice]
+	if !ok {
+		l = &bookLevel{}
+		levels[scaledPrice] = l
+	}
+	return l
+}
+
+// prune drops a level once nothing rests at it
+func (b *book) prune(buy bool, scaledPrice int64) {
+	levels := b.side(buy)
+	if l, ok := levels[scaledPrice]; ok && l.empty() {
+		delete(levels, scaledPrice)
+	}
+}
+
+// apply updates the book from a real-time market data message and returns the event
+// to publish, or nil if the top of the book did not change
+func (b *book) apply(contractID uint32, rtData *pb.RealTimeMarketData) *BookEvent {
+	// A snapshot replaces everything known about the contract
+	if rtData.GetIsSnapshot() {
+		b.bids = make(map[int64]*bookLevel)
+		b.asks = make(map[int64]*bookLevel)
+		b.domStale = false
+		b.disconnected = false
+		b.incomplete = false
+		b.reset = true
+	}
+
+	for _, quote := range rtData.GetQuotes() {
+		switch pb.Quote_Type(quote.GetType()) {
+		case pb.Quote_TYPE_BID:
+			b.applyQuote(true, false, quote)
+		case pb.Quote_TYPE_ASK:
+			b.applyQuote(false, false, quote)
+		case pb.Quote_TYPE_IMPLIED_BID:
+			b.applyQuote(true, true, quote)
+		case pb.Quote_TYPE_IMPLIED_ASK:
+			b.applyQuote(false, true, quote)
+		}
+	}
+
+	if dom := rtData.GetDetailedDom(); dom != nil {
+		b.applyDetailedDOM(dom)
+	}
+
+	return b.publish(contractID)
+}
+
+// applyQuote sets the volume at a DOM price; zero volume clears it
+func (b *book) applyQuote(buy, implied bool, quote *pb.Quote) {
+	price := quote.GetScaledPrice()
+	volume := quote.GetVolume().GetSignificand()
+	l := b.level(buy, price)
+	if implied {
+		l.impliedVolume = volume
+	} else {
+		l.quoteVolume = volume
+		l.hasQuote = volume != 0
+	}
+	b.prune(buy, price)
+}
+
+// applyDetailedDOM applies a detailed DOM snapshot or update to the orders of the book
+func (b *book) applyDetailedDOM(dom *pb.DetailedDOM) {
+	// A detailed DOM snapshot replaces every order but not the combined volumes
+	if dom.GetIsSnapshot() {
+		for _, buy := range []bool{true, false} {
+			for price, l := range b.side(buy) {
+				l.orders = nil
+				b.prune(buy, price)
+			}
+		}
+		b.reset = true
+	}
+	b.domStale = dom.GetIsStale()
+	b.incomplete = !dom.GetIsDetailedDomComplete()
+
+	for _, priceLevel := range dom.GetPriceLevels() {
+		buy := priceLevel.GetSide() == sideBuy
+		if !buy && priceLevel.GetSide() != sideSell {
+			continue
+		}
+		price := priceLevel.GetScaledPrice()
+		l := b.level(buy, price)
+		if priceLevel.GetIsSnapshot() {
+			l.orders = nil
+		}
+
+		// Insert indexes may be omitted when they follow the previous order
+		index := -1
+		for _, order := range priceLevel.GetOrders() {
+			if order.OrderIndex != nil {
+				index = int(order.GetOrderIndex())
+			} else {
+				index++
+			}
+			l.orders = applyOrder(l.orders, order, index)
+		}
+		b.prune(buy, price)
+	}
+}
+
+// applyOrder applies one detailed DOM operation to the orders of a level
+func applyOrder(orders []Order, op *pb.DetailedDOMOrder, index int) []Order {
+	id := op.GetDetailedDomOrderId()
+	pos := -1
+	for i := range orders {
+		if orders[i].ID == id {
+			pos = i
+			break
+		}
+	}
+
+	switch pb.DetailedDOMOrder_Operation(op.GetOperation()) {
+	case pb.DetailedDOMOrder_OPERATION_INSERT, pb.DetailedDOMOrder_OPERATION_MOVE_TO_PRICE:
+		if pos >= 0 {
+			orders = append(orders[:pos], orders[pos+1:]...)
+		}
+		order := Order{ID: id, Volume: op.GetVolume().GetSignificand(), Implied: op.GetImplied()}
+		return insertOrder(orders, order, index)
+
+	case pb.DetailedDOMOrder_OPERATION_REMOVE, pb.DetailedDOMOrder_OPERATION_MOVE_FROM_PRICE:
+		if pos < 0 {
+			log.Printf("detailed DOM: unknown order %s removed", id)
+			return orders
+		}
+		return append(orders[:pos], orders[pos+1:]...)
+
+	case pb.DetailedDOMOrder_OPERATION_MODIFY:
+		if pos < 0 {
+			log.Printf("detailed DOM: unknown order %s modified", id)
+			return orders
+		}
+		order := orders[pos]
+		if op.Volume != nil {
+			order.Volume = op.GetVolume().GetSignificand()
+		}
+		if op.Implied != nil {
+			order.Implied = op.GetImplied()
+		}
+		orders[pos] = order
+
+		// The index is only given when the order changed its place in the queue
+		if op.OrderIndex != nil && int(op.GetOrderIndex()) != pos {
+			orders = append(orders[:pos], orders[pos+1:]...)
+			orders = insertOrder(orders, order, int(op.GetOrderIndex()))
+		}
+		return orders
+	}
+	return orders
+}
+
+// insertOrder inserts an order at index, appending it when index is out of range
+func insertOrder(orders []Order, order Order, index int) []Order {
+	if index < 0 || index >= len(orders) {
+		return append(orders, order)
+	}
+	orders = append(orders, Order{})
+	copy(orders[index+1:], orders[index:])
+	orders[index] = order
+	return orders
+}
+
+// setDisconnected marks the book stale while the connection is down and returns the
+// event to publish, if any
+func (b *book) setDisconnected(contractID uint32, disconnected bool) *BookEvent {
+	b.disconnected = disconnected
+	return b.publish(contractID)
+}
+
+// top returns the best BookDepth levels of a side
+func (b *book) top(buy bool) []PriceLevel {
+	levels := b.side(buy)
+	prices := make([]int64, 0, len(levels))
+	for price := range levels {
+		prices = append(prices, price)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		if buy {
+			return prices[i] > prices[j]
+		}
+		return prices[i] < prices[j]
+	})
+	if len(prices) > BookDepth {
+		prices = prices[:BookDepth]
+	}
+
+	top := make([]PriceLevel, 0, len(prices))
+	for _, price := range prices {
+		l := levels[price]
+		top = append(top, PriceLevel{
+			Price:         b.format.Price(price),
+			Volume:        l.volume(),
+			ImpliedVolume: l.impliedVolume,
+			Orders:        append([]Order(nil), l.orders...),
+		})
+	}
+	return top
+}
+
+// publish compares the top of the book with the last published one and returns a
+// snapshot after a reset, a delta of the changed levels otherwise, or nil when nothing
+// changed. Nothing is published while a detailed DOM series is incomplete.
+func (b *book) publish(contractID uint32) *BookEvent {
+	if b.incomplete {
+		return nil
+	}
+
+	bids, asks := b.top(true), b.top(false)
+	stale := b.stale()
+	if len(bids) > 0 && len(asks) > 0 && bids[0].Price.Scaled >= asks[0].Price.Scaled && !stale {
+		log.Printf("order book of contract %d is crossed: bid %v, ask %v", contractID, bids[0].Price, asks[0].Price)
+	}
+
+	event := &BookEvent{Type: BookDelta, ContractID: contractID, Stale: stale}
+	if b.reset || !b.published {
+		event.Type = BookSnapshot
+		event.Bids, event.Asks = bids, asks
+	} else {
+		event.Bids, event.Asks = diffLevels(b.lastBids, bids), diffLevels(b.lastAsks, asks)
+		if len(event.Bids) == 0 && len(event.Asks) == 0 && stale == b.lastStale {
+			return nil
+		}
+	}
+
+	b.reset = false
+	b.published = true
+	b.lastBids, b.lastAsks, b.lastStale = bids, asks, stale
+	return event
+}
+
+// snapshot returns the last published top of the book, or nil if none was published
+func (b *book) snapshot(contractID uint32) *BookEvent {
+	if !b.published {
+		return nil
+	}
+	return &BookEvent{Type: BookSnapshot, ContractID: contractID, Bids: b.lastBids, Asks: b.lastAsks, Stale: b.lastStale}
+}
+
+// diffLevels returns the levels of next that differ from prev, and the levels of prev
+// that left the top with zero volume
+func diffLevels(prev, next []PriceLevel) []PriceLevel {
+	old := make(map[int64]PriceLevel, len(prev))
+	for _, l := range prev {
+		old[l.Price.Scaled] = l
+	}
+
+	changed := make([]PriceLevel, 0)
+	for _, l := range next {
+		if p, ok := old[l.Price.Scaled]; !ok || !sameLevel(p, l) {
+			changed = append(changed, l)
+		}
+		delete(old, l.Price.Scaled)
+	}
+	for _, l := range prev {
+		if _, ok := old[l.Price.Scaled]; ok {
+			changed = append(changed, PriceLevel{Price: l.Price})
+		}
+	}
+	return changed
+}
+
+// sameLevel reports whether two levels hold the same volumes and orders
+func sameLevel(a, b PriceLevel) bool {
+	if a.Volume != b.Volume || a.ImpliedVolume != b.ImpliedVolume || len(a.Orders) != len(b.Orders) {
+		return false
+	}
+	for i := range a.Orders {
+		if a.Orders[i] != b.Orders[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// forLevel returns the event as seen by a subscriber of the given level: nothing below
+// the DOM levels, and no individual orders below the detailed DOM
+func (e *BookEvent) forLevel(level uint32) *BookEvent {
+	rank := levelRank(level)
+	if rank < levelRank(uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DOM)) {
+		return nil
+	}
+	if rank >= levelRank(uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DETAILED_DOM)) {
+		return e
+	}
+
+	stripped := *e
+	stripped.Bids = withoutOrders(e.Bids)
+	stripped.Asks = withoutOrders(e.Asks)
+	return &stripped
+}
+
+// withoutOrders copies price levels without their individual orders
+func withoutOrders(levels []PriceLevel) []PriceLevel {
+	stripped := make([]PriceLevel, len(levels))
+	for i, l := range levels {
+		l.Orders = nil
+		stripped[i] = l
+	}
+	return stripped
+}
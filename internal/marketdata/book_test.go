@@ -0,0 +1,229 @@
+package marketdata
+
+import (
+	"testing"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// testContractID is the contract of the books in these tests
+const testContractID = 7
+
+// quote returns a DOM quote of the given type
+func quote(quoteType pb.Quote_Type, price, volume int64) *pb.Quote {
+	return &pb.Quote{
+		Type:        proto.Uint32(uint32(quoteType)),
+		ScaledPrice: proto.Int64(price),
+		Volume:      &shared.Decimal{Significand: proto.Int64(volume)},
+	}
+}
+
+// domOrder returns a detailed DOM operation on an order
+func domOrder(id string, op pb.DetailedDOMOrder_Operation, volume int64) *pb.DetailedDOMOrder {
+	return &pb.DetailedDOMOrder{
+		DetailedDomOrderId: proto.String(id),
+		Operation:          proto.Uint32(uint32(op)),
+		Volume:             &shared.Decimal{Significand: proto.Int64(volume)},
+	}
+}
+
+// detailedDOM returns a complete detailed DOM message for the orders at one price
+func detailedDOM(snapshot bool, side uint32, price int64, orders ...*pb.DetailedDOMOrder) *pb.RealTimeMarketData {
+	return &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		DetailedDom: &pb.DetailedDOM{
+			IsSnapshot:            proto.Bool(snapshot),
+			IsDetailedDomComplete: proto.Bool(true),
+			PriceLevels: []*pb.DetailedDOMAtPrice{{
+				ScaledPrice: proto.Int64(price),
+				Side:        proto.Uint32(side),
+				Orders:      orders,
+			}},
+		},
+	}
+}
+
+// levelsOf returns the scaled prices and volumes of price levels
+func levelsOf(levels []PriceLevel) [][2]int64 {
+	out := make([][2]int64, 0, len(levels))
+	for _, l := range levels {
+		out = append(out, [2]int64{l.Price.Scaled, l.Volume})
+	}
+	return out
+}
+
+// checkLevels fails the test unless levels hold the expected prices and volumes
+func checkLevels(t *testing.T, side string, levels []PriceLevel, want ...[2]int64) {
+	t.Helper()
+	got := levelsOf(levels)
+	if len(got) != len(want) {
+		t.Fatalf("%s = %v, want %v", side, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("%s = %v, want %v", side, got, want)
+		}
+	}
+}
+
+func TestBookSnapshotThenDeltas(t *testing.T) {
+	b := newBook(NewPriceFormat(nil))
+
+	event := b.apply(testContractID, &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		IsSnapshot: proto.Bool(true),
+		Quotes: []*pb.Quote{
+			quote(pb.Quote_TYPE_BID, 99, 5),
+			quote(pb.Quote_TYPE_BID, 100, 3),
+			quote(pb.Quote_TYPE_ASK, 102, 4),
+			quote(pb.Quote_TYPE_ASK, 101, 2),
+		},
+	})
+	if event == nil || event.Type != BookSnapshot {
+		t.Fatalf("first event = %+v, want a snapshot", event)
+	}
+	checkLevels(t, "bids", event.Bids, [2]int64{100, 3}, [2]int64{99, 5})
+	checkLevels(t, "asks", event.Asks, [2]int64{101, 2}, [2]int64{102, 4})
+
+	// A changed level and a removed one are sent as a delta
+	event = b.apply(testContractID, &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		Quotes: []*pb.Quote{
+			quote(pb.Quote_TYPE_BID, 100, 7),
+			quote(pb.Quote_TYPE_ASK, 101, 0),
+		},
+	})
+	if event == nil || event.Type != BookDelta {
+		t.Fatalf("second event = %+v, want a delta", event)
+	}
+	checkLevels(t, "bid delta", event.Bids, [2]int64{100, 7})
+	checkLevels(t, "ask delta", event.Asks, [2]int64{101, 0})
+
+	// Nothing is published when the top of the book did not change
+	event = b.apply(testContractID, &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		Quotes:     []*pb.Quote{quote(pb.Quote_TYPE_BID, 100, 7)},
+	})
+	if event != nil {
+		t.Fatalf("unchanged book published %+v", event)
+	}
+
+	snapshot := b.snapshot(testContractID)
+	checkLevels(t, "snapshot bids", snapshot.Bids, [2]int64{100, 7}, [2]int64{99, 5})
+	checkLevels(t, "snapshot asks", snapshot.Asks, [2]int64{102, 4})
+}
+
+func TestBookDepthLimit(t *testing.T) {
+	b := newBook(NewPriceFormat(nil))
+	data := &pb.RealTimeMarketData{ContractId: proto.Uint32(testContractID), IsSnapshot: proto.Bool(true)}
+	for price := int64(1); price <= BookDepth+5; price++ {
+		data.Quotes = append(data.Quotes, quote(pb.Quote_TYPE_BID, price, 1))
+	}
+	event := b.apply(testContractID, data)
+	if len(event.Bids) != BookDepth {
+		t.Fatalf("got %d bid levels, want %d", len(event.Bids), BookDepth)
+	}
+	if best := event.Bids[0].Price.Scaled; best != BookDepth+5 {
+		t.Fatalf("best bid = %d, want %d", best, BookDepth+5)
+	}
+
+	// Removing the best bid brings the next level into the top
+	event = b.apply(testContractID, &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		Quotes:     []*pb.Quote{quote(pb.Quote_TYPE_BID, BookDepth+5, 0)},
+	})
+	checkLevels(t, "bid delta", event.Bids, [2]int64{5, 1}, [2]int64{BookDepth + 5, 0})
+}
+
+func TestBookDetailedDOM(t *testing.T) {
+	b := newBook(NewPriceFormat(nil))
+
+	event := b.apply(testContractID, detailedDOM(true, sideBuy, 100,
+		domOrder("a", pb.DetailedDOMOrder_OPERATION_INSERT, 2),
+		domOrder("b", pb.DetailedDOMOrder_OPERATION_INSERT, 3),
+	))
+	if event == nil || event.Type != BookSnapshot {
+		t.Fatalf("first event = %+v, want a snapshot", event)
+	}
+	checkLevels(t, "bids", event.Bids, [2]int64{100, 5})
+	if orders := event.Bids[0].Orders; len(orders) != 2 || orders[0].ID != "a" || orders[1].ID != "b" {
+		t.Fatalf("orders = %+v, want a then b", orders)
+	}
+
+	// Insert at the front of the queue, modify and remove
+	insert := domOrder("c", pb.DetailedDOMOrder_OPERATION_INSERT, 1)
+	insert.OrderIndex = proto.Uint32(0)
+	modify := &pb.DetailedDOMOrder{
+		DetailedDomOrderId: proto.String("b"),
+		Operation:          proto.Uint32(uint32(pb.DetailedDOMOrder_OPERATION_MODIFY)),
+		Volume:             &shared.Decimal{Significand: proto.Int64(4)},
+	}
+	remove := &pb.DetailedDOMOrder{
+		DetailedDomOrderId: proto.String("a"),
+		Operation:          proto.Uint32(uint32(pb.DetailedDOMOrder_OPERATION_REMOVE)),
+	}
+	event = b.apply(testContractID, detailedDOM(false, sideBuy, 100, insert, modify, remove))
+	if event == nil || event.Type != BookDelta {
+		t.Fatalf("second event = %+v, want a delta", event)
+	}
+	checkLevels(t, "bid delta", event.Bids, [2]int64{100, 5})
+	orders := event.Bids[0].Orders
+	if len(orders) != 2 || orders[0] != (Order{ID: "c", Volume: 1}) || orders[1] != (Order{ID: "b", Volume: 4}) {
+		t.Fatalf("orders = %+v, want c then b", orders)
+	}
+
+	// Subscribers below the detailed DOM level see the volumes only
+	stripped := event.forLevel(uint32(pb.MarketDataSubscription_LEVEL_TRADES_BBA_DOM))
+	if len(stripped.Bids[0].Orders) != 0 || len(event.Bids[0].Orders) != 2 {
+		t.Fatalf("forLevel kept orders %+v or changed the event", stripped.Bids[0].Orders)
+	}
+	if event.forLevel(uint32(pb.MarketDataSubscription_LEVEL_TRADES)) != nil {
+		t.Fatal("trades subscribers received the book")
+	}
+}
+
+func TestBookIncompleteDetailedDOM(t *testing.T) {
+	b := newBook(NewPriceFormat(nil))
+
+	// Nothing is published until the series of messages is complete
+	partial := detailedDOM(true, sideSell, 101, domOrder("a", pb.DetailedDOMOrder_OPERATION_INSERT, 2))
+	partial.DetailedDom.IsDetailedDomComplete = proto.Bool(false)
+	if event := b.apply(testContractID, partial); event != nil {
+		t.Fatalf("incomplete detailed DOM published %+v", event)
+	}
+
+	event := b.apply(testContractID, detailedDOM(false, sideSell, 102, domOrder("b", pb.DetailedDOMOrder_OPERATION_INSERT, 3)))
+	if event == nil || event.Type != BookSnapshot {
+		t.Fatalf("event = %+v, want a snapshot", event)
+	}
+	checkLevels(t, "asks", event.Asks, [2]int64{101, 2}, [2]int64{102, 3})
+}
+
+func TestBookStaleWhileDisconnected(t *testing.T) {
+	b := newBook(NewPriceFormat(nil))
+	b.apply(testContractID, &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		IsSnapshot: proto.Bool(true),
+		Quotes:     []*pb.Quote{quote(pb.Quote_TYPE_BID, 100, 1)},
+	})
+
+	event := b.setDisconnected(testContractID, true)
+	if event == nil || event.Type != BookDelta || !event.Stale || len(event.Bids) != 0 {
+		t.Fatalf("disconnect published %+v, want an empty stale delta", event)
+	}
+
+	// The snapshot sent after the reconnect replaces the book and clears the flag
+	b.setDisconnected(testContractID, false)
+	event = b.apply(testContractID, &pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		IsSnapshot: proto.Bool(true),
+		Quotes:     []*pb.Quote{quote(pb.Quote_TYPE_BID, 99, 2)},
+	})
+	if event == nil || event.Type != BookSnapshot || event.Stale {
+		t.Fatalf("resubscription published %+v, want a fresh snapshot", event)
+	}
+	checkLevels(t, "bids", event.Bids, [2]int64{99, 2})
+}
@@ -0,0 +1,250 @@
+package marketdata
+
+import (
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// TradeAmendmentType is the event type of trade amendments
+const TradeAmendmentType = "trade_amended"
+
+// Actions of trade amendments
+const (
+	ActionCancelled = "cancelled" // The trade was busted
+	ActionCorrected = "corrected" // The trade's price or volume changed
+	ActionInserted  = "inserted"  // A trade was added after the fact
+)
+
+// TradeAmendment reports a trade of the current trading day changed by a correction
+// from CQG, with the market values that result
+type TradeAmendment struct {
+	Type         string       `json:"type"`
+	ContractID   uint32       `json:"contract_id"`
+	Action       string       `json:"action"`
+	Original     *Trade       `json:"original,omitempty"` // Trade as first reported, unless inserted
+	Trade        *Trade       `json:"trade,omitempty"`    // Trade as corrected or inserted, unless cancelled
+	MarketValues MarketValues `json:"market_values"`
+
+	entry *tradeEntry
+}
+
+// tradeEntry is a trade of the current trading day that corrections can refer to
+type tradeEntry struct {
+	trade     Trade
+	price     Price
+	cancelled bool
+	record    *record
+}
+
+// record is a PocketBase record of trades, kept so that corrections to its trades can
+// be saved. Only the goroutine of the feed uses it.
+type record struct {
+	id       string        // Set once saved
+	entries  []*tradeEntry // Trades of the record in the order received
+	inserted bool          // Holds a trade inserted by a correction, created when amended
+}
+
+// trades returns the trades of the record as amended
+func (r *record) trades() []Trade {
+	trades := make([]Trade, 0, len(r.entries))
+	for _, entry := range r.entries {
+		if !entry.cancelled {
+			trades = append(trades, entry.trade)
+		}
+	}
+	return trades
+}
+
+// hasIndicator reports whether a quote carries an indicator
+func hasIndicator(quote *pb.Quote, indicator pb.Quote_Indicator) bool {
+	for _, i := range quote.GetIndicators() {
+		if i == uint32(indicator) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeletion reports whether a correction removes a quote. CQG marks deletions with an
+// indicator; without indicators a zero volume deletes.
+func isDeletion(corr *pb.Quote) bool {
+	if hasIndicator(corr, pb.Quote_INDICATOR_DELETION) {
+		return true
+	}
+	return !hasIndicator(corr, pb.Quote_INDICATOR_INSERTION) && corr.GetVolume() != nil && corr.GetVolume().GetSignificand() == 0
+}
+
+// correct applies a trade correction to the trades of the current trading day and
+// returns the amendments so far. A deletion cancels the trade with the same time, price
+// and volume, and an insertion adds a trade; a deletion followed by an insertion at the
+// same time amends the deleted trade. Corrections without indicators amend the trade at
+// their time, or insert one if there is none.
+func (d *decoder) correct(contractID uint32, corr *pb.Quote, t time.Time, amendments []*TradeAmendment) []*TradeAmendment {
+	if corr.GetType() != uint32(pb.Quote_TYPE_TRADE) || t.IsZero() {
+		return amendments
+	}
+	s := d.session
+	price := d.format.Price(corr.GetScaledPrice())
+
+	if isDeletion(corr) {
+		var volume *int64
+		if corr.GetVolume().GetSignificand() > 0 {
+			v := corr.GetVolume().GetSignificand()
+			volume = &v
+		}
+		entry := s.find(t, &price, volume)
+		if entry == nil {
+			return amendments
+		}
+		original := entry.trade
+		entry.cancelled = true
+		s.recalculate(-original.Volume)
+		return append(amendments, &TradeAmendment{
+			Type:       TradeAmendmentType,
+			ContractID: contractID,
+			Action:     ActionCancelled,
+			Original:   &original,
+			entry:      entry,
+		})
+	}
+
+	trade := d.trade(price, corr.GetVolume().GetSignificand(), t)
+
+	// An insertion right after the deletion of a trade at the same time replaces it
+	if hasIndicator(corr, pb.Quote_INDICATOR_INSERTION) {
+		if n := len(amendments); n > 0 {
+			last := amendments[n-1]
+			if last.Action == ActionCancelled && last.Original.time.Equal(t) {
+				entry := last.entry
+				entry.trade, entry.price, entry.cancelled = trade, price, false
+				s.recalculate(trade.Volume)
+				last.Action, last.Trade = ActionCorrected, &trade
+				return amendments
+			}
+		}
+	} else if entry := s.find(t, nil, nil); entry != nil {
+		original := entry.trade
+		entry.trade, entry.price = trade, price
+		s.recalculate(trade.Volume - original.Volume)
+		return append(amendments, &TradeAmendment{
+			Type:       TradeAmendmentType,
+			ContractID: contractID,
+			Action:     ActionCorrected,
+			Original:   &original,
+			Trade:      &trade,
+			entry:      entry,
+		})
+	}
+
+	// Inserted trades are stored in a record of their own
+	entry := s.insert(price, trade)
+	entry.record = &record{entries: []*tradeEntry{entry}, inserted: true}
+	return append(amendments, &TradeAmendment{
+		Type:       TradeAmendmentType,
+		ContractID: contractID,
+		Action:     ActionInserted,
+		Trade:      &trade,
+		entry:      entry,
+	})
+}
+
+// trade builds a trade at a price, volume and time
+func (d *decoder) trade(price Price, volume int64, t time.Time) Trade {
+	return Trade{
+		Price:        price.Decimal(),
+		DisplayPrice: price.Display(),
+		Volume:       volume,
+		UTCTime:      formatTime(t, time.UTC),
+		LocalTime:    formatTime(t, d.location),
+		time:         t,
+	}
+}
+
+// find returns the latest trade of the current trading day at a time that was not
+// cancelled, also matching its price and volume if given
+func (s *sessionStats) find(t time.Time, price *Price, volume *int64) *tradeEntry {
+	for i := len(s.trades) - 1; i >= 0; i-- {
+		entry := s.trades[i]
+		switch {
+		case entry.cancelled || !entry.trade.time.Equal(t):
+		case price != nil && entry.price.Scaled != price.Scaled:
+		case volume != nil && entry.trade.Volume != *volume:
+		default:
+			return entry
+		}
+	}
+	return nil
+}
+
+// insert adds a trade reported by a correction in time order and updates the statistics
+func (s *sessionStats) insert(price Price, trade Trade) *tradeEntry {
+	entry := &tradeEntry{trade: trade, price: price}
+	i := len(s.trades)
+	for i > 0 && s.trades[i-1].trade.time.After(trade.time) {
+		i--
+	}
+	s.trades = append(s.trades, nil)
+	copy(s.trades[i+1:], s.trades[i:])
+	s.trades[i] = entry
+	s.recalculate(trade.Volume)
+	return entry
+}
+
+// recalculate restores the statistics after a correction. They are rebuilt from the
+// trades of the day when every one of them is known; otherwise the volume is adjusted
+// and the last price taken from the latest trade, leaving the rest to the market values
+// CQG sends after a correction.
+func (s *sessionStats) recalculate(volumeDelta int64) {
+	v := &s.values
+	if !s.complete {
+		v.Volume += volumeDelta
+		for i := len(s.trades) - 1; i >= 0; i-- {
+			if entry := s.trades[i]; !entry.cancelled {
+				v.Last, v.Close, v.UTCTime = entry.price, entry.price, entry.trade.UTCTime
+				break
+			}
+		}
+		return
+	}
+
+	zero := s.format.Price(0)
+	v.Open, v.High, v.Low, v.Last, v.Close = zero, zero, zero, zero, zero
+	v.Volume, v.UTCTime = 0, ""
+	s.traded = false
+	for _, entry := range s.trades {
+		if entry.cancelled {
+			continue
+		}
+		price := entry.price
+		if !s.traded {
+			v.Open, v.High, v.Low = price, price, price
+			s.traded = true
+		}
+		if price.Scaled > v.High.Scaled {
+			v.High = price
+		}
+		if price.Scaled < v.Low.Scaled {
+			v.Low = price
+		}
+		v.Last, v.Close = price, price
+		v.Volume += entry.trade.Volume
+		v.UTCTime = entry.trade.UTCTime
+	}
+}
+
+// In returns the amendment with the local times of its trades in the given zone
+func (a *TradeAmendment) In(location *time.Location) *TradeAmendment {
+	zoned := *a
+	if a.Original != nil {
+		original := *a.Original
+		original.LocalTime = formatTime(original.time, location)
+		zoned.Original = &original
+	}
+	if a.Trade != nil {
+		trade := *a.Trade
+		trade.LocalTime = formatTime(trade.time, location)
+		zoned.Trade = &trade
+	}
+	return &zoned
+}
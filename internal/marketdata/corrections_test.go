@@ -0,0 +1,162 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// tradeQuote returns a trade at a time relative to testBase, with optional indicators
+func tradeQuote(price, volume, ms int64, indicators ...pb.Quote_Indicator) *pb.Quote {
+	q := quote(pb.Quote_TYPE_TRADE, price, volume)
+	q.QuoteUtcTime = proto.Int64(ms)
+	for _, i := range indicators {
+		q.Indicators = append(q.Indicators, uint32(i))
+	}
+	return q
+}
+
+// tradedDecoder returns a decoder that received trades at 100, 105 and 98 at 10:00,
+// 11:00 and 12:00 on the first trading day of the test schedule, and the update of
+// those trades
+func tradedDecoder(t *testing.T) (*decoder, *Update) {
+	t.Helper()
+	d := newDecoder(NewPriceFormat(nil), testClock, time.UTC)
+	d.session.setSchedule(testSchedule(2))
+	update := d.decode(&pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		Quotes: []*pb.Quote{
+			tradeQuote(100, 2, at(1, 10)),
+			tradeQuote(105, 1, at(1, 11)),
+			tradeQuote(98, 3, at(1, 12)),
+		},
+	})
+	checkValues(t, update.MarketValues, 100, 105, 98, 98, 6)
+	return d, update
+}
+
+// correct decodes a message carrying only corrections and returns its amendments
+func correct(d *decoder, corrections ...*pb.Quote) []*TradeAmendment {
+	return d.decode(&pb.RealTimeMarketData{
+		ContractId:  proto.Uint32(testContractID),
+		Corrections: corrections,
+	}).Amendments()
+}
+
+func TestCorrectionCancelsTrade(t *testing.T) {
+	d, traded := tradedDecoder(t)
+
+	amendments := correct(d, tradeQuote(105, 1, at(1, 11), pb.Quote_INDICATOR_DELETION))
+	if len(amendments) != 1 {
+		t.Fatalf("got %d amendments, want 1", len(amendments))
+	}
+	a := amendments[0]
+	if a.Action != ActionCancelled || a.Original == nil || a.Original.Price != "105" || a.Trade != nil {
+		t.Fatalf("amendment = %+v, want 105 cancelled", a)
+	}
+
+	// The day is rebuilt from its remaining trades, and the record drops the trade
+	checkValues(t, a.MarketValues, 100, 100, 98, 98, 5)
+	if trades := traded.record.trades(); len(trades) != 2 || trades[0].Price != "100" || trades[1].Price != "98" {
+		t.Fatalf("record trades = %+v", trades)
+	}
+
+	// A deletion matching no trade changes nothing
+	if amendments := correct(d, tradeQuote(105, 1, at(1, 11), pb.Quote_INDICATOR_DELETION)); len(amendments) != 0 {
+		t.Fatalf("second cancel gave %+v", amendments)
+	}
+}
+
+func TestCorrectionAmendsTrade(t *testing.T) {
+	d, _ := tradedDecoder(t)
+
+	// Without indicators a correction replaces the trade at its time
+	amendments := correct(d, tradeQuote(99, 4, at(1, 12)))
+	if len(amendments) != 1 {
+		t.Fatalf("got %d amendments, want 1", len(amendments))
+	}
+	a := amendments[0]
+	if a.Action != ActionCorrected || a.Original.Price != "98" || a.Trade.Price != "99" || a.Trade.Volume != 4 {
+		t.Fatalf("amendment = %+v, want 98 corrected to 99", a)
+	}
+	checkValues(t, a.MarketValues, 100, 105, 99, 99, 7)
+
+	// A deletion followed by an insertion at the same time is one correction
+	amendments = correct(d,
+		tradeQuote(100, 2, at(1, 10), pb.Quote_INDICATOR_DELETION),
+		tradeQuote(101, 2, at(1, 10), pb.Quote_INDICATOR_INSERTION),
+	)
+	if len(amendments) != 1 {
+		t.Fatalf("got %d amendments, want 1", len(amendments))
+	}
+	a = amendments[0]
+	if a.Action != ActionCorrected || a.Original.Price != "100" || a.Trade.Price != "101" {
+		t.Fatalf("amendment = %+v, want 100 corrected to 101", a)
+	}
+	checkValues(t, a.MarketValues, 101, 105, 99, 99, 7)
+}
+
+func TestCorrectionInsertsTrade(t *testing.T) {
+	d, traded := tradedDecoder(t)
+
+	amendments := correct(d, tradeQuote(97, 1, at(1, 11)+500, pb.Quote_INDICATOR_INSERTION))
+	if len(amendments) != 1 {
+		t.Fatalf("got %d amendments, want 1", len(amendments))
+	}
+	a := amendments[0]
+	if a.Action != ActionInserted || a.Original != nil || a.Trade.Price != "97" {
+		t.Fatalf("amendment = %+v, want 97 inserted", a)
+	}
+
+	// The inserted trade is in time order: the last price stays with the 12:00 trade
+	checkValues(t, a.MarketValues, 100, 105, 97, 98, 7)
+	if a.entry.record == traded.record || !a.entry.record.inserted {
+		t.Fatal("inserted trade was added to the record of the original trades")
+	}
+
+	zoned := a.In(time.FixedZone("UTC+2", 2*60*60))
+	if zoned.Trade.LocalTime != "2026-03-02T13:00:00.500+02:00" || a.Trade.LocalTime != "2026-03-02T11:00:00.500Z" {
+		t.Fatalf("local times = %s and %s", zoned.Trade.LocalTime, a.Trade.LocalTime)
+	}
+}
+
+func TestCorrectionWithIncompleteDay(t *testing.T) {
+	d := newDecoder(NewPriceFormat(nil), testClock, time.UTC)
+	d.session.setSchedule(testSchedule(2))
+
+	// The snapshot shows trades this feed did not see
+	d.decode(&pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		IsSnapshot: proto.Bool(true),
+		MarketValues: []*pb.MarketValues{{
+			DayIndex:                    proto.Int32(0),
+			TradeDate:                   proto.Int64(at(1, 0)),
+			ScaledOpenPrice:             proto.Int64(90),
+			ScaledHighPrice:             proto.Int64(120),
+			ScaledLowPrice:              proto.Int64(80),
+			ScaledLastPriceNoSettlement: proto.Int64(100),
+			TotalVolume:                 &shared.Decimal{Significand: proto.Int64(100)},
+		}},
+	})
+	d.decode(&pb.RealTimeMarketData{
+		ContractId: proto.Uint32(testContractID),
+		Quotes: []*pb.Quote{
+			tradeQuote(101, 1, at(1, 10)),
+			tradeQuote(102, 1, at(1, 11)),
+		},
+	})
+	if d.session.complete {
+		t.Fatal("trades after the snapshot are taken as the whole day")
+	}
+
+	// Only the volume and last price can be adjusted
+	amendments := correct(d, tradeQuote(102, 1, at(1, 11), pb.Quote_INDICATOR_DELETION))
+	if len(amendments) != 1 {
+		t.Fatalf("got %d amendments, want 1", len(amendments))
+	}
+	checkValues(t, amendments[0].MarketValues, 90, 120, 80, 101, 101)
+}
@@ -0,0 +1,562 @@
+package marketdata
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go-websocket/internal/client"
+	"go-websocket/internal/config"
+	"go-websocket/internal/services"
+	pb "go-websocket/proto/WebAPI"
+)
+
+// subscriberQueueSize is the number of events queued per subscriber before further
+// events are dropped for that subscriber
+const subscriberQueueSize = 256
+
+// tradingDaysAhead is the number of trading days requested at a time for a contract
+const tradingDaysAhead = 5
+
+// scheduleRetry is the least time between two requests for the trading days of a contract
+const scheduleRetry = 15 * time.Minute
+
+// Event is delivered to subscribers: a decoded update, an order book change, a
+// subscription status, a trade amended by a correction or a connection notice
+type Event struct {
+	Update    *Update
+	Book      *BookEvent
+	Status    *SubscriptionStatus
+	Amendment *TradeAmendment
+	Notice    *client.ConnectionNotice
+}
+
+// Hub shares one upstream market data subscription per contract between any number of
+// subscribers. Each message is decoded and stored once and then broadcast to every
+// subscriber through its own bounded queue. The upstream level is the highest level
+// requested by the subscribers, and the subscription is dropped when the last one leaves,
+// as is the subscription keeping the metadata of the contract current.
+type Hub struct {
+	cfg   *config.Config
+	store *storeQueue
+
+	upstreamMu sync.Mutex // Serializes changes to upstream subscriptions
+	mu         sync.Mutex // Guards feeds and their subscribers
+	feeds      map[feedKey]*feed
+}
+
+// feedKey identifies the market data of a contract on a CQG session
+type feedKey struct {
+	client     *client.CQGClient
+	contractID uint32
+}
+
+// feed is the upstream subscription of one contract and its subscribers
+type feed struct {
+	hub               *Hub
+	key               feedKey
+	listener          *client.Listener
+	decoder           *decoder
+	book              *book                            // Guarded by hub.mu so that new subscribers get a consistent snapshot
+	level             uint32                           // Level of the upstream subscription
+	requestID         uint32                           // Request ID of the latest upstream subscription
+	metadataID        uint32                           // Request ID of the contract metadata subscription, guarded by hub.upstreamMu
+	status            *pb.MarketDataSubscriptionStatus // Answer to the latest upstream subscription, nil while pending
+	scheduleRequested time.Time                        // Last request for the trading days of the contract
+	subscribers       map[*Subscription]struct{}
+}
+
+// Subscription receives the events of one contract at a given level. The caller must
+// Close it when done.
+type Subscription struct {
+	C          <-chan Event // Closed when the subscription or the CQG session is closed
+	ContractID uint32
+
+	ch     chan Event
+	feed   *feed
+	level  uint32
+	closed bool
+}
+
+// NewHub creates a hub that stores published updates in PocketBase
+func NewHub(cfg *config.Config, store *services.PocketBase) *Hub {
+	return &Hub{
+		cfg:   cfg,
+		store: newStoreQueue(store),
+		feeds: make(map[feedKey]*feed),
+	}
+}
+
+// Subscribe attaches a subscriber to the market data of a contract, subscribing upstream
+// or raising the upstream level if needed
+func (h *Hub) Subscribe(ctx context.Context, c *client.CQGClient, contractID, level uint32) (*Subscription, error) {
+	h.upstreamMu.Lock()
+	defer h.upstreamMu.Unlock()
+
+	h.mu.Lock()
+	f := h.lookup(c, contractID)
+	if f == nil {
+		f = h.newFeed(c, contractID)
+	}
+	ch := make(chan Event, subscriberQueueSize)
+	sub := &Subscription{C: ch, ContractID: contractID, ch: ch, feed: f, level: level}
+	f.subscribers[sub] = struct{}{}
+
+	// Start late joiners from the current book; deltas follow in order
+	f.sendSnapshotLocked(sub)
+	h.mu.Unlock()
+
+	if err := h.watchMetadata(ctx, f); err != nil {
+		h.remove(sub)
+		return nil, err
+	}
+	changed, err := h.syncLevel(ctx, f)
+	if err != nil {
+		h.remove(sub)
+		h.releaseMetadata(ctx, f)
+		return nil, err
+	}
+
+	// A new upstream subscription reports its status to every subscriber when answered;
+	// otherwise report the status of the subscription joined
+	h.mu.Lock()
+	if !changed && f.status != nil {
+		f.sendLocked(sub, Event{Status: newSubscriptionStatus(f.status, level)})
+	}
+	h.mu.Unlock()
+	return sub, nil
+}
+
+// lookup finds the feed of a contract. Feeds are keyed by the contract ID they were
+// created with, so a feed whose contract was renumbered after a reconnect is found
+// through its listener and moved to the new ID. The caller must hold h.mu.
+func (h *Hub) lookup(c *client.CQGClient, contractID uint32) *feed {
+	key := feedKey{client: c, contractID: contractID}
+	if f, ok := h.feeds[key]; ok {
+		return f
+	}
+	for oldKey, f := range h.feeds {
+		if oldKey.client == c && f.listener.ContractID() == contractID {
+			delete(h.feeds, oldKey)
+			f.key = key
+			h.feeds[key] = f
+			return f
+		}
+	}
+	return nil
+}
+
+// newFeed attaches to a contract and starts decoding its messages. The caller must hold h.mu.
+func (h *Hub) newFeed(c *client.CQGClient, contractID uint32) *feed {
+	format := NewPriceFormat(c.ContractMetadata(contractID))
+	log.Printf("Using price scale: %v for contract: %v", format.scale, contractID)
+
+	f := &feed{
+		hub:         h,
+		key:         feedKey{client: c, contractID: contractID},
+		listener:    c.ListenContract(contractID),
+		decoder:     newDecoder(format, c.Time, h.cfg.Location),
+		book:        newBook(format),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+	h.feeds[f.key] = f
+
+	go f.run()
+	return f
+}
+
+// syncLevel moves the upstream subscription of a feed to the highest level requested
+// by its subscribers, unsubscribing when none is left, and reports whether it changed.
+// The caller must hold h.upstreamMu.
+func (h *Hub) syncLevel(ctx context.Context, f *feed) (bool, error) {
+	h.mu.Lock()
+	want := uint32(pb.MarketDataSubscription_LEVEL_NONE)
+	for sub := range f.subscribers {
+		if levelRank(sub.level) > levelRank(want) {
+			want = sub.level
+		}
+	}
+	current := f.level
+	c := f.key.client
+	if want == current || c.Closed() {
+		h.mu.Unlock()
+		return false, nil
+	}
+
+	// Record the new level before sending, so that a status answering it applies to it
+	f.level = want
+	f.status = nil
+	h.mu.Unlock()
+
+	contractID := f.listener.ContractID()
+	var requestID uint32
+	var err error
+	if want == uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+		err = c.UnsubscribeMarketData(ctx, contractID)
+	} else {
+		requestID, err = c.SubscribeMarketData(ctx, contractID, want)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		f.level = current
+		return false, err
+	}
+	f.requestID = requestID
+	return true, nil
+}
+
+// watchMetadata subscribes to the metadata of the contract of a feed unless it already
+// is. The caller must hold h.upstreamMu.
+func (h *Hub) watchMetadata(ctx context.Context, f *feed) error {
+	if f.metadataID != 0 {
+		return nil
+	}
+	requestID, err := f.key.client.SubscribeContractMetadata(ctx, f.listener.ContractID())
+	if err != nil {
+		return err
+	}
+	f.metadataID = requestID
+	return nil
+}
+
+// releaseMetadata cancels the metadata subscription of a feed left without subscribers.
+// The caller must hold h.upstreamMu.
+func (h *Hub) releaseMetadata(ctx context.Context, f *feed) {
+	h.mu.Lock()
+	inUse := len(f.subscribers) > 0
+	h.mu.Unlock()
+	if inUse || f.metadataID == 0 {
+		return
+	}
+
+	c := f.key.client
+	requestID := f.metadataID
+	f.metadataID = 0
+	if c.Closed() {
+		return
+	}
+	if err := c.UnsubscribeContractMetadata(ctx, requestID); err != nil {
+		log.Println("metadata unsubscribe error:", err)
+	}
+}
+
+// remove detaches a subscriber and closes its channel, detaching the feed from the
+// session when it was the last one. It reports whether the subscriber was attached.
+func (h *Hub) remove(sub *Subscription) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sub.closed {
+		return false
+	}
+	sub.closed = true
+	close(sub.ch)
+
+	f := sub.feed
+	delete(f.subscribers, sub)
+	if len(f.subscribers) == 0 {
+		if h.feeds[f.key] == f {
+			delete(h.feeds, f.key)
+		}
+		f.listener.Close()
+	}
+	return true
+}
+
+// Level returns the level requested by the subscriber
+func (s *Subscription) Level() uint32 {
+	h := s.feed.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return s.level
+}
+
+// RequestID returns the request ID of the upstream subscription serving the subscriber
+func (s *Subscription) RequestID() uint32 {
+	h := s.feed.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return s.feed.requestID
+}
+
+// PriceFormat returns the price format of the contract
+func (s *Subscription) PriceFormat() *PriceFormat {
+	return s.feed.decoder.format
+}
+
+// SetLevel changes the level requested by the subscriber and adjusts the upstream
+// subscription accordingly
+func (s *Subscription) SetLevel(ctx context.Context, level uint32) error {
+	h := s.feed.hub
+	h.upstreamMu.Lock()
+	defer h.upstreamMu.Unlock()
+
+	h.mu.Lock()
+	previous := s.level
+	s.level = level
+
+	// Resend the book as seen at the new level
+	if level != previous && !s.closed {
+		s.feed.sendSnapshotLocked(s)
+	}
+	h.mu.Unlock()
+
+	changed, err := h.syncLevel(ctx, s.feed)
+	if err != nil {
+		h.mu.Lock()
+		s.level = previous
+		h.mu.Unlock()
+		return err
+	}
+
+	// Report the status at the new level unless a new one is on its way
+	h.mu.Lock()
+	if !changed && s.feed.status != nil && !s.closed {
+		s.feed.sendLocked(s, Event{Status: newSubscriptionStatus(s.feed.status, level)})
+	}
+	h.mu.Unlock()
+	return nil
+}
+
+// Close detaches the subscriber and lowers or drops the upstream subscription if it
+// was the highest or last subscriber of the contract
+func (s *Subscription) Close() {
+	h := s.feed.hub
+	h.upstreamMu.Lock()
+	defer h.upstreamMu.Unlock()
+
+	if !h.remove(s) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeouts.Upstream)
+	defer cancel()
+	if _, err := h.syncLevel(ctx, s.feed); err != nil {
+		log.Println("unsubscribe error:", err)
+	}
+	h.releaseMetadata(ctx, s.feed)
+}
+
+// run decodes the messages of a feed and broadcasts them until its listener is closed
+func (f *feed) run() {
+	notices := f.listener.Notices
+	for {
+		select {
+		case notice, ok := <-notices:
+			// Pass upstream gaps on to every subscriber
+			if !ok {
+				notices = nil
+				continue
+			}
+			f.broadcast(Event{Notice: &notice})
+
+			// The book is stale until CQG sends a new snapshot
+			if notice.State == client.StateDisconnected {
+				f.hub.mu.Lock()
+				if event := f.book.setDisconnected(f.key.contractID, true); event != nil {
+					f.broadcastLocked(Event{Book: event})
+				}
+				f.hub.mu.Unlock()
+			}
+
+		case serverMsg, ok := <-f.listener.C:
+			if !ok {
+				if errors.Is(f.listener.Err(), client.ErrListenerOverflow) && f.resubscribe() {
+					// Updates were lost; start over from a new snapshot
+					notices = f.listener.Notices
+					continue
+				}
+				f.close()
+				return
+			}
+
+			for _, status := range serverMsg.GetMarketDataSubscriptionStatuses() {
+				f.handleStatus(status)
+			}
+
+			for _, rtData := range serverMsg.GetRealTimeMarketData() {
+				// Rebuild the order book and top of book and publish their changes
+				f.hub.mu.Lock()
+				if event := f.book.apply(rtData.GetContractId(), rtData); event != nil {
+					f.broadcastLocked(Event{Book: event})
+				}
+				update := f.decoder.decode(rtData)
+
+				// Only publish updates with valid trades, a new best bid or offer or a
+				// new trading day
+				if update.published() {
+					f.broadcastLocked(Event{Update: update})
+				}
+				for _, amendment := range update.amendments {
+					f.broadcastLocked(Event{Amendment: amendment})
+				}
+
+				// Keep the trading day schedule ahead of the market
+				if f.decoder.session.needsSchedule() && time.Since(f.scheduleRequested) >= scheduleRetry {
+					f.scheduleRequested = time.Now()
+					go f.loadSchedule(f.listener.ContractID())
+				}
+				f.hub.mu.Unlock()
+
+				// Save trades to PocketBase
+				f.hub.store.save(update)
+			}
+		}
+	}
+}
+
+// broadcast queues an event for every subscriber without blocking on slow ones
+func (f *feed) broadcast(event Event) {
+	f.hub.mu.Lock()
+	defer f.hub.mu.Unlock()
+
+	f.broadcastLocked(event)
+}
+
+// broadcastLocked queues an event for every subscriber that receives it at its level.
+// The caller must hold hub.mu.
+func (f *feed) broadcastLocked(event Event) {
+	for sub := range f.subscribers {
+		subEvent := event
+		if event.Book != nil {
+			if subEvent.Book = event.Book.forLevel(sub.level); subEvent.Book == nil {
+				continue
+			}
+		}
+		if event.Update != nil {
+			if subEvent.Update = event.Update.forLevel(sub.level); subEvent.Update == nil {
+				continue
+			}
+		}
+		f.sendLocked(sub, subEvent)
+	}
+}
+
+// sendSnapshotLocked sends a subscriber the current book and top of book as seen at
+// its level. The caller must hold hub.mu.
+func (f *feed) sendSnapshotLocked(sub *Subscription) {
+	if snapshot := f.book.snapshot(f.listener.ContractID()); snapshot != nil {
+		if event := snapshot.forLevel(sub.level); event != nil {
+			f.sendLocked(sub, Event{Book: event})
+		}
+	}
+	if update := f.decoder.snapshot(f.listener.ContractID()); update != nil {
+		if update = update.forLevel(sub.level); update != nil {
+			f.sendLocked(sub, Event{Update: update})
+		}
+	}
+}
+
+// sendLocked queues an event for one subscriber without blocking.
+// The caller must hold hub.mu.
+func (f *feed) sendLocked(sub *Subscription, event Event) {
+	select {
+	case sub.ch <- event:
+	default:
+		log.Printf("subscriber queue full, dropping market data event for contract %d", sub.ContractID)
+	}
+}
+
+// handleStatus records the answer to the upstream subscription and tells every
+// subscriber what it receives. A rejected subscription is retried on the next change.
+func (f *feed) handleStatus(status *pb.MarketDataSubscriptionStatus) {
+	f.hub.mu.Lock()
+	defer f.hub.mu.Unlock()
+
+	if rejected(status) {
+		log.Printf("market data subscription for contract %d rejected: %s", status.GetContractId(), newSubscriptionStatus(status, 0).Status)
+		f.level = uint32(pb.MarketDataSubscription_LEVEL_NONE)
+	} else if status.GetStatusCode() == uint32(pb.MarketDataSubscriptionStatus_STATUS_CODE_SUCCESS) && status.GetLevel() != f.level && f.level != uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+		log.Printf("market data subscription for contract %d lowered from level %d to %d", status.GetContractId(), f.level, status.GetLevel())
+	}
+	f.status = status
+
+	for sub := range f.subscribers {
+		f.sendLocked(sub, Event{Status: newSubscriptionStatus(status, sub.level)})
+	}
+}
+
+// loadSchedule requests the upcoming trading days of the contract, so that its session
+// statistics reset when a new trading day begins. Without them the statistics reset
+// only when CQG reports a new trade date.
+func (f *feed) loadSchedule(contractID uint32) {
+	c := f.key.client
+	metadata := c.ContractMetadata(contractID)
+	if metadata.GetSessionInfoId() == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.hub.cfg.Timeouts.Upstream)
+	defer cancel()
+	ranges, err := c.RequestTradingDays(ctx, metadata.GetSessionInfoId(), time.Now(), tradingDaysAhead)
+	if err != nil {
+		log.Printf("trading days of contract %d unavailable: %v", f.key.contractID, err)
+		return
+	}
+
+	f.hub.mu.Lock()
+	defer f.hub.mu.Unlock()
+	f.decoder.session.setSchedule(scheduleFrom(ranges, c.Time))
+}
+
+// resubscribe replaces the listener of a feed that fell behind and subscribes again at
+// the current level, so that CQG sends a new snapshot to rebuild the book and session
+// statistics from. The book is marked stale until the snapshot arrives. It reports
+// false if the last subscriber left meanwhile.
+func (f *feed) resubscribe() bool {
+	h := f.hub
+	h.upstreamMu.Lock()
+	defer h.upstreamMu.Unlock()
+
+	c := f.key.client
+	h.mu.Lock()
+	if len(f.subscribers) == 0 {
+		h.mu.Unlock()
+		return false
+	}
+	contractID := f.listener.ContractID()
+	log.Printf("market data of contract %d fell behind, subscribing again", contractID)
+	f.listener = c.ListenContract(contractID)
+	if event := f.book.setDisconnected(f.key.contractID, true); event != nil {
+		f.broadcastLocked(Event{Book: event})
+	}
+	level := f.level
+	h.mu.Unlock()
+
+	if level == uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeouts.Upstream)
+	defer cancel()
+	requestID, err := c.SubscribeMarketData(ctx, contractID, level)
+	if err != nil {
+		log.Println("resubscribe error:", err)
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f.requestID = requestID
+	return true
+}
+
+// close ends a feed whose listener was closed, closing the channels of subscribers
+// still attached when the CQG session itself went away
+func (f *feed) close() {
+	h := f.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.feeds[f.key] == f {
+		delete(h.feeds, f.key)
+	}
+	for sub := range f.subscribers {
+		sub.closed = true
+		close(sub.ch)
+	}
+	f.subscribers = make(map[*Subscription]struct{})
+}
@@ -0,0 +1,68 @@
+package marketdata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// levelNames maps the names accepted for subscription levels to CQG levels
+var levelNames = map[string]pb.MarketDataSubscription_Level{
+	"trades":             pb.MarketDataSubscription_LEVEL_TRADES,
+	"trades_bba":         pb.MarketDataSubscription_LEVEL_TRADES_BBA,
+	"trades_bba_volumes": pb.MarketDataSubscription_LEVEL_TRADES_BBA_VOLUMES,
+	"dom":                pb.MarketDataSubscription_LEVEL_TRADES_BBA_DOM,
+	"detailed_dom":       pb.MarketDataSubscription_LEVEL_TRADES_BBA_DETAILED_DOM,
+	"settlements":        pb.MarketDataSubscription_LEVEL_SETTLEMENTS,
+	"market_values":      pb.MarketDataSubscription_LEVEL_END_OF_DAY,
+}
+
+// ParseLevel parses a subscription level given by name, such as "dom", or by its CQG
+// number. Level none is rejected; unsubscribing is done by closing the subscription.
+func ParseLevel(value string) (uint32, error) {
+	if level, ok := levelNames[strings.ToLower(value)]; ok {
+		return uint32(level), nil
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || levelRank(uint32(n)) == 0 {
+		return 0, fmt.Errorf("invalid level: %q", value)
+	}
+	return uint32(n), nil
+}
+
+// LevelName returns the name of a subscription level as accepted by ParseLevel
+func LevelName(level uint32) string {
+	for name, l := range levelNames {
+		if uint32(l) == level {
+			return name
+		}
+	}
+	if level == uint32(pb.MarketDataSubscription_LEVEL_NONE) {
+		return "none"
+	}
+	return strconv.FormatUint(uint64(level), 10)
+}
+
+// levelRank orders subscription levels by the amount of data they include
+func levelRank(level uint32) int {
+	switch pb.MarketDataSubscription_Level(level) {
+	case pb.MarketDataSubscription_LEVEL_SETTLEMENTS:
+		return 1
+	case pb.MarketDataSubscription_LEVEL_END_OF_DAY:
+		return 2
+	case pb.MarketDataSubscription_LEVEL_TRADES:
+		return 3
+	case pb.MarketDataSubscription_LEVEL_TRADES_BBA:
+		return 4
+	case pb.MarketDataSubscription_LEVEL_TRADES_BBA_VOLUMES:
+		return 5
+	case pb.MarketDataSubscription_LEVEL_TRADES_BBA_DOM:
+		return 6
+	case pb.MarketDataSubscription_LEVEL_TRADES_BBA_DETAILED_DOM:
+		return 7
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,244 @@
+package marketdata
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// maxScaleDigits is the largest number of decimals of a price scale read exactly
+const maxScaleDigits = 15
+
+// PriceFormat converts the scaled integer prices of a contract into exact prices and
+// renders them in the contract's native display format. It is built from the contract
+// metadata and shared by every price of the contract.
+type PriceFormat struct {
+	scale        float64 // CorrectPriceScale
+	scaleNum     int64   // CorrectPriceScale as scaleNum / 10^scaleDigits, if exact
+	scaleDigits  int
+	exact        bool
+	displayScale uint32 // DisplayPriceScale: decimals up to 15, fractions from 101
+	tickSize     float64
+	tickSizes    []*pb.TickSizeByPrice
+}
+
+// PriceFormatInfo describes a price format to clients
+type PriceFormatInfo struct {
+	CorrectPriceScale float64 `json:"correct_price_scale"`
+	DisplayPriceScale uint32  `json:"display_price_scale"`
+	TickSize          float64 `json:"tick_size"`
+	VariableTickSize  bool    `json:"variable_tick_size"`
+}
+
+// NewPriceFormat creates the price format of a contract. Missing metadata gives a
+// scale of 1.
+func NewPriceFormat(metadata *pb.ContractMetadata) *PriceFormat {
+	f := &PriceFormat{
+		scale:        metadata.GetCorrectPriceScale(),
+		displayScale: metadata.GetDisplayPriceScale(),
+		tickSize:     metadata.GetTickSize(),
+		tickSizes:    metadata.GetTickSizesByPrice(),
+	}
+	if f.scale == 0 {
+		f.scale = 1
+	}
+
+	// Price scales are decimal fractions such as 0.01 or 0.0078125 (1/128); find the
+	// fewest decimals that represent the scale exactly
+	pow := 1.0
+	for digits := 0; digits <= maxScaleDigits; digits++ {
+		n := f.scale * pow
+		if r := math.Round(n); r != 0 && math.Abs(n-r) <= 1e-9*math.Abs(n) {
+			f.scaleNum, f.scaleDigits, f.exact = int64(r), digits, true
+			break
+		}
+		pow *= 10
+	}
+	return f
+}
+
+// Price returns the price of a scaled integer sent by CQG
+func (f *PriceFormat) Price(scaled int64) Price {
+	return Price{Scaled: scaled, format: f}
+}
+
+// Info describes the format for clients
+func (f *PriceFormat) Info() PriceFormatInfo {
+	return PriceFormatInfo{
+		CorrectPriceScale: f.scale,
+		DisplayPriceScale: f.displayScale,
+		TickSize:          f.tickSize,
+		VariableTickSize:  len(f.tickSizes) > 0,
+	}
+}
+
+// TickSize returns the tick size at a price, following the variable tick sizes of the
+// contract if it has any. A positive boundary starts the range [boundary, next), a
+// negative one ends the range (previous, boundary] and zero belongs to both sides.
+func (f *PriceFormat) TickSize(p Price) float64 {
+	price := p.Float()
+	tickSize := f.tickSize
+	best := math.Inf(1)
+	for _, t := range f.tickSizes {
+		boundary := t.GetBoundaryPrice()
+		var distance float64
+		switch {
+		case price >= 0 && boundary >= 0 && boundary <= price:
+			distance = price - boundary
+		case price <= 0 && boundary <= 0 && boundary >= price:
+			distance = boundary - price
+		default:
+			continue
+		}
+		if distance < best {
+			best, tickSize = distance, t.GetTickSize()
+		}
+	}
+	return tickSize
+}
+
+// halved returns the format of prices scaled by half the scale, such as mid-prices.
+// Fractional formats move to the next finer fraction, or to plain decimals when no
+// finer one exists.
+func (f *PriceFormat) halved() *PriceFormat {
+	h := *f
+	h.scale = f.scale / 2
+	h.scaleNum, h.scaleDigits = f.scaleNum*5, f.scaleDigits+1
+	switch scale := f.displayScale; {
+	case scale < maxScaleDigits:
+		h.displayScale = scale + 1
+	case scale >= 101 && scale < 110:
+		h.displayScale = scale + 1
+	case scale == 201, scale == 202, scale == 204:
+		// Halves to quarters to eighths of a 32nd, and halves to quarters of a 64th
+		h.displayScale = scale + 1
+	case scale == 203:
+		// Eighths to sixteenths of a 32nd
+		h.displayScale = 206
+	case scale == 110, scale == 205, scale == 206:
+		// No finer fraction; a display scale of 0 shows every decimal the price needs
+		h.displayScale = 0
+	}
+	return &h
+}
+
+// Price is an exact contract price: the scaled integer sent by CQG and the format of
+// its contract. It marshals to a JSON number carrying the exact decimal digits.
+type Price struct {
+	Scaled int64
+	format *PriceFormat
+}
+
+// rat returns the price as an exact rational number
+func (p Price) rat() *big.Rat {
+	f := p.format
+	if f == nil {
+		return new(big.Rat).SetInt64(p.Scaled)
+	}
+	if !f.exact {
+		r, _ := new(big.Rat).SetString(strconv.FormatFloat(float64(p.Scaled)*f.scale, 'f', -1, 64))
+		return r
+	}
+	den := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(f.scaleDigits)), nil)
+	num := new(big.Int).Mul(big.NewInt(p.Scaled), big.NewInt(f.scaleNum))
+	return new(big.Rat).SetFrac(num, den)
+}
+
+// Float returns the price as a float, for arithmetic that need not be exact
+func (p Price) Float() float64 {
+	v, _ := p.rat().Float64()
+	return v
+}
+
+// Decimal returns the exact price in decimal notation without trailing zeros
+func (p Price) Decimal() string {
+	digits := 0
+	if p.format != nil {
+		digits = p.format.scaleDigits
+		if !p.format.exact {
+			digits = maxScaleDigits
+		}
+	}
+	s := p.rat().FloatString(digits)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// Display renders the price in the native format of its contract: decimals as given
+// by the display price scale, or whole units and fractions such as 32nds, e.g.
+// "110'162" for 110 and 16.25/32 in quarter 32nds.
+func (p Price) Display() string {
+	f := p.format
+	if f == nil {
+		return p.Decimal()
+	}
+
+	scale := f.displayScale
+	switch {
+	case scale <= maxScaleDigits:
+		// Show the display decimals, or more if the price needs them
+		d := p.Decimal()
+		if i := strings.Index(d, "."); i >= 0 && len(d)-i-1 > int(scale) {
+			return d
+		}
+		return p.rat().FloatString(int(scale))
+	case scale >= 101 && scale <= 110:
+		return p.fraction(1<<(scale-100), 1, 0)
+	case scale == 201:
+		return p.fraction(32, 2, 1)
+	case scale == 202:
+		return p.fraction(32, 4, 1)
+	case scale == 203:
+		return p.fraction(32, 8, 3)
+	case scale == 204:
+		return p.fraction(64, 2, 1)
+	case scale == 205:
+		return p.fraction(64, 4, 1)
+	case scale == 206:
+		return p.fraction(32, 16, 4)
+	default:
+		return p.Decimal()
+	}
+}
+
+// fraction renders whole units and a fraction in units of 1/den, followed by parts of
+// that unit in 1/sub as subDigits truncated decimals, e.g. 32nds with quarters as "2"
+// for .25, "5" for .5 and "7" for .75
+func (p Price) fraction(den, sub int64, subDigits int) string {
+	r := p.rat()
+	sign := ""
+	if r.Sign() < 0 {
+		sign = "-"
+		r.Neg(r)
+	}
+
+	// Count the price in the smallest unit, 1/(den*sub), truncating anything finer
+	units := new(big.Rat).Mul(r, new(big.Rat).SetInt64(den*sub))
+	n := new(big.Int).Quo(units.Num(), units.Denom()).Int64()
+
+	whole := n / (den * sub)
+	frac := n % (den * sub)
+	width := len(strconv.FormatInt(den-1, 10))
+	s := fmt.Sprintf("%s%d'%0*d", sign, whole, width, frac/sub)
+	if subDigits > 0 {
+		part := strconv.FormatFloat(float64(frac%sub)/float64(sub), 'f', subDigits+2, 64)
+		s += part[2 : 2+subDigits]
+	}
+	return s
+}
+
+// String returns the exact decimal price
+func (p Price) String() string {
+	return p.Decimal()
+}
+
+// MarshalJSON writes the price as a JSON number with its exact digits
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.Decimal()), nil
+}
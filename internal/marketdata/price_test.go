@@ -0,0 +1,142 @@
+package marketdata
+
+import (
+	"encoding/json"
+	"testing"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// priceFormat returns the format of a contract with the given scales and tick size
+func priceFormat(scale float64, displayScale uint32, tickSize float64) *PriceFormat {
+	return NewPriceFormat(&pb.ContractMetadata{
+		CorrectPriceScale: proto.Float64(scale),
+		DisplayPriceScale: proto.Uint32(displayScale),
+		TickSize:          proto.Float64(tickSize),
+	})
+}
+
+func TestPriceDecimal(t *testing.T) {
+	tests := []struct {
+		name   string
+		format *PriceFormat
+		scaled int64
+		want   string
+	}{
+		{"cents", priceFormat(0.01, 2, 0.01), 12345, "123.45"},
+		{"trailing zero", priceFormat(0.01, 2, 0.01), 12340, "123.4"},
+		{"whole", priceFormat(0.01, 2, 0.01), 12300, "123"},
+		{"negative", priceFormat(0.01, 2, 0.01), -5, "-0.05"},
+		{"128ths", priceFormat(0.0078125, 202, 0.015625), 14145, "110.5078125"},
+		{"scale above one", priceFormat(25, 0, 25), 3, "75"},
+		{"missing metadata", NewPriceFormat(nil), 42, "42"},
+		{"no format", nil, 42, "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Price{Scaled: tt.scaled, format: tt.format}
+			if got := p.Decimal(); got != tt.want {
+				t.Errorf("Decimal() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriceDisplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		format *PriceFormat
+		scaled int64
+		want   string
+	}{
+		{"display decimals", priceFormat(0.01, 2, 0.01), 12340, "123.40"},
+		{"more decimals than displayed", priceFormat(0.001, 2, 0.001), 12345, "12.345"},
+		{"eighths", priceFormat(0.125, 103, 0.125), 83, "10'3"},
+		{"negative eighths", priceFormat(0.125, 103, 0.125), -11, "-1'3"},
+		{"32nds", priceFormat(0.03125, 105, 0.03125), 3521, "110'01"},
+		{"32nds and quarters", priceFormat(0.0078125, 202, 0.0078125), 14145, "110'162"},
+		{"32nds and halves", priceFormat(0.0078125, 202, 0.0078125), 14146, "110'165"},
+		{"32nds and three quarters", priceFormat(0.0078125, 202, 0.0078125), 14147, "110'167"},
+		{"unknown display scale", priceFormat(0.01, 150, 0.01), 12345, "123.45"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.format.Price(tt.scaled)
+			if got := p.Display(); got != tt.want {
+				t.Errorf("Display() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriceMarshalJSON(t *testing.T) {
+	format := priceFormat(0.0078125, 202, 0.0078125)
+	data, err := json.Marshal(map[string]Price{"price": format.Price(14145)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{"price":110.5078125}`; got != want {
+		t.Fatalf("Marshal = %s, want %s", got, want)
+	}
+}
+
+func TestPriceHalved(t *testing.T) {
+	// Mid-prices need one more decimal than the contract's prices
+	mid := priceFormat(0.25, 2, 0.25).halved().Price(201)
+	if got, want := mid.Display(), "25.125"; got != want {
+		t.Fatalf("Display() = %q, want %q", got, want)
+	}
+
+	// Fractions move to the next finer one, or to decimals past the finest
+	tests := []struct {
+		name   string
+		format *PriceFormat
+		scaled int64 // Of the halved format
+		want   string
+	}{
+		{"32nds and halves", priceFormat(0.015625, 201, 0.015625), 14145, "110'162"},
+		{"32nds and quarters", priceFormat(0.0078125, 202, 0.0078125), 28291, "110'16375"},
+		{"32nds and eighths", priceFormat(0.00390625, 203, 0.00390625), 56583, "110'164375"},
+		{"64ths and quarters", priceFormat(0.00390625, 205, 0.00390625), 56583, "110.513671875"},
+		{"1024ths", priceFormat(0.0009765625, 110, 0.0009765625), 1, "0.00048828125"},
+	}
+	for _, tt := range tests {
+		if got := tt.format.halved().Price(tt.scaled).Display(); got != tt.want {
+			t.Errorf("%s: Display() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPriceFormatTickSize(t *testing.T) {
+	format := NewPriceFormat(&pb.ContractMetadata{
+		CorrectPriceScale: proto.Float64(0.01),
+		TickSize:          proto.Float64(0.01),
+		TickSizesByPrice: []*pb.TickSizeByPrice{
+			{TickSize: proto.Float64(0.05), BoundaryPrice: proto.Float64(-5)},
+			{TickSize: proto.Float64(0.01), BoundaryPrice: proto.Float64(0)},
+			{TickSize: proto.Float64(0.05), BoundaryPrice: proto.Float64(5)},
+		},
+	})
+	tests := []struct {
+		scaled int64
+		want   float64
+	}{
+		{300, 0.01},  // [0, 5)
+		{500, 0.05},  // [5, ...)
+		{700, 0.05},  // [5, ...)
+		{-300, 0.01}, // (-5, 0]
+		{-500, 0.05}, // (..., -5]
+		{-700, 0.05}, // (..., -5]
+	}
+	for _, tt := range tests {
+		if got := format.TickSize(format.Price(tt.scaled)); got != tt.want {
+			t.Errorf("TickSize(%d) = %v, want %v", tt.scaled, got, tt.want)
+		}
+	}
+
+	if got := priceFormat(0.01, 2, 0.25).TickSize(Price{Scaled: 100}); got != 0.25 {
+		t.Errorf("fixed TickSize = %v, want 0.25", got)
+	}
+}
@@ -0,0 +1,347 @@
+package marketdata
+
+import (
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// maxPriorDays is the number of prior trading days whose statistics are kept
+const maxPriorDays = 10
+
+// maxDayTrades is the number of trades of the current trading day kept for corrections
+const maxDayTrades = 20000
+
+// dateLayout is the format of trade dates sent to clients
+const dateLayout = "2006-01-02"
+
+// Field numbers of pb.MarketValues listed in cleared_fields
+const (
+	fieldOpen               = 1
+	fieldHigh               = 2
+	fieldLow                = 3
+	fieldTotalVolumeScaled  = 6
+	fieldOpenInterestScaled = 10
+	fieldTotalVolume        = 21
+	fieldOpenInterest       = 23
+	fieldClose              = 25
+	fieldLastNoSettlement   = 26
+	fieldLastTradeUTCTime   = 28
+)
+
+// TradingDay is the trading day the session statistics of an update belong to
+type TradingDay struct {
+	Date  string `json:"date"`            // Trade date, YYYY-MM-DD
+	Start string `json:"start,omitempty"` // Pre-open, RFC 3339 in UTC; empty until the schedule is known
+	End   string `json:"end,omitempty"`   // Post-close, RFC 3339 in UTC
+}
+
+// tradingDay is a trading day of a session schedule
+type tradingDay struct {
+	date       time.Time // Trade date at midnight UTC
+	start, end time.Time // Pre-open and post-close
+}
+
+// scheduleFrom converts trading day time ranges reported by CQG, skipping holidays.
+// clock converts their session-relative times.
+func scheduleFrom(ranges []*pb.TradingDayTimeRange, clock func(int64) time.Time) []tradingDay {
+	days := make([]tradingDay, 0, len(ranges))
+	for _, r := range ranges {
+		if r.TradingDayPreOpenUtcTime == nil || r.TradingDayPostCloseUtcTime == nil {
+			continue
+		}
+		days = append(days, tradingDay{
+			date:  tradeDate(clock(r.GetTradeDate())),
+			start: clock(r.GetTradingDayPreOpenUtcTime()),
+			end:   clock(r.GetTradingDayPostCloseUtcTime()),
+		})
+	}
+	return days
+}
+
+// tradeDate truncates a CQG trade date, whose time part is unused, to its day
+func tradeDate(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// sessionStats aggregates the open, high, low, last and volume of a contract over its
+// current trading day and keeps the statistics of prior days. A new trading day starts
+// when the schedule says so or when CQG reports market values of a later trade date,
+// whichever comes first; CQG's market values always override the aggregated ones.
+type sessionStats struct {
+	format   *PriceFormat
+	schedule []tradingDay // Known trading days that have not ended, oldest first
+	day      tradingDay   // Current trading day, zero until known
+	values   MarketValues
+	traded   bool           // values has an open, high and low
+	prior    []MarketValues // Day index -1 first
+	trades   []*tradeEntry  // Trades of the current trading day, oldest first
+	complete bool           // trades holds every trade of the current trading day
+
+	dayChanged   bool // Not yet reported by takeChanges
+	priorChanged bool
+}
+
+// newSessionStats creates the statistics of a contract with the given price format
+func newSessionStats(format *PriceFormat) *sessionStats {
+	return &sessionStats{format: format}
+}
+
+// setSchedule replaces the known trading days and fills in the times of the current one
+func (s *sessionStats) setSchedule(days []tradingDay) {
+	s.schedule = days
+	for _, day := range days {
+		if day.date.Equal(s.day.date) && s.day.start.IsZero() {
+			s.day = day
+			s.dayChanged = true
+		}
+	}
+}
+
+// needsSchedule reports whether the trading day after the current one is unknown
+func (s *sessionStats) needsSchedule() bool {
+	return len(s.schedule) < 2
+}
+
+// advance moves to the trading day in progress at t if the schedule says the current
+// one is over. Times between two trading days belong to the earlier one.
+func (s *sessionStats) advance(t time.Time) {
+	i := 0
+	for i < len(s.schedule) && !t.Before(s.schedule[i].end) {
+		i++
+	}
+	s.schedule = s.schedule[i:]
+	if len(s.schedule) == 0 || t.Before(s.schedule[0].start) {
+		return
+	}
+
+	next := s.schedule[0]
+	switch {
+	case s.day.date.IsZero():
+		s.day = next
+		s.values.TradeDate = next.date.Format(dateLayout)
+		s.dayChanged = true
+	case next.date.After(s.day.date):
+		s.roll(next)
+	}
+}
+
+// scheduled returns the known times of a trade date
+func (s *sessionStats) scheduled(date time.Time) tradingDay {
+	for _, day := range s.schedule {
+		if day.date.Equal(date) {
+			return day
+		}
+	}
+	return tradingDay{date: date}
+}
+
+// roll starts a new trading day, moving the statistics of the current one to the
+// prior days
+func (s *sessionStats) roll(day tradingDay) {
+	if !s.day.date.IsZero() {
+		s.prior = append([]MarketValues{s.values}, s.prior...)
+		if len(s.prior) > maxPriorDays {
+			s.prior = s.prior[:maxPriorDays]
+		}
+		for i := range s.prior {
+			s.prior[i].DayIndex = -int32(i + 1)
+		}
+		s.priorChanged = true
+	}
+
+	// Open interest is only restated by CQG
+	s.day = day
+	s.values = MarketValues{OI: s.values.OI, TradeDate: day.date.Format(dateLayout)}
+	s.traded = false
+	s.trades, s.complete = nil, false
+	s.dayChanged = true
+}
+
+// trade adds a trade to the statistics of the current trading day and keeps it for
+// corrections
+func (s *sessionStats) trade(price Price, trade Trade) *tradeEntry {
+	entry := &tradeEntry{trade: trade, price: price}
+	s.trades = append(s.trades, entry)
+	if len(s.trades) > maxDayTrades {
+		s.trades = s.trades[len(s.trades)-maxDayTrades:]
+		s.complete = false
+	}
+
+	// The history is complete when the day's first trade is seen here
+	v := &s.values
+	if !s.traded {
+		s.complete = v.Volume == 0 && len(s.trades) == 1
+		v.Open, v.High, v.Low = price, price, price
+		s.traded = true
+	}
+	if price.Scaled > v.High.Scaled {
+		v.High = price
+	}
+	if price.Scaled < v.Low.Scaled {
+		v.Low = price
+	}
+	v.Last = price
+	v.Close = price
+	v.Volume += trade.Volume
+	v.UTCTime = trade.UTCTime
+	return entry
+}
+
+// apply reconciles the statistics with market values sent by CQG. Day index 0 is the
+// current trading day and starts a new one if its trade date is later; negative day
+// indexes are prior days.
+func (s *sessionStats) apply(mv *pb.MarketValues, clock func(int64) time.Time) {
+	var date time.Time
+	if mv.TradeDate != nil {
+		date = tradeDate(clock(mv.GetTradeDate()))
+	}
+
+	index := mv.GetDayIndex()
+	if index == 0 {
+		switch {
+		case date.IsZero() || date.Equal(s.day.date):
+		case s.day.date.IsZero():
+			s.day = s.scheduled(date)
+			s.values.TradeDate = date.Format(dateLayout)
+			s.dayChanged = true
+		case date.After(s.day.date):
+			s.roll(s.scheduled(date))
+		default:
+			// CQG has not started the trading day the schedule already moved to
+			if prior := s.priorOn(date); prior != nil {
+				s.merge(prior, mv)
+				s.priorChanged = true
+			}
+			return
+		}
+
+		s.merge(&s.values, mv)
+		if mv.ScaledOpenPrice != nil {
+			s.traded = true
+		}
+		return
+	}
+
+	// Prior days are matched by trade date when given, as the day index is relative
+	// to CQG's current trading day
+	prior := s.priorOn(date)
+	if prior == nil {
+		n := int(-index)
+		if n > maxPriorDays {
+			return
+		}
+		for len(s.prior) < n {
+			s.prior = append(s.prior, MarketValues{DayIndex: -int32(len(s.prior) + 1)})
+		}
+		prior = &s.prior[n-1]
+		if !date.IsZero() && prior.TradeDate != "" {
+			// The slot holds another day; keep it and drop the report
+			return
+		}
+	}
+	if !date.IsZero() {
+		prior.TradeDate = date.Format(dateLayout)
+	}
+	s.merge(prior, mv)
+	s.priorChanged = true
+}
+
+// priorOn returns the statistics of a prior trade date, or nil if they are not kept
+func (s *sessionStats) priorOn(date time.Time) *MarketValues {
+	if date.IsZero() {
+		return nil
+	}
+	name := date.Format(dateLayout)
+	for i := range s.prior {
+		if s.prior[i].TradeDate == name {
+			return &s.prior[i]
+		}
+	}
+	return nil
+}
+
+// merge copies the fields CQG sent into v and zeroes the fields it cleared
+func (s *sessionStats) merge(v *MarketValues, mv *pb.MarketValues) {
+	for _, field := range mv.GetClearedFields() {
+		switch field {
+		case fieldOpen:
+			v.Open = s.format.Price(0)
+			if v == &s.values {
+				s.traded = false
+			}
+		case fieldHigh:
+			v.High = s.format.Price(0)
+		case fieldLow:
+			v.Low = s.format.Price(0)
+		case fieldClose:
+			v.Close = s.format.Price(0)
+		case fieldLastNoSettlement:
+			v.Last = s.format.Price(0)
+		case fieldTotalVolume, fieldTotalVolumeScaled:
+			v.Volume = 0
+		case fieldOpenInterest, fieldOpenInterestScaled:
+			v.OI = 0
+		case fieldLastTradeUTCTime:
+			v.UTCTime = ""
+		}
+	}
+
+	if mv.ScaledOpenPrice != nil {
+		v.Open = s.format.Price(mv.GetScaledOpenPrice())
+	}
+	if mv.ScaledHighPrice != nil {
+		v.High = s.format.Price(mv.GetScaledHighPrice())
+	}
+	if mv.ScaledLowPrice != nil {
+		v.Low = s.format.Price(mv.GetScaledLowPrice())
+	}
+	if mv.ScaledClosePrice != nil {
+		v.Close = s.format.Price(mv.GetScaledClosePrice())
+	}
+	if mv.ScaledLastPriceNoSettlement != nil {
+		v.Last = s.format.Price(mv.GetScaledLastPriceNoSettlement())
+	}
+	if mv.TotalVolume != nil {
+		v.Volume = mv.GetTotalVolume().GetSignificand()
+	}
+	if mv.OpenInterest != nil {
+		v.OI = mv.GetOpenInterest().GetSignificand()
+	}
+	if mv.LastTradeUtcTimestamp != nil {
+		v.UTCTime = formatTime(mv.GetLastTradeUtcTimestamp().AsTime(), time.UTC)
+	}
+}
+
+// tradingDay describes the current trading day, or returns nil while it is unknown
+func (s *sessionStats) tradingDay() *TradingDay {
+	if s.day.date.IsZero() {
+		return nil
+	}
+	return &TradingDay{
+		Date:  s.day.date.Format(dateLayout),
+		Start: formatTime(s.day.start, time.UTC),
+		End:   formatTime(s.day.end, time.UTC),
+	}
+}
+
+// priorDays returns a copy of the statistics of prior days
+func (s *sessionStats) priorDays() []MarketValues {
+	return append([]MarketValues(nil), s.prior...)
+}
+
+// takeChanges returns the trading day and prior days if they changed since the last
+// call, and nil for those that did not
+func (s *sessionStats) takeChanges() (*TradingDay, []MarketValues) {
+	var day *TradingDay
+	var prior []MarketValues
+	if s.dayChanged {
+		day = s.tradingDay()
+	}
+	if s.priorChanged && len(s.prior) > 0 {
+		prior = s.priorDays()
+	}
+	s.dayChanged, s.priorChanged = false, false
+	return day, prior
+}
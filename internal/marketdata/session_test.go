@@ -0,0 +1,177 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// testBase is the base time of the session-relative times in these tests
+var testBase = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// testClock converts times relative to testBase as CQG sends them
+func testClock(ms int64) time.Time {
+	return testBase.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// at returns the time relative to testBase of a day and hour, the day of testBase
+// being 0
+func at(day, hour int) int64 {
+	return (time.Duration(day)*24*time.Hour + time.Duration(hour)*time.Hour).Milliseconds()
+}
+
+// testSchedule returns trading days running from 22:00 the day before to 21:00, the
+// first one on the day after testBase
+func testSchedule(n int) []tradingDay {
+	days := make([]tradingDay, 0, n)
+	for i := 1; i <= n; i++ {
+		days = append(days, tradingDay{
+			date:  testClock(at(i, 0)),
+			start: testClock(at(i-1, 22)),
+			end:   testClock(at(i, 21)),
+		})
+	}
+	return days
+}
+
+// checkValues fails the test unless market values hold the expected open, high, low,
+// last and volume
+func checkValues(t *testing.T, v MarketValues, open, high, low, last, volume int64) {
+	t.Helper()
+	if v.Open.Scaled != open || v.High.Scaled != high || v.Low.Scaled != low || v.Last.Scaled != last || v.Volume != volume {
+		t.Fatalf("values = open %d high %d low %d last %d volume %d, want %d %d %d %d %d",
+			v.Open.Scaled, v.High.Scaled, v.Low.Scaled, v.Last.Scaled, v.Volume, open, high, low, last, volume)
+	}
+}
+
+func TestSessionStatsAggregateTrades(t *testing.T) {
+	format := NewPriceFormat(nil)
+	s := newSessionStats(format)
+	s.setSchedule(testSchedule(2))
+
+	s.advance(testClock(at(1, 10)))
+	s.trade(format.Price(100), Trade{Volume: 2})
+	s.trade(format.Price(105), Trade{Volume: 1})
+	s.trade(format.Price(98), Trade{Volume: 3})
+	checkValues(t, s.values, 100, 105, 98, 98, 6)
+	if !s.complete {
+		t.Fatal("trades seen from the first of the day are not complete")
+	}
+
+	day, prior := s.takeChanges()
+	if day == nil || day.Date != "2026-03-02" || day.Start != "2026-03-01T22:00:00.000Z" || day.End != "2026-03-02T21:00:00.000Z" {
+		t.Fatalf("trading day = %+v", day)
+	}
+	if prior != nil {
+		t.Fatalf("prior days = %+v, want none", prior)
+	}
+	if day, _ := s.takeChanges(); day != nil {
+		t.Fatalf("unchanged trading day reported again: %+v", day)
+	}
+}
+
+func TestSessionStatsRollOnSchedule(t *testing.T) {
+	format := NewPriceFormat(nil)
+	s := newSessionStats(format)
+	s.setSchedule(testSchedule(2))
+	s.advance(testClock(at(1, 10)))
+	s.trade(format.Price(100), Trade{Volume: 2})
+	s.values.OI = 40
+	s.takeChanges()
+
+	// Between two trading days the earlier one goes on
+	s.advance(testClock(at(1, 21)))
+	if day, _ := s.takeChanges(); day != nil || s.values.Volume != 2 {
+		t.Fatalf("trading day changed after the close: %+v", day)
+	}
+
+	s.advance(testClock(at(1, 22)))
+	day, prior := s.takeChanges()
+	if day == nil || day.Date != "2026-03-03" {
+		t.Fatalf("trading day = %+v, want 2026-03-03", day)
+	}
+	if len(prior) != 1 || prior[0].DayIndex != -1 || prior[0].TradeDate != "2026-03-02" || prior[0].Volume != 2 {
+		t.Fatalf("prior days = %+v", prior)
+	}
+	checkValues(t, s.values, 0, 0, 0, 0, 0)
+	if s.values.OI != 40 {
+		t.Fatalf("open interest = %d, want it kept until restated", s.values.OI)
+	}
+	if !s.needsSchedule() {
+		t.Fatal("schedule with one trading day left is not refreshed")
+	}
+}
+
+func TestSessionStatsMarketValues(t *testing.T) {
+	format := NewPriceFormat(nil)
+	s := newSessionStats(format)
+	s.setSchedule(testSchedule(3))
+	s.advance(testClock(at(1, 10)))
+	s.trade(format.Price(100), Trade{Volume: 2})
+
+	// CQG's values override the aggregated ones and clear fields
+	s.apply(&pb.MarketValues{
+		DayIndex:        proto.Int32(0),
+		TradeDate:       proto.Int64(at(1, 0)),
+		ScaledHighPrice: proto.Int64(110),
+		TotalVolume:     &shared.Decimal{Significand: proto.Int64(50)},
+		ClearedFields:   []uint32{fieldLow},
+	}, testClock)
+	checkValues(t, s.values, 100, 110, 0, 100, 50)
+
+	// Prior days are kept by trade date
+	s.apply(&pb.MarketValues{
+		DayIndex:         proto.Int32(-1),
+		TradeDate:        proto.Int64(at(0, 0)),
+		ScaledClosePrice: proto.Int64(90),
+	}, testClock)
+	_, prior := s.takeChanges()
+	if len(prior) != 1 || prior[0].TradeDate != "2026-03-01" || prior[0].Close.Scaled != 90 {
+		t.Fatalf("prior days = %+v", prior)
+	}
+
+	// A later trade date starts a new trading day before the schedule does
+	s.apply(&pb.MarketValues{
+		DayIndex:        proto.Int32(0),
+		TradeDate:       proto.Int64(at(2, 0)),
+		ScaledOpenPrice: proto.Int64(120),
+	}, testClock)
+	day, prior := s.takeChanges()
+	if day == nil || day.Date != "2026-03-03" || day.Start != "2026-03-02T22:00:00.000Z" {
+		t.Fatalf("trading day = %+v, want 2026-03-03 from the schedule", day)
+	}
+	if len(prior) != 2 || prior[0].TradeDate != "2026-03-02" || prior[0].DayIndex != -1 || prior[1].TradeDate != "2026-03-01" || prior[1].DayIndex != -2 {
+		t.Fatalf("prior days = %+v", prior)
+	}
+	if s.values.Open.Scaled != 120 || !s.traded {
+		t.Fatalf("open = %d, want 120", s.values.Open.Scaled)
+	}
+
+	// Values of a day CQG has not moved past yet go to the prior day
+	s.apply(&pb.MarketValues{
+		DayIndex:         proto.Int32(0),
+		TradeDate:        proto.Int64(at(1, 0)),
+		ScaledClosePrice: proto.Int64(111),
+	}, testClock)
+	if s.prior[0].Close.Scaled != 111 || s.values.Close.Scaled != 0 {
+		t.Fatalf("late values applied to %+v", s.values)
+	}
+}
+
+func TestScheduleFromSkipsHolidays(t *testing.T) {
+	days := scheduleFrom([]*pb.TradingDayTimeRange{
+		{
+			TradeDate:                  proto.Int64(at(1, 0)),
+			TradingDayPreOpenUtcTime:   proto.Int64(at(0, 22)),
+			TradingDayPostCloseUtcTime: proto.Int64(at(1, 21)),
+		},
+		{TradeDate: proto.Int64(at(2, 0))},
+	}, testClock)
+	if len(days) != 1 || !days[0].date.Equal(testClock(at(1, 0))) || !days[0].end.Equal(testClock(at(1, 21))) {
+		t.Fatalf("schedule = %+v", days)
+	}
+}
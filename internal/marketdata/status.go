@@ -0,0 +1,83 @@
+package marketdata
+
+import (
+	"fmt"
+	"strings"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// SubscriptionStatusType is the event type of subscription statuses
+const SubscriptionStatusType = "subscription_status"
+
+// SubscriptionStatus tells a subscriber how CQG answered the upstream subscription of
+// its contract. CQG may lower the level to what the user is entitled to, or reject it.
+type SubscriptionStatus struct {
+	Type           string `json:"type"`
+	ContractID     uint32 `json:"contract_id"`
+	Status         string `json:"status"`          // CQG status code, e.g. success or access_denied
+	Reason         string `json:"reason"`          // Readable explanation of the status code
+	RequestedLevel uint32 `json:"requested_level"` // Level asked for by the subscriber
+	Level          uint32 `json:"level"`           // Level actually received, 0 when rejected
+	Downgraded     bool   `json:"downgraded"`
+	Rejected       bool   `json:"rejected"`
+	Message        string `json:"message,omitempty"`
+}
+
+// newSubscriptionStatus describes an upstream subscription status to a subscriber of
+// the given level. The upstream level serves every subscriber of the contract, so a
+// subscriber is only downgraded when it receives less than it asked for.
+func newSubscriptionStatus(status *pb.MarketDataSubscriptionStatus, requested uint32) *SubscriptionStatus {
+	code := pb.MarketDataSubscriptionStatus_StatusCode(status.GetStatusCode())
+	event := &SubscriptionStatus{
+		Type:           SubscriptionStatusType,
+		ContractID:     status.GetContractId(),
+		Status:         strings.ToLower(strings.TrimPrefix(code.String(), "STATUS_CODE_")),
+		Reason:         statusReason(code),
+		RequestedLevel: requested,
+		Level:          requested,
+		Rejected:       rejected(status),
+		Message:        status.GetDetails().GetText(),
+	}
+	if event.Message == "" {
+		event.Message = status.GetTextMessage()
+	}
+
+	if event.Rejected {
+		event.Level = uint32(pb.MarketDataSubscription_LEVEL_NONE)
+	} else if code == pb.MarketDataSubscriptionStatus_STATUS_CODE_SUCCESS && levelRank(status.GetLevel()) < levelRank(requested) {
+		event.Level = status.GetLevel()
+		event.Downgraded = true
+	}
+	return event
+}
+
+// statusReasons explains the CQG subscription status codes
+var statusReasons = map[pb.MarketDataSubscriptionStatus_StatusCode]string{
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_SUCCESS:                           "Subscription is active",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_DISCONNECTED:                      "Subscription is disconnected and will be restored by CQG",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_FAILURE:                           "Subscription failed",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_INVALID_PARAMS:                    "Subscription parameters are invalid",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_ACCESS_DENIED:                     "User is not entitled to market data of this contract",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_DELETED:                           "Market data source was deleted, e.g. because the contract expired",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_SUBSCRIPTION_LIMIT_VIOLATION:      "Too many market data subscriptions",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_CONTRIBUTOR_REQUIRED:              "An authorized OTC contributor ID is required",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_SUBSCRIPTION_RATE_LIMIT_VIOLATION: "Market data subscriptions are changed too often",
+	pb.MarketDataSubscriptionStatus_STATUS_CODE_NOT_SUPPORTED:                     "Market data is not available for this contract",
+}
+
+// statusReason explains a status code, including codes added to the protocol later
+func statusReason(code pb.MarketDataSubscriptionStatus_StatusCode) string {
+	if reason, ok := statusReasons[code]; ok {
+		return reason
+	}
+	if code >= 100 {
+		return fmt.Sprintf("Subscription failed with status code %d", code)
+	}
+	return fmt.Sprintf("Subscription status code %d", code)
+}
+
+// rejected reports whether a status carries one of the failure codes, numbered from 100
+func rejected(status *pb.MarketDataSubscriptionStatus) bool {
+	return status.GetStatusCode() >= 100
+}
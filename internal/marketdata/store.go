@@ -0,0 +1,109 @@
+package marketdata
+
+import (
+	"log"
+	"sync/atomic"
+
+	"go-websocket/internal/services"
+)
+
+// storeQueueSize is the number of PocketBase writes queued before further writes are
+// dropped
+const storeQueueSize = 1024
+
+// storeWrite is a write to PocketBase: a new record for an update, or the amended trades
+// of a record saved before. Records inserted by a correction are created by their first
+// amendment.
+type storeWrite struct {
+	update *Update // Update to create a record for, nil for an amendment
+	rec    *record // Record created by the update or amended
+	trades []Trade // Trades of an amended record, copied when the write was queued
+	insert *Update // Record to create instead if the amended record was inserted
+}
+
+// storeQueue writes updates to PocketBase from a goroutine of its own, so that a slow
+// or unreachable PocketBase never holds up the decoding of market data. Writes queued
+// while the queue is full are dropped and counted. Record IDs are only set and read by
+// the writing goroutine.
+type storeQueue struct {
+	store   *services.PocketBase
+	writes  chan storeWrite
+	dropped atomic.Int64 // Writes dropped since the last one queued
+}
+
+// newStoreQueue creates a queue writing to store and starts its goroutine
+func newStoreQueue(store *services.PocketBase) *storeQueue {
+	q := &storeQueue{
+		store:  store,
+		writes: make(chan storeWrite, storeQueueSize),
+	}
+	go q.run()
+	return q
+}
+
+// save queues the trades of an update and the corrections it applied to the records of
+// earlier trades. It must be called by the goroutine decoding the updates.
+func (q *storeQueue) save(update *Update) {
+	if update.record != nil {
+		q.queue(storeWrite{update: update, rec: update.record})
+	}
+
+	queued := make(map[*record]bool)
+	for _, amendment := range update.amendments {
+		rec := amendment.entry.record
+		if queued[rec] {
+			continue
+		}
+		queued[rec] = true
+
+		write := storeWrite{rec: rec, trades: rec.trades()}
+		if rec.inserted {
+			write.insert = &Update{
+				ContractID:   amendment.ContractID,
+				Bids:         make([]BestQuote, 0),
+				Asks:         make([]BestQuote, 0),
+				Trades:       write.trades,
+				Corrections:  update.Corrections,
+				MarketValues: amendment.MarketValues,
+			}
+		}
+		q.queue(write)
+	}
+}
+
+// queue adds a write to the queue, or drops it if the queue is full
+func (q *storeQueue) queue(write storeWrite) {
+	select {
+	case q.writes <- write:
+		if dropped := q.dropped.Swap(0); dropped > 0 {
+			log.Printf("PocketBase queue was full, dropped %d write(s)", dropped)
+		}
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// run performs the queued writes in order
+func (q *storeQueue) run() {
+	for write := range q.writes {
+		switch {
+		case write.update != nil:
+			id, err := q.store.SaveToPocketBase(write.update)
+			if err != nil {
+				log.Println("Failed to save data into pocketbase:", err)
+			}
+			write.rec.id = id
+		case write.rec.id != "":
+			if err := q.store.UpdateRecord(write.rec.id, map[string]interface{}{"trades": write.trades}); err != nil {
+				log.Println("Failed to amend trades in pocketbase:", err)
+			}
+		case write.insert != nil:
+			// Trades inserted by a correction get a record of their own
+			id, err := q.store.SaveToPocketBase(write.insert)
+			if err != nil {
+				log.Println("Failed to save data into pocketbase:", err)
+			}
+			write.rec.id = id
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package marketdata
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// TimeAndSalesType is the event type of time and sales pages
+const TimeAndSalesType = "time_and_sales"
+
+// timeAndSalesLevels maps the names accepted for time and sales levels to CQG levels
+var timeAndSalesLevels = map[string]pb.TimeAndSalesParameters_Level{
+	"trades":             pb.TimeAndSalesParameters_LEVEL_TRADES,
+	"trades_bba_volumes": pb.TimeAndSalesParameters_LEVEL_TRADES_BBA_VOLUMES,
+}
+
+// quoteTypes names the quote types of time and sales ticks
+var quoteTypes = map[pb.Quote_Type]string{
+	pb.Quote_TYPE_TRADE:       "trade",
+	pb.Quote_TYPE_BESTBID:     "best_bid",
+	pb.Quote_TYPE_BESTASK:     "best_ask",
+	pb.Quote_TYPE_BID:         "bid",
+	pb.Quote_TYPE_ASK:         "ask",
+	pb.Quote_TYPE_SETTLEMENT:  "settlement",
+	pb.Quote_TYPE_IMPLIED_BID: "implied_bid",
+	pb.Quote_TYPE_IMPLIED_ASK: "implied_ask",
+}
+
+// quoteIndicators names the indicators of quotes
+var quoteIndicators = map[pb.Quote_Indicator]string{
+	pb.Quote_INDICATOR_OPEN:                             "open",
+	pb.Quote_INDICATOR_HIGH:                             "high",
+	pb.Quote_INDICATOR_LOW:                              "low",
+	pb.Quote_INDICATOR_LAST:                             "last",
+	pb.Quote_INDICATOR_CLOSE:                            "close",
+	pb.Quote_INDICATOR_PAST:                             "past",
+	pb.Quote_INDICATOR_FALL_BACK_TO_TRADE_OR_SETTLEMENT: "fall_back_to_trade_or_settlement",
+	pb.Quote_INDICATOR_INSERTION:                        "insertion",
+	pb.Quote_INDICATOR_DELETION:                         "deletion",
+	pb.Quote_INDICATOR_OFF_MARKET:                       "off_market",
+	pb.Quote_INDICATOR_CURRENCY_RATE_CHANGED:            "currency_rate_changed",
+}
+
+// salesConditions names the sales conditions of trades
+var salesConditions = map[pb.Quote_SalesCondition]string{
+	pb.Quote_SALES_CONDITION_HIT:                 "hit",
+	pb.Quote_SALES_CONDITION_TAKE:                "take",
+	pb.Quote_SALES_CONDITION_SPREAD_LEG:          "spread_leg",
+	pb.Quote_SALES_CONDITION_BUY_SIDE_AGGRESSOR:  "buy_side_aggressor",
+	pb.Quote_SALES_CONDITION_SELL_SIDE_AGGRESSOR: "sell_side_aggressor",
+}
+
+// TimeAndSales is one page of historical trades and quotes of a contract
+type TimeAndSales struct {
+	Type                    string `json:"type"`
+	ContractID              uint32 `json:"contract_id"`
+	Ticks                   []Tick `json:"ticks"`
+	Corrections             []Tick `json:"corrections"`
+	UpToUTCTime             string `json:"up_to_utc_time,omitempty"` // Set when no end time was requested
+	Complete                bool   `json:"is_report_complete"`       // No more pages follow
+	Truncated               bool   `json:"truncated"`                // The start was beyond the history CQG keeps
+	OffMarketTradesIncluded bool   `json:"off_market_trades_included"`
+	TradeAttributesIncluded bool   `json:"trade_attributes_included"`
+}
+
+// Tick is a trade or quote of time and sales history
+type Tick struct {
+	Type            string           `json:"type"` // trade, best_bid, best_ask or settlement
+	Price           Price            `json:"price"`
+	DisplayPrice    string           `json:"display_price"` // Price in the contract's native format
+	Volume          int64            `json:"volume"`        // Zero if CQG sent no volume
+	Cleared         bool             `json:"cleared,omitempty"`
+	UTCTime         string           `json:"utc_time"`   // RFC 3339 in UTC
+	LocalTime       string           `json:"local_time"` // RFC 3339 in the zone chosen by the client
+	Indicators      []string         `json:"indicators,omitempty"`
+	SalesCondition  string           `json:"sales_condition,omitempty"`
+	TradeAttributes *TradeAttributes `json:"trade_attributes,omitempty"`
+}
+
+// TradeAttributes are the exchange details of a trade
+type TradeAttributes struct {
+	Buyer         int32  `json:"buyer,omitempty"`  // Exchange member ID of the buyer
+	Seller        int32  `json:"seller,omitempty"` // Exchange member ID of the seller
+	TradeType     string `json:"trade_type,omitempty"`
+	MatchID       string `json:"match_id,omitempty"`
+	AgreementTime string `json:"agreement_time,omitempty"` // RFC 3339 in UTC
+}
+
+// ParseTimeAndSalesLevel parses a time and sales level given by name. An empty value
+// asks for trades and best bid and ask quotes with their volumes.
+func ParseTimeAndSalesLevel(value string) (uint32, error) {
+	if value == "" {
+		return uint32(pb.TimeAndSalesParameters_LEVEL_TRADES_BBA_VOLUMES), nil
+	}
+	level, ok := timeAndSalesLevels[strings.ToLower(value)]
+	if !ok {
+		return 0, fmt.Errorf("invalid level: %q", value)
+	}
+	return uint32(level), nil
+}
+
+// TimeAndSalesResult names the result code of a time and sales report, such as
+// "outside_allowed_range"
+func TimeAndSalesResult(code uint32) string {
+	name, ok := pb.TimeAndSalesReport_ResultCode_name[int32(code)]
+	if !ok {
+		return fmt.Sprintf("code_%d", code)
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "RESULT_CODE_"))
+}
+
+// TimeAndSalesDecoder turns the reports answering one time and sales request into
+// pages. A quote without a time has the time of the quote before it, also across
+// reports, so one decoder must see every report of its request in order.
+type TimeAndSalesDecoder struct {
+	format    *PriceFormat
+	clock     func(int64) time.Time // Converts CQG timestamps into absolute times
+	location  *time.Location        // Zone of local times
+	quoteTime time.Time
+	atTime    int // Quotes decoded with quoteTime
+	skip      int // Quotes with quoteTime still to skip after Resume
+}
+
+// NewTimeAndSalesDecoder creates a decoder for a contract with the given price format.
+// clock converts the session-relative timestamps of the reports.
+func NewTimeAndSalesDecoder(format *PriceFormat, clock func(int64) time.Time, location *time.Location) *TimeAndSalesDecoder {
+	return &TimeAndSalesDecoder{format: format, clock: clock, location: location}
+}
+
+// Decode converts a successful time and sales report into a page
+func (d *TimeAndSalesDecoder) Decode(contractID uint32, report *pb.TimeAndSalesReport) *TimeAndSales {
+	page := &TimeAndSales{
+		Type:                    TimeAndSalesType,
+		ContractID:              contractID,
+		Ticks:                   make([]Tick, 0, len(report.GetQuotes())),
+		Corrections:             make([]Tick, 0, len(report.GetCorrections())),
+		Complete:                report.GetIsReportComplete(),
+		Truncated:               report.GetTruncated(),
+		OffMarketTradesIncluded: report.GetOffMarketTradesIncluded(),
+		TradeAttributesIncluded: report.GetTradeAttributesIncluded(),
+	}
+	if report.UpToUtcTime != nil {
+		page.UpToUTCTime = formatTime(d.clock(report.GetUpToUtcTime()), time.UTC)
+	}
+
+	for _, quote := range report.GetQuotes() {
+		if quote.QuoteUtcTime != nil {
+			if t := d.clock(quote.GetQuoteUtcTime()); !t.Equal(d.quoteTime) {
+				d.quoteTime, d.atTime, d.skip = t, 0, 0
+			}
+		}
+		if d.skip > 0 {
+			// Sent in answer to the request made before
+			d.skip--
+			continue
+		}
+		d.atTime++
+		page.Ticks = append(page.Ticks, d.tick(quote, d.quoteTime))
+	}
+
+	// Corrections refer to earlier quotes and carry their own times
+	for _, corr := range report.GetCorrections() {
+		var t time.Time
+		if corr.QuoteUtcTime != nil {
+			t = d.clock(corr.GetQuoteUtcTime())
+		}
+		page.Corrections = append(page.Corrections, d.tick(corr, t))
+	}
+	return page
+}
+
+// Last returns the time of the latest quote decoded, zero before the first one
+func (d *TimeAndSalesDecoder) Last() time.Time {
+	return d.quoteTime
+}
+
+// Resume prepares the decoder for the reports of a request made again from the time
+// of the latest quote, which skip the quotes with that time decoded already. Quotes
+// sharing a millisecond are told apart only by their order.
+func (d *TimeAndSalesDecoder) Resume() {
+	d.skip = d.atTime
+}
+
+// tick converts a quote at a time
+func (d *TimeAndSalesDecoder) tick(quote *pb.Quote, t time.Time) Tick {
+	price := d.format.Price(quote.GetScaledPrice())
+	tick := Tick{
+		Type:         quoteTypes[pb.Quote_Type(quote.GetType())],
+		Price:        price,
+		DisplayPrice: price.Display(),
+		Volume:       quote.GetVolume().GetSignificand(),
+		Cleared:      quote.GetVolume() != nil && quote.GetVolume().GetSignificand() == 0,
+		UTCTime:      formatTime(t, time.UTC),
+		LocalTime:    formatTime(t, d.location),
+	}
+	if tick.Type == "" {
+		tick.Type = fmt.Sprintf("type_%d", quote.GetType())
+	}
+
+	for _, indicator := range quote.GetIndicators() {
+		name, ok := quoteIndicators[pb.Quote_Indicator(indicator)]
+		if !ok {
+			name = fmt.Sprintf("indicator_%d", indicator)
+		}
+		tick.Indicators = append(tick.Indicators, name)
+	}
+	if quote.SalesCondition != nil {
+		name, ok := salesConditions[pb.Quote_SalesCondition(quote.GetSalesCondition())]
+		if !ok {
+			name = fmt.Sprintf("condition_%d", quote.GetSalesCondition())
+		}
+		tick.SalesCondition = name
+	}
+
+	if attributes := quote.GetTradeAttributes(); attributes != nil {
+		tick.TradeAttributes = &TradeAttributes{
+			Buyer:     attributes.GetBuyer(),
+			Seller:    attributes.GetSeller(),
+			TradeType: attributes.GetTradeType(),
+			MatchID:   attributes.GetMatchId(),
+		}
+		if attributes.AgreementTimeUtc != nil {
+			tick.TradeAttributes.AgreementTime = formatTime(attributes.GetAgreementTimeUtc().AsTime(), time.UTC)
+		}
+	}
+	return tick
+}
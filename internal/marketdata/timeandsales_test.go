@@ -0,0 +1,136 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// timedQuote returns a time and sales quote at a time relative to testBase
+func timedQuote(quoteType pb.Quote_Type, price, volume, ms int64) *pb.Quote {
+	q := quote(quoteType, price, volume)
+	q.QuoteUtcTime = proto.Int64(ms)
+	return q
+}
+
+// tickPrices returns the scaled prices of ticks
+func tickPrices(ticks []Tick) []int64 {
+	prices := make([]int64, 0, len(ticks))
+	for _, tick := range ticks {
+		prices = append(prices, tick.Price.Scaled)
+	}
+	return prices
+}
+
+func TestTimeAndSalesDecode(t *testing.T) {
+	zone := time.FixedZone("exchange", -6*3600)
+	d := NewTimeAndSalesDecoder(priceFormat(0.25, 2, 0.25), testClock, zone)
+
+	// A quote without a time has the time of the quote before it
+	untimed := quote(pb.Quote_TYPE_BESTBID, 399, 0)
+	trade := timedQuote(pb.Quote_TYPE_TRADE, 401, 2, at(1, 11))
+	trade.Indicators = []uint32{uint32(pb.Quote_INDICATOR_HIGH), 99}
+	trade.SalesCondition = proto.Uint32(uint32(pb.Quote_SALES_CONDITION_BUY_SIDE_AGGRESSOR))
+	trade.TradeAttributes = &pb.TradeAttributes{Buyer: proto.Int32(7), MatchId: proto.String("m1")}
+	page := d.Decode(testContractID, &pb.TimeAndSalesReport{
+		RequestId:        proto.Uint32(1),
+		ResultCode:       proto.Uint32(uint32(pb.TimeAndSalesReport_RESULT_CODE_SUCCESS)),
+		UpToUtcTime:      proto.Int64(at(1, 12)),
+		IsReportComplete: proto.Bool(true),
+		Quotes: []*pb.Quote{
+			timedQuote(pb.Quote_TYPE_TRADE, 400, 3, at(1, 10)),
+			untimed,
+			trade,
+		},
+		Corrections: []*pb.Quote{timedQuote(pb.Quote_TYPE_TRADE, 398, 1, at(1, 9))},
+	})
+
+	if page.Type != TimeAndSalesType || !page.Complete || page.UpToUTCTime != "2026-03-02T12:00:00.000Z" {
+		t.Fatalf("page = %+v", page)
+	}
+	if len(page.Ticks) != 3 {
+		t.Fatalf("got %d ticks, want 3", len(page.Ticks))
+	}
+	first, bid, last := page.Ticks[0], page.Ticks[1], page.Ticks[2]
+	if first.Type != "trade" || first.DisplayPrice != "100.00" || first.Volume != 3 ||
+		first.UTCTime != "2026-03-02T10:00:00.000Z" || first.LocalTime != "2026-03-02T04:00:00.000-06:00" {
+		t.Errorf("first tick = %+v", first)
+	}
+	if bid.Type != "best_bid" || !bid.Cleared || bid.UTCTime != first.UTCTime {
+		t.Errorf("untimed tick = %+v, want a cleared bid at the time of the first", bid)
+	}
+	if len(last.Indicators) != 2 || last.Indicators[0] != "high" || last.Indicators[1] != "indicator_99" ||
+		last.SalesCondition != "buy_side_aggressor" || last.TradeAttributes == nil ||
+		last.TradeAttributes.Buyer != 7 || last.TradeAttributes.MatchID != "m1" {
+		t.Errorf("last tick = %+v", last)
+	}
+	if len(page.Corrections) != 1 || page.Corrections[0].UTCTime != "2026-03-02T09:00:00.000Z" {
+		t.Errorf("corrections = %+v", page.Corrections)
+	}
+	if !d.Last().Equal(testClock(at(1, 11))) {
+		t.Errorf("Last() = %v, want the time of the last quote", d.Last())
+	}
+}
+
+func TestTimeAndSalesResume(t *testing.T) {
+	d := NewTimeAndSalesDecoder(NewPriceFormat(nil), testClock, time.UTC)
+	ms := at(1, 10)
+	page := d.Decode(testContractID, &pb.TimeAndSalesReport{
+		Quotes: []*pb.Quote{
+			timedQuote(pb.Quote_TYPE_TRADE, 100, 1, ms-1),
+			timedQuote(pb.Quote_TYPE_TRADE, 101, 1, ms),
+			timedQuote(pb.Quote_TYPE_TRADE, 102, 1, ms),
+		},
+	})
+	if got := tickPrices(page.Ticks); len(got) != 3 {
+		t.Fatalf("ticks = %v", got)
+	}
+
+	// The request made again from the last millisecond repeats the two ticks sent
+	d.Resume()
+	page = d.Decode(testContractID, &pb.TimeAndSalesReport{
+		Quotes: []*pb.Quote{
+			timedQuote(pb.Quote_TYPE_TRADE, 101, 1, ms),
+			timedQuote(pb.Quote_TYPE_TRADE, 102, 1, ms),
+			timedQuote(pb.Quote_TYPE_TRADE, 103, 1, ms),
+			timedQuote(pb.Quote_TYPE_TRADE, 104, 1, ms+1),
+		},
+	})
+	if got := tickPrices(page.Ticks); len(got) != 2 || got[0] != 103 || got[1] != 104 {
+		t.Fatalf("ticks after Resume = %v, want 103 and 104", got)
+	}
+
+	// Nothing is skipped when the answer starts past the last millisecond
+	d.Resume()
+	page = d.Decode(testContractID, &pb.TimeAndSalesReport{
+		Quotes: []*pb.Quote{
+			timedQuote(pb.Quote_TYPE_TRADE, 105, 1, ms+2),
+			quote(pb.Quote_TYPE_TRADE, 106, 1),
+		},
+	})
+	if got := tickPrices(page.Ticks); len(got) != 2 || got[0] != 105 || got[1] != 106 {
+		t.Fatalf("ticks after Resume = %v, want 105 and 106", got)
+	}
+}
+
+func TestTimeAndSalesNames(t *testing.T) {
+	if level, err := ParseTimeAndSalesLevel(""); err != nil || level != uint32(pb.TimeAndSalesParameters_LEVEL_TRADES_BBA_VOLUMES) {
+		t.Errorf(`ParseTimeAndSalesLevel("") = %d, %v`, level, err)
+	}
+	if level, err := ParseTimeAndSalesLevel("Trades"); err != nil || level != uint32(pb.TimeAndSalesParameters_LEVEL_TRADES) {
+		t.Errorf(`ParseTimeAndSalesLevel("Trades") = %d, %v`, level, err)
+	}
+	if _, err := ParseTimeAndSalesLevel("dom"); err == nil {
+		t.Error(`ParseTimeAndSalesLevel("dom") accepted`)
+	}
+
+	if got := TimeAndSalesResult(uint32(pb.TimeAndSalesReport_RESULT_CODE_OUTSIDE_ALLOWED_RANGE)); got != "outside_allowed_range" {
+		t.Errorf("TimeAndSalesResult = %q", got)
+	}
+	if got := TimeAndSalesResult(12345); got != "code_12345" {
+		t.Errorf("TimeAndSalesResult(12345) = %q", got)
+	}
+}
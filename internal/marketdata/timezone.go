@@ -0,0 +1,104 @@
+package marketdata
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// TimeLayout is the RFC 3339 layout of timestamps sent to clients, with milliseconds
+const TimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// ExchangeZone is the zone name that selects the exchange's own time zone
+const ExchangeZone = "exchange"
+
+// micZones maps market identifier codes (ISO 10383) to the time zone of their exchange
+var micZones = map[string]string{
+	// CME Group
+	"XCME": "America/Chicago",
+	"XCBT": "America/Chicago",
+	"XNYM": "America/Chicago",
+	"XCEC": "America/Chicago",
+	"GLBX": "America/Chicago",
+	"CBCM": "America/Chicago",
+	"NYUM": "America/Chicago",
+
+	// Americas
+	"IFUS": "America/New_York",
+	"XCBF": "America/Chicago",
+	"XMOD": "America/Toronto",
+	"BVMF": "America/Sao_Paulo",
+	"XMEX": "America/Mexico_City",
+
+	// Europe
+	"IFEU": "Europe/London",
+	"IFLL": "Europe/London",
+	"XLME": "Europe/London",
+	"XLON": "Europe/London",
+	"XEUR": "Europe/Berlin",
+	"XEEE": "Europe/Berlin",
+	"XMAT": "Europe/Paris",
+	"XPAR": "Europe/Paris",
+	"XAMS": "Europe/Amsterdam",
+	"XMRV": "Europe/Madrid",
+	"XDMI": "Europe/Rome",
+	"NDEX": "Europe/Amsterdam",
+
+	// Asia Pacific and Africa
+	"XNSE": "Asia/Kolkata",
+	"XBOM": "Asia/Kolkata",
+	"XSGE": "Asia/Shanghai",
+	"XDCE": "Asia/Shanghai",
+	"XZCE": "Asia/Shanghai",
+	"XOSE": "Asia/Tokyo",
+	"XTKS": "Asia/Tokyo",
+	"XTKT": "Asia/Tokyo",
+	"XSES": "Asia/Singapore",
+	"XSIM": "Asia/Singapore",
+	"XHKF": "Asia/Hong_Kong",
+	"XKRX": "Asia/Seoul",
+	"XSFE": "Australia/Sydney",
+	"XASX": "Australia/Sydney",
+	"XSAF": "Africa/Johannesburg",
+	"XJSE": "Africa/Johannesburg",
+}
+
+// ParseZone loads the zone a client asked for. An empty name gives the fallback zone
+// and ExchangeZone gives nil, to be resolved per contract with ExchangeLocation.
+func ParseZone(name string, fallback *time.Location) (*time.Location, error) {
+	switch name {
+	case "":
+		return fallback, nil
+	case ExchangeZone:
+		return nil, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", name, err)
+	}
+	return location, nil
+}
+
+// ExchangeLocation returns the time zone of the exchange a contract trades on, found
+// from its market identifier code, and reports whether it is known
+func ExchangeLocation(metadata *pb.ContractMetadata) (*time.Location, bool) {
+	name, ok := micZones[strings.ToUpper(metadata.GetMic())]
+	if !ok {
+		return nil, false
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, false
+	}
+	return location, true
+}
+
+// formatTime renders a time in a zone for clients, or nothing for an unknown time
+func formatTime(t time.Time, location *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(location).Format(TimeLayout)
+}
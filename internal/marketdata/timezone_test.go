@@ -0,0 +1,50 @@
+package marketdata
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseZone(t *testing.T) {
+	fallback := time.FixedZone("configured", 3600)
+
+	location, err := ParseZone("", fallback)
+	if err != nil || location != fallback {
+		t.Errorf(`ParseZone("") = %v, %v, want the configured zone`, location, err)
+	}
+
+	// The exchange's zone is only known once the contract is
+	location, err = ParseZone(ExchangeZone, fallback)
+	if err != nil || location != nil {
+		t.Errorf("ParseZone(%q) = %v, %v, want nil", ExchangeZone, location, err)
+	}
+
+	location, err = ParseZone("America/Chicago", fallback)
+	if err != nil || location.String() != "America/Chicago" {
+		t.Errorf(`ParseZone("America/Chicago") = %v, %v`, location, err)
+	}
+
+	if location, err = ParseZone("Nowhere/Nothing", fallback); err == nil || !strings.Contains(err.Error(), "invalid time zone") {
+		t.Errorf(`ParseZone("Nowhere/Nothing") = %v, %v, want an error`, location, err)
+	}
+}
+
+func TestExchangeLocation(t *testing.T) {
+	// Codes are matched regardless of case
+	location, ok := ExchangeLocation(&pb.ContractMetadata{Mic: proto.String("xcme")})
+	if !ok || location.String() != "America/Chicago" {
+		t.Errorf("ExchangeLocation(xcme) = %v, %v, want America/Chicago", location, ok)
+	}
+
+	// Unknown or missing codes leave the choice of a fallback to the caller
+	for _, metadata := range []*pb.ContractMetadata{{Mic: proto.String("XXXX")}, {}, nil} {
+		if location, ok := ExchangeLocation(metadata); ok || location != nil {
+			t.Errorf("ExchangeLocation(%v) = %v, %v, want not found", metadata, location, ok)
+		}
+	}
+}
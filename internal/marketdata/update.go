@@ -0,0 +1,232 @@
+package marketdata
+
+import (
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+)
+
+// Update is a decoded real-time market data message of one contract
+type Update struct {
+	ContractID   uint32       `json:"contract_id"`
+	Bids         []BestQuote  `json:"bids"`
+	Asks         []BestQuote  `json:"asks"`
+	TopOfBook    *TopOfBook   `json:"top_of_book,omitempty"` // Set when the best bid or offer changed
+	Trades       []Trade      `json:"trades"`
+	Corrections  []Correction `json:"corrections"`
+	MarketValues MarketValues `json:"market_values"`
+
+	// TradingDay is set when the trading day of the market values changed, and
+	// PriorDays when the statistics of prior trading days did
+	TradingDay *TradingDay    `json:"trading_day,omitempty"`
+	PriorDays  []MarketValues `json:"prior_days,omitempty"`
+
+	record     *record           // Record of the trades, saved with the update
+	amendments []*TradeAmendment // Earlier trades changed by the corrections
+}
+
+// Trade is a single trade quote
+type Trade struct {
+	Price        string `json:"price"`         // Exact decimal price
+	DisplayPrice string `json:"display_price"` // Price in the contract's native format
+	Volume       int64  `json:"volume"`
+	UTCTime      string `json:"utc_time"`   // RFC 3339 in UTC
+	LocalTime    string `json:"local_time"` // RFC 3339 in the zone chosen by the client
+
+	time time.Time
+}
+
+// Correction amends or cancels an earlier quote
+type Correction struct {
+	Type      string `json:"type"`
+	OldPrice  Price  `json:"old_price"`
+	NewPrice  Price  `json:"new_price"`
+	Timestamp string `json:"timestamp"` // RFC 3339 in UTC
+	IsCancel  bool   `json:"is_cancel"`
+}
+
+// MarketValues are the statistics of a contract over one trading day
+type MarketValues struct {
+	DayIndex  int32  `json:"day_index"`            // 0 for the current trading day, -1 for the one before
+	TradeDate string `json:"trade_date,omitempty"` // YYYY-MM-DD
+	Open      Price  `json:"open"`
+	High      Price  `json:"high"`
+	Low       Price  `json:"low"`
+	Close     Price  `json:"close"`
+	Last      Price  `json:"last"`
+	Volume    int64  `json:"volume"`
+	OI        int64  `json:"oi"`
+	UTCTime   string `json:"utctime,omitempty"` // Time of the last trade, RFC 3339 in UTC
+}
+
+// decoder turns the real-time messages of one contract into updates, keeping the
+// session statistics and the best bid and offer between messages
+type decoder struct {
+	format   *PriceFormat
+	clock    func(int64) time.Time // Converts CQG timestamps into absolute times
+	location *time.Location        // Zone of local times unless a client picks another
+	session  *sessionStats
+	bbo      bbo
+}
+
+// newDecoder creates a decoder for a contract with the given price format. clock
+// converts the session-relative timestamps of the contract's messages.
+func newDecoder(format *PriceFormat, clock func(int64) time.Time, location *time.Location) *decoder {
+	return &decoder{
+		format:   format,
+		clock:    clock,
+		location: location,
+		session:  newSessionStats(format),
+	}
+}
+
+// decode converts a real-time market data entry into an update
+func (d *decoder) decode(rtData *pb.RealTimeMarketData) *Update {
+	update := &Update{
+		ContractID:  rtData.GetContractId(),
+		Bids:        make([]BestQuote, 0),
+		Asks:        make([]BestQuote, 0),
+		Trades:      make([]Trade, 0),
+		Corrections: make([]Correction, 0),
+	}
+
+	// A snapshot restates the best bid and offer
+	bboChanged := rtData.GetIsSnapshot()
+	if bboChanged {
+		d.bbo.reset()
+	}
+
+	// Process quotes (trades and best bid and offer). A quote without a time has the
+	// time of the quote before it.
+	var quoteTime time.Time
+	var entries []*tradeEntry
+	for _, quote := range rtData.GetQuotes() {
+		if quote.QuoteUtcTime != nil {
+			quoteTime = d.clock(quote.GetQuoteUtcTime())
+			d.session.advance(quoteTime)
+		}
+
+		switch quote.GetType() {
+		case uint32(pb.Quote_TYPE_BESTBID), uint32(pb.Quote_TYPE_BESTASK):
+			d.bbo.apply(quote)
+			bboChanged = true
+
+			best := BestQuote{
+				Price:   d.format.Price(quote.GetScaledPrice()),
+				Volume:  quote.GetVolume().GetSignificand(),
+				Cleared: quote.GetVolume() != nil && quote.GetVolume().GetSignificand() == 0,
+				UTCTime: formatTime(quoteTime, time.UTC),
+			}
+			if quote.GetType() == uint32(pb.Quote_TYPE_BESTBID) {
+				update.Bids = append(update.Bids, best)
+			} else {
+				update.Asks = append(update.Asks, best)
+			}
+			continue
+		case uint32(pb.Quote_TYPE_TRADE):
+		default:
+			// Depth quotes are handled by the order book
+			continue
+		}
+
+		price := d.format.Price(quote.GetScaledPrice())
+		volume := quote.GetVolume().GetSignificand()
+		if quoteTime.IsZero() {
+			continue
+		}
+
+		// Update session statistics
+		trade := d.trade(price, volume, quoteTime)
+		entries = append(entries, d.session.trade(price, trade))
+		update.Trades = append(update.Trades, trade)
+	}
+
+	// Keep the new trades together so that corrections can amend their record
+	if len(entries) > 0 {
+		update.record = &record{entries: entries}
+		for _, entry := range entries {
+			entry.record = update.record
+		}
+	}
+
+	// Apply trade corrections before CQG restates the market values they affect
+	for _, corr := range rtData.GetCorrections() {
+		var corrTime time.Time
+		if corr.QuoteUtcTime != nil {
+			corrTime = d.clock(corr.GetQuoteUtcTime())
+		}
+		update.Corrections = append(update.Corrections, Correction{
+			Type:      pb.Quote_Type(corr.GetType()).String(),
+			OldPrice:  d.format.Price(corr.GetScaledSourcePrice()),
+			NewPrice:  d.format.Price(corr.GetScaledPrice()),
+			Timestamp: formatTime(corrTime, time.UTC),
+			IsCancel:  isDeletion(corr),
+		})
+		update.amendments = d.correct(update.ContractID, corr, corrTime, update.amendments)
+	}
+
+	// Reconcile with the market values sent by CQG
+	for _, mv := range rtData.GetMarketValues() {
+		d.session.apply(mv, d.clock)
+	}
+	update.MarketValues = d.session.values
+	update.TradingDay, update.PriorDays = d.session.takeChanges()
+	for _, amendment := range update.amendments {
+		amendment.MarketValues = d.session.values
+	}
+	if bboChanged {
+		update.TopOfBook = d.bbo.top(d.format)
+	}
+
+	return update
+}
+
+// snapshot returns an update restating the current top of book, trading day and prior
+// days, or nil if none of them is known yet
+func (d *decoder) snapshot(contractID uint32) *Update {
+	update := &Update{
+		ContractID:   contractID,
+		Bids:         make([]BestQuote, 0),
+		Asks:         make([]BestQuote, 0),
+		Trades:       make([]Trade, 0),
+		Corrections:  make([]Correction, 0),
+		MarketValues: d.session.values,
+		TradingDay:   d.session.tradingDay(),
+	}
+	if len(d.session.prior) > 0 {
+		update.PriorDays = d.session.priorDays()
+	}
+	if d.bbo.bid != nil || d.bbo.ask != nil {
+		update.TopOfBook = d.bbo.top(d.format)
+	}
+	if !update.published() {
+		return nil
+	}
+	return update
+}
+
+// published reports whether an update carries anything worth sending: trades, a new
+// best bid or offer, or a change of trading day or prior days
+func (u *Update) published() bool {
+	return len(u.Trades) > 0 || u.TopOfBook != nil || u.TradingDay != nil || u.PriorDays != nil
+}
+
+// Amendments returns the earlier trades changed by the corrections of the update
+func (u *Update) Amendments() []*TradeAmendment {
+	return u.amendments
+}
+
+// In returns the update with the local times of its trades in the given zone
+func (u *Update) In(location *time.Location) *Update {
+	if len(u.Trades) == 0 {
+		return u
+	}
+
+	zoned := *u
+	zoned.Trades = make([]Trade, len(u.Trades))
+	for i, trade := range u.Trades {
+		trade.LocalTime = formatTime(trade.time, location)
+		zoned.Trades[i] = trade
+	}
+	return &zoned
+}
@@ -0,0 +1,209 @@
+package marketdata
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+)
+
+// VolumeProfileType is the event type of volume profiles
+const VolumeProfileType = "volume_profile"
+
+// DefaultValueArea is the share of the volume in the value area, in percent
+const DefaultValueArea = 70
+
+// VolumeProfile is the volume traded at each price of a contract over a time range,
+// with its point of control and value area
+type VolumeProfile struct {
+	Type        string         `json:"type"`
+	ContractID  uint32         `json:"contract_id"`
+	Levels      []ProfileLevel `json:"levels"` // By price, highest first
+	Volume      float64        `json:"volume"`
+	TickVolume  uint64         `json:"tick_volume"`
+	UpToUTCTime string         `json:"up_to_utc_time,omitempty"` // Set when no end time was requested
+	Truncated   bool           `json:"truncated"`                // The start was beyond the history CQG keeps
+
+	// PointOfControl is the price with the most volume; the value area is the range
+	// around it holding ValueAreaPercent of the volume. Unset without trades.
+	PointOfControl   *Price  `json:"point_of_control,omitempty"`
+	ValueAreaHigh    *Price  `json:"value_area_high,omitempty"`
+	ValueAreaLow     *Price  `json:"value_area_low,omitempty"`
+	ValueAreaVolume  float64 `json:"value_area_volume"`
+	ValueAreaPercent float64 `json:"value_area_percent"`
+
+	// The last best bid and ask of the range, and the volume traded on each side since
+	// either changed
+	LastBid        *Price  `json:"last_bid,omitempty"`
+	LastAsk        *Price  `json:"last_ask,omitempty"`
+	BidTradeVolume float64 `json:"bid_trade_volume"`
+	AskTradeVolume float64 `json:"ask_trade_volume"`
+}
+
+// ProfileLevel is the volume traded at one price, split into the volume associated with
+// the bid and with the ask as CQG assigns it
+type ProfileLevel struct {
+	Price         Price   `json:"price"`
+	DisplayPrice  string  `json:"display_price"` // Price in the contract's native format
+	Volume        float64 `json:"volume"`
+	AskVolume     float64 `json:"ask_volume"`
+	BidVolume     float64 `json:"bid_volume"`
+	Delta         float64 `json:"delta"` // Ask volume less bid volume
+	TickVolume    uint32  `json:"tick_volume"`
+	AskTickVolume float64 `json:"ask_tick_volume"`
+	BidTickVolume float64 `json:"bid_tick_volume"`
+	InValueArea   bool    `json:"in_value_area"`
+}
+
+// VolumeProfileResult names the result code of a volume profile report, such as
+// "invalid_params"
+func VolumeProfileResult(code uint32) string {
+	name, ok := pb.VolumeProfileReport_ResultCode_name[int32(code)]
+	if !ok {
+		return fmt.Sprintf("code_%d", code)
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "RESULT_CODE_"))
+}
+
+// VolumeProfileBuilder collects the reports answering one volume profile request,
+// which CQG may split over several chunks, into a single profile
+type VolumeProfileBuilder struct {
+	format    *PriceFormat
+	clock     func(int64) time.Time // Converts CQG timestamps into absolute times
+	valueArea float64               // Share of the volume in the value area, in percent
+	levels    map[int64]*ProfileLevel
+	profile   VolumeProfile
+}
+
+// NewVolumeProfileBuilder creates a builder for a contract with the given price format
+// and value area percentage. clock converts the session-relative timestamps of the
+// reports.
+func NewVolumeProfileBuilder(format *PriceFormat, clock func(int64) time.Time, valueArea float64) *VolumeProfileBuilder {
+	return &VolumeProfileBuilder{
+		format:    format,
+		clock:     clock,
+		valueArea: valueArea,
+		levels:    make(map[int64]*ProfileLevel),
+	}
+}
+
+// Add merges a successful volume profile report into the profile
+func (b *VolumeProfileBuilder) Add(report *pb.VolumeProfileReport) {
+	if report.UpToUtcTime != nil {
+		b.profile.UpToUTCTime = formatTime(b.clock(report.GetUpToUtcTime()), time.UTC)
+	}
+	b.profile.Truncated = b.profile.Truncated || report.GetTruncated()
+
+	// Only the first chunk carries the statistics of the last quotes
+	if stats := report.GetLastQuotesCumulativeStatistics(); stats != nil {
+		if stats.ScaledLastBidPrice != nil {
+			bid := b.format.Price(stats.GetScaledLastBidPrice())
+			b.profile.LastBid = &bid
+		}
+		if stats.ScaledLastAskPrice != nil {
+			ask := b.format.Price(stats.GetScaledLastAskPrice())
+			b.profile.LastAsk = &ask
+		}
+		b.profile.BidTradeVolume = stats.GetBidTradeVolume()
+		b.profile.AskTradeVolume = stats.GetAskTradeVolume()
+	}
+
+	for _, item := range report.GetVolumeProfileItems() {
+		level, ok := b.levels[item.GetScaledPrice()]
+		if !ok {
+			price := b.format.Price(item.GetScaledPrice())
+			level = &ProfileLevel{Price: price, DisplayPrice: price.Display()}
+			b.levels[item.GetScaledPrice()] = level
+		}
+		level.Volume += decimalValue(item.GetVolume())
+		level.AskVolume += decimalValue(item.GetAskVolume())
+		level.BidVolume += decimalValue(item.GetBidVolume())
+		level.Delta = level.AskVolume - level.BidVolume
+		level.TickVolume += item.GetTickVolume()
+		level.AskTickVolume += decimalValue(item.GetAskTickVolume())
+		level.BidTickVolume += decimalValue(item.GetBidTickVolume())
+	}
+}
+
+// Profile returns the profile of the reports added so far for a contract, with its
+// point of control and value area
+func (b *VolumeProfileBuilder) Profile(contractID uint32) *VolumeProfile {
+	profile := b.profile
+	profile.Type = VolumeProfileType
+	profile.ContractID = contractID
+	profile.ValueAreaPercent = b.valueArea
+
+	scaled := make([]int64, 0, len(b.levels))
+	for price := range b.levels {
+		scaled = append(scaled, price)
+	}
+	sort.Slice(scaled, func(i, j int) bool { return scaled[i] > scaled[j] })
+
+	profile.Levels = make([]ProfileLevel, len(scaled))
+	for i, price := range scaled {
+		profile.Levels[i] = *b.levels[price]
+		profile.Volume += profile.Levels[i].Volume
+		profile.TickVolume += uint64(profile.Levels[i].TickVolume)
+	}
+	if profile.Volume > 0 {
+		b.valueAreaOf(&profile)
+	}
+	return &profile
+}
+
+// valueAreaOf finds the point of control of a profile and grows the value area from it
+// one price at a time, taking the neighbouring price with more volume, until the value
+// area holds the requested share of the volume
+func (b *VolumeProfileBuilder) valueAreaOf(profile *VolumeProfile) {
+	levels := profile.Levels
+
+	// Of prices with equal volume, the one closest to the middle of the range wins
+	poc := 0
+	middle := float64(len(levels)-1) / 2
+	for i, level := range levels {
+		if level.Volume > levels[poc].Volume ||
+			(level.Volume == levels[poc].Volume && math.Abs(float64(i)-middle) < math.Abs(float64(poc)-middle)) {
+			poc = i
+		}
+	}
+
+	target := profile.Volume * b.valueArea / 100
+	high, low := poc, poc // Levels are sorted highest price first
+	volume := levels[poc].Volume
+	for volume < target && (high > 0 || low < len(levels)-1) {
+		above, below := -1.0, -1.0
+		if high > 0 {
+			above = levels[high-1].Volume
+		}
+		if low < len(levels)-1 {
+			below = levels[low+1].Volume
+		}
+		if above >= below {
+			high--
+			volume += above
+		} else {
+			low++
+			volume += below
+		}
+	}
+
+	for i := high; i <= low; i++ {
+		levels[i].InValueArea = true
+	}
+	profile.PointOfControl = &levels[poc].Price
+	profile.ValueAreaHigh = &levels[high].Price
+	profile.ValueAreaLow = &levels[low].Price
+	profile.ValueAreaVolume = volume
+}
+
+// decimalValue returns the value of a CQG decimal, zero if it is unset
+func decimalValue(d *shared.Decimal) float64 {
+	if d == nil {
+		return 0
+	}
+	return float64(d.GetSignificand()) * math.Pow10(int(d.GetExponent()))
+}
@@ -0,0 +1,125 @@
+package marketdata
+
+import (
+	"testing"
+
+	pb "go-websocket/proto/WebAPI"
+	shared "go-websocket/proto/common"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// profileItem returns the volumes traded at a price, split between the ask and bid
+func profileItem(price, ask, bid int64) *pb.VolumeProfileItem {
+	return &pb.VolumeProfileItem{
+		ScaledPrice: proto.Int64(price),
+		Volume:      &shared.Decimal{Significand: proto.Int64(ask + bid)},
+		AskVolume:   &shared.Decimal{Significand: proto.Int64(ask)},
+		BidVolume:   &shared.Decimal{Significand: proto.Int64(bid)},
+		TickVolume:  proto.Uint32(1),
+	}
+}
+
+// profileOf builds the profile of items given as prices and volumes, all on the ask
+func profileOf(valueArea float64, levels ...[2]int64) *VolumeProfile {
+	report := &pb.VolumeProfileReport{}
+	for _, level := range levels {
+		report.VolumeProfileItems = append(report.VolumeProfileItems, profileItem(level[0], level[1], 0))
+	}
+	b := NewVolumeProfileBuilder(NewPriceFormat(nil), testClock, valueArea)
+	b.Add(report)
+	return b.Profile(testContractID)
+}
+
+func TestVolumeProfileMergesChunks(t *testing.T) {
+	b := NewVolumeProfileBuilder(priceFormat(0.25, 2, 0.25), testClock, DefaultValueArea)
+
+	// Only the first chunk carries the last quotes; a price may span chunks
+	b.Add(&pb.VolumeProfileReport{
+		UpToUtcTime: proto.Int64(at(1, 12)),
+		LastQuotesCumulativeStatistics: &pb.VolumeProfileLastQuotesCumulativeStatistics{
+			ScaledLastBidPrice: proto.Int64(399),
+			ScaledLastAskPrice: proto.Int64(400),
+			BidTradeVolume:     proto.Float64(3),
+			AskTradeVolume:     proto.Float64(4),
+		},
+		VolumeProfileItems: []*pb.VolumeProfileItem{profileItem(399, 1, 2), profileItem(400, 5, 1)},
+	})
+	b.Add(&pb.VolumeProfileReport{
+		Truncated:          proto.Bool(true),
+		VolumeProfileItems: []*pb.VolumeProfileItem{profileItem(400, 2, 0), profileItem(401, 0, 4)},
+	})
+
+	profile := b.Profile(testContractID)
+	if profile.Type != VolumeProfileType || profile.UpToUTCTime != "2026-03-02T12:00:00.000Z" || !profile.Truncated {
+		t.Fatalf("profile = %+v", profile)
+	}
+	if profile.LastBid == nil || profile.LastBid.Decimal() != "99.75" || profile.LastAsk == nil || profile.LastAsk.Decimal() != "100" ||
+		profile.BidTradeVolume != 3 || profile.AskTradeVolume != 4 {
+		t.Errorf("last quotes = %v / %v, volumes %v / %v", profile.LastBid, profile.LastAsk, profile.BidTradeVolume, profile.AskTradeVolume)
+	}
+
+	if len(profile.Levels) != 3 {
+		t.Fatalf("got %d levels, want 3", len(profile.Levels))
+	}
+	merged := profile.Levels[1]
+	if profile.Levels[0].Price.Scaled != 401 || merged.Price.Scaled != 400 || profile.Levels[2].Price.Scaled != 399 {
+		t.Fatalf("levels are not sorted highest price first: %+v", profile.Levels)
+	}
+	if merged.Volume != 8 || merged.AskVolume != 7 || merged.BidVolume != 1 || merged.Delta != 6 ||
+		merged.TickVolume != 2 || merged.DisplayPrice != "100.00" {
+		t.Errorf("merged level = %+v", merged)
+	}
+	if profile.Volume != 15 || profile.TickVolume != 4 {
+		t.Errorf("totals = %v volume, %d ticks, want 15 and 4", profile.Volume, profile.TickVolume)
+	}
+}
+
+func TestVolumeProfilePointOfControl(t *testing.T) {
+	// Of prices with equal volume, the one closest to the middle of the range wins
+	profile := profileOf(DefaultValueArea, [2]int64{105, 10}, [2]int64{104, 5}, [2]int64{103, 10}, [2]int64{102, 5}, [2]int64{101, 10})
+	if profile.PointOfControl == nil || profile.PointOfControl.Scaled != 103 {
+		t.Fatalf("point of control = %v, want 103", profile.PointOfControl)
+	}
+
+	profile = profileOf(DefaultValueArea, [2]int64{105, 10}, [2]int64{104, 5}, [2]int64{103, 11})
+	if profile.PointOfControl.Scaled != 103 {
+		t.Fatalf("point of control = %v, want 103", profile.PointOfControl)
+	}
+
+	// Nothing to point at without volume
+	if profile := profileOf(DefaultValueArea); profile.PointOfControl != nil || profile.ValueAreaHigh != nil {
+		t.Fatalf("empty profile = %+v", profile)
+	}
+}
+
+func TestVolumeProfileValueArea(t *testing.T) {
+	// 43 in total, so the value area needs 30.1: from 20 at 103 it takes 8 above, then
+	// 5 below rather than 2 above
+	profile := profileOf(70,
+		[2]int64{106, 1}, [2]int64{105, 2}, [2]int64{104, 8}, [2]int64{103, 20},
+		[2]int64{102, 5}, [2]int64{101, 6}, [2]int64{100, 1})
+	if profile.PointOfControl.Scaled != 103 || profile.ValueAreaHigh.Scaled != 104 || profile.ValueAreaLow.Scaled != 102 {
+		t.Fatalf("value area = %v to %v around %v, want 102 to 104 around 103",
+			profile.ValueAreaLow, profile.ValueAreaHigh, profile.PointOfControl)
+	}
+	if profile.ValueAreaVolume != 33 || profile.ValueAreaPercent != 70 {
+		t.Errorf("value area volume = %v of %v percent, want 33 of 70", profile.ValueAreaVolume, profile.ValueAreaPercent)
+	}
+	for _, level := range profile.Levels {
+		want := level.Price.Scaled >= 102 && level.Price.Scaled <= 104
+		if level.InValueArea != want {
+			t.Errorf("level %d in value area = %v, want %v", level.Price.Scaled, level.InValueArea, want)
+		}
+	}
+
+	// Ties between the neighbours grow the area upwards, and it stops at the edges
+	profile = profileOf(100, [2]int64{102, 3}, [2]int64{101, 4}, [2]int64{100, 3})
+	if profile.ValueAreaHigh.Scaled != 102 || profile.ValueAreaLow.Scaled != 100 || profile.ValueAreaVolume != 10 {
+		t.Errorf("full value area = %v to %v with %v", profile.ValueAreaLow, profile.ValueAreaHigh, profile.ValueAreaVolume)
+	}
+	profile = profileOf(50, [2]int64{102, 3}, [2]int64{101, 4}, [2]int64{100, 3})
+	if profile.ValueAreaHigh.Scaled != 102 || profile.ValueAreaLow.Scaled != 101 {
+		t.Errorf("value area = %v to %v, want 101 to 102", profile.ValueAreaLow, profile.ValueAreaHigh)
+	}
+}
@@ -5,33 +5,77 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
-const POCKETBASE_URL = "http://127.0.0.1:8090/api/collections/market_data/records"
+// PocketBase stores market data records in a PocketBase collection
+type PocketBase struct {
+	URL    string // Records endpoint of the collection
+	client *http.Client
+}
+
+// NewPocketBase creates a PocketBase store for the given records endpoint
+func NewPocketBase(url string, timeout time.Duration) *PocketBase {
+	return &PocketBase{
+		URL:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// SaveToPocketBase creates a new record from data, which must marshal to a JSON object,
+// and returns the ID of the record
+func (p *PocketBase) SaveToPocketBase(data interface{}) (string, error) {
+	resp, err := p.do("POST", p.URL, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-func SaveToPocketBase(data map[string]interface{}) error {
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("error decoding response: %v", err)
+	}
+	return created.ID, nil
+}
+
+// UpdateRecord changes the fields of an existing record to those of data, which must
+// marshal to a JSON object
+func (p *PocketBase) UpdateRecord(id string, data interface{}) error {
+	resp, err := p.do("PATCH", strings.TrimRight(p.URL, "/")+"/"+url.PathEscape(id), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends data as JSON and checks that the request succeeded
+func (p *PocketBase) do(method, endpoint string, data interface{}) (*http.Response, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("error marshaling data: %v", err)
+		return nil, fmt.Errorf("error marshaling data: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", POCKETBASE_URL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest(method, endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("error creating request: %v", err)
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := p.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error making request: %v", err)
+		return nil, fmt.Errorf("error making request: %v", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	return nil
+	return resp, nil
 }